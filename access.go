@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Join policies a room can have
+const (
+	JoinOpen     = "open"
+	JoinPassword = "password"
+	JoinInvite   = "invite"
+)
+
+// Room visibilities. Private rooms are left out of /rooms for everyone
+// who is not in them, invited to them or moderating them.
+const (
+	VisibilityPublic  = "public"
+	VisibilityPrivate = "private"
+)
+
+// Reasons a client may not join a room
+var (
+	errInviteOnly       = errors.New("room is invite-only")
+	errPasswordRequired = errors.New("room needs a password")
+	errWrongPassword    = errors.New("wrong room password")
+	errGuestCreate      = errors.New("guests cannot create rooms")
+)
+
+// roomPolicy is the data of a room.policy event
+type roomPolicy struct {
+	PasswordHash string `json:"password_hash,omitempty"`
+}
+
+// hashRoomPassword returns a salted hash of a room password, so the event
+// log never holds the password itself
+func hashRoomPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(append(salt, password...))
+	return hex.EncodeToString(salt) + ":" + hex.EncodeToString(sum[:]), nil
+}
+
+// checkRoomPassword reports whether password matches a hash from hashRoomPassword
+func checkRoomPassword(hash, password string) bool {
+	saltHex, sumHex, ok := strings.Cut(hash, ":")
+	salt, err1 := hex.DecodeString(saltHex)
+	want, err2 := hex.DecodeString(sumHex)
+	if !ok || err1 != nil || err2 != nil {
+		return false
+	}
+	sum := sha256.Sum256(append(salt, password...))
+	return subtle.ConstantTimeCompare(sum[:], want) == 1
+}
+
+// CanJoin reports why a client may not join a room, or nil if it may.
+// Admins, moderators of the room and invited users may always join; the
+// password is only checked in password protected rooms. Rooms that do not
+// exist yet are open.
+func (cs *ChatServer) CanJoin(client *Client, name, password string) error {
+	if client.Admin {
+		return nil
+	}
+	cs.Mutex.Lock()
+	room, ok := cs.Rooms[name]
+	var policy, hash string
+	var member bool
+	if ok {
+		policy, hash = room.JoinPolicy, room.PasswordHash
+		member = client.Authenticated && (room.Invited[client.Name] || room.Roles[client.Name] == RoleModerator)
+	}
+	cs.Mutex.Unlock()
+
+	switch {
+	case !ok && client.Guest:
+		return errGuestCreate
+	case !ok || policy == JoinOpen || member:
+		return nil
+	case policy == JoinPassword && password == "":
+		return errPasswordRequired
+	case policy == JoinPassword && !checkRoomPassword(hash, password):
+		return errWrongPassword
+	case policy == JoinPassword:
+		return nil
+	default:
+		return errInviteOnly
+	}
+}
+
+// AdmitToRoom checks whether a client may join a room with the credential
+// given to /join, which is an invite code or, in password protected rooms,
+// the room password. A valid invite code is counted as used.
+func (cs *ChatServer) AdmitToRoom(client *Client, name, credential string) error {
+	if credential != "" {
+		cs.Mutex.Lock()
+		invite, isInvite := cs.Invites[credential]
+		isInvite = isInvite && invite.Room == name
+		room, ok := cs.Rooms[name]
+		protected := ok && room.JoinPolicy == JoinPassword
+		cs.Mutex.Unlock()
+		if isInvite || !protected {
+			return cs.UseInvite(client, name, credential)
+		}
+	}
+	return cs.CanJoin(client, name, credential)
+}
+
+// joinError describes why a client could not join a room
+func joinError(name string, err error) string {
+	switch err {
+	case errInviteOnly:
+		return name + " is invite-only"
+	case errPasswordRequired:
+		return fmt.Sprintf("%s needs a password: /join %s <password>", name, name)
+	case errWrongPassword:
+		return "Wrong password for " + name
+	case errGuestCreate:
+		return name + " does not exist. Register to create your own rooms."
+	default:
+		return err.Error()
+	}
+}
+
+// SetJoinPolicy changes who may join a room. The password is only used for
+// the password policy.
+func (cs *ChatServer) SetJoinPolicy(client *Client, name, policy, password string) error {
+	var data json.RawMessage
+	if policy == JoinPassword {
+		hash, err := hashRoomPassword(password)
+		if err != nil {
+			return err
+		}
+		if data, err = json.Marshal(roomPolicy{PasswordHash: hash}); err != nil {
+			return err
+		}
+	}
+	cs.Record(Event{Type: EventRoomPolicy, Room: name, User: client.Name, Body: policy, Data: data})
+	cs.Audit(client, "room.policy", name, policy, "")
+	return nil
+}
+
+// applyAccessEvent updates the join policy, visibility and invite list of a
+// room for an event log entry. Caller must hold cs.Mutex.
+func (cs *ChatServer) applyAccessEvent(ev Event) {
+	room := cs.getRoom(ev.Room)
+	switch ev.Type {
+	case EventRoomPolicy:
+		var policy roomPolicy
+		if len(ev.Data) > 0 {
+			if err := json.Unmarshal(ev.Data, &policy); err != nil {
+				log.Println("Invalid room policy in event log:", err)
+				return
+			}
+		}
+		room.JoinPolicy = ev.Body
+		room.PasswordHash = policy.PasswordHash
+	case EventRoomVisibility:
+		room.Visibility = ev.Body
+	case EventRoomInvite:
+		room.Invited[ev.Target] = true
+	case EventRoomUninvite:
+		delete(room.Invited, ev.Target)
+	}
+}
+
+// canSee reports whether a room shows up for a client, or for anyone when
+// client is nil. Caller must hold cs.Mutex.
+func (cs *ChatServer) canSee(client *Client, name string, room *Room) bool {
+	if room.Visibility != VisibilityPrivate {
+		return true
+	}
+	return client != nil && (client.Admin || name == client.Room ||
+		(client.Authenticated && (room.Invited[client.Name] || room.Roles[client.Name] == RoleModerator)))
+}
+
+// roomCommand shows or changes the settings of the client's room
+func (cs *ChatServer) roomCommand(client *Client, fields []string) {
+	usage := "Usage: /room [policy open|invite|password <password>] [visibility public|private] [topic moderators|everyone] [description <text>] [persist on|off] [retention forever|none|days N|messages N] [format plain|markdown]"
+	if client.Room == "" {
+		client.Fail(CodeNotInRoom, "You are not in a room")
+		return
+	}
+	if len(fields) == 1 {
+		cs.SendRoomInfo(client, client.Room)
+		return
+	}
+	if !cs.IsModerator(client, client.Room) {
+		client.Fail(CodePermissionDenied, "Permission denied")
+		return
+	}
+
+	switch {
+	case len(fields) == 3 && fields[1] == "policy" && (fields[2] == JoinOpen || fields[2] == JoinInvite),
+		len(fields) == 4 && fields[1] == "policy" && fields[2] == JoinPassword:
+		password := ""
+		if len(fields) == 4 {
+			password = fields[3]
+		}
+		if err := cs.SetJoinPolicy(client, client.Room, fields[2], password); err != nil {
+			log.Println("Error setting room policy:", err)
+			client.Notice("Could not change the room policy")
+			return
+		}
+		client.Noticef("%s is now %s to join", client.Room, fields[2])
+	case len(fields) == 3 && fields[1] == "visibility" && (fields[2] == VisibilityPublic || fields[2] == VisibilityPrivate):
+		cs.Record(Event{Type: EventRoomVisibility, Room: client.Room, User: client.Name, Body: fields[2]})
+		cs.Audit(client, "room.visibility", client.Room, fields[2], "")
+		client.Noticef("%s is now %s", client.Room, fields[2])
+	case len(fields) == 3 && fields[1] == "topic" && (fields[2] == "moderators" || fields[2] == "everyone"):
+		cs.Record(Event{Type: EventRoomTopicLock, Room: client.Room, User: client.Name, Body: fields[2]})
+		cs.Audit(client, "room.topic_lock", client.Room, fields[2], "")
+		client.Noticef("The topic of %s can now be changed by %s", client.Room, fields[2])
+	case len(fields) >= 2 && fields[1] == "description":
+		description := strings.Join(fields[2:], " ")
+		cs.Record(Event{Type: EventRoomDescription, Room: client.Room, User: client.Name, Body: description})
+		cs.Audit(client, "room.description", client.Room, description, "")
+		client.Noticef("Description of %s updated", client.Room)
+	case len(fields) >= 3 && fields[1] == "retention":
+		policy, err := parseRetention(fields[2:])
+		if err != nil {
+			client.Notice(err.Error())
+			return
+		}
+		if err := cs.SetRetention(client, client.Room, policy); err != nil {
+			log.Println("Error setting retention:", err)
+			client.Notice("Could not change the retention policy")
+			return
+		}
+		client.Noticef("Messages in %s are now kept for: %s", client.Room, policy)
+	case len(fields) == 3 && fields[1] == "persist" && (fields[2] == "on" || fields[2] == "off"):
+		cs.Record(Event{Type: EventRoomPersist, Room: client.Room, User: client.Name, Body: fields[2]})
+		cs.Audit(client, "room.persist", client.Room, fields[2], "")
+		if fields[2] == "on" {
+			client.Noticef("%s will be kept when empty", client.Room)
+		} else {
+			client.Noticef("%s will expire once it has been empty for a while", client.Room)
+		}
+	case len(fields) == 3 && fields[1] == "format" && (fields[2] == FormatPlain || fields[2] == FormatMarkdown):
+		cs.Record(Event{Type: EventRoomFormat, Room: client.Room, User: client.Name, Body: fields[2]})
+		cs.Audit(client, "room.format", client.Room, fields[2], "")
+		client.Noticef("Messages in %s are now shown as %s", client.Room, fields[2])
+	default:
+		client.Notice(usage)
+	}
+}
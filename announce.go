@@ -0,0 +1,39 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+)
+
+// motd returns the message of the day from MOTD_FILE, falling back to MOTD
+func motd() string {
+	if path := os.Getenv("MOTD_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			return strings.TrimSpace(string(data))
+		}
+		log.Println("Error reading MOTD file:", err)
+	}
+	return os.Getenv("MOTD")
+}
+
+// SendMOTD sends the message of the day to a newly connected client
+func (cs *ChatServer) SendMOTD(client *Client) {
+	if text := motd(); text != "" {
+		client.Send(&Message{Type: MessageMOTD, Body: text})
+	}
+}
+
+// Announce broadcasts a server announcement to every room. Clients still
+// logging in are in no room and do not get it.
+func (cs *ChatServer) Announce(from, text string) {
+	log.Printf("Announcement from %s: %s", from, text)
+	msg := &Message{Type: MessageAnnouncement, From: from, Body: text}
+	if cs.archive(msg) != nil {
+		return
+	}
+	for _, room := range cs.Clients.Rooms() {
+		cs.Broadcast(room, msg, 0)
+	}
+}
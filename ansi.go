@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+// ANSI escape sequences used to color text for TCP clients
+const (
+	ansiReset  = "\x1b[0m"
+	ansiBold   = "\x1b[1m"
+	ansiDim    = "\x1b[2m"
+	ansiRed    = "\x1b[31m"
+	ansiYellow = "\x1b[33m"
+)
+
+// ansiNickColors are the foreground colors nicknames are drawn in
+var ansiNickColors = []int{31, 32, 33, 34, 35, 36, 91, 92, 93, 94, 95, 96}
+
+// ansiNick colors a nickname, always in the same color
+func ansiNick(name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return fmt.Sprintf("\x1b[1;%dm%s%s", ansiNickColors[h.Sum32()%uint32(len(ansiNickColors))], name, ansiReset)
+}
+
+// ANSIText renders a message like Text, with colored nicknames and dimmed
+// server messages for terminals that understand ANSI escapes
+func (m *Message) ANSIText() string {
+	switch m.Type {
+	case MessageChat:
+		plain, from := m.From, ansiNick(m.From)
+		if m.Bot {
+			plain += " [bot]"
+			from += ansiDim + " [bot]" + ansiReset
+		}
+		return from + strings.TrimPrefix(m.Text(), plain)
+	case MessageAnnouncement, MessageMention:
+		return ansiBold + ansiYellow + m.Text() + ansiReset
+	case MessageModeration, MessageError:
+		return ansiRed + m.Text() + ansiReset
+	case MessageSnippet, MessageLocation, MessagePoll, MessageEncrypted, MessageKey, MessageTopic, MessageRoomKey:
+		// These start with the sender's name
+		text := m.Text()
+		if m.From != "" && strings.HasPrefix(text, m.From) {
+			return ansiNick(m.From) + text[len(m.From):]
+		}
+		return text
+	default:
+		return ansiDim + m.Text() + ansiReset
+	}
+}
+
+// colorCommand turns ANSI colors on or off for a TCP client
+func (cs *ChatServer) colorCommand(client *Client, fields []string) {
+	t, ok := client.Transport.(*tcpTransport)
+	if !ok {
+		client.Notice("Colors are only available to TCP clients")
+		return
+	}
+	if len(fields) != 2 || (fields[1] != "on" && fields[1] != "off") {
+		client.Fail(CodeUsage, "Usage: /color on|off")
+		return
+	}
+	t.color.Store(fields[1] == "on")
+	client.Noticef("Colors turned %s", fields[1])
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Largest request body accepted by the HTTP API
+const maxAPIBodySize = 64 * 1024
+
+// APIToken lets an external service post messages
+type APIToken struct {
+	Name    string
+	hash    [32]byte
+	limiter *RateLimiter
+}
+
+// APITokens holds the tokens accepted by the HTTP API
+type APITokens struct {
+	mu     sync.Mutex
+	tokens []*APIToken
+}
+
+// LoadAPITokens reads comma separated name:token pairs from an environment
+// variable. Each token may be used perMinute times per minute.
+func LoadAPITokens(key string, perMinute int) *APITokens {
+	t := &APITokens{}
+	for _, entry := range envList(key) {
+		name, token, ok := strings.Cut(entry, ":")
+		if !ok || name == "" || token == "" {
+			log.Fatalf("Invalid %s entry %q, expected name:token", key, entry)
+		}
+		t.tokens = append(t.tokens, &APIToken{
+			Name:    name,
+			hash:    sha256.Sum256([]byte(token)),
+			limiter: NewRateLimiter(float64(perMinute)/60, perMinute),
+		})
+	}
+	return t
+}
+
+// SetRate changes how many times per minute each token may be used
+func (t *APITokens) SetRate(perMinute int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, token := range t.tokens {
+		token.limiter.SetRate(float64(perMinute)/60, perMinute)
+	}
+}
+
+// Authenticate returns the token sent as a bearer token in the request, or nil
+func (t *APITokens) Authenticate(r *http.Request) *APIToken {
+	bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil
+	}
+	return t.Lookup(bearer)
+}
+
+// Lookup returns the token matching a secret, or nil
+func (t *APITokens) Lookup(secret string) *APIToken {
+	hash := sha256.Sum256([]byte(secret))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, token := range t.tokens {
+		if subtle.ConstantTimeCompare(hash[:], token.hash[:]) == 1 {
+			return token
+		}
+	}
+	return nil
+}
+
+// writeJSON sends a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeConditional sends a response body with an ETag and, when modified is
+// known, a Last-Modified header. Requests whose validators still match get
+// 304 Not Modified instead of the body.
+func writeConditional(w http.ResponseWriter, r *http.Request, contentType string, body []byte, modified time.Time) {
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+
+	notModified := false
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		for _, tag := range strings.Split(match, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == etag || tag == "*" {
+				notModified = true
+			}
+		}
+	} else if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.IsZero() {
+		notModified = !modified.Truncate(time.Second).After(since)
+	}
+	if notModified {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(body)
+}
+
+// writeError sends a JSON error response
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// HandleGetMessages returns a room's recent history to an API token. Clients
+// polling for new messages can send If-None-Match or If-Modified-Since.
+func (cs *ChatServer) HandleGetMessages(w http.ResponseWriter, r *http.Request) {
+	if cs.APITokens.Authenticate(r) == nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, "missing or invalid token")
+		return
+	}
+
+	var since uint64
+	if s := r.URL.Query().Get("since"); s != "" {
+		var err error
+		if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+			writeError(w, http.StatusBadRequest, "since must be a sequence number")
+			return
+		}
+	}
+
+	cs.Mutex.Lock()
+	room, ok := cs.Rooms[r.PathValue("room")]
+	var messages []*Message
+	var updated time.Time
+	if ok {
+		messages = room.Replay.Range(since, 0)
+		updated = room.Updated
+	}
+	cs.Mutex.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "room not found")
+		return
+	}
+
+	if messages == nil {
+		messages = []*Message{}
+	}
+	body, err := json.Marshal(map[string]interface{}{"messages": messages})
+	if err != nil {
+		log.Println("Error encoding history:", err)
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	writeConditional(w, r, "application/json", body, updated)
+}
+
+// HandlePostMessage injects a message into a room on behalf of an API token
+func (cs *ChatServer) HandlePostMessage(w http.ResponseWriter, r *http.Request) {
+	token := cs.APITokens.Authenticate(r)
+	if token == nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, "missing or invalid token")
+		return
+	}
+	if !token.limiter.Allow() {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(token.limiter.Delay().Seconds()))))
+		writeError(w, http.StatusTooManyRequests, "rate limit exceeded")
+		return
+	}
+
+	var req struct {
+		Body string `json:"body"`
+		From string `json:"from"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxAPIBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if !utf8.ValidString(req.Body) || strings.TrimSpace(sanitizeText(req.Body)) == "" {
+		writeError(w, http.StatusBadRequest, "body must be non-empty UTF-8 text")
+		return
+	}
+
+	room := r.PathValue("room")
+	from, err := apiSender(token, req.From)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid from: "+err.Error())
+		return
+	}
+	span := cs.Tracer.StartRequest(r, "api.message")
+	span.SetAttr("api.token", token.Name)
+	defer span.End()
+	if status, err := cs.postAPIMessage(span, token, room, from, req.Body); err != nil {
+		span.SetError(err)
+		var throttle *throttleError
+		if errors.As(err, &throttle) {
+			w.Header().Set("Retry-After", strconv.Itoa(retrySeconds(throttle.retry)))
+		}
+		writeError(w, status, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "accepted"})
+}
+
+// apiSender returns the name an API message is posted under: the token's, or
+// the one the request gives, which must be a name a client could take without
+// logging in
+func apiSender(token *APIToken, from string) (string, error) {
+	if from == "" {
+		return token.Name, nil
+	}
+	if err := validateName(from, false); err != nil {
+		return "", err
+	}
+	return from, nil
+}
+
+// postAPIMessage filters, enriches and posts a message from an API token. On
+// failure it returns the HTTP status describing the error.
+func (cs *ChatServer) postAPIMessage(span *Span, token *APIToken, room, from, body string) (int, error) {
+	cs.Mutex.Lock()
+	_, exists := cs.Rooms[room]
+	cs.Mutex.Unlock()
+	if !exists {
+		return http.StatusNotFound, errors.New("room not found")
+	}
+
+	text, err := cs.ApplyFilters(nil, room, body)
+	if err != nil {
+		return http.StatusUnprocessableEntity, err
+	}
+	msg := &Message{Type: MessageChat, Room: room, From: from, Body: text, span: span}
+	if err := cs.ApplyEnrichers(nil, msg); err != nil {
+		return http.StatusUnprocessableEntity, err
+	}
+	if err := cs.PostMessage(msg, 0); err != nil {
+		var throttle *throttleError
+		if errors.As(err, &throttle) {
+			return http.StatusTooManyRequests, err
+		}
+		return http.StatusInternalServerError, errors.New("message could not be posted")
+	}
+	log.Printf("API token %s posted to %s", token.Name, room)
+	return http.StatusAccepted, nil
+}
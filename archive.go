@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Archive is a write-once record of every message, for deployments that
+// must keep one for compliance. Messages are archived before they are
+// delivered, and a message that cannot be archived is not delivered.
+//
+// The archive is a directory of JSON Lines segments, a new one every
+// ARCHIVE_ROTATE period. Segments are only ever appended to and are made
+// read-only once closed. Each record carries the SHA-256 of the line before it, so removing
+// or changing a record breaks the chain; VerifyArchive checks it. With
+// ARCHIVE_S3_BUCKET set, closed segments are also uploaded to S3 under
+// object lock.
+type Archive struct {
+	dir    string
+	rotate time.Duration
+	fsync  bool
+	upload func(path string) error
+
+	mu      sync.Mutex
+	file    *os.File
+	segment time.Time
+	n       uint64
+	prev    string
+}
+
+// ArchiveRecord is a line in the archive
+type ArchiveRecord struct {
+	N        uint64    `json:"n"`
+	Archived time.Time `json:"archived"`
+	Message  *Message  `json:"message"`
+	// Prev is the SHA-256 of the previous line, empty for the first record
+	Prev string `json:"prev"`
+}
+
+// archiveSegmentName names a segment opened at a time. Names sort in the
+// order the segments were written.
+func archiveSegmentName(opened time.Time) string {
+	return "archive-" + opened.UTC().Format("20060102T150405.000000000Z") + ".jsonl"
+}
+
+// archiveSegments lists the segments in an archive directory, oldest first
+func archiveSegments(dir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "archive-*.jsonl"))
+	sort.Strings(paths)
+	return paths, err
+}
+
+// hashLine returns the hex SHA-256 of an archive line without its newline
+func hashLine(line []byte) string {
+	sum := sha256.Sum256(bytes.TrimRight(line, "\n"))
+	return hex.EncodeToString(sum[:])
+}
+
+// OpenArchive opens the archive in dir, continuing the chain from its last
+// record. upload, if not nil, is given each segment once it is closed.
+func OpenArchive(dir string, rotate time.Duration, fsync bool, upload func(path string) error) (*Archive, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	a := &Archive{dir: dir, rotate: rotate, fsync: fsync, upload: upload}
+	segments, err := archiveSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) > 0 {
+		last, err := lastLine(segments[len(segments)-1])
+		if err != nil {
+			return nil, err
+		}
+		if last != nil {
+			var rec ArchiveRecord
+			if err := json.Unmarshal(last, &rec); err != nil {
+				return nil, fmt.Errorf("%s: %w", segments[len(segments)-1], err)
+			}
+			a.n, a.prev = rec.N, hashLine(last)
+		}
+	}
+	// Segments left over from before a restart are closed now
+	for _, path := range segments {
+		a.close(path)
+	}
+	return a, nil
+}
+
+// lastLine returns the last line of a file, or nil if it is empty
+func lastLine(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var last []byte
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		last = append(last[:0], scanner.Bytes()...)
+	}
+	return last, scanner.Err()
+}
+
+// close makes a finished segment read-only and hands it to the uploader
+func (a *Archive) close(path string) {
+	if err := os.Chmod(path, 0o440); err != nil {
+		log.Println("Archive error:", err)
+	}
+	if a.upload == nil {
+		return
+	}
+	if _, err := os.Stat(path + ".uploaded"); err == nil {
+		return
+	}
+	go func() {
+		for {
+			err := a.upload(path)
+			if err == nil {
+				os.WriteFile(path+".uploaded", nil, 0o440)
+				return
+			}
+			log.Printf("Error uploading archive segment %s: %v", filepath.Base(path), err)
+			time.Sleep(time.Minute)
+		}
+	}()
+}
+
+// Add appends a message to the archive, returning once it is written
+func (a *Archive) Add(msg *Message) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now().UTC()
+	start := now.Truncate(a.rotate)
+	if a.file == nil || !start.Equal(a.segment) {
+		if a.file != nil {
+			a.file.Close()
+			a.close(a.file.Name())
+		}
+		// Segments are created read-only; the open descriptor can still append.
+		// A restart always starts a new segment, even within the same period.
+		file, err := os.OpenFile(filepath.Join(a.dir, archiveSegmentName(now)), os.O_CREATE|os.O_EXCL|os.O_APPEND|os.O_WRONLY, 0o440)
+		if err != nil {
+			return err
+		}
+		a.file, a.segment = file, start
+	}
+
+	line, err := json.Marshal(ArchiveRecord{N: a.n + 1, Archived: now, Message: msg, Prev: a.prev})
+	if err != nil {
+		return err
+	}
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if a.fsync {
+		if err := a.file.Sync(); err != nil {
+			return err
+		}
+	}
+	a.n, a.prev = a.n+1, hashLine(line)
+	return nil
+}
+
+// Close closes the current segment without uploading it, so it is picked up
+// when the archive is opened again
+func (a *Archive) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Close()
+}
+
+// VerifyArchive checks the hash chain of the archive segments in dir and
+// returns the number of records
+func VerifyArchive(dir string) (uint64, error) {
+	segments, err := archiveSegments(dir)
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	prev := ""
+	for _, path := range segments {
+		file, err := os.Open(path)
+		if err != nil {
+			return n, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			var rec ArchiveRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				file.Close()
+				return n, fmt.Errorf("%s:%d: %w", filepath.Base(path), line, err)
+			}
+			if rec.Prev != prev || rec.N != n+1 {
+				file.Close()
+				return n, fmt.Errorf("%s:%d: record %d does not follow record %d", filepath.Base(path), line, rec.N, n)
+			}
+			n, prev = rec.N, hashLine(scanner.Bytes())
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// errNotArchived is returned for messages the archive could not record
+var errNotArchived = errors.New("message could not be archived")
+
+// archive records a message in the compliance archive when one is
+// configured. Messages it returns an error for must not be delivered.
+func (cs *ChatServer) archive(msg *Message) error {
+	if cs.Archive == nil {
+		return nil
+	}
+	if err := cs.Archive.Add(msg); err != nil {
+		log.Printf("Archive error: %v", err)
+		return errNotArchived
+	}
+	return nil
+}
+
+// OpenArchiveFromEnv opens the archive in ARCHIVE_DIR, uploading closed
+// segments to ARCHIVE_S3_BUCKET when it is set
+func OpenArchiveFromEnv() (*Archive, error) {
+	dir := os.Getenv("ARCHIVE_DIR")
+	if dir == "" {
+		return nil, nil
+	}
+	var upload func(string) error
+	if bucket := os.Getenv("ARCHIVE_S3_BUCKET"); bucket != "" {
+		s3, err := newS3Uploader(bucket)
+		if err != nil {
+			return nil, err
+		}
+		upload = s3.Upload
+	}
+	return OpenArchive(dir, envDuration("ARCHIVE_ROTATE", 24*time.Hour), envBool("ARCHIVE_FSYNC", true), upload)
+}
+
+// runVerifyArchive implements the verify-archive subcommand
+func runVerifyArchive(args []string, stderr io.Writer) int {
+	if len(args) != 1 || strings.HasPrefix(args[0], "-") {
+		fmt.Fprintln(stderr, "Usage: app verify-archive <dir>")
+		return 2
+	}
+	n, err := VerifyArchive(args[0])
+	if err != nil {
+		fmt.Fprintf(stderr, "Archive is broken after %d records: %v\n", n, err)
+		return 1
+	}
+	fmt.Fprintf(stderr, "Archive is intact: %d records\n", n)
+	return 0
+}
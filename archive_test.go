@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestArchiveChain(t *testing.T) {
+	dir := t.TempDir()
+	archive, err := OpenArchive(dir, time.Hour, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"one", "two"} {
+		if err := archive.Add(&Message{Type: MessageChat, Room: defaultRoom, From: "alice", Body: body}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	archive.Close()
+
+	// A restart continues the chain in a new segment
+	archive, err = OpenArchive(dir, time.Hour, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := archive.Add(&Message{Type: MessageChat, Room: defaultRoom, From: "bob", Body: "three"}); err != nil {
+		t.Fatal(err)
+	}
+	archive.Close()
+
+	segments, _ := archiveSegments(dir)
+	if len(segments) != 2 {
+		t.Fatalf("got %d segments, want 2", len(segments))
+	}
+	if info, err := os.Stat(segments[0]); err != nil || info.Mode().Perm()&0o222 != 0 {
+		t.Errorf("closed segment is writable: %v", info.Mode())
+	}
+	if n, err := VerifyArchive(dir); n != 3 || err != nil {
+		t.Fatalf("VerifyArchive = %d, %v", n, err)
+	}
+
+	// Changing a message breaks the chain at the record after it
+	data, _ := os.ReadFile(segments[0])
+	os.Chmod(segments[0], 0o640)
+	os.WriteFile(segments[0], []byte(strings.Replace(string(data), `"one"`, `"uno"`, 1)), 0o640)
+	if n, err := VerifyArchive(dir); n != 1 || err == nil {
+		t.Fatalf("VerifyArchive of a changed archive = %d, %v", n, err)
+	}
+}
+
+func TestArchiveBeforeDelivery(t *testing.T) {
+	s := startServer(t)
+	dir := t.TempDir()
+	archive, err := OpenArchive(dir, time.Hour, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.cs.Archive = archive
+	alice := s.dialTCP(t, "alice")
+	bob := s.dialTCP(t, "bob")
+
+	alice.Send("on the record")
+	bob.Expect("alice: on the record")
+	segments, _ := archiveSegments(dir)
+	data, _ := os.ReadFile(segments[0])
+	if !strings.Contains(string(data), `"body":"on the record"`) {
+		t.Fatalf("archive does not have the message: %s", data)
+	}
+
+	// Messages that cannot be archived are not delivered
+	archive.Close()
+	alice.Send("off the record")
+	bob.ExpectNone("off the record", 200*time.Millisecond)
+}
+
+func TestArchiveS3Upload(t *testing.T) {
+	var got *http.Request
+	var body []byte
+	s3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer s3.Close()
+	t.Setenv("ARCHIVE_S3_ENDPOINT", s3.URL)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("ARCHIVE_RETENTION", "24h")
+	uploader, err := newS3Uploader("chat-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	uploader.now = func() time.Time { return now }
+
+	path := filepath.Join(t.TempDir(), archiveSegmentName(now))
+	os.WriteFile(path, []byte("{}\n"), 0o440)
+	if err := uploader.Upload(path); err != nil {
+		t.Fatal(err)
+	}
+	if got.Method != http.MethodPut || got.URL.Path != "/chat-archive/"+filepath.Base(path) || string(body) != "{}\n" {
+		t.Fatalf("got %s %s with %q", got.Method, got.URL.Path, body)
+	}
+	sum := md5.Sum(body)
+	for header, want := range map[string]string{
+		"Content-MD5":                         base64.StdEncoding.EncodeToString(sum[:]),
+		"X-Amz-Object-Lock-Mode":              "COMPLIANCE",
+		"X-Amz-Object-Lock-Retain-Until-Date": "2026-10-17T12:00:00Z",
+		"X-Amz-Date":                          "20261016T120000Z",
+	} {
+		if v := got.Header.Get(header); v != want {
+			t.Errorf("%s = %q, want %q", header, v, want)
+		}
+	}
+	if auth := got.Header.Get("Authorization"); !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/20261016/us-east-1/s3/aws4_request, SignedHeaders=content-md5;content-type;host;x-amz-content-sha256;") {
+		t.Errorf("Authorization = %q", auth)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Default number of audit entries returned by the admin API
+const defaultAuditLimit = 100
+
+// AuditEntry records one administrative action: who did what to which
+// target, when, and why
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	Room   string    `json:"room,omitempty"`
+	Target string    `json:"target,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// AuditLog is an append-only store of administrative actions. Entries are
+// kept in memory for queries and, when a file is open, written to it as
+// JSON lines.
+type AuditLog struct {
+	mu      sync.Mutex
+	file    *os.File
+	enc     *json.Encoder
+	entries []AuditEntry
+}
+
+// OpenAuditLog loads the entries in the file at path and appends all further
+// entries to it
+func OpenAuditLog(path string) (*AuditLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	a := &AuditLog{file: file, enc: json.NewEncoder(file)}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			file.Close()
+			return nil, err
+		}
+		a.entries = append(a.entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// Add appends an entry to the audit log
+func (a *AuditLog) Add(entry AuditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.entries = append(a.entries, entry)
+	if a.enc == nil {
+		return nil
+	}
+	return a.enc.Encode(entry)
+}
+
+// Query returns the most recent entries matching every non-empty field of
+// match and made at or after since, oldest first
+func (a *AuditLog) Query(match AuditEntry, since time.Time, limit int) []AuditEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	result := []AuditEntry{}
+	for i := len(a.entries) - 1; i >= 0 && len(result) < limit; i-- {
+		entry := a.entries[i]
+		if entry.Time.Before(since) {
+			break
+		}
+		if (match.Actor != "" && entry.Actor != match.Actor) ||
+			(match.Action != "" && entry.Action != match.Action) ||
+			(match.Room != "" && entry.Room != match.Room) ||
+			(match.Target != "" && entry.Target != match.Target) {
+			continue
+		}
+		result = append(result, entry)
+	}
+	for i, j := 0, len(result)-1; i < j; i, j = i+1, j-1 {
+		result[i], result[j] = result[j], result[i]
+	}
+	return result
+}
+
+// Close closes the underlying file
+func (a *AuditLog) Close() error {
+	if a.file == nil {
+		return nil
+	}
+	return a.file.Close()
+}
+
+// Audit records an administrative action taken by a client
+func (cs *ChatServer) Audit(client *Client, action, room, target, reason string) {
+	entry := AuditEntry{
+		Time:   time.Now().UTC(),
+		Actor:  client.Name,
+		Action: action,
+		Room:   room,
+		Target: target,
+		Reason: reason,
+	}
+	if err := cs.AuditLog.Add(entry); err != nil {
+		log.Println("Audit log error:", err)
+	}
+}
+
+// auditAdmin records an action taken with an admin token
+func (cs *ChatServer) auditAdmin(token *APIToken, action, target string) {
+	entry := AuditEntry{Time: time.Now().UTC(), Actor: "token:" + token.Name, Action: action, Target: target}
+	if err := cs.AuditLog.Add(entry); err != nil {
+		log.Println("Audit log error:", err)
+	}
+}
+
+// auditServer records an action the server took on its own, such as
+// muting a spammer or expiring a room
+func (cs *ChatServer) auditServer(action, room, target, reason string) {
+	entry := AuditEntry{Time: time.Now().UTC(), Actor: "server", Action: action, Room: room, Target: target, Reason: reason}
+	if err := cs.AuditLog.Add(entry); err != nil {
+		log.Println("Audit log error:", err)
+	}
+}
+
+// HandleGetAudit lists audit entries to an admin token. The actor, action,
+// room and target parameters filter the entries, since limits them to those
+// made at or after an RFC 3339 time, and limit caps how many are returned.
+func (cs *ChatServer) HandleGetAudit(w http.ResponseWriter, r *http.Request) {
+	if cs.AdminTokens.Authenticate(r) == nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, "missing or invalid token")
+		return
+	}
+
+	query := r.URL.Query()
+	var since time.Time
+	if v := query.Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "since must be an RFC 3339 time")
+			return
+		}
+		since = t
+	}
+	limit := defaultAuditLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = n
+	}
+
+	match := AuditEntry{
+		Actor:  query.Get("actor"),
+		Action: query.Get("action"),
+		Room:   query.Get("room"),
+		Target: query.Get("target"),
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"entries": cs.AuditLog.Query(match, since, limit)})
+}
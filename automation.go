@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Automation triggers
+const (
+	TriggerMessage = "message"
+	TriggerJoin    = "join"
+	TriggerCommand = "command"
+)
+
+// maxAutomationOutput caps how many characters one run of a script may say
+const maxAutomationOutput = 2000
+
+// automationName restricts names to ones that read well as a bot's name
+var automationName = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,32}$`)
+
+// Automation is a small script admins attach to the chat, such as an
+// auto-response, a greeting or a custom command. Its script is a Go
+// text/template; whatever it renders is posted to the room from the
+// automation's name, or sent only to the client that triggered it when
+// Private is set. Scripts that render nothing stay quiet.
+//
+// The script sees .User, .Room, .Text, .Args (a command's arguments) and
+// .Match (the submatches of Match), and can call upper, lower, join, split,
+// contains, pick (a random argument) and now.
+type Automation struct {
+	Name string `json:"name"`
+	// Room limits the automation to one room; empty means every room
+	Room    string `json:"room,omitempty"`
+	Trigger string `json:"trigger"`
+	// Match is a regular expression messages must match, or for commands
+	// the command name, such as /faq
+	Match   string `json:"match,omitempty"`
+	Script  string `json:"script"`
+	Private bool   `json:"private,omitempty"`
+
+	match  *regexp.Regexp
+	script *template.Template
+}
+
+// automationInput is what a script can read
+type automationInput struct {
+	User  string
+	Room  string
+	Text  string
+	Args  []string
+	Match []string
+}
+
+var automationFuncs = template.FuncMap{
+	"upper":    strings.ToUpper,
+	"lower":    strings.ToLower,
+	"join":     strings.Join,
+	"split":    strings.Split,
+	"contains": strings.Contains,
+	"pick": func(choices ...string) string {
+		if len(choices) == 0 {
+			return ""
+		}
+		return choices[rand.Intn(len(choices))]
+	},
+	"now": func() string { return time.Now().UTC().Format(time.RFC3339) },
+}
+
+// compile checks an automation and prepares it to run
+func (a *Automation) compile() error {
+	if !automationName.MatchString(a.Name) {
+		return errors.New("name must be 1-32 letters, digits, dashes or underscores")
+	}
+	switch a.Trigger {
+	case TriggerMessage:
+		if a.Match != "" {
+			re, err := regexp.Compile(a.Match)
+			if err != nil {
+				return fmt.Errorf("invalid match: %w", err)
+			}
+			a.match = re
+		}
+	case TriggerJoin:
+	case TriggerCommand:
+		if !strings.HasPrefix(a.Match, "/") || strings.ContainsAny(a.Match, " \t") {
+			return errors.New("command automations must match a command such as /faq")
+		}
+	default:
+		return fmt.Errorf("trigger must be %s, %s or %s", TriggerMessage, TriggerJoin, TriggerCommand)
+	}
+	script, err := template.New(a.Name).Funcs(automationFuncs).Option("missingkey=zero").Parse(a.Script)
+	if err != nil {
+		return fmt.Errorf("invalid script: %w", err)
+	}
+	a.script = script
+	return nil
+}
+
+// run renders the script, returning "" when it has nothing to say
+func (a *Automation) run(in automationInput) string {
+	var out bytes.Buffer
+	if err := a.script.Execute(&out, in); err != nil {
+		log.Printf("Automation %s error: %v", a.Name, err)
+		return ""
+	}
+	return clip(strings.TrimSpace(out.String()), maxAutomationOutput)
+}
+
+// applyAutomationEvent updates the automations from the event log
+func (cs *ChatServer) applyAutomationEvent(ev Event) {
+	if ev.Type == EventAutomationDelete {
+		delete(cs.Automations, ev.Target)
+		return
+	}
+	var a Automation
+	if err := json.Unmarshal(ev.Data, &a); err != nil {
+		log.Println("Invalid automation in event log:", err)
+		return
+	}
+	if err := a.compile(); err != nil {
+		log.Printf("Invalid automation %s in event log: %v", a.Name, err)
+		return
+	}
+	cs.Automations[a.Name] = &a
+}
+
+// automationsFor returns the automations a trigger in a room runs, in name
+// order
+func (cs *ChatServer) automationsFor(trigger, room string) []*Automation {
+	cs.Mutex.Lock()
+	var found []*Automation
+	for _, a := range cs.Automations {
+		if a.Trigger == trigger && (a.Room == "" || a.Room == room) {
+			found = append(found, a)
+		}
+	}
+	cs.Mutex.Unlock()
+	sort.Slice(found, func(i, j int) bool { return found[i].Name < found[j].Name })
+	return found
+}
+
+// respond delivers an automation's output
+func (cs *ChatServer) respond(a *Automation, client *Client, room, text string) {
+	if text == "" {
+		return
+	}
+	if a.Private || room == "" {
+		client.Send(&Message{Type: MessageSystem, Room: room, From: a.Name, Body: text, Bot: true})
+		return
+	}
+	if err := cs.PostMessage(&Message{Type: MessageChat, Room: room, From: a.Name, Body: text, Bot: true}, 0); err != nil {
+		log.Printf("Automation %s could not post to %s: %v", a.Name, room, err)
+	}
+}
+
+// RunMessageAutomations answers a chat message that was posted
+func (cs *ChatServer) RunMessageAutomations(client *Client, msg *Message) {
+	for _, a := range cs.automationsFor(TriggerMessage, msg.Room) {
+		in := automationInput{User: client.Name, Room: msg.Room, Text: msg.Body}
+		if a.match != nil {
+			if in.Match = a.match.FindStringSubmatch(msg.Body); in.Match == nil {
+				continue
+			}
+		}
+		cs.respond(a, client, msg.Room, a.run(in))
+	}
+}
+
+// RunJoinAutomations greets a client that joined a room
+func (cs *ChatServer) RunJoinAutomations(client *Client, room string) {
+	for _, a := range cs.automationsFor(TriggerJoin, room) {
+		cs.respond(a, client, room, a.run(automationInput{User: client.Name, Room: room}))
+	}
+}
+
+// hasCommandAutomation reports whether an automation answers a command in the client's room
+func (cs *ChatServer) hasCommandAutomation(client *Client, command string) bool {
+	for _, a := range cs.automationsFor(TriggerCommand, client.Room) {
+		if strings.EqualFold(a.Match, command) {
+			return true
+		}
+	}
+	return false
+}
+
+// RunCommandAutomation runs the automation handling a command, reporting
+// whether there was one
+func (cs *ChatServer) RunCommandAutomation(client *Client, fields []string) bool {
+	for _, a := range cs.automationsFor(TriggerCommand, client.Room) {
+		if !strings.EqualFold(a.Match, fields[0]) {
+			continue
+		}
+		in := automationInput{User: client.Name, Room: client.Room, Text: strings.Join(fields[1:], " "), Args: fields[1:]}
+		cs.respond(a, client, client.Room, a.run(in))
+		return true
+	}
+	return false
+}
+
+// HandleListAutomations lists the automations to an admin token
+func (cs *ChatServer) HandleListAutomations(w http.ResponseWriter, r *http.Request) {
+	if cs.AdminTokens.Authenticate(r) == nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, "missing or invalid token")
+		return
+	}
+	cs.Mutex.Lock()
+	list := make([]*Automation, 0, len(cs.Automations))
+	for _, a := range cs.Automations {
+		list = append(list, a)
+	}
+	cs.Mutex.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	writeJSON(w, http.StatusOK, map[string]interface{}{"automations": list})
+}
+
+// HandlePutAutomation creates or replaces an automation. It takes effect
+// immediately.
+func (cs *ChatServer) HandlePutAutomation(w http.ResponseWriter, r *http.Request) {
+	token := cs.AdminTokens.Authenticate(r)
+	if token == nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, "missing or invalid token")
+		return
+	}
+	var a Automation
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&a); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	a.Name = r.PathValue("name")
+	if err := a.compile(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	data, err := json.Marshal(&a)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	cs.Record(Event{Type: EventAutomationSet, Target: a.Name, Data: data})
+	cs.auditAdmin(token, "automation.set", a.Name)
+	writeJSON(w, http.StatusOK, &a)
+}
+
+// HandleDeleteAutomation removes an automation
+func (cs *ChatServer) HandleDeleteAutomation(w http.ResponseWriter, r *http.Request) {
+	token := cs.AdminTokens.Authenticate(r)
+	if token == nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, "missing or invalid token")
+		return
+	}
+	name := r.PathValue("name")
+	cs.Mutex.Lock()
+	_, ok := cs.Automations[name]
+	cs.Mutex.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such automation")
+		return
+	}
+	cs.Record(Event{Type: EventAutomationDelete, Target: name})
+	cs.auditAdmin(token, "automation.delete", name)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// blocksMessage reports whether msg comes from a user the client has blocked.
+// Announcements are delivered regardless.
+func (c *Client) blocksMessage(msg *Message) bool {
+	if msg.From == "" || msg.Type == MessageAnnouncement {
+		return false
+	}
+	blocked := c.blocked.Load()
+	return blocked != nil && (*blocked)[msg.From]
+}
+
+// blockedNames returns a copy of the names the client has blocked
+func (c *Client) blockedNames() map[string]bool {
+	names := make(map[string]bool)
+	if blocked := c.blocked.Load(); blocked != nil {
+		for name := range *blocked {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// LoadBlocks restores the block list of a logged in client
+func (cs *ChatServer) LoadBlocks(client *Client) {
+	if !client.Authenticated {
+		return
+	}
+	cs.Mutex.Lock()
+	names := make(map[string]bool, len(cs.Blocks[client.Name]))
+	for name := range cs.Blocks[client.Name] {
+		names[name] = true
+	}
+	cs.Mutex.Unlock()
+	client.blocked.Store(&names)
+}
+
+// SetBlocked blocks or unblocks a user for a client. Block lists of logged
+// in users are saved with their account and apply to all their connections;
+// guests keep theirs until they disconnect.
+func (cs *ChatServer) SetBlocked(client *Client, name string, block bool) {
+	if !client.Authenticated {
+		names := client.blockedNames()
+		if block {
+			names[name] = true
+		} else {
+			delete(names, name)
+		}
+		client.blocked.Store(&names)
+		return
+	}
+
+	eventType := EventUnblock
+	if block {
+		eventType = EventBlock
+	}
+	cs.Record(Event{Type: eventType, User: client.Name, Target: name})
+	for _, c := range cs.Clients.All() {
+		if c.Authenticated && c.Name == client.Name {
+			cs.LoadBlocks(c)
+		}
+	}
+}
+
+// applyBlockEvent updates the block list of an account for an event log
+// entry. Caller must hold cs.Mutex.
+func (cs *ChatServer) applyBlockEvent(ev Event) {
+	switch ev.Type {
+	case EventBlock:
+		if cs.Blocks[ev.User] == nil {
+			cs.Blocks[ev.User] = make(map[string]bool)
+		}
+		cs.Blocks[ev.User][ev.Target] = true
+	case EventUnblock:
+		delete(cs.Blocks[ev.User], ev.Target)
+	}
+}
+
+// blockCommand lists the users a client has blocked or blocks and unblocks one
+func (cs *ChatServer) blockCommand(client *Client, fields []string) {
+	if fields[0] == "/block" && len(fields) == 1 {
+		names := client.blockedNames()
+		if len(names) == 0 {
+			client.Notice("You have not blocked anyone")
+			return
+		}
+		list := make([]string, 0, len(names))
+		for name := range names {
+			list = append(list, name)
+		}
+		sort.Strings(list)
+		client.Noticef("Blocked: %s", strings.Join(list, ", "))
+		return
+	}
+	if len(fields) != 2 {
+		client.Fail(CodeUsage, "Usage: %s <nick>", fields[0])
+		return
+	}
+	if fields[1] == client.Name {
+		client.Notice("You cannot block yourself")
+		return
+	}
+
+	block := fields[0] == "/block"
+	cs.SetBlocked(client, fields[1], block)
+	if block {
+		client.Noticef("You will no longer receive messages from %s", fields[1])
+	} else {
+		client.Noticef("%s is no longer blocked", fields[1])
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"strings"
+)
+
+// Events a bot can subscribe to
+var botEvents = map[string]bool{"message": true, "join": true, "leave": true, "command": true}
+
+// botEvent returns the subscription that covers a message type, or an empty
+// string for messages every bot receives
+func botEvent(msgType string) string {
+	switch msgType {
+	case MessageChat, MessageSnippet, MessageLocation, MessagePoll, MessageEncrypted:
+		return "message"
+	case MessageJoin:
+		return "join"
+	case MessageLeave:
+		return "leave"
+	case MessageCommand:
+		return "command"
+	}
+	return ""
+}
+
+// subscribed reports whether a bot wants to receive a broadcast message
+func (c *Client) subscribed(msg *Message) bool {
+	event := botEvent(msg.Type)
+	return event == "" || c.subscribedTo(event)
+}
+
+// subscribedTo reports whether a bot has subscribed to an event
+func (c *Client) subscribedTo(event string) bool {
+	subscriptions := c.subscriptions.Load()
+	return subscriptions != nil && (*subscriptions)[event]
+}
+
+// HandleBotConnection handles a WebSocket client that authenticated with a bot token
+func (cs *ChatServer) HandleBotConnection(transport *wsTransport, name string) {
+	wsConn := transport.conn
+	client := &Client{
+		Transport:     transport,
+		Name:          name,
+		Address:       transport.Remote(),
+		Bot:           true,
+		Authenticated: true,
+	}
+	client.subscriptions.Store(&map[string]bool{"command": true})
+	defer wsConn.Close()
+	if cs.AddClient(client) != nil {
+		return
+	}
+	defer cs.RemoveClient(client)
+	if !cs.Authenticated(client) {
+		return
+	}
+
+	log.Printf("Bot %s connected from %s", name, client.Address)
+	client.Noticef("Authenticated as bot %s. Subscribed to: command", name)
+	cs.JoinRoom(client, defaultRoom, client.ID)
+	cs.readWebSocket(client, wsConn)
+}
+
+// Subscribe replaces the events a bot receives
+func (cs *ChatServer) Subscribe(client *Client, events []string) {
+	if !client.Bot {
+		client.Notice("Only bots can subscribe to events")
+		return
+	}
+	subscriptions := make(map[string]bool)
+	for _, event := range events {
+		if !botEvents[event] {
+			client.Noticef("Unknown event: %s", event)
+			return
+		}
+		subscriptions[event] = true
+	}
+
+	client.subscriptions.Store(&subscriptions)
+
+	names := make([]string, 0, len(subscriptions))
+	for event := range subscriptions {
+		names = append(names, event)
+	}
+	sort.Strings(names)
+	client.Noticef("Subscribed to: %s", strings.Join(names, ", "))
+}
+
+// BotChat posts a reply from a bot. Bots are trusted integrations, so they
+// skip spam detection, but room filters still apply.
+func (cs *ChatServer) BotChat(client *Client, text string, sender ClientID) {
+	text, err := cs.ApplyFilters(client, client.Room, text)
+	if err != nil {
+		client.Fail(CodeRejected, "Message rejected: %s", err.Error())
+		return
+	}
+	msg := &Message{Type: MessageChat, Room: client.Room, From: client.Name, Body: text, Bot: true}
+	if err := cs.runHooks(func(h Hooks) error { return h.OnMessage(client, msg) }); err != nil {
+		client.Fail(CodeRejected, "Message rejected: %s", err.Error())
+		return
+	}
+	if err := cs.PostMessage(msg, sender); err != nil {
+		tellThrottled(client, err)
+	}
+}
+
+// DispatchBotCommand sends a chat message starting with !<bot> to that bot as a command event
+func (cs *ChatServer) DispatchBotCommand(msg *Message) {
+	if !strings.HasPrefix(msg.Body, "!") {
+		return
+	}
+	name, args, _ := strings.Cut(strings.TrimPrefix(msg.Body, "!"), " ")
+	if name == "" {
+		return
+	}
+
+	cs.Mutex.Lock()
+	var bots []*Client
+	for _, client := range cs.Clients.All() {
+		if client.Bot && client.Name == name && client.Room == msg.Room && client.subscribedTo("command") {
+			bots = append(bots, client)
+		}
+	}
+	cs.Mutex.Unlock()
+
+	command := &Message{Type: MessageCommand, Room: msg.Room, From: msg.From, Body: strings.TrimSpace(args)}
+	for _, bot := range bots {
+		bot.Send(command)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Default largest signaling payload, in bytes. Session descriptions of calls
+// with several tracks run to a few kilobytes.
+const defaultMaxSignal = 32 * 1024
+
+// Codes of call errors
+const (
+	CodeCallInvalid     = "call.invalid"
+	CodeCallUnreachable = "call.unreachable"
+	CodeTURNUnavailable = "call.turn_unavailable"
+)
+
+// ICEServer is a STUN or TURN server clients may use to connect calls, in
+// the form of RTCIceServer
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// ICEConfig is what a call.turn request returns: the servers to use and when
+// their credentials expire
+type ICEConfig struct {
+	Servers []ICEServer `json:"servers"`
+	Expires time.Time   `json:"expires"`
+}
+
+// canCall reports whether a client can take part in calls. Plain text
+// clients cannot, and clients of the typed protocol must select FeatureCalls.
+func canCall(c *Client) bool {
+	if _, text := c.Transport.(messageEncoder); text {
+		return false
+	}
+	ws, ok := c.Transport.(*wsTransport)
+	return !ok || ws.selected(FeatureCalls)
+}
+
+// RelaySignal relays WebRTC signaling, an offer, answer, ICE candidate or
+// hangup, from a client. Signals naming a recipient go to that user wherever
+// they are, for calls between two people; others go to everyone in the
+// client's room. The server does not look inside the signal.
+func (cs *ChatServer) RelaySignal(client *Client, req *Request, sender ClientID) {
+	if req.Call == "" || len(req.Call) > 64 {
+		client.Fail(CodeCallInvalid, "Call signals need a call ID of at most 64 characters")
+		return
+	}
+	if req.Type != MessageCallHangup && len(req.Signal) == 0 {
+		client.Fail(CodeCallInvalid, "Call signals need a signal")
+		return
+	}
+	if limit := envInt("CALL_SIGNAL_MAX_SIZE", defaultMaxSignal); len(req.Signal) > limit {
+		client.Fail(CodeCallInvalid, "Call signals can be at most %d bytes", limit)
+		return
+	}
+	if req.To == "" && client.Room == "" {
+		client.Fail(CodeNotInRoom, "You are not in a room")
+		return
+	}
+
+	msg := &Message{Type: req.Type, From: client.Name, To: req.To, Call: req.Call, Signal: req.Signal}
+	var recipients []*Client
+	if req.To != "" {
+		for _, c := range cs.Clients.All() {
+			if c.Name == req.To && c.ID != sender && canCall(c) && !c.blocksMessage(msg) {
+				recipients = append(recipients, c)
+			}
+		}
+	} else {
+		msg.Room = client.Room
+		for _, c := range cs.Clients.InRoom(client.Room) {
+			if c.ID != sender && canCall(c) && !c.blocksMessage(msg) {
+				recipients = append(recipients, c)
+			}
+		}
+	}
+	if len(recipients) == 0 && req.Type == MessageCallOffer {
+		if req.To != "" {
+			client.Fail(CodeCallUnreachable, "%s cannot take calls right now", req.To)
+		} else {
+			client.Fail(CodeCallUnreachable, "Nobody in %s can take calls right now", client.Room)
+		}
+		return
+	}
+	for _, c := range recipients {
+		c.Send(msg)
+	}
+}
+
+// turnConfigured reports whether the server mints TURN credentials, which
+// needs TURN_URLS and the TURN_SECRET shared with the TURN server
+func turnConfigured() bool {
+	return len(envList("TURN_URLS")) > 0 && os.Getenv("TURN_SECRET") != ""
+}
+
+// TURNCredentials mints short-lived credentials for the TURN server with
+// the shared secret scheme of the TURN REST API, which coturn implements
+// as use-auth-secret. STUN_URLS are listed too.
+func TURNCredentials(user string, now time.Time) (*ICEConfig, error) {
+	if !turnConfigured() {
+		return nil, fmt.Errorf("TURN is not configured")
+	}
+	expires := now.Add(envDuration("TURN_TTL", 12*time.Hour)).UTC().Truncate(time.Second)
+	username := strconv.FormatInt(expires.Unix(), 10) + ":" + user
+	mac := hmac.New(sha1.New, []byte(os.Getenv("TURN_SECRET")))
+	mac.Write([]byte(username))
+
+	config := &ICEConfig{Expires: expires}
+	if stun := envList("STUN_URLS"); len(stun) > 0 {
+		config.Servers = append(config.Servers, ICEServer{URLs: stun})
+	}
+	config.Servers = append(config.Servers, ICEServer{
+		URLs:       envList("TURN_URLS"),
+		Username:   username,
+		Credential: base64.StdEncoding.EncodeToString(mac.Sum(nil)),
+	})
+	return config, nil
+}
+
+// SendTURNCredentials answers a call.turn request
+func (cs *ChatServer) SendTURNCredentials(client *Client) {
+	if client.Guest {
+		client.Fail(CodeGuest, "Guests cannot make calls. Register to take part.")
+		return
+	}
+	config, err := TURNCredentials(client.Name, time.Now())
+	if err != nil {
+		client.Fail(CodeTURNUnavailable, "This server does not provide a TURN server")
+		return
+	}
+	client.Send(&Message{Type: MessageCallTURN, ICE: config})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Reconnect backoff bounds
+const (
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
+)
+
+// errLogin is returned when the server rejects the credentials, which
+// retrying will not fix
+var errLogin = errors.New("login rejected")
+
+// Message is the subset of the server's message envelope the client shows
+type Message struct {
+	Type string     `json:"type"`
+	Room string     `json:"room"`
+	From string     `json:"from"`
+	Body string     `json:"body"`
+	ID   string     `json:"id"`
+	Time *time.Time `json:"time"`
+}
+
+// Events the connection sends to the event loop
+type (
+	connected    struct{ conn *websocket.Conn }
+	disconnected struct{ err error }
+	rawText      string
+	statusText   string
+)
+
+// session logs in to a chat server and keeps a connection to it open
+type session struct {
+	server   *url.URL
+	username string
+	password string
+	guest    bool
+
+	events chan interface{}
+	// retry receives a two-factor code, or "", when the user asks to try a
+	// rejected login again
+	retry chan string
+}
+
+// ticket exchanges the credentials for a connect ticket
+func (s *session) ticket(code string) (string, error) {
+	body, _ := json.Marshal(map[string]string{"username": s.username, "password": s.password, "code": code})
+	resp, err := http.Post(s.server.JoinPath("tickets").String(), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Ticket string `json:"ticket"`
+		Error  string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+	switch {
+	case resp.StatusCode == http.StatusCreated:
+		return result.Ticket, nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusBadRequest:
+		return "", fmt.Errorf("%w: %s", errLogin, result.Error)
+	case result.Error != "":
+		return "", errors.New(result.Error)
+	}
+	return "", fmt.Errorf("server answered %s", resp.Status)
+}
+
+// dial opens a WebSocket connection, logged in with a fresh ticket unless
+// visiting as a guest
+func (s *session) dial(code string) (*websocket.Conn, error) {
+	u := *s.server
+	u.Scheme = strings.Replace(u.Scheme, "http", "ws", 1)
+	u = *u.JoinPath("ws")
+	if !s.guest {
+		ticket, err := s.ticket(code)
+		if err != nil {
+			return nil, err
+		}
+		u.RawQuery = url.Values{"ticket": {ticket}}.Encode()
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	return conn, err
+}
+
+// run connects, forwards messages to the event loop until the connection
+// drops, and reconnects with exponential backoff
+func (s *session) run() {
+	backoff := minBackoff
+	code := ""
+	for {
+		s.events <- statusText("connecting")
+		conn, err := s.dial(code)
+		code = ""
+		if errors.Is(err, errLogin) {
+			s.events <- disconnected{err}
+			code = <-s.retry
+			continue
+		}
+		if err != nil {
+			s.events <- disconnected{err}
+			time.Sleep(backoff)
+			backoff = min(backoff*2, maxBackoff)
+			continue
+		}
+		backoff = minBackoff
+		s.events <- connected{conn}
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				conn.Close()
+				s.events <- disconnected{err}
+				break
+			}
+			var msg Message
+			if json.Unmarshal(data, &msg) != nil || msg.Type == "" {
+				// Login prompts are plain text
+				s.events <- rawText(data)
+				continue
+			}
+			s.events <- msg
+		}
+		time.Sleep(backoff)
+	}
+}
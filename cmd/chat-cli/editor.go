@@ -0,0 +1,172 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// maxHistory is how many sent lines the editor remembers
+const maxHistory = 500
+
+// editor is a readline-style input line with history and nickname
+// completion
+type editor struct {
+	buf []rune
+	pos int
+
+	history []string
+	// hist indexes history while browsing it, len(history) when editing a
+	// new line, which is kept in draft
+	hist  int
+	draft []rune
+}
+
+func (e *editor) String() string { return string(e.buf) }
+
+func (e *editor) insert(r rune) {
+	e.buf = append(e.buf, 0)
+	copy(e.buf[e.pos+1:], e.buf[e.pos:])
+	e.buf[e.pos] = r
+	e.pos++
+}
+
+func (e *editor) backspace() {
+	if e.pos > 0 {
+		e.buf = append(e.buf[:e.pos-1], e.buf[e.pos:]...)
+		e.pos--
+	}
+}
+
+func (e *editor) delete() {
+	if e.pos < len(e.buf) {
+		e.buf = append(e.buf[:e.pos], e.buf[e.pos+1:]...)
+	}
+}
+
+func (e *editor) left() {
+	if e.pos > 0 {
+		e.pos--
+	}
+}
+
+func (e *editor) right() {
+	if e.pos < len(e.buf) {
+		e.pos++
+	}
+}
+
+func (e *editor) home() { e.pos = 0 }
+
+func (e *editor) end() { e.pos = len(e.buf) }
+
+// wordLeft moves to the start of the word before the cursor
+func (e *editor) wordLeft() {
+	for e.pos > 0 && unicode.IsSpace(e.buf[e.pos-1]) {
+		e.pos--
+	}
+	for e.pos > 0 && !unicode.IsSpace(e.buf[e.pos-1]) {
+		e.pos--
+	}
+}
+
+// wordRight moves past the end of the word after the cursor
+func (e *editor) wordRight() {
+	for e.pos < len(e.buf) && unicode.IsSpace(e.buf[e.pos]) {
+		e.pos++
+	}
+	for e.pos < len(e.buf) && !unicode.IsSpace(e.buf[e.pos]) {
+		e.pos++
+	}
+}
+
+// killWord deletes the word before the cursor
+func (e *editor) killWord() {
+	end := e.pos
+	e.wordLeft()
+	e.buf = append(e.buf[:e.pos], e.buf[end:]...)
+}
+
+// killStart deletes everything before the cursor
+func (e *editor) killStart() {
+	e.buf = append([]rune(nil), e.buf[e.pos:]...)
+	e.pos = 0
+}
+
+// killEnd deletes everything from the cursor on
+func (e *editor) killEnd() {
+	e.buf = e.buf[:e.pos]
+}
+
+// set replaces the line and moves the cursor to its end
+func (e *editor) set(line []rune) {
+	e.buf = append([]rune(nil), line...)
+	e.pos = len(e.buf)
+}
+
+// prev shows the previous line in the history
+func (e *editor) prev() {
+	if e.hist == 0 {
+		return
+	}
+	if e.hist == len(e.history) {
+		e.draft = append([]rune(nil), e.buf...)
+	}
+	e.hist--
+	e.set([]rune(e.history[e.hist]))
+}
+
+// next shows the next line in the history, or the line being written
+func (e *editor) next() {
+	if e.hist >= len(e.history) {
+		return
+	}
+	e.hist++
+	if e.hist == len(e.history) {
+		e.set(e.draft)
+		return
+	}
+	e.set([]rune(e.history[e.hist]))
+}
+
+// submit returns the line, adds it to the history and clears the editor
+func (e *editor) submit() string {
+	line := string(e.buf)
+	if strings.TrimSpace(line) != "" && (len(e.history) == 0 || e.history[len(e.history)-1] != line) {
+		e.history = append(e.history, line)
+		if len(e.history) > maxHistory {
+			e.history = e.history[len(e.history)-maxHistory:]
+		}
+	}
+	e.hist = len(e.history)
+	e.buf, e.pos, e.draft = nil, 0, nil
+	return line
+}
+
+// complete replaces the word before the cursor with the first name it is a
+// prefix of. A name completed at the start of the line is addressed with a
+// colon.
+func (e *editor) complete(names []string) {
+	start := e.pos
+	for start > 0 && !unicode.IsSpace(e.buf[start-1]) {
+		start--
+	}
+	prefix := strings.ToLower(string(e.buf[start:e.pos]))
+	if prefix == "" {
+		return
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(strings.ToLower(name), prefix) {
+			continue
+		}
+		e.buf = append(e.buf[:start], e.buf[e.pos:]...)
+		e.pos = start
+		word := name + " "
+		if start == 0 {
+			word = name + ": "
+		}
+		for _, r := range word {
+			e.insert(r)
+		}
+		return
+	}
+}
@@ -0,0 +1,612 @@
+// Command chat-cli is an interactive terminal client for the chat server.
+// It logs in through POST /tickets, keeps a tab for each room joined and
+// reconnects with backoff when the connection drops.
+//
+//	CHAT_PASSWORD=secret go run ./cmd/chat-cli -server http://localhost:8081 -user alice
+//
+// Without CHAT_PASSWORD the password is prompted for, and -guest visits
+// without an account when the server allows it.
+//
+// Keys: Enter sends, Up/Down browse the history, Tab completes nicknames,
+// Alt-1..9 or Ctrl-P/Ctrl-N switch tabs, Ctrl-A/E/U/K/W edit the line as in
+// readline and Ctrl-C or Ctrl-D on an empty line quits. /join opens a tab,
+// /close closes the current one, /tab <n> switches to one, /reconnect
+// [code] retries a rejected login and /quit exits; everything else is sent
+// to the server.
+//
+// When standard input is not a terminal, or raw mode is not available, the
+// client reads whole lines and prints messages as they arrive.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// defaultRoom is the room the server puts new connections in
+const defaultRoom = "lobby"
+
+// Line styles
+const (
+	styleChat    = ""
+	styleSystem  = "\x1b[2;3m"
+	styleMention = ansiBold + ansiYellow
+	styleError   = "\x1b[31m"
+)
+
+// Input events
+type (
+	keyInput  []byte
+	lineInput string
+	resized   struct{}
+)
+
+// client is the event loop's state. Only the loop touches it.
+type client struct {
+	session *session
+	conn    *websocket.Conn
+	name    string
+	// ready is set once the server is past the login prompts. Lines entered
+	// before then are queued in pending.
+	ready   bool
+	pending []string
+
+	tabs   []*tab
+	active int
+	status string
+
+	input  editor
+	nicks  []string
+	screen *screen // nil when printing lines instead
+	quit   bool
+}
+
+func main() {
+	server := flag.String("server", "http://localhost:8081", "chat server URL")
+	user := flag.String("user", "", "username to log in as")
+	guest := flag.Bool("guest", false, "visit as a guest instead of logging in")
+	flag.Parse()
+
+	base, err := url.Parse(*server)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") {
+		log.Fatalf("Invalid server URL %q", *server)
+	}
+
+	fd := int(os.Stdin.Fd())
+	interactive := isTerminal(fd)
+	stdin := bufio.NewReader(os.Stdin)
+	s := &session{
+		server: base,
+		guest:  *guest,
+		events: make(chan interface{}, 64),
+		retry:  make(chan string),
+	}
+	if !s.guest {
+		s.username = *user
+		if s.username == "" {
+			fmt.Print("Username: ")
+			line, _ := stdin.ReadString('\n')
+			s.username = strings.TrimSpace(line)
+		}
+		s.password = os.Getenv("CHAT_PASSWORD")
+		if s.password == "" {
+			fmt.Print("Password: ")
+			if s.password, err = readPassword(fd, stdin, interactive); err != nil {
+				log.Fatalf("Error reading password: %v", err)
+			}
+			fmt.Println()
+		}
+		if s.username == "" || s.password == "" {
+			log.Fatal("A username and password are required, or -guest")
+		}
+	}
+
+	c := &client{session: s, name: s.username, tabs: []*tab{{room: defaultRoom}}}
+	events := make(chan interface{}, 16)
+	if interactive {
+		if state, err := makeRaw(fd); err == nil {
+			defer restore(fd, state)
+			c.screen = &screen{out: os.Stdout}
+			c.resize(fd)
+			fmt.Print(altScreen)
+			defer fmt.Print(mainScreen)
+			if resizeSignal != nil {
+				signals := make(chan os.Signal, 1)
+				signal.Notify(signals, resizeSignal)
+				go func() {
+					for range signals {
+						events <- resized{}
+					}
+				}()
+			}
+		}
+	}
+	if c.screen != nil {
+		go func() {
+			buf := make([]byte, 256)
+			for {
+				n, err := stdin.Read(buf)
+				if err != nil {
+					close(events)
+					return
+				}
+				events <- keyInput(append([]byte(nil), buf[:n]...))
+			}
+		}()
+	} else {
+		go func() {
+			for {
+				line, err := stdin.ReadString('\n')
+				if line = strings.TrimRight(line, "\r\n"); line != "" {
+					events <- lineInput(line)
+				}
+				if err != nil {
+					close(events)
+					return
+				}
+			}
+		}()
+	}
+
+	go s.run()
+	c.draw()
+	for !c.quit {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				c.quit = true
+				break
+			}
+			switch ev := ev.(type) {
+			case keyInput:
+				c.keys(ev)
+			case lineInput:
+				c.submit(string(ev))
+			case resized:
+				c.resize(fd)
+			}
+		case ev := <-s.events:
+			c.handle(ev)
+		}
+		c.draw()
+	}
+	if c.conn != nil {
+		c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+		c.conn.Close()
+	}
+}
+
+// readPassword reads a line from the terminal without echoing it
+func readPassword(fd int, stdin *bufio.Reader, interactive bool) (string, error) {
+	if !interactive {
+		line, err := stdin.ReadString('\n')
+		return strings.TrimRight(line, "\r\n"), err
+	}
+	state, err := makeRaw(fd)
+	if err != nil {
+		line, err := stdin.ReadString('\n')
+		return strings.TrimRight(line, "\r\n"), err
+	}
+	defer restore(fd, state)
+	var password []byte
+	for {
+		b, err := stdin.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch b {
+		case '\r', '\n':
+			return string(password), nil
+		case 3:
+			return "", errors.New("interrupted")
+		case 127, 8:
+			if len(password) > 0 {
+				_, size := utf8.DecodeLastRune(password)
+				password = password[:len(password)-size]
+			}
+		default:
+			password = append(password, b)
+		}
+	}
+}
+
+func (c *client) resize(fd int) {
+	if c.screen == nil {
+		return
+	}
+	w, h, err := termSize(fd)
+	if err != nil || w <= 0 || h < 3 {
+		w, h = 80, 24
+	}
+	c.screen.width, c.screen.height = w, h
+}
+
+func (c *client) draw() {
+	if c.screen != nil {
+		c.screen.draw(c.tabs, c.active, c.status, &c.input)
+	}
+}
+
+// tab finds the tab for a room, opening one if asked to
+func (c *client) tab(room string, open bool) (int, *tab) {
+	for i, t := range c.tabs {
+		if strings.EqualFold(t.room, room) {
+			return i, t
+		}
+	}
+	if !open {
+		return -1, nil
+	}
+	c.tabs = append(c.tabs, &tab{room: room})
+	return len(c.tabs) - 1, c.tabs[len(c.tabs)-1]
+}
+
+// show adds a line to a tab, or prints it when not drawing the screen
+func (c *client) show(t *tab, l line) {
+	if l.time.IsZero() {
+		l.time = time.Now()
+	}
+	if c.screen == nil {
+		from := ""
+		if l.from != "" {
+			from = l.from + ": "
+		}
+		fmt.Printf("[%s] %s %s%s\n", t.room, l.time.Local().Format("15:04"), from, l.body)
+		return
+	}
+	t.add(l)
+	if t != c.tabs[c.active] {
+		t.unread = true
+	}
+}
+
+// notice shows a client message in the current tab
+func (c *client) notice(style, format string, args ...interface{}) {
+	c.show(c.tabs[c.active], line{body: fmt.Sprintf(format, args...), style: style})
+}
+
+// send writes a line to the server, or queues it until connected
+func (c *client) send(text string) {
+	if c.conn == nil || !c.ready {
+		c.pending = append(c.pending, text)
+		return
+	}
+	if err := c.conn.WriteMessage(websocket.TextMessage, []byte(text)); err != nil {
+		c.notice(styleError, "Error sending: %v", err)
+	}
+}
+
+// switchTo makes a tab current and moves the connection into its room
+func (c *client) switchTo(i int) {
+	if i < 0 || i >= len(c.tabs) || i == c.active {
+		return
+	}
+	c.active = i
+	t := c.tabs[i]
+	t.unread, t.mention = false, false
+	c.send("/join " + t.room)
+}
+
+// spoke moves a nickname to the front of the completion list
+func (c *client) spoke(name string) {
+	if name == "" || name == c.name {
+		return
+	}
+	for i, n := range c.nicks {
+		if n == name {
+			c.nicks = append(c.nicks[:i], c.nicks[i+1:]...)
+			break
+		}
+	}
+	c.nicks = append([]string{name}, c.nicks...)
+	if len(c.nicks) > 200 {
+		c.nicks = c.nicks[:200]
+	}
+}
+
+// handle applies an event from the connection
+func (c *client) handle(ev interface{}) {
+	switch ev := ev.(type) {
+	case statusText:
+		c.status = string(ev)
+	case connected:
+		c.conn = ev.conn
+		c.status = "connected"
+		if c.name != "" {
+			c.status += " as " + c.name
+		}
+	case disconnected:
+		c.conn, c.ready = nil, false
+		c.status = "disconnected"
+		if errors.Is(ev.err, errLogin) {
+			c.notice(styleError, "%v. Type /reconnect [two-factor code] to try again.", ev.err)
+		} else {
+			c.notice(styleError, "Disconnected: %v. Reconnecting...", ev.err)
+		}
+	case rawText:
+		text := string(ev)
+		switch {
+		case c.session.guest && strings.Contains(text, "3. Continue as guest"):
+			c.conn.WriteMessage(websocket.TextMessage, []byte("3"))
+		case c.session.guest && strings.HasPrefix(text, "1. Login"):
+			c.notice(styleError, "This server does not allow guests")
+			c.quit = true
+		default:
+			c.notice(styleSystem, "%s", strings.TrimSpace(text))
+		}
+	case Message:
+		if !c.ready {
+			c.ready = true
+			// The server starts every connection in the lobby
+			if room := c.tabs[c.active].room; !strings.EqualFold(room, defaultRoom) {
+				c.send("/join " + room)
+			}
+			pending := c.pending
+			c.pending = nil
+			for _, text := range pending {
+				c.send(text)
+			}
+		}
+		c.message(ev)
+	}
+}
+
+// message shows a message from the server in its room's tab
+func (c *client) message(msg Message) {
+	l := line{from: msg.From, body: msg.Body, style: styleSystem}
+	if msg.Time != nil {
+		l.time = *msg.Time
+	}
+	t := c.tabs[c.active]
+	if msg.Room != "" {
+		if _, rt := c.tab(msg.Room, false); rt != nil {
+			t = rt
+		}
+	}
+	switch msg.Type {
+	case "chat", "snippet", "command":
+		l.style = styleChat
+		c.spoke(msg.From)
+	case "room.info":
+		// Joining a room, by /join or by switching tabs, opens its tab
+		i, rt := c.tab(msg.Room, true)
+		c.active = i
+		rt.unread, rt.mention = false, false
+		t, l.from = rt, ""
+	case "topic":
+		l.from, l.body = "", msg.From+" set the topic: "+msg.Body
+	case "mention":
+		// Mentions arrive wherever the connection is and mark the room's tab
+		l.style = styleMention
+		t = c.tabs[c.active]
+		if _, rt := c.tab(msg.Room, false); rt != nil && rt != t {
+			rt.mention = true
+		}
+		l.from = ""
+	case "join", "leave", "presence":
+		l.from = ""
+		c.spoke(msg.From)
+	case "announcement":
+		l.style = styleMention
+	case "error":
+		l.style, l.from = styleError, ""
+	case "history.end":
+		return
+	default:
+		l.from = ""
+	}
+	if msg.ID != "" {
+		if t.seen == nil {
+			t.seen = make(map[string]bool)
+		}
+		if t.seen[msg.ID] {
+			return
+		}
+		t.seen[msg.ID] = true
+	}
+	if l.body == "" {
+		return
+	}
+	c.show(t, l)
+}
+
+// submit handles an entered line, running the client's own commands and
+// sending the rest to the server
+func (c *client) submit(text string) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return
+	}
+	fields := strings.Fields(text)
+	switch strings.ToLower(fields[0]) {
+	case "/quit", "/exit":
+		c.quit = true
+	case "/tab":
+		n := 0
+		if len(fields) == 2 {
+			n, _ = strconv.Atoi(fields[1])
+		}
+		if n < 1 || n > len(c.tabs) {
+			c.notice(styleError, "Usage: /tab <1-%d>", len(c.tabs))
+			return
+		}
+		c.switchTo(n - 1)
+	case "/close":
+		if len(c.tabs) == 1 {
+			c.notice(styleError, "The last tab cannot be closed")
+			return
+		}
+		c.tabs = append(c.tabs[:c.active], c.tabs[c.active+1:]...)
+		i := c.active - 1
+		if i < 0 {
+			i = 0
+		}
+		// Force the switch even though the index may not have changed
+		c.active = -1
+		c.switchTo(i)
+	case "/join":
+		if len(fields) == 2 {
+			if i, _ := c.tab(fields[1], false); i >= 0 {
+				c.switchTo(i)
+				return
+			}
+		}
+		c.send(text)
+	case "/reconnect":
+		code := ""
+		if len(fields) == 2 {
+			code = fields[1]
+		}
+		select {
+		case c.session.retry <- code:
+		default:
+			if c.conn != nil {
+				// Dropping the connection makes the session dial again
+				c.conn.Close()
+			}
+		}
+	default:
+		c.send(text)
+	}
+}
+
+// Control keys
+const (
+	keyCtrlA     = 1
+	keyCtrlB     = 2
+	keyCtrlC     = 3
+	keyCtrlD     = 4
+	keyCtrlE     = 5
+	keyCtrlF     = 6
+	keyBackspace = 8
+	keyTab       = 9
+	keyCtrlK     = 11
+	keyCtrlL     = 12
+	keyEnter     = 13
+	keyCtrlN     = 14
+	keyCtrlP     = 16
+	keyCtrlU     = 21
+	keyCtrlW     = 23
+	keyEscape    = 27
+	keyDelete    = 127
+)
+
+// keys applies input read from the terminal in raw mode
+func (c *client) keys(data []byte) {
+	for len(data) > 0 {
+		if data[0] == keyEscape && len(data) > 1 {
+			data = c.escape(data[1:])
+			continue
+		}
+		r, size := utf8.DecodeRune(data)
+		data = data[size:]
+		switch r {
+		case keyEnter, '\n':
+			c.submit(c.input.submit())
+		case keyBackspace, keyDelete:
+			c.input.backspace()
+		case keyCtrlA:
+			c.input.home()
+		case keyCtrlE:
+			c.input.end()
+		case keyCtrlB:
+			c.input.left()
+		case keyCtrlF:
+			c.input.right()
+		case keyCtrlK:
+			c.input.killEnd()
+		case keyCtrlU:
+			c.input.killStart()
+		case keyCtrlW:
+			c.input.killWord()
+		case keyCtrlC:
+			c.quit = true
+		case keyCtrlD:
+			if len(c.input.buf) == 0 {
+				c.quit = true
+			}
+			c.input.delete()
+		case keyCtrlN:
+			c.switchTo((c.active + 1) % len(c.tabs))
+		case keyCtrlP:
+			c.switchTo((c.active + len(c.tabs) - 1) % len(c.tabs))
+		case keyTab:
+			c.input.complete(c.nicks)
+		case keyCtrlL:
+			// Redrawn after every event anyway
+		default:
+			if r >= ' ' && r != utf8.RuneError {
+				c.input.insert(r)
+			}
+		}
+	}
+}
+
+// escape applies an escape sequence, given the bytes after ESC, and returns
+// the input that follows it
+func (c *client) escape(data []byte) []byte {
+	switch data[0] {
+	case '[', 'O':
+		// CSI: parameter bytes, then a final byte
+		i := 1
+		for i < len(data) && data[i] >= 0x30 && data[i] <= 0x3f {
+			i++
+		}
+		if i == len(data) {
+			return nil
+		}
+		params, final := string(data[1:i]), data[i]
+		ctrl := strings.HasSuffix(params, ";5") || strings.HasSuffix(params, ";3")
+		switch final {
+		case 'A':
+			c.input.prev()
+		case 'B':
+			c.input.next()
+		case 'C':
+			if ctrl {
+				c.input.wordRight()
+			} else {
+				c.input.right()
+			}
+		case 'D':
+			if ctrl {
+				c.input.wordLeft()
+			} else {
+				c.input.left()
+			}
+		case 'H':
+			c.input.home()
+		case 'F':
+			c.input.end()
+		case '~':
+			switch params {
+			case "1", "7":
+				c.input.home()
+			case "4", "8":
+				c.input.end()
+			case "3":
+				c.input.delete()
+			}
+		}
+		return data[i+1:]
+	case 'b':
+		c.input.wordLeft()
+	case 'f':
+		c.input.wordRight()
+	case '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		c.switchTo(int(data[0] - '1'))
+	}
+	return data[1:]
+}
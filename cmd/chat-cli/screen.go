@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// maxScrollback is how many lines each tab keeps
+const maxScrollback = 1000
+
+// ANSI escape sequences
+const (
+	ansiReset   = "\x1b[0m"
+	ansiBold    = "\x1b[1m"
+	ansiDim     = "\x1b[2m"
+	ansiReverse = "\x1b[7m"
+	ansiYellow  = "\x1b[33m"
+	clearLine   = "\x1b[K"
+	altScreen   = "\x1b[?1049h"
+	mainScreen  = "\x1b[?1049l"
+)
+
+// nickColors are the 256-color palette entries nicknames are drawn in,
+// chosen to read on both dark and light backgrounds
+var nickColors = []int{31, 32, 33, 34, 35, 36, 91, 92, 93, 94, 95, 96, 166, 172, 38, 105}
+
+// nickColor picks a stable color for a nickname
+func nickColor(name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	c := nickColors[h.Sum32()%uint32(len(nickColors))]
+	if c < 100 {
+		return fmt.Sprintf("\x1b[%dm", c)
+	}
+	return fmt.Sprintf("\x1b[38;5;%dm", c)
+}
+
+// line is one entry in a tab's scrollback
+type line struct {
+	time  time.Time
+	from  string
+	body  string
+	style string
+}
+
+// tab is a room the user has open
+type tab struct {
+	room    string
+	lines   []line
+	unread  bool
+	mention bool
+	// seen holds the IDs of posted messages already shown, so the history
+	// replayed when rejoining the room is not shown twice
+	seen map[string]bool
+}
+
+func (t *tab) add(l line) {
+	t.lines = append(t.lines, l)
+	if len(t.lines) > maxScrollback {
+		t.lines = t.lines[len(t.lines)-maxScrollback:]
+	}
+}
+
+// screen draws the tab bar, the active tab's messages and the input line
+type screen struct {
+	out           io.Writer
+	width, height int
+}
+
+// wrap breaks text into rows of at most width runes, at spaces where it can
+func wrap(text string, width int) []string {
+	runes := []rune(text)
+	var rows []string
+	for len(runes) > width {
+		n := width
+		if i := strings.LastIndex(string(runes[:n]), " "); i > 0 {
+			n = utf8.RuneCountInString(string(runes[:n])[:i]) + 1
+		}
+		rows = append(rows, string(runes[:n]))
+		runes = runes[n:]
+	}
+	return append(rows, string(runes))
+}
+
+// rows lays a line out on the screen. Only the timestamp and nickname are
+// colored, so the text is wrapped before escape sequences are added.
+func (s *screen) rows(l line) []string {
+	stamp := l.time.Local().Format("15:04") + " "
+	prefix := stamp
+	if l.from != "" {
+		prefix += l.from + ": "
+	}
+	width := s.width
+	if width < 10 {
+		width = 10
+	}
+	var rows []string
+	for i, text := range strings.Split(prefix+l.body, "\n") {
+		rows = append(rows, wrap(text, width)...)
+		if i == 0 && strings.HasPrefix(rows[0], prefix) {
+			head := ansiDim + stamp + ansiReset
+			if l.from != "" {
+				head += ansiBold + nickColor(l.from) + l.from + ansiReset + ": "
+			}
+			rows[0] = head + l.style + strings.TrimPrefix(rows[0], prefix)
+		} else if i == 0 {
+			rows[0] = l.style + rows[0]
+		}
+	}
+	for i := 1; i < len(rows); i++ {
+		rows[i] = l.style + rows[i]
+	}
+	for i := range rows {
+		rows[i] += ansiReset
+	}
+	return rows
+}
+
+// draw redraws the whole screen
+func (s *screen) draw(tabs []*tab, active int, status string, input *editor) {
+	var b strings.Builder
+	b.WriteString("\x1b[?25l\x1b[H")
+
+	// Tab bar, with the connection status on the right
+	bar := 0
+	for i, t := range tabs {
+		label := fmt.Sprintf(" %d:%s ", i+1, t.room)
+		if t.mention {
+			label = fmt.Sprintf(" %d:%s! ", i+1, t.room)
+		} else if t.unread {
+			label = fmt.Sprintf(" %d:%s* ", i+1, t.room)
+		}
+		bar += utf8.RuneCountInString(label)
+		switch {
+		case i == active:
+			b.WriteString(ansiReverse + label + ansiReset)
+		case t.mention:
+			b.WriteString(ansiBold + ansiYellow + label + ansiReset)
+		case t.unread:
+			b.WriteString(ansiBold + label + ansiReset)
+		default:
+			b.WriteString(label)
+		}
+	}
+	if pad := s.width - bar - utf8.RuneCountInString(status) - 1; pad > 0 {
+		b.WriteString(strings.Repeat(" ", pad) + ansiDim + status + ansiReset)
+	}
+	b.WriteString(clearLine)
+
+	// Messages, newest at the bottom
+	visible := s.height - 2
+	var rows []string
+	if active < len(tabs) {
+		lines := tabs[active].lines
+		for i := len(lines) - 1; i >= 0 && len(rows) < visible; i-- {
+			rows = append(s.rows(lines[i]), rows...)
+		}
+	}
+	if len(rows) > visible {
+		rows = rows[len(rows)-visible:]
+	}
+	for i := 0; i < visible; i++ {
+		fmt.Fprintf(&b, "\x1b[%d;1H", i+2)
+		if j := i - (visible - len(rows)); j >= 0 {
+			b.WriteString(rows[j])
+		}
+		b.WriteString(clearLine)
+	}
+
+	// Input line, scrolled so the cursor stays visible
+	const prompt = "> "
+	room := s.width - len(prompt) - 1
+	start := 0
+	if room > 0 && input.pos > room {
+		start = input.pos - room
+	}
+	end := len(input.buf)
+	if room > 0 && end-start > room {
+		end = start + room
+	}
+	fmt.Fprintf(&b, "\x1b[%d;1H%s%s%s", s.height, prompt, string(input.buf[start:end]), clearLine)
+	fmt.Fprintf(&b, "\x1b[%d;%dH\x1b[?25h", s.height, len(prompt)+input.pos-start+1)
+	io.WriteString(s.out, b.String())
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// Raw mode is only implemented for Linux. Elsewhere the client falls back to
+// reading whole lines.
+var errNoRawMode = errors.New("raw terminal mode is not supported on this platform")
+
+var resizeSignal os.Signal
+
+type termState struct{}
+
+func isTerminal(fd int) bool { return false }
+
+func makeRaw(fd int) (*termState, error) { return nil, errNoRawMode }
+
+func restore(fd int, state *termState) error { return nil }
+
+func termSize(fd int) (width, height int, err error) { return 0, 0, errNoRawMode }
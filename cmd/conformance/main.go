@@ -0,0 +1,444 @@
+// Command conformance runs scripted server-side scenarios against a chat
+// client so third-party implementations can check they speak the same
+// protocol as the real server.
+//
+// Start the harness, then point the client under test at it:
+//
+//	go run ./cmd/conformance -scenario login
+//	go run ./cmd/conformance -scenario nickname
+//
+// Besides logging in, scenarios check that clients resume from the last
+// sequence number they saw after a reconnect, grant flow control credits as
+// they read, and honor the retryable flag and retry_after of error frames.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Conn is the side of a client connection a scenario talks to
+type Conn interface {
+	Send(msg string) error
+	Receive(timeout time.Duration) (string, error)
+	// Reconnect drops the connection and waits for the client to connect again
+	Reconnect(timeout time.Duration) error
+}
+
+// Step is one action in a scenario script
+type Step struct {
+	Name string
+	Run  func(c Conn) error
+}
+
+// Scenario is a named script the harness plays against a connected client
+type Scenario struct {
+	Name        string
+	Transport   string
+	Description string
+	Steps       []Step
+}
+
+var scenarios = map[string]Scenario{
+	"login": {
+		Name:        "login",
+		Transport:   "ws",
+		Description: "client picks Login, sends credentials and receives a chat message",
+		Steps: append(authSteps("1", "logged in successfully"),
+			chatSteps()...),
+	},
+	"register": {
+		Name:        "register",
+		Transport:   "ws",
+		Description: "client picks Register, sends credentials and receives a chat message",
+		Steps: append(authSteps("2", "created successfully"),
+			chatSteps()...),
+	},
+	"nickname": {
+		Name:        "nickname",
+		Transport:   "tcp",
+		Description: "client sends a nickname and exchanges chat lines",
+		Steps: []Step{
+			send("prompt for nickname", "Please enter your nickname: "),
+			expect("send nickname", nonEmpty),
+			sendLine("announce another user", "conformance has joined the chat!"),
+			sendLine("deliver chat line", "conformance: hello"),
+			expect("send chat line", nonEmpty),
+		},
+	},
+	"resume": {
+		Name:        "resume",
+		Transport:   "ws",
+		Description: "client reconnects after a dropped connection and replays from the last sequence number it saw",
+		Steps: concat(
+			authSteps("1", "logged in successfully"),
+			[]Step{
+				send("deliver message 1", `{"type":"chat","room":"lobby","from":"conformance","body":"first","id":"m1","seq":1}`),
+				send("deliver message 2", `{"type":"chat","room":"lobby","from":"conformance","body":"second","id":"m2","seq":2}`),
+				{Name: "drop connection", Run: func(c Conn) error { return c.Reconnect(*timeout) }},
+			},
+			authSteps("1", "logged in successfully"),
+			[]Step{
+				expect("request replay since 3", request("replay", func(req clientRequest) error {
+					if req.Since != 3 {
+						return fmt.Errorf("since = %d, want 3", req.Since)
+					}
+					return nil
+				})),
+				send("replay message 3", `{"type":"chat","room":"lobby","from":"conformance","body":"third","id":"m3","seq":3}`),
+				send("end replay", `{"type":"history.end","room":"lobby","seq":3,"body":"End of history for lobby"}`),
+			},
+		),
+	},
+	"acks": {
+		Name:        "acks",
+		Transport:   "ws",
+		Description: "client grants flow control credits and grants more once it has read what they allowed",
+		Steps:       concat(authSteps("1", "logged in successfully"), creditSteps()),
+	},
+	"ratelimit": {
+		Name:        "ratelimit",
+		Transport:   "ws",
+		Description: "client resends a throttled message after retry_after and does not resend after a non-retryable error",
+		Steps: concat(
+			authSteps("1", "logged in successfully"),
+			retrySteps(),
+		),
+	},
+}
+
+// concat joins the steps of several scripts
+func concat(scripts ...[]Step) []Step {
+	var steps []Step
+	for _, s := range scripts {
+		steps = append(steps, s...)
+	}
+	return steps
+}
+
+// clientRequest is the part of a typed client request the scenarios check
+type clientRequest struct {
+	Type    string `json:"type"`
+	Body    string `json:"body"`
+	Since   uint64 `json:"since"`
+	Credits int    `json:"credits"`
+}
+
+// request checks that a client frame is a JSON request of the given type
+func request(typ string, check func(clientRequest) error) func(string) error {
+	return func(msg string) error {
+		var req clientRequest
+		if err := json.Unmarshal([]byte(msg), &req); err != nil {
+			return fmt.Errorf("want a %s request, got %q", typ, msg)
+		}
+		if req.Type != typ {
+			return fmt.Errorf("want a %s request, got type %q", typ, req.Type)
+		}
+		return check(req)
+	}
+}
+
+// creditSteps scripts flow control: the client grants credits, the harness
+// sends that many messages, and the client grants more
+func creditSteps() []Step {
+	credits := 0
+	granted := func(req clientRequest) error {
+		if req.Credits <= 0 || req.Credits > 100 {
+			return fmt.Errorf("credits = %d, want 1 to 100", req.Credits)
+		}
+		credits = req.Credits
+		return nil
+	}
+	return []Step{
+		expect("grant credits", request("credit", granted)),
+		{Name: "use up credits", Run: func(c Conn) error {
+			for i := 1; i <= credits; i++ {
+				msg := fmt.Sprintf(`{"type":"chat","room":"lobby","from":"conformance","body":"message %d","id":"m%d","seq":%d}`, i, i, i)
+				if err := c.Send(msg); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+		expect("grant more credits", request("credit", granted)),
+	}
+}
+
+// retrySteps scripts error frames: a throttled message must be sent again,
+// no sooner than retry_after, and a message refused for good must not
+func retrySteps() []Step {
+	var first string
+	var throttled time.Time
+	return []Step{
+		{Name: "send chat message", Run: func(c Conn) error {
+			msg, err := c.Receive(*timeout)
+			if err != nil {
+				return err
+			}
+			first = msg
+			return nonEmpty(msg)
+		}},
+		{Name: "throttle it", Run: func(c Conn) error {
+			throttled = time.Now()
+			return c.Send(`{"type":"error","code":"message.throttled","room":"lobby","body":"Too many messages in lobby right now, try again in 1s","retryable":true,"retry_after":1}`)
+		}},
+		{Name: "resend after retry_after", Run: func(c Conn) error {
+			msg, err := c.Receive(*timeout)
+			if err != nil {
+				return err
+			}
+			if waited := time.Since(throttled); waited < time.Second {
+				return fmt.Errorf("resent after %s, before retry_after", waited.Round(time.Millisecond))
+			}
+			if msg != first {
+				return fmt.Errorf("resent %q, want %q", msg, first)
+			}
+			return nil
+		}},
+		send("refuse it", `{"type":"error","code":"permission.denied","body":"Permission denied"}`),
+		{Name: "do not resend", Run: func(c Conn) error {
+			msg, err := c.Receive(2 * time.Second)
+			if err == nil && msg == first {
+				return errors.New("resent a message after a non-retryable error")
+			}
+			return nil
+		}},
+	}
+}
+
+// authSteps scripts the login/register exchange the WebSocket server runs
+func authSteps(choice, result string) []Step {
+	var username string
+	return []Step{
+		send("offer login or registration", "1. Login\n2. Register"),
+		expect("choose option "+choice, equals(choice)),
+		send("prompt for username", "Please enter username:"),
+		{Name: "send username", Run: func(c Conn) error {
+			msg, err := c.Receive(*timeout)
+			if err != nil {
+				return err
+			}
+			if strings.TrimSpace(msg) == "" {
+				return errors.New("empty username")
+			}
+			username = msg
+			return nil
+		}},
+		send("prompt for password", "Please enter password:"),
+		expect("send password", nonEmpty),
+		{Name: "confirm account", Run: func(c Conn) error {
+			return c.Send(fmt.Sprintf("%s %s", username, result))
+		}},
+	}
+}
+
+// chatSteps scripts a join notice, an incoming message and an outgoing one.
+// After authentication the server sends JSON message envelopes.
+func chatSteps() []Step {
+	return []Step{
+		send("announce another user", `{"type":"join","room":"lobby","from":"conformance","body":"conformance has joined the chat!"}`),
+		send("deliver chat message", `{"type":"chat","room":"lobby","from":"conformance","body":"hello"}`),
+		expect("send chat message", nonEmpty),
+	}
+}
+
+func send(name, msg string) Step {
+	return Step{Name: name, Run: func(c Conn) error { return c.Send(msg) }}
+}
+
+func sendLine(name, msg string) Step {
+	return send(name, msg+"\n")
+}
+
+func expect(name string, check func(string) error) Step {
+	return Step{Name: name, Run: func(c Conn) error {
+		msg, err := c.Receive(*timeout)
+		if err != nil {
+			return err
+		}
+		return check(msg)
+	}}
+}
+
+func nonEmpty(msg string) error {
+	if strings.TrimSpace(msg) == "" {
+		return errors.New("empty message")
+	}
+	return nil
+}
+
+func equals(want string) func(string) error {
+	return func(msg string) error {
+		if strings.TrimSpace(msg) != want {
+			return fmt.Errorf("got %q, want %q", msg, want)
+		}
+		return nil
+	}
+}
+
+// wsConn adapts a WebSocket connection to Conn. Later connections of the
+// client arrive on next.
+type wsConn struct {
+	conn *websocket.Conn
+	next chan *websocket.Conn
+}
+
+func (w *wsConn) Send(msg string) error {
+	return w.conn.WriteMessage(websocket.TextMessage, []byte(msg))
+}
+
+func (w *wsConn) Receive(timeout time.Duration) (string, error) {
+	w.conn.SetReadDeadline(time.Now().Add(timeout))
+	_, msg, err := w.conn.ReadMessage()
+	return string(msg), err
+}
+
+func (w *wsConn) Reconnect(timeout time.Duration) error {
+	w.conn.Close()
+	select {
+	case w.conn = <-w.next:
+		return nil
+	case <-time.After(timeout):
+		return errors.New("client did not reconnect")
+	}
+}
+
+// tcpConn adapts a raw TCP connection to Conn
+type tcpConn struct {
+	conn     net.Conn
+	listener net.Listener
+}
+
+func (t *tcpConn) Send(msg string) error {
+	_, err := t.conn.Write([]byte(msg))
+	return err
+}
+
+func (t *tcpConn) Receive(timeout time.Duration) (string, error) {
+	t.conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 1024)
+	n, err := t.conn.Read(buf)
+	return string(buf[:n]), err
+}
+
+func (t *tcpConn) Reconnect(timeout time.Duration) error {
+	t.conn.Close()
+	accepted := make(chan error, 1)
+	go func() {
+		conn, err := t.listener.Accept()
+		if err == nil {
+			t.conn = conn
+		}
+		accepted <- err
+	}()
+	select {
+	case err := <-accepted:
+		return err
+	case <-time.After(timeout):
+		return errors.New("client did not reconnect")
+	}
+}
+
+// run plays a scenario against a client and reports each step
+func run(s Scenario, c Conn) bool {
+	log.Printf("Running scenario %q: %s", s.Name, s.Description)
+	for i, step := range s.Steps {
+		if err := step.Run(c); err != nil {
+			log.Printf("FAIL step %d (%s): %v", i+1, step.Name, err)
+			return false
+		}
+		log.Printf("ok   step %d (%s)", i+1, step.Name)
+	}
+	log.Printf("PASS scenario %q", s.Name)
+	return true
+}
+
+func serveWebSocket(addr string, s Scenario) bool {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+	}
+	conns := make(chan *websocket.Conn)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Println("WebSocket upgrade error:", err)
+			return
+		}
+		// The scenario owns the connection from here, and closes it
+		conns <- conn
+	})
+	go func() {
+		log.Fatal(http.ListenAndServe(addr, mux))
+	}()
+	log.Printf("Waiting for a WebSocket client on ws://%s/ws", addr)
+	c := &wsConn{conn: <-conns, next: conns}
+	defer func() { c.conn.Close() }()
+	return run(s, c)
+}
+
+func serveTCP(addr string, s Scenario) bool {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatal("TCP listen error:", err)
+	}
+	defer listener.Close()
+
+	log.Printf("Waiting for a TCP client on %s", addr)
+	conn, err := listener.Accept()
+	if err != nil {
+		log.Fatal("TCP accept error:", err)
+	}
+	c := &tcpConn{conn: conn, listener: listener}
+	defer func() { c.conn.Close() }()
+	return run(s, c)
+}
+
+var timeout = flag.Duration("timeout", 10*time.Second, "how long to wait for each client reply")
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:9090", "address to listen on")
+	name := flag.String("scenario", "login", "scenario to run")
+	list := flag.Bool("list", false, "list available scenarios and exit")
+	flag.Parse()
+
+	if *list {
+		names := make([]string, 0, len(scenarios))
+		for n := range scenarios {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			fmt.Printf("%-10s %-4s %s\n", n, scenarios[n].Transport, scenarios[n].Description)
+		}
+		return
+	}
+
+	s, ok := scenarios[*name]
+	if !ok {
+		log.Fatalf("Unknown scenario %q (use -list)", *name)
+	}
+
+	var passed bool
+	if s.Transport == "tcp" {
+		passed = serveTCP(*addr, s)
+	} else {
+		passed = serveWebSocket(*addr, s)
+	}
+	if !passed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,71 @@
+// Command echobot is a sample bot for the chat server. It connects with a
+// bot token and replies to "!<name> <text>" commands with the same text.
+//
+//	BOT_TOKEN=secret go run ./cmd/echobot -url ws://localhost:8081/ws
+//
+// The server must list the bot in BOT_TOKENS, for example BOT_TOKENS=echo:secret.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/websocket"
+)
+
+// Message is the subset of the server's message envelope the bot reads
+type Message struct {
+	Type string `json:"type"`
+	Room string `json:"room"`
+	From string `json:"from"`
+	Body string `json:"body"`
+}
+
+func main() {
+	url := flag.String("url", "ws://localhost:8081/ws", "chat server WebSocket URL")
+	room := flag.String("room", "", "room to join after connecting")
+	flag.Parse()
+
+	token := os.Getenv("BOT_TOKEN")
+	if token == "" {
+		log.Fatal("BOT_TOKEN must be set")
+	}
+
+	header := http.Header{"Authorization": {"Bearer " + token}}
+	conn, _, err := websocket.DefaultDialer.Dial(*url, header)
+	if err != nil {
+		log.Fatalf("Error connecting to %s: %v", *url, err)
+	}
+	defer conn.Close()
+
+	// Only commands addressed to the bot are needed
+	subscribe := map[string]interface{}{"type": "subscribe", "events": []string{"command"}}
+	if err := conn.WriteJSON(subscribe); err != nil {
+		log.Fatalf("Error subscribing: %v", err)
+	}
+	if *room != "" {
+		conn.WriteMessage(websocket.TextMessage, []byte("/join "+*room))
+	}
+
+	for {
+		var msg Message
+		if err := conn.ReadJSON(&msg); err != nil {
+			log.Fatalf("Connection closed: %v", err)
+		}
+		switch msg.Type {
+		case "command":
+			log.Printf("%s in %s: %s", msg.From, msg.Room, msg.Body)
+			reply := msg.Body
+			if reply == "" {
+				reply = "Usage: !<bot> <text>"
+			}
+			if err := conn.WriteJSON(map[string]string{"type": "chat", "body": reply}); err != nil {
+				log.Fatalf("Error replying: %v", err)
+			}
+		case "system":
+			log.Println(msg.Body)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// Command exampleplugin is a sample plugin for the chat server. It adds a
+// /roll command, a filter that calms messages written in capitals and a
+// /stats command counting the messages and joins it has been told about.
+//
+//	go build -o exampleplugin ./cmd/exampleplugin
+//	PLUGINS=./exampleplugin go run .
+//
+// Rooms turn the filter on with /filter on plugin:example. The server talks
+// to the plugin with JSON-RPC over its standard input and output, so
+// logging goes to standard error.
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// The plugin protocol's types, as the server declares them
+
+type Info struct {
+	Name     string   `json:"name"`
+	Commands []string `json:"commands"`
+	Filter   bool     `json:"filter"`
+	Events   []string `json:"events"`
+}
+
+type Command struct {
+	User    string   `json:"user"`
+	Room    string   `json:"room"`
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+}
+
+type Reply struct {
+	Reply string `json:"reply"`
+	Say   string `json:"say"`
+}
+
+type FilterRequest struct {
+	User string `json:"user"`
+	Room string `json:"room"`
+	Text string `json:"text"`
+}
+
+type FilterResult struct {
+	Text   string `json:"text"`
+	Reject string `json:"reject"`
+}
+
+type Event struct {
+	Type string `json:"type"`
+	User string `json:"user"`
+	Room string `json:"room"`
+	Body string `json:"body"`
+}
+
+// Plugin is the RPC service the server calls
+type Plugin struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (p *Plugin) Describe(_ struct{}, info *Info) error {
+	*info = Info{
+		Name:     "example",
+		Commands: []string{"/roll", "/stats"},
+		Filter:   true,
+		Events:   []string{"join", "message"},
+	}
+	return nil
+}
+
+func (p *Plugin) Command(cmd Command, reply *Reply) error {
+	switch cmd.Command {
+	case "/roll":
+		sides := 6
+		if len(cmd.Args) == 1 {
+			n, err := strconv.Atoi(cmd.Args[0])
+			if err != nil || n < 2 || n > 1000 {
+				reply.Reply = "Usage: /roll [sides]"
+				return nil
+			}
+			sides = n
+		}
+		reply.Say = fmt.Sprintf("%s rolled %d (1-%d)", cmd.User, rand.Intn(sides)+1, sides)
+	case "/stats":
+		p.mu.Lock()
+		reply.Reply = fmt.Sprintf("%d messages and %d joins in %s", p.counts["message "+cmd.Room], p.counts["join "+cmd.Room], cmd.Room)
+		p.mu.Unlock()
+	}
+	return nil
+}
+
+func (p *Plugin) Filter(req FilterRequest, result *FilterResult) error {
+	letters, upper := 0, 0
+	for _, r := range req.Text {
+		if unicode.IsLetter(r) {
+			letters++
+			if unicode.IsUpper(r) {
+				upper++
+			}
+		}
+	}
+	result.Text = req.Text
+	if letters >= 8 && upper == letters {
+		result.Text = strings.ToLower(req.Text)
+	}
+	return nil
+}
+
+func (p *Plugin) Event(event Event, _ *struct{}) error {
+	p.mu.Lock()
+	p.counts[event.Type+" "+event.Room]++
+	p.mu.Unlock()
+	return nil
+}
+
+// stdio joins standard input and output into one connection
+type stdio struct {
+	io.Reader
+	io.Writer
+}
+
+func (stdio) Close() error { return os.Stdin.Close() }
+
+func main() {
+	log.SetPrefix("exampleplugin: ")
+	server := rpc.NewServer()
+	if err := server.RegisterName("Plugin", &Plugin{counts: make(map[string]int)}); err != nil {
+		log.Fatal(err)
+	}
+	// Returns when the server closes standard input
+	server.ServeCodec(jsonrpc.NewServerCodec(stdio{os.Stdin, os.Stdout}))
+}
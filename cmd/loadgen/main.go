@@ -0,0 +1,313 @@
+// Command loadgen connects many WebSocket and TCP clients to a chat server,
+// has each send messages at a fixed rate into one room, and reports how
+// long messages take to reach the other clients.
+//
+//	go run ./cmd/loadgen -ws-clients 100 -tcp-clients 100 -rate 0.5 -duration 1m
+//
+// WebSocket clients log in through the server's auth service, so it must
+// accept the generated names with -password. The server's spam detection
+// mutes clients sending more than SPAM_FLOOD_LIMIT messages per
+// SPAM_FLOOD_WINDOW; raise the limit or set SPAM_DETECTION=false for high rates.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Prefix of message bodies sent by loadgen, followed by the send time in Unix nanoseconds
+const marker = "loadgen|"
+
+// Message is the subset of the server's message envelope loadgen reads
+type Message struct {
+	Type string `json:"type"`
+	Body string `json:"body"`
+}
+
+// Client is one simulated user
+type Client interface {
+	Send(body string) error
+	Close() error
+}
+
+// Stats collects the results of a run
+type Stats struct {
+	sent     atomic.Int64
+	errors   atomic.Int64
+	mu       sync.Mutex
+	latency  []time.Duration
+	received int64
+}
+
+// record notes the arrival of a message body, if it was sent by loadgen
+func (s *Stats) record(body string) {
+	sent, ok := strings.CutPrefix(body, marker)
+	if !ok {
+		return
+	}
+	nanos, err := strconv.ParseInt(sent, 10, 64)
+	if err != nil {
+		return
+	}
+	latency := time.Since(time.Unix(0, nanos))
+	s.mu.Lock()
+	s.latency = append(s.latency, latency)
+	s.received++
+	s.mu.Unlock()
+}
+
+// wsClient logs in over WebSocket with the login prompts
+type wsClient struct {
+	conn *websocket.Conn
+	mu   sync.Mutex
+}
+
+func dialWebSocket(url, name, password, room string, stats *Stats) (*wsClient, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for _, reply := range []string{"1", name, password} {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(reply)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	_, result, err := conn.ReadMessage()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.Contains(string(result), "logged in successfully") {
+		conn.Close()
+		return nil, errors.New("login failed: " + string(result))
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	c := &wsClient{conn: conn}
+	go c.read(stats)
+	if err := c.Send("/join " + room); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// read records every chat message, including batches sent as JSON arrays
+func (c *wsClient) read(stats *Stats) {
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var batch []Message
+		if len(data) > 0 && data[0] == '[' {
+			if json.Unmarshal(data, &batch) != nil {
+				continue
+			}
+		} else {
+			var msg Message
+			if json.Unmarshal(data, &msg) != nil {
+				continue
+			}
+			batch = append(batch, msg)
+		}
+		for _, msg := range batch {
+			if msg.Type == "chat" {
+				stats.record(msg.Body)
+			}
+		}
+	}
+}
+
+func (c *wsClient) Send(body string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, []byte(body))
+}
+
+func (c *wsClient) Close() error {
+	return c.conn.Close()
+}
+
+// tcpClient speaks the plain text protocol
+type tcpClient struct {
+	conn net.Conn
+	mu   sync.Mutex
+}
+
+func dialTCP(addr, name, room string, stats *Stats) (*tcpClient, error) {
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	// The nickname prompt has no trailing newline
+	prompt := make([]byte, len("Please enter your nickname: "))
+	if _, err := reader.Read(prompt); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	c := &tcpClient{conn: conn}
+	if err := c.Send(name); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go c.read(reader, stats)
+	// The server reads each line in one read, so give it a moment before the next
+	time.Sleep(50 * time.Millisecond)
+	if err := c.Send("/join " + room); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// read records every "name: body" line
+func (c *tcpClient) read(reader *bufio.Reader, stats *Stats) {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		if _, body, ok := strings.Cut(scanner.Text(), ": "); ok {
+			stats.record(body)
+		}
+	}
+}
+
+func (c *tcpClient) Send(body string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.conn.Write([]byte(body + "\n"))
+	return err
+}
+
+func (c *tcpClient) Close() error {
+	return c.conn.Close()
+}
+
+// percentile returns the p-th percentile of sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p / 100)
+	return sorted[i]
+}
+
+func main() {
+	wsURL := flag.String("ws", "ws://localhost:8081/ws", "chat server WebSocket URL")
+	tcpAddr := flag.String("tcp", "localhost:8080", "chat server TCP address")
+	wsClients := flag.Int("ws-clients", 10, "number of WebSocket clients")
+	tcpClients := flag.Int("tcp-clients", 10, "number of TCP clients")
+	rate := flag.Float64("rate", 1, "messages per second sent by each client, 0 to only listen")
+	duration := flag.Duration("duration", 30*time.Second, "how long to send messages")
+	drain := flag.Duration("drain", 2*time.Second, "how long to wait for messages after sending stops")
+	room := flag.String("room", "loadgen", "room the clients join")
+	prefix := flag.String("prefix", "loadgen", "prefix of the client names")
+	password := flag.String("password", "loadgen", "password WebSocket clients log in with")
+	flag.Parse()
+
+	stats := &Stats{}
+	var clients []Client
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var failed atomic.Int64
+	connect := func(kind string, i int, dial func(name string) (Client, error)) {
+		defer wg.Done()
+		name := fmt.Sprintf("%s-%s-%d", *prefix, kind, i)
+		c, err := dial(name)
+		if err != nil {
+			failed.Add(1)
+			log.Printf("Error connecting %s: %v", name, err)
+			return
+		}
+		mu.Lock()
+		clients = append(clients, c)
+		mu.Unlock()
+	}
+
+	start := time.Now()
+	for i := 0; i < *wsClients; i++ {
+		wg.Add(1)
+		go connect("ws", i, func(name string) (Client, error) {
+			return dialWebSocket(*wsURL, name, *password, *room, stats)
+		})
+	}
+	for i := 0; i < *tcpClients; i++ {
+		wg.Add(1)
+		go connect("tcp", i, func(name string) (Client, error) {
+			return dialTCP(*tcpAddr, name, *room, stats)
+		})
+	}
+	wg.Wait()
+	log.Printf("Connected %d clients in %v, %d failed", len(clients), time.Since(start).Round(time.Millisecond), failed.Load())
+	if len(clients) == 0 {
+		log.Fatal("No clients connected")
+	}
+
+	// Let the join notices settle before measuring
+	time.Sleep(500 * time.Millisecond)
+	stop := time.Now().Add(*duration)
+	if *rate > 0 {
+		interval := time.Duration(float64(time.Second) / *rate)
+		for i, c := range clients {
+			wg.Add(1)
+			go func(c Client, offset time.Duration) {
+				defer wg.Done()
+				// Spread the clients over one interval so they do not send in lockstep
+				time.Sleep(offset)
+				ticker := time.NewTicker(interval)
+				defer ticker.Stop()
+				for time.Now().Before(stop) {
+					if err := c.Send(marker + strconv.FormatInt(time.Now().UnixNano(), 10)); err != nil {
+						stats.errors.Add(1)
+						return
+					}
+					stats.sent.Add(1)
+					<-ticker.C
+				}
+			}(c, interval*time.Duration(i)/time.Duration(len(clients)))
+		}
+	}
+	wg.Wait()
+	time.Sleep(*drain)
+	for _, c := range clients {
+		c.Close()
+	}
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+	sort.Slice(stats.latency, func(i, j int) bool { return stats.latency[i] < stats.latency[j] })
+	sent := stats.sent.Load()
+	expected := sent * int64(len(clients)-1)
+	fmt.Printf("clients   %d connected, %d failed\n", len(clients), failed.Load())
+	fmt.Printf("messages  %d sent, %d send errors\n", sent, stats.errors.Load())
+	fmt.Printf("delivered %d of %d expected", stats.received, expected)
+	if expected > 0 {
+		fmt.Printf(" (%.1f%%)", 100*float64(stats.received)/float64(expected))
+	}
+	fmt.Printf(", %.0f/s\n", float64(stats.received)/duration.Seconds())
+	fmt.Printf("latency   p50 %v  p90 %v  p99 %v  max %v\n",
+		percentile(stats.latency, 50), percentile(stats.latency, 90),
+		percentile(stats.latency, 99), percentile(stats.latency, 100))
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"sync"
+	"time"
+)
+
+// Default number of messages after which a coalesced batch is sent without waiting
+const defaultCoalesceMax = 100
+
+// coalesceWindow is how long messages to a WebSocket client are held so
+// they can share one frame. Zero, the default, sends every message at once.
+var coalesceWindow = sync.OnceValue(func() time.Duration {
+	return envDuration("WS_COALESCE_WINDOW", 0)
+})
+
+// coalesceState holds messages waiting to be sent to a WebSocket client as
+// one frame containing a JSON array. Guarded by Client.writeMu.
+type coalesceState struct {
+	pending [][]byte
+	timer   *time.Timer
+}
+
+// coalescing reports whether messages to the client are batched. Flow
+// controlled clients count credits per message, so they are not, nor are
+// clients whose hello left out batching.
+func (c *Client) coalescing() bool {
+	ws, ok := c.Transport.(*wsTransport)
+	return ok && !ws.flow.enabled && coalesceWindow() > 0 && ws.selected(FeatureBatch)
+}
+
+// queueCoalesced adds a message to the client's batch, starting the window
+// with the first one. Caller must hold c.writeMu.
+func (c *Client) queueCoalesced(data []byte) error {
+	c.coalesce.pending = append(c.coalesce.pending, append([]byte(nil), data...))
+	if len(c.coalesce.pending) >= envInt("WS_COALESCE_MAX", defaultCoalesceMax) {
+		return c.flushCoalescedLocked()
+	}
+	if c.coalesce.timer == nil {
+		c.coalesce.timer = time.AfterFunc(coalesceWindow(), c.flushCoalesced)
+	}
+	return nil
+}
+
+// flushCoalesced sends the batch when its window closes
+func (c *Client) flushCoalesced() {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	// Closing the connection makes its handler remove the client
+	if err := c.flushCoalescedLocked(); err != nil {
+		log.Printf("Write to %s error: %v", c.Address, err)
+		c.Transport.Close()
+	}
+}
+
+// flushCoalescedLocked sends the batch now, as a plain message if it holds
+// only one. Caller must hold c.writeMu.
+func (c *Client) flushCoalescedLocked() error {
+	if c.coalesce.timer != nil {
+		c.coalesce.timer.Stop()
+		c.coalesce.timer = nil
+	}
+	pending := c.coalesce.pending
+	c.coalesce.pending = nil
+	switch len(pending) {
+	case 0:
+		return nil
+	case 1:
+		return c.Transport.Send(pending[0])
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	buf.Write(bytes.Join(pending, []byte{','}))
+	buf.WriteByte(']')
+	return c.Transport.Send(buf.Bytes())
+}
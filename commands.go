@@ -0,0 +1,386 @@
+package main
+
+import (
+	"strings"
+)
+
+// HandleCommand runs a slash command sent by a client. It returns false if
+// the message is not a command and should be treated as chat.
+func (cs *ChatServer) HandleCommand(client *Client, msg string, sender ClientID) bool {
+	if !strings.HasPrefix(msg, "/") {
+		return false
+	}
+	fields := strings.Fields(msg)
+	if postingCommands[fields[0]] && cs.refuseGuest(client) {
+		return true
+	}
+	switch fields[0] {
+	case "/join":
+		if len(fields) != 2 && len(fields) != 3 {
+			client.Fail(CodeUsage, "Usage: /join <room> [invite code|password]")
+			return true
+		}
+		if fields[1] == client.Room {
+			client.Noticef("You are already in %s", fields[1])
+			return true
+		}
+		credential := ""
+		if len(fields) == 3 {
+			credential = fields[2]
+		}
+		if err := cs.AdmitToRoom(client, fields[1], credential); err != nil {
+			client.Notice(joinError(fields[1], err))
+			return true
+		}
+		cs.JoinRoom(client, fields[1], sender)
+	case "/room":
+		cs.roomCommand(client, fields)
+	case "/list", "/rooms":
+		cs.listCommand(client, fields[1:])
+	case "/away", "/dnd", "/back":
+		cs.presenceCommand(client, fields)
+	case "/digest":
+		cs.digestCommand(client, fields)
+	case "/2fa":
+		cs.twoFactorCommand(client, fields)
+	case "/lang":
+		cs.langCommand(client, fields)
+	case "/sessions":
+		cs.sessionsCommand(client, fields)
+	case "/push":
+		cs.pushCommand(client, fields)
+	case "/profile":
+		cs.profileCommand(client, fields)
+	case "/stream", "/streams":
+		cs.streamCommand(client, fields)
+	case "/who":
+		cs.whoCommand(client)
+	case "/block", "/unblock":
+		cs.blockCommand(client, fields)
+	case "/topic":
+		cs.topicCommand(client, msg)
+	case "/invite":
+		cs.inviteCommand(client, fields)
+	case "/announce":
+		if !client.Admin {
+			client.Fail(CodePermissionDenied, "Permission denied")
+			return true
+		}
+		text := strings.TrimSpace(strings.TrimPrefix(msg, "/announce"))
+		if text == "" {
+			client.Fail(CodeUsage, "Usage: /announce <message>")
+			return true
+		}
+		cs.Announce(client.Name, text)
+		cs.Audit(client, "announce", "", "", "")
+	case "/filter":
+		cs.filterCommand(client, fields)
+	case "/enrich":
+		cs.enrichCommand(client, fields)
+	case "/giphy":
+		// Expanded by the giphy enricher when it is enabled in the room
+		cs.Chat(client, msg, sender)
+	case "/event":
+		cs.eventCommand(client, splitArgs(strings.TrimPrefix(msg, "/event")))
+	case "/events":
+		cs.eventsCommand(client)
+	case "/pin", "/unpin":
+		cs.pinCommand(client, fields)
+	case "/react":
+		cs.reactCommand(client, fields)
+	case "/emoji":
+		cs.SendEmoji(client)
+	case "/pins":
+		cs.SendPins(client, client.Room)
+	case "/export":
+		cs.exportCommand(client, fields[1:])
+	case "/poll":
+		cs.pollCommand(client, splitArgs(strings.TrimPrefix(msg, "/poll")))
+	case "/vote":
+		cs.voteCommand(client, fields[1:])
+	case "/remind":
+		cs.delayedCommand(client, DelayedReminder, fields[1:])
+	case "/schedule":
+		cs.delayedCommand(client, DelayedPost, fields[1:])
+	case "/rsvp":
+		cs.rsvpCommand(client, fields[1:])
+	case "/webhook":
+		cs.webhookCommand(client, fields)
+	case "/replay":
+		since, until, err := parseSeqRange(fields[1:])
+		if err != nil {
+			client.Fail(CodeUsage, "Usage: /replay <from seq> [to seq]")
+			return true
+		}
+		cs.Replay(client, since, until)
+	case "/color":
+		cs.colorCommand(client, fields)
+	case "/echo":
+		if len(fields) != 2 || (fields[1] != "on" && fields[1] != "off") {
+			client.Fail(CodeUsage, "Usage: /echo on|off")
+			return true
+		}
+		client.echo.Store(fields[1] == "on")
+		client.Noticef("Echo of your own messages turned %s", fields[1])
+	case "/snippet":
+		if len(fields) != 2 {
+			client.Fail(CodeUsage, "Usage: /snippet <id>")
+			return true
+		}
+		snippet, err := cs.Snippets.Get(fields[1])
+		if err != nil {
+			client.Noticef("Snippet not found: %s", fields[1])
+			return true
+		}
+		client.Notice(snippet.Body)
+	default:
+		// Automations and plugins may answer in the room
+		if (cs.hasCommandAutomation(client, fields[0]) || cs.pluginFor(fields[0]) != nil) && cs.refuseGuest(client) {
+			return true
+		}
+		if cs.RunCommandAutomation(client, fields) {
+			return true
+		}
+		if p := cs.pluginFor(fields[0]); p != nil {
+			cs.pluginCommand(p, client, fields)
+			return true
+		}
+		client.Fail(CodeUnknownCommand, "Unknown command: %s", fields[0])
+	}
+	return true
+}
+
+// filterCommand lists the filters of the client's room or turns one on or off
+func (cs *ChatServer) filterCommand(client *Client, fields []string) {
+	if len(fields) == 1 {
+		cs.Mutex.Lock()
+		room := cs.getRoom(client.Room)
+		lines := make([]string, 0, len(cs.Filters))
+		for _, filter := range cs.Filters {
+			state := "off"
+			if room.Filters[filter.Name()] {
+				state = "on"
+			} else if room.ShadowFilters[filter.Name()] {
+				state = "shadow"
+			}
+			lines = append(lines, filter.Name()+": "+state)
+		}
+		cs.Mutex.Unlock()
+		client.Noticef("Filters in %s\n%s", client.Room, strings.Join(lines, "\n"))
+		return
+	}
+	if len(fields) != 3 || (fields[1] != "on" && fields[1] != "off" && fields[1] != "shadow") {
+		client.Fail(CodeUsage, "Usage: /filter [on|off|shadow <name>]")
+		return
+	}
+	if !cs.IsModerator(client, client.Room) {
+		client.Fail(CodePermissionDenied, "Permission denied")
+		return
+	}
+	if err := cs.SetRoomFilter(client, client.Room, fields[2], fields[1]); err != nil {
+		client.Notice(err.Error())
+		return
+	}
+	if fields[1] == "shadow" {
+		client.Noticef("Filter %s is in shadow mode in %s: violations are reported but not enforced", fields[2], client.Room)
+		return
+	}
+	client.Noticef("Filter %s turned %s in %s", fields[2], fields[1], client.Room)
+}
+
+// enrichCommand lists the enrichers of the client's room or turns one on or off
+func (cs *ChatServer) enrichCommand(client *Client, fields []string) {
+	if len(fields) == 1 {
+		cs.Mutex.Lock()
+		enabled := cs.getRoom(client.Room).Enrichers
+		lines := make([]string, 0, len(cs.Enrichers))
+		for _, enricher := range cs.Enrichers {
+			state := "off"
+			if enabled[enricher.Name()] {
+				state = "on"
+			}
+			lines = append(lines, enricher.Name()+": "+state)
+		}
+		cs.Mutex.Unlock()
+		client.Noticef("Enrichers in %s\n%s", client.Room, strings.Join(lines, "\n"))
+		return
+	}
+	if len(fields) != 3 || (fields[1] != "on" && fields[1] != "off") {
+		client.Fail(CodeUsage, "Usage: /enrich [on|off <name>]")
+		return
+	}
+	if !cs.IsModerator(client, client.Room) {
+		client.Fail(CodePermissionDenied, "Permission denied")
+		return
+	}
+	if err := cs.SetRoomEnricher(client, client.Room, fields[2], fields[1] == "on"); err != nil {
+		client.Notice(err.Error())
+		return
+	}
+	client.Noticef("Enricher %s turned %s in %s", fields[2], fields[1], client.Room)
+}
+
+// postingCommands are the commands that post to the client's room, which
+// guests may only use within their limits. Chat messages are checked by Chat.
+var postingCommands = map[string]bool{
+	"/event":    true,
+	"/rsvp":     true,
+	"/react":    true,
+	"/poll":     true,
+	"/vote":     true,
+	"/schedule": true,
+}
+
+// postingRequests are the request types that post to the client's room
+var postingRequests = map[string]bool{
+	MessageSnippet:   true,
+	MessageLocation:  true,
+	MessageKey:       true,
+	MessageEncrypted: true,
+	MessageReaction:  true,
+}
+
+// refuseGuest tells a guest why it may not post to its room now, and reports
+// whether it was refused
+func (cs *ChatServer) refuseGuest(client *Client) bool {
+	refused := cs.guestRestriction(client)
+	if refused != nil {
+		client.Send(refused)
+	}
+	return refused != nil
+}
+
+// HandleRequest runs a structured request sent by a WebSocket client
+func (cs *ChatServer) HandleRequest(client *Client, req *Request, sender ClientID) {
+	// Call signals without a recipient go to the whole room
+	posts := postingRequests[req.Type] || (req.To == "" && (req.Type == MessageCallOffer || req.Type == MessageCallAnswer || req.Type == MessageCallCandidate || req.Type == MessageCallHangup))
+	if posts && cs.refuseGuest(client) {
+		return
+	}
+	switch req.Type {
+	case MessageChat:
+		if !cs.HandleCommand(client, req.Body, sender) {
+			cs.Chat(client, req.Body, sender)
+		}
+	case MessageSnippet:
+		cs.ShareSnippet(client, req, sender)
+	case MessageLocation:
+		cs.ShareLocation(client, req, sender)
+	case "subscribe":
+		cs.Subscribe(client, req.Events)
+	case MessageKey:
+		cs.PublishKey(client, req, sender)
+	case MessageKeys:
+		cs.SendKeys(client)
+	case MessageEncrypted:
+		cs.RelayEncrypted(client, req, sender)
+	case MessageRoomKey:
+		cs.SendRoomKey(client, req)
+	case MessageCallOffer, MessageCallAnswer, MessageCallCandidate, MessageCallHangup:
+		cs.RelaySignal(client, req, sender)
+	case MessageCallTURN:
+		cs.SendTURNCredentials(client)
+	case "replay":
+		cs.Replay(client, req.Since, req.Until)
+	case "push.register":
+		if req.Push == nil {
+			client.Notice("push.register needs a push subscription")
+			break
+		}
+		device, err := cs.RegisterDevice(client, *req.Push)
+		if err != nil {
+			client.Notice(err.Error())
+			break
+		}
+		client.Noticef("Registered device %s for push notifications", device.ID)
+	case "push.unregister":
+		cs.pushCommand(client, []string{"/push", "remove", req.ID})
+	case "room.info":
+		room := req.Room
+		if room == "" {
+			room = client.Room
+		}
+		cs.SendRoomInfo(client, room)
+	case "room.pins":
+		room := req.Room
+		if room == "" {
+			room = client.Room
+		}
+		cs.SendPins(client, room)
+	case MessageEmojiList:
+		cs.SendEmoji(client)
+	case MessageReaction:
+		cs.React(client, req.ID, req.Body)
+	case "stream.start":
+		if req.Stream == nil {
+			client.Notice("stream.start needs a stream")
+			break
+		}
+		cs.StartStream(client, req.Stream)
+	case "stream.stop":
+		cs.streamCommand(client, []string{"/stream", "off"})
+	case MessageStreams:
+		room := req.Room
+		if room == "" {
+			room = client.Room
+		}
+		cs.SendStreams(client, room)
+	case "stream.follow", "stream.unfollow":
+		cs.FollowStreams(client, req.Room, req.Type == "stream.follow")
+	case "locale":
+		if err := cs.SetLocale(client, req.Body); err != nil {
+			client.Noticef("No translation for %s", req.Body)
+		}
+	case "history.range":
+		if req.Room == "" {
+			client.Notice("history.range needs a room")
+			break
+		}
+		cs.HistoryRange(client, req.Room, req.FromSeq, req.ToSeq)
+	case "credit":
+		if req.Credits <= 0 {
+			client.Notice("credits must be a positive number")
+			return
+		}
+		client.GrantCredits(req.Credits)
+	default:
+		client.Fail(CodeUnknownCommand, "Unknown request type: %s", req.Type)
+	}
+}
+
+// splitArgs splits command arguments on spaces, keeping "double quoted" text together
+func splitArgs(s string) []string {
+	var args []string
+	var current strings.Builder
+	inQuotes, hasArg := false, false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			hasArg = true
+		case r == ' ' && !inQuotes:
+			if hasArg {
+				args = append(args, current.String())
+				current.Reset()
+				hasArg = false
+			}
+		default:
+			current.WriteRune(r)
+			hasArg = true
+		}
+	}
+	if hasArg {
+		args = append(args, current.String())
+	}
+	return args
+}
+
+// isAdmin reports whether an authenticated user is listed in ADMIN_USERS
+func isAdmin(name string) bool {
+	for _, admin := range envList("ADMIN_USERS") {
+		if admin == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envInt reads a non-negative integer from the environment, returning def if it is unset or invalid
+func envInt(key string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || v < 0 {
+		return def
+	}
+	return v
+}
+
+// envPositiveInt reads a positive integer from the environment, returning def if it is unset, invalid or zero
+func envPositiveInt(key string, def int) int {
+	if v := envInt(key, def); v > 0 {
+		return v
+	}
+	return def
+}
+
+// envDuration reads a duration such as "30s" from the environment, returning def if it is unset or invalid
+func envDuration(key string, def time.Duration) time.Duration {
+	v, err := time.ParseDuration(os.Getenv(key))
+	if err != nil || v < 0 {
+		return def
+	}
+	return v
+}
+
+// envBool reads a boolean from the environment, returning def if it is unset or invalid
+func envBool(key string, def bool) bool {
+	v, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// envList reads a comma separated list from the environment, skipping empty entries
+func envList(key string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
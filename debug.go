@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// clientDebug describes one client in the hub dump
+type clientDebug struct {
+	ID      ClientID `json:"id"`
+	Name    string   `json:"name"`
+	Address string   `json:"address"`
+	Room    string   `json:"room"`
+	Kind    string   `json:"kind"`
+	// Queued counts messages waiting to be written to the client. Writing is
+	// set when a write was in progress, which for a long time means a stalled client.
+	Queued  int  `json:"queued"`
+	Writing bool `json:"writing,omitempty"`
+	// Dropped counts messages the slow consumer policy dropped
+	Dropped int `json:"dropped,omitempty"`
+}
+
+// StartDebugServer serves pprof profiles and a dump of the hub's internals on
+// a separate address, which should only be reachable by operators
+func (cs *ChatServer) StartDebugServer(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("GET /debug/hub", cs.HandleDebugHub)
+
+	listener, _, err := listen("tcp", addr)
+	if err != nil {
+		log.Fatal("Debug server error:", err)
+	}
+	log.Println("Debug server listening on", addr)
+	if err := http.Serve(listener, mux); !errors.Is(err, net.ErrClosed) {
+		log.Fatal(err)
+	}
+}
+
+// hidePprof keeps the handlers net/http/pprof registers on the default mux
+// off the public server
+func hidePprof(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/debug/pprof") {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// HandleDebugHub dumps goroutine and memory counts, queue depths and every
+// client's pending messages as JSON
+func (cs *ChatServer) HandleDebugHub(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	cs.Mutex.Lock()
+	rooms := make(map[string]int, len(cs.Rooms))
+	for name := range cs.Rooms {
+		rooms[name] = 0
+	}
+	clients := make([]clientDebug, 0, len(cs.Clients.All()))
+	for _, client := range cs.Clients.All() {
+		rooms[client.Room]++
+		clients = append(clients, client.debug())
+	}
+	sessions := len(cs.Sessions)
+	cs.Mutex.Unlock()
+
+	queues := map[string]int{
+		"webhooks":       len(cs.Webhooks.queue),
+		"webhooks_limit": cap(cs.Webhooks.queue),
+		"fanout":         len(cs.Fanout.jobs),
+		"fanout_limit":   cap(cs.Fanout.jobs),
+	}
+	if cs.Matrix != nil {
+		queues["matrix"] = len(cs.Matrix.queue)
+		queues["matrix_limit"] = cap(cs.Matrix.queue)
+	}
+	if cs.Tracer != nil {
+		queues["spans"] = len(cs.Tracer.queue)
+		queues["spans_limit"] = cap(cs.Tracer.queue)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"time":       time.Now().UTC(),
+		"goroutines": runtime.NumGoroutine(),
+		"memory": map[string]uint64{
+			"heap_alloc":  mem.HeapAlloc,
+			"heap_inuse":  mem.HeapInuse,
+			"sys":         mem.Sys,
+			"num_gc":      uint64(mem.NumGC),
+			"pause_total": mem.PauseTotalNs,
+		},
+		"queues":         queues,
+		"fanout":         cs.Fanout.stats.snapshot(),
+		"slow_consumers": cs.SlowConsumers.snapshot(),
+		"rooms":          rooms,
+		"sessions":       sessions,
+		"clients":        clients,
+	})
+}
+
+// debug describes the client for the hub dump. It does not wait for a write
+// in progress, so a stalled client cannot hang the dump. Caller must hold cs.Mutex.
+func (c *Client) debug() clientDebug {
+	d := clientDebug{ID: c.ID, Name: c.Name, Address: c.Address, Room: c.Room, Kind: c.kind()}
+	switch t := c.Transport.(type) {
+	case *wsTransport:
+		if c.writeMu.TryLock() {
+			d.Queued = len(t.flow.pending) + len(c.coalesce.pending)
+			c.writeMu.Unlock()
+		} else {
+			d.Writing = true
+		}
+	case *pollQueue:
+		t.mu.Lock()
+		d.Queued = len(t.msgs)
+		t.mu.Unlock()
+	}
+	if c.queue != nil {
+		queued, dropped := c.queue.depth()
+		d.Queued += queued
+		d.Dropped = dropped
+	}
+	return d
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How often the scheduler checks for messages that are due
+const delayedInterval = time.Second
+
+// Kinds of delayed messages
+const (
+	DelayedReminder = "remind"
+	DelayedPost     = "schedule"
+)
+
+// DelayedMessage is a message to deliver later: a reminder sent back to its
+// user, or a chat message posted to a room
+type DelayedMessage struct {
+	ID   string    `json:"id"`
+	Kind string    `json:"kind"`
+	User string    `json:"user"`
+	Room string    `json:"room,omitempty"`
+	Body string    `json:"body"`
+	Due  time.Time `json:"due"`
+	// Account is set when the user was logged in, so a reminder that falls
+	// due while they are away waits for their next login
+	Account bool      `json:"account,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// parseWhen reads when a delayed message is due from the start of its
+// arguments: a duration such as 10m, 1h30m or 2d, a clock time such as
+// 18:00, or a day and a clock time as /event takes them. It returns the
+// remaining arguments.
+func parseWhen(args []string, now time.Time) (time.Time, []string, error) {
+	if len(args) == 0 {
+		return time.Time{}, nil, errors.New("missing time")
+	}
+	when := strings.ToLower(args[0])
+	if days, ok := strings.CutSuffix(when, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n > 0 {
+			return now.AddDate(0, 0, n), args[1:], nil
+		}
+	}
+	if d, err := time.ParseDuration(when); err == nil {
+		if d <= 0 {
+			return time.Time{}, nil, errors.New("time must be in the future")
+		}
+		return now.Add(d), args[1:], nil
+	}
+	if _, err := time.Parse("15:04", when); err == nil {
+		due, err := parseEventTime("today", when, now)
+		if err != nil {
+			due, err = parseEventTime("tomorrow", when, now)
+		}
+		return due, args[1:], err
+	}
+	if len(args) >= 2 {
+		due, err := parseEventTime(args[0], args[1], now)
+		if err == nil {
+			return due, args[2:], nil
+		}
+	}
+	return time.Time{}, nil, errors.New("time must be a duration such as 10m or 2d, a time such as 18:00, or a day and a time")
+}
+
+// ScheduleMessage stores a message to deliver later
+func (cs *ChatServer) ScheduleMessage(client *Client, kind, room, body string, due time.Time) (*DelayedMessage, error) {
+	limit := envInt("DELAYED_MAX_PER_USER", 25)
+	cs.Mutex.Lock()
+	pending := 0
+	for _, d := range cs.Delayed {
+		if d.User == client.Name {
+			pending++
+		}
+	}
+	cs.Mutex.Unlock()
+	if pending >= limit {
+		return nil, fmt.Errorf("you already have %d scheduled messages", pending)
+	}
+
+	id, err := newID(4)
+	if err != nil {
+		return nil, err
+	}
+	d := &DelayedMessage{
+		ID:      id,
+		Kind:    kind,
+		User:    client.Name,
+		Room:    room,
+		Body:    body,
+		Due:     due.UTC(),
+		Account: client.Authenticated,
+		Created: time.Now().UTC(),
+	}
+	data, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	cs.Record(Event{Type: EventDelayedCreate, Room: room, User: client.Name, Target: id, Data: data})
+	return d, nil
+}
+
+// applyDelayedEvent updates the delayed messages for an event log entry.
+// Caller must hold cs.Mutex.
+func (cs *ChatServer) applyDelayedEvent(ev Event) {
+	switch ev.Type {
+	case EventDelayedCreate:
+		var d DelayedMessage
+		if err := json.Unmarshal(ev.Data, &d); err != nil {
+			log.Println("Invalid delayed message in event log:", err)
+			return
+		}
+		cs.Delayed[d.ID] = &d
+	case EventDelayedDone, EventDelayedCancel:
+		delete(cs.Delayed, ev.Target)
+	}
+}
+
+// delayedOf returns a user's pending messages, soonest first
+func (cs *ChatServer) delayedOf(user string) []DelayedMessage {
+	cs.Mutex.Lock()
+	var list []DelayedMessage
+	for _, d := range cs.Delayed {
+		if d.User == user {
+			list = append(list, *d)
+		}
+	}
+	cs.Mutex.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Due.Before(list[j].Due) })
+	return list
+}
+
+// reminderRecipients returns the connections a reminder is delivered to
+func (cs *ChatServer) reminderRecipients(d *DelayedMessage) []*Client {
+	if d.Account {
+		return cs.sessionsOf(d.User)
+	}
+	var clients []*Client
+	for _, c := range cs.Clients.All() {
+		if !c.Authenticated && c.Name == d.User {
+			clients = append(clients, c)
+		}
+	}
+	return clients
+}
+
+// deliver sends a delayed message that is due. It reports false for a
+// reminder whose user is away and should wait for their next login, or a
+// post the room's throughput caps hold back for now.
+func (cs *ChatServer) deliver(d *DelayedMessage) bool {
+	if d.Kind == DelayedPost {
+		return cs.postDelayed(d)
+	}
+	recipients := cs.reminderRecipients(d)
+	if len(recipients) == 0 && d.Account {
+		return false
+	}
+	for _, c := range recipients {
+		c.Send((&Message{Type: MessageSystem}).setText("Reminder: %s", d.Body))
+	}
+	return true
+}
+
+// postDelayed posts a scheduled message once it passes the checks a chat
+// message from its user would pass now. A message that may no longer be
+// posted is dropped and its user told why.
+func (cs *ChatServer) postDelayed(d *DelayedMessage) bool {
+	// The user's session in the room is checked for spam, or a stand-in
+	// when they have left it
+	sender := &Client{Name: d.User, Authenticated: d.Account, Admin: d.Account && isAdmin(d.User)}
+	for _, c := range cs.reminderRecipients(d) {
+		if c.Room == d.Room {
+			sender = c
+			break
+		}
+	}
+	refuse := func(reason string) bool {
+		for _, c := range cs.reminderRecipients(d) {
+			c.Send((&Message{Type: MessageSystem}).setText("Scheduled message %s was not posted to %s: %s", d.ID, d.Room, reason))
+		}
+		return true
+	}
+
+	cs.Mutex.Lock()
+	room := cs.Rooms[d.Room]
+	allowed := room != nil && cs.canSee(sender, d.Room, room)
+	cs.Mutex.Unlock()
+	if room == nil {
+		return refuse("the room no longer exists")
+	}
+	if !allowed {
+		return refuse("you may no longer post there")
+	}
+	if refused := cs.CheckSpam(sender, d.Body); refused != nil {
+		return refuse(refused.Body)
+	}
+	err := cs.PostMessage(&Message{Type: MessageChat, Room: d.Room, From: d.User, Body: d.Body}, 0)
+	var throttle *throttleError
+	return !errors.As(err, &throttle)
+}
+
+// RunDelayedMessages delivers delayed messages as they fall due, including
+// ones that fell due while the server was down. Reminders for users who are
+// away are retried until they log in again.
+func (cs *ChatServer) RunDelayedMessages() {
+	for {
+		now := time.Now()
+		var due []*DelayedMessage
+		cs.Mutex.Lock()
+		for _, d := range cs.Delayed {
+			if !d.Due.After(now) {
+				due = append(due, d)
+			}
+		}
+		cs.Mutex.Unlock()
+		sort.Slice(due, func(i, j int) bool { return due[i].Due.Before(due[j].Due) })
+
+		for _, d := range due {
+			if cs.deliver(d) {
+				cs.Record(Event{Type: EventDelayedDone, Room: d.Room, User: d.User, Target: d.ID})
+			}
+		}
+		time.Sleep(delayedInterval)
+	}
+}
+
+// delayedCommand handles /remind and /schedule: creating a delayed
+// message, listing the user's pending ones or cancelling one
+func (cs *ChatServer) delayedCommand(client *Client, kind string, args []string) {
+	usage := "Usage: /remind <when> <text> | /remind list | /remind cancel <id>"
+	if kind == DelayedPost {
+		usage = "Usage: /schedule <when> <message> | /schedule list | /schedule cancel <id>"
+	}
+	switch {
+	case len(args) == 1 && args[0] == "list":
+		var lines []string
+		for _, d := range cs.delayedOf(client.Name) {
+			if d.Kind != kind {
+				continue
+			}
+			where := ""
+			if d.Kind == DelayedPost {
+				where = " in " + d.Room
+			}
+			lines = append(lines, fmt.Sprintf("%s  %s%s: %s", d.ID, d.Due.Local().Format("Mon Jan 2 15:04"), where, d.Body))
+		}
+		if len(lines) == 0 {
+			client.Notice("Nothing scheduled")
+			return
+		}
+		client.Notice(strings.Join(lines, "\n"))
+		return
+	case len(args) == 2 && args[0] == "cancel":
+		cs.Mutex.Lock()
+		d := cs.Delayed[args[1]]
+		cs.Mutex.Unlock()
+		if d == nil || d.User != client.Name {
+			client.Noticef("Nothing scheduled with ID %s", args[1])
+			return
+		}
+		cs.Record(Event{Type: EventDelayedCancel, Room: d.Room, User: client.Name, Target: d.ID})
+		client.Noticef("Cancelled %s", d.ID)
+		return
+	}
+
+	due, rest, err := parseWhen(args, time.Now())
+	if err != nil || len(rest) == 0 {
+		client.Notice(usage)
+		return
+	}
+	body := strings.Join(rest, " ")
+	room := ""
+	if kind == DelayedPost {
+		if client.Room == "" {
+			client.Fail(CodeNotInRoom, "You are not in a room")
+			return
+		}
+		// Filters run now, while the user is around to hear about a rejection
+		if body, err = cs.ApplyFilters(client, client.Room, body); err != nil {
+			client.Fail(CodeRejected, "Message rejected: %s", err.Error())
+			return
+		}
+		room = client.Room
+	}
+	d, err := cs.ScheduleMessage(client, kind, room, body, due)
+	if err != nil {
+		client.Notice(err.Error())
+		return
+	}
+	if kind == DelayedPost {
+		client.Noticef("Message %s will be posted to %s at %s", d.ID, room, due.Local().Format("Mon Jan 2 15:04:05"))
+	} else {
+		client.Noticef("Reminder %s set for %s", d.ID, due.Local().Format("Mon Jan 2 15:04:05"))
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Most mentions listed in one digest email
+const maxDigestMentions = 20
+
+// How long a digest address confirmation code is valid, how many wrong codes
+// cancel it, and how long to wait before mailing another one
+const (
+	digestConfirmTTL         = 30 * time.Minute
+	maxDigestConfirmAttempts = 5
+	digestConfirmInterval    = time.Minute
+)
+
+// digestConfirmation is an address a user wants digests sent to, waiting for
+// them to enter the code mailed to it
+type digestConfirmation struct {
+	address  string
+	code     string
+	sent     time.Time
+	attempts int
+}
+
+// missedMention is a mention of a user who was offline
+type missedMention struct {
+	From string
+	Room string
+	Body string
+	Time time.Time
+}
+
+// DigestMailer emails users a summary of the mentions they missed once they
+// have been offline for a while. It is configured with SMTP_ADDR, SMTP_FROM
+// and optionally SMTP_USER and SMTP_PASSWORD.
+type DigestMailer struct {
+	addr  string
+	from  string
+	auth  smtp.Auth
+	after time.Duration
+
+	mu       sync.Mutex
+	missed   map[string][]missedMention
+	lastSeen map[string]time.Time
+
+	// send delivers an email, smtp.SendMail outside of tests
+	send func(addr string, auth smtp.Auth, from string, to []string, msg []byte) error
+}
+
+// NewDigestMailer returns nil when no SMTP server is configured
+func NewDigestMailer() *DigestMailer {
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		return nil
+	}
+	m := &DigestMailer{
+		addr:     addr,
+		from:     os.Getenv("SMTP_FROM"),
+		after:    envDuration("DIGEST_AFTER", time.Hour),
+		missed:   make(map[string][]missedMention),
+		lastSeen: make(map[string]time.Time),
+		send:     smtp.SendMail,
+	}
+	if user := os.Getenv("SMTP_USER"); user != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		m.auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return m
+}
+
+// Seen notes that a user has just been online
+func (m *DigestMailer) Seen(user string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.lastSeen[user] = time.Now()
+	m.mu.Unlock()
+}
+
+// Missed saves a mention of an offline user for their next digest
+func (m *DigestMailer) Missed(user string, mention missedMention) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.lastSeen[user]; !ok {
+		m.lastSeen[user] = mention.Time
+	}
+	if len(m.missed[user]) < maxDigestMentions {
+		m.missed[user] = append(m.missed[user], mention)
+	}
+}
+
+// RunDigests sends digests every DIGEST_INTERVAL
+func (cs *ChatServer) RunDigests() {
+	interval := envDuration("DIGEST_INTERVAL", time.Minute)
+	for {
+		time.Sleep(interval)
+		cs.SendDigests(time.Now())
+	}
+}
+
+// SendDigests emails the mentions they missed to users who have been offline
+// for long enough. Mentions of users who came back online are dropped.
+func (cs *ChatServer) SendDigests(now time.Time) {
+	m := cs.Digest
+	due := make(map[string][]missedMention)
+	m.mu.Lock()
+	for user, mentions := range m.missed {
+		switch {
+		case cs.online(user):
+			delete(m.missed, user)
+		case now.Sub(m.lastSeen[user]) >= m.after:
+			due[user] = mentions
+			delete(m.missed, user)
+		}
+	}
+	m.mu.Unlock()
+
+	for user, mentions := range due {
+		cs.Mutex.Lock()
+		to := cs.DigestEmails[user]
+		cs.Mutex.Unlock()
+		if to == "" {
+			continue
+		}
+		if err := m.send(m.addr, m.auth, m.from, []string{to}, m.compose(user, to, mentions, now)); err != nil {
+			log.Printf("Error emailing digest to %s: %v", user, err)
+		}
+	}
+}
+
+// compose writes the digest email for a user
+func (m *DigestMailer) compose(user, to string, mentions []missedMention, now time.Time) []byte {
+	var b strings.Builder
+	subject := "You were mentioned while you were away"
+	if len(mentions) > 1 {
+		subject = fmt.Sprintf("You were mentioned %d times while you were away", len(mentions))
+	}
+	fmt.Fprintf(&b, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n", m.from, to, subject, now.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&b, "Hi %s,\r\n\r\n", user)
+	for _, mention := range mentions {
+		fmt.Fprintf(&b, "[%s] %s in %s: %s\r\n", mention.Time.Local().Format("Jan 2 15:04"), mention.From, mention.Room, mention.Body)
+	}
+	b.WriteString("\r\nTurn these emails off with /digest off.\r\n")
+	return []byte(b.String())
+}
+
+// composeConfirmation writes the email asking a user to confirm an address
+func (m *DigestMailer) composeConfirmation(user, to, code string, now time.Time) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\nTo: %s\r\nSubject: Confirm your email digests\r\nDate: %s\r\n", m.from, to, now.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&b, "Hi %s,\r\n\r\n", user)
+	fmt.Fprintf(&b, "To have the mentions you miss emailed to this address, enter /digest confirm %s in the chat.\r\n", code)
+	b.WriteString("\r\nIf you did not ask for this, ignore this email.\r\n")
+	return []byte(b.String())
+}
+
+// RequestDigestEmail mails a confirmation code to the address a logged in
+// client wants its digests sent to. Digests only go there once the code is
+// confirmed, so nobody can have them sent to someone else's address.
+func (cs *ChatServer) RequestDigestEmail(client *Client, address string) (string, error) {
+	if !client.Authenticated {
+		return "", errors.New("log in to receive email digests")
+	}
+	parsed, err := mail.ParseAddress(address)
+	if err != nil {
+		return "", errors.New("invalid email address")
+	}
+	now := time.Now()
+	cs.Mutex.Lock()
+	pending := cs.digestCodes[client.Name]
+	cs.Mutex.Unlock()
+	if pending != nil && now.Sub(pending.sent) < digestConfirmInterval {
+		return "", errors.New("a confirmation code was just sent, please wait a minute before asking for another")
+	}
+	code, err := newID(4)
+	if err != nil {
+		return "", err
+	}
+	m := cs.Digest
+	if err := m.send(m.addr, m.auth, m.from, []string{parsed.Address}, m.composeConfirmation(client.Name, parsed.Address, code, now)); err != nil {
+		log.Printf("Error emailing digest confirmation to %s: %v", client.Name, err)
+		return "", errors.New("could not send the confirmation email")
+	}
+	cs.Mutex.Lock()
+	cs.digestCodes[client.Name] = &digestConfirmation{address: parsed.Address, code: code, sent: now}
+	cs.Mutex.Unlock()
+	return parsed.Address, nil
+}
+
+// ConfirmDigestEmail starts sending a client's digests to the address it
+// asked for once it enters the code mailed there, and returns the address
+func (cs *ChatServer) ConfirmDigestEmail(client *Client, code string) (string, error) {
+	cs.Mutex.Lock()
+	pending := cs.digestCodes[client.Name]
+	if pending == nil || time.Since(pending.sent) > digestConfirmTTL {
+		delete(cs.digestCodes, client.Name)
+		cs.Mutex.Unlock()
+		return "", errors.New("no email address is waiting to be confirmed")
+	}
+	if subtle.ConstantTimeCompare([]byte(strings.ToLower(code)), []byte(pending.code)) != 1 {
+		pending.attempts++
+		if pending.attempts >= maxDigestConfirmAttempts {
+			delete(cs.digestCodes, client.Name)
+		}
+		cs.Mutex.Unlock()
+		return "", errors.New("wrong confirmation code")
+	}
+	delete(cs.digestCodes, client.Name)
+	cs.Mutex.Unlock()
+	cs.Record(Event{Type: EventDigestEmail, User: client.Name, Body: pending.address})
+	return pending.address, nil
+}
+
+// ClearDigestEmail stops sending a logged in client digests
+func (cs *ChatServer) ClearDigestEmail(client *Client) error {
+	if !client.Authenticated {
+		return errors.New("log in to receive email digests")
+	}
+	cs.Mutex.Lock()
+	delete(cs.digestCodes, client.Name)
+	cs.Mutex.Unlock()
+	cs.Record(Event{Type: EventDigestEmail, User: client.Name})
+	return nil
+}
+
+// digestCommand shows or changes where the client's digests are sent
+func (cs *ChatServer) digestCommand(client *Client, fields []string) {
+	if cs.Digest == nil {
+		client.Notice("Email digests are not enabled on this server")
+		return
+	}
+	switch {
+	case len(fields) == 1:
+		cs.Mutex.Lock()
+		address := cs.DigestEmails[client.Name]
+		cs.Mutex.Unlock()
+		if address == "" || !client.Authenticated {
+			client.Notice("Email digests are off. Turn them on with /digest email <address>")
+			return
+		}
+		client.Noticef("Mentions you miss while offline for %s are emailed to %s", cs.Digest.after, address)
+	case len(fields) == 3 && fields[1] == "email":
+		address, err := cs.RequestDigestEmail(client, fields[2])
+		if err != nil {
+			client.Notice(err.Error())
+			return
+		}
+		client.Noticef("A confirmation code was emailed to %s. Enter it with /digest confirm <code>", address)
+	case len(fields) == 3 && fields[1] == "confirm":
+		address, err := cs.ConfirmDigestEmail(client, fields[2])
+		if err != nil {
+			client.Notice(err.Error())
+			return
+		}
+		client.Noticef("Email digests will be sent to %s", address)
+	case len(fields) == 2 && fields[1] == "off":
+		if err := cs.ClearDigestEmail(client); err != nil {
+			client.Notice(err.Error())
+			return
+		}
+		client.Notice("Email digests turned off")
+	default:
+		client.Fail(CodeUsage, "Usage: /digest [email <address>|confirm <code>|off]")
+	}
+}
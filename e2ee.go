@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+)
+
+// Largest public key a client can publish, in bytes once decoded
+const maxPublicKeySize = 1024
+
+// Default largest encrypted payload relayed, in base64 characters
+const defaultMaxCiphertext = 64 * 1024
+
+// decodeOpaque checks that a client supplied value is non-empty base64 no larger than max
+func decodeOpaque(value string, max int) error {
+	if value == "" {
+		return errors.New("missing value")
+	}
+	if len(value) > max {
+		return errors.New("too large")
+	}
+	if _, err := base64.StdEncoding.DecodeString(value); err != nil {
+		return errors.New("must be base64")
+	}
+	return nil
+}
+
+// PublishKey stores a client's public key and announces it to the room so
+// members can encrypt room keys for it
+func (cs *ChatServer) PublishKey(client *Client, req *Request, sender ClientID) {
+	if err := decodeOpaque(req.Key, base64.StdEncoding.EncodedLen(maxPublicKeySize)); err != nil {
+		client.Noticef("Invalid key: %s", err.Error())
+		return
+	}
+	cs.Mutex.Lock()
+	cs.PublicKeys[client.Name] = req.Key
+	cs.Mutex.Unlock()
+	cs.Broadcast(client.Room, &Message{Type: MessageKey, Room: client.Room, From: client.Name, Key: req.Key}, sender)
+}
+
+// SendKeys replies with the public keys of the members of the client's room
+func (cs *ChatServer) SendKeys(client *Client) {
+	keys := make(map[string]string)
+	cs.Mutex.Lock()
+	for _, c := range cs.Clients.All() {
+		if c.Room == client.Room {
+			if key, ok := cs.PublicKeys[c.Name]; ok {
+				keys[c.Name] = key
+			}
+		}
+	}
+	cs.Mutex.Unlock()
+	client.Send(&Message{Type: MessageKeys, Room: client.Room, Keys: keys})
+}
+
+// RelayEncrypted broadcasts an encrypted payload to the room without
+// inspecting it. Encrypted messages skip filters and enrichers and are not
+// kept in the room history.
+func (cs *ChatServer) RelayEncrypted(client *Client, req *Request, sender ClientID) {
+	if err := decodeOpaque(req.Ciphertext, envInt("E2EE_MAX_SIZE", defaultMaxCiphertext)); err != nil {
+		client.Noticef("Invalid ciphertext: %s", err.Error())
+		return
+	}
+	if refused := cs.CheckSpam(client, req.Ciphertext); refused != nil {
+		client.Send(refused)
+		return
+	}
+	if !cs.admitMessage(client, client.Room) {
+		return
+	}
+	msg := &Message{Type: MessageEncrypted, Room: client.Room, From: client.Name, Ciphertext: req.Ciphertext}
+	if cs.archive(msg) != nil {
+		client.Notice("Could not send message")
+		return
+	}
+	cs.Broadcast(client.Room, msg, sender)
+}
+
+// SendRoomKey delivers a room key, encrypted by the sender for one member, to that member
+func (cs *ChatServer) SendRoomKey(client *Client, req *Request) {
+	if req.To == "" {
+		client.Notice("Invalid room key: missing recipient")
+		return
+	}
+	if err := decodeOpaque(req.Ciphertext, base64.StdEncoding.EncodedLen(maxPublicKeySize)); err != nil {
+		client.Noticef("Invalid room key: %s", err.Error())
+		return
+	}
+	cs.Mutex.Lock()
+	var recipients []*Client
+	for _, c := range cs.Clients.All() {
+		if c.Room == client.Room && c.Name == req.To {
+			recipients = append(recipients, c)
+		}
+	}
+	cs.Mutex.Unlock()
+	if len(recipients) == 0 {
+		client.Noticef("%s is not in %s", req.To, client.Room)
+		return
+	}
+	msg := &Message{Type: MessageRoomKey, Room: client.Room, From: client.Name, To: req.To, Ciphertext: req.Ciphertext}
+	for _, c := range recipients {
+		if !c.blocksMessage(msg) {
+			c.Send(msg)
+		}
+	}
+}
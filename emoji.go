@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Default largest custom emoji image, in bytes
+const defaultEmojiMaxSize = 64 * 1024
+
+// Codes of reaction errors
+const (
+	CodeUnknownEmoji  = "emoji.unknown"
+	CodeNoSuchMessage = "message.not_found"
+)
+
+// emojiName restricts custom emoji names to what can be typed between colons
+var emojiName = regexp.MustCompile(`^[a-z0-9_+-]{2,32}$`)
+
+// emojiTypes are the image types custom emoji may have
+var emojiTypes = map[string]bool{"image/png": true, "image/gif": true, "image/webp": true}
+
+// CustomEmoji is an image admins upload to the server. Clients use it in
+// reactions as :name: and fetch the image from URL.
+type CustomEmoji struct {
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Size    int       `json:"size"`
+	URL     string    `json:"url"`
+	Added   time.Time `json:"added"`
+	AddedBy string    `json:"added_by"`
+
+	image []byte
+}
+
+// emojiRecord is a custom emoji as kept in the event log, image included
+type emojiRecord struct {
+	CustomEmoji
+	Image []byte `json:"image"`
+}
+
+// Reaction is a reaction to a message, with a standard emoji or :name: of a
+// custom one
+type Reaction struct {
+	Message string `json:"message"`
+	Emoji   string `json:"emoji"`
+}
+
+// emojiText renders the custom emoji list for plain text clients
+func emojiText(list []*CustomEmoji) string {
+	if len(list) == 0 {
+		return "No custom emoji"
+	}
+	names := make([]string, len(list))
+	for i, e := range list {
+		names[i] = ":" + e.Name + ":"
+	}
+	return "Custom emoji: " + strings.Join(names, " ")
+}
+
+// applyEmojiEvent adds or removes a custom emoji for an event log entry.
+// Caller must hold cs.Mutex.
+func (cs *ChatServer) applyEmojiEvent(ev Event) {
+	if ev.Type == EventEmojiRemove {
+		delete(cs.Emoji, ev.Target)
+		return
+	}
+	var rec emojiRecord
+	if err := json.Unmarshal(ev.Data, &rec); err != nil {
+		log.Println("Invalid emoji in event log:", err)
+		return
+	}
+	e := rec.CustomEmoji
+	e.image = rec.Image
+	cs.Emoji[e.Name] = &e
+}
+
+// EmojiList returns the custom emoji of the server, in name order
+func (cs *ChatServer) EmojiList() []*CustomEmoji {
+	cs.Mutex.Lock()
+	list := make([]*CustomEmoji, 0, len(cs.Emoji))
+	for _, e := range cs.Emoji {
+		list = append(list, e)
+	}
+	cs.Mutex.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// SendEmoji sends a client the custom emoji of the server
+func (cs *ChatServer) SendEmoji(client *Client) {
+	list := cs.EmojiList()
+	client.Send(&Message{Type: MessageEmojiList, Body: emojiText(list), Emoji: list})
+}
+
+// isEmoji reports whether text is a standard emoji: symbols, optionally
+// joined and modified as emoji sequences are
+func isEmoji(text string) bool {
+	if text == "" || len(text) > 32 {
+		return false
+	}
+	symbol := false
+	for _, r := range text {
+		switch {
+		case unicode.Is(unicode.So, r):
+			symbol = true
+		case r == 0x200d, r == 0xfe0f, r == 0xfe0e, r == 0x20e3,
+			r >= 0x1f3fb && r <= 0x1f3ff, r >= 0xe0020 && r <= 0xe007f:
+			// Joiners, variation selectors, keycaps, skin tones and flag tags
+		default:
+			return false
+		}
+	}
+	return symbol
+}
+
+// validReaction reports whether a reaction uses a standard emoji or the
+// :name: of a custom one
+func (cs *ChatServer) validReaction(emoji string) bool {
+	if name, ok := strings.CutPrefix(emoji, ":"); ok && strings.HasSuffix(name, ":") {
+		cs.Mutex.Lock()
+		_, known := cs.Emoji[strings.TrimSuffix(name, ":")]
+		cs.Mutex.Unlock()
+		return known
+	}
+	return isEmoji(emoji)
+}
+
+// React adds a reaction from a client to a message of its room
+func (cs *ChatServer) React(client *Client, id, emoji string) {
+	if client.Room == "" {
+		client.Fail(CodeNotInRoom, "You are not in a room")
+		return
+	}
+	if !cs.validReaction(emoji) {
+		client.Fail(CodeUnknownEmoji, "Cannot react with %s: use an emoji or a custom emoji from /emoji", emoji)
+		return
+	}
+	msg := cs.findRoomMessage(client.Room, id)
+	if msg == nil {
+		client.Fail(CodeNoSuchMessage, "No message %s in %s", id, client.Room)
+		return
+	}
+	reaction := &Reaction{Message: msg.ID, Emoji: emoji}
+	cs.Broadcast(client.Room, (&Message{Type: MessageReaction, Room: client.Room, From: client.Name, Reaction: reaction}).setText("%s reacted %s to a message from %s", client.Name, emoji, msg.From), 0)
+}
+
+// reactCommand reacts to a message by ID, or the latest one
+func (cs *ChatServer) reactCommand(client *Client, fields []string) {
+	if len(fields) != 3 {
+		client.Fail(CodeUsage, "Usage: /react <id>|last <emoji>")
+		return
+	}
+	cs.React(client, fields[1], fields[2])
+}
+
+// HandleAddEmoji uploads a custom emoji. The request body is the PNG, GIF or
+// WebP image, up to EMOJI_MAX_SIZE bytes. An emoji with the same name is
+// replaced.
+func (cs *ChatServer) HandleAddEmoji(w http.ResponseWriter, r *http.Request) {
+	token := cs.AdminTokens.Authenticate(r)
+	if token == nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, "missing or invalid token")
+		return
+	}
+	name := r.PathValue("name")
+	if !emojiName.MatchString(name) {
+		writeError(w, http.StatusBadRequest, "emoji names are 2 to 32 lowercase letters, digits, '_', '+' or '-'")
+		return
+	}
+	limit := envInt("EMOJI_MAX_SIZE", defaultEmojiMaxSize)
+	image, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(limit)))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("emoji images can be at most %d bytes", limit))
+		return
+	}
+	// The type is sniffed rather than trusted, since the image is served back
+	contentType := http.DetectContentType(image)
+	if len(image) == 0 || !emojiTypes[contentType] {
+		writeError(w, http.StatusUnsupportedMediaType, "emoji must be PNG, GIF or WebP images")
+		return
+	}
+
+	rec := emojiRecord{
+		CustomEmoji: CustomEmoji{
+			Name:    name,
+			Type:    contentType,
+			Size:    len(image),
+			URL:     "/emoji/" + name,
+			Added:   time.Now().UTC(),
+			AddedBy: "token:" + token.Name,
+		},
+		Image: image,
+	}
+	data, err := json.Marshal(&rec)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	cs.Record(Event{Type: EventEmojiAdd, Target: name, Data: data})
+	cs.auditAdmin(token, "emoji.add", name)
+	writeJSON(w, http.StatusOK, &rec.CustomEmoji)
+}
+
+// HandleDeleteEmoji removes a custom emoji
+func (cs *ChatServer) HandleDeleteEmoji(w http.ResponseWriter, r *http.Request) {
+	token := cs.AdminTokens.Authenticate(r)
+	if token == nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, "missing or invalid token")
+		return
+	}
+	name := r.PathValue("name")
+	cs.Mutex.Lock()
+	_, ok := cs.Emoji[name]
+	cs.Mutex.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "no such emoji")
+		return
+	}
+	cs.Record(Event{Type: EventEmojiRemove, Target: name})
+	cs.auditAdmin(token, "emoji.remove", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleGetEmoji serves the image of a custom emoji
+func (cs *ChatServer) HandleGetEmoji(w http.ResponseWriter, r *http.Request) {
+	cs.Mutex.Lock()
+	e, ok := cs.Emoji[r.PathValue("name")]
+	cs.Mutex.Unlock()
+	if !ok {
+		http.Error(w, "no such emoji", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	writeConditional(w, r, e.Type, e.image, e.Added)
+}
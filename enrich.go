@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Enricher expands shortcodes in a chat message into rich content before it
+// is broadcast. Returning an error drops the message. The client is nil for
+// messages posted through the HTTP API.
+type Enricher interface {
+	Name() string
+	Enrich(client *Client, msg *Message) error
+}
+
+// Shortcodes expanded by the emoji enricher
+var emojiShortcodes = map[string]string{
+	":shrug:":      `¯\_(ツ)_/¯`,
+	":tableflip:":  "(╯°□°)╯︵ ┻━┻",
+	":smile:":      "😄",
+	":laughing:":   "😆",
+	":wink:":       "😉",
+	":heart:":      "❤️",
+	":thumbsup:":   "👍",
+	":+1:":         "👍",
+	":thumbsdown:": "👎",
+	":fire:":       "🔥",
+	":tada:":       "🎉",
+	":eyes:":       "👀",
+	":rocket:":     "🚀",
+	":thinking:":   "🤔",
+	":cry:":        "😢",
+	":wave:":       "👋",
+}
+
+var shortcodePattern = regexp.MustCompile(`:[a-z0-9_+\-]+:`)
+
+// EmojiEnricher replaces emoji shortcodes with the emoji itself
+type EmojiEnricher struct{}
+
+func (e *EmojiEnricher) Name() string {
+	return "emoji"
+}
+
+func (e *EmojiEnricher) Enrich(client *Client, msg *Message) error {
+	msg.Body = shortcodePattern.ReplaceAllStringFunc(msg.Body, func(code string) string {
+		if emoji, ok := emojiShortcodes[code]; ok {
+			return emoji
+		}
+		return code
+	})
+	return nil
+}
+
+// GiphyEnricher turns "/giphy <term>" into a GIF attachment found through the Giphy search API
+type GiphyEnricher struct {
+	apiKey  string
+	apiURL  string
+	limiter *RateLimiter
+	client  *http.Client
+}
+
+// NewGiphyEnricher creates an enricher allowing up to perMinute API calls per minute
+func NewGiphyEnricher(apiKey string, perMinute int) *GiphyEnricher {
+	apiURL := os.Getenv("GIPHY_API_URL")
+	if apiURL == "" {
+		apiURL = "https://api.giphy.com/v1/gifs/search"
+	}
+	return &GiphyEnricher{
+		apiKey:  apiKey,
+		apiURL:  apiURL,
+		limiter: NewRateLimiter(float64(perMinute)/60, perMinute),
+		client:  &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (g *GiphyEnricher) Name() string {
+	return "giphy"
+}
+
+func (g *GiphyEnricher) Enrich(client *Client, msg *Message) error {
+	if !strings.HasPrefix(msg.Body, "/giphy ") {
+		return nil
+	}
+	term := strings.TrimSpace(strings.TrimPrefix(msg.Body, "/giphy "))
+	if term == "" {
+		return errors.New("usage: /giphy <search term>")
+	}
+	if !g.limiter.Allow() {
+		return errors.New("GIF search is busy, try again in a moment")
+	}
+
+	query := url.Values{"api_key": {g.apiKey}, "q": {term}, "limit": {"1"}, "rating": {"g"}}
+	resp, err := g.client.Get(g.apiURL + "?" + query.Encode())
+	if err != nil {
+		log.Println("Giphy request error:", err)
+		return errors.New("GIF search failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Println("Giphy request failed with status code:", resp.StatusCode)
+		return errors.New("GIF search failed")
+	}
+
+	var result struct {
+		Data []struct {
+			Title  string `json:"title"`
+			Images struct {
+				Original struct {
+					URL string `json:"url"`
+				} `json:"original"`
+			} `json:"images"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		log.Println("Error decoding Giphy response:", err)
+		return errors.New("GIF search failed")
+	}
+	if len(result.Data) == 0 {
+		return fmt.Errorf("no GIFs found for %q", term)
+	}
+
+	gif := result.Data[0]
+	msg.Body = term
+	msg.Attachments = append(msg.Attachments, Attachment{Type: "gif", URL: gif.Images.Original.URL, Title: gif.Title})
+	return nil
+}
+
+// defaultEnrichers builds the enrichers shipped with the server. Giphy is
+// only available when GIPHY_API_KEY is set, and runs first so its search
+// term is not rewritten by other enrichers. Link previews are fetched before
+// emoji are expanded.
+func defaultEnrichers() []Enricher {
+	var enrichers []Enricher
+	if key := os.Getenv("GIPHY_API_KEY"); key != "" {
+		enrichers = append(enrichers, NewGiphyEnricher(key, envPositiveInt("GIPHY_RATE_LIMIT", 30)))
+	}
+	enrichers = append(enrichers, NewPreviewEnricher(envDuration("UNFURL_TIMEOUT", 3*time.Second), envDuration("UNFURL_CACHE_TTL", time.Hour)))
+	return append(enrichers, &EmojiEnricher{})
+}
+
+// RegisterEnricher makes an enricher available for rooms to enable
+func (cs *ChatServer) RegisterEnricher(enricher Enricher) {
+	cs.Mutex.Lock()
+	defer cs.Mutex.Unlock()
+	cs.Enrichers = append(cs.Enrichers, enricher)
+}
+
+// findEnricher returns the registered enricher with the given name. Caller must hold cs.Mutex.
+func (cs *ChatServer) findEnricher(name string) Enricher {
+	for _, enricher := range cs.Enrichers {
+		if enricher.Name() == name {
+			return enricher
+		}
+	}
+	return nil
+}
+
+// roomEnricherDefaults reads the enrichers enabled in new rooms from ROOM_ENRICHERS
+func roomEnricherDefaults() map[string]bool {
+	enabled := make(map[string]bool)
+	for _, name := range envList("ROOM_ENRICHERS") {
+		enabled[name] = true
+	}
+	return enabled
+}
+
+// ApplyEnrichers runs the enrichers enabled in the message's room, in registration order
+func (cs *ChatServer) ApplyEnrichers(client *Client, msg *Message) error {
+	cs.Mutex.Lock()
+	var enrichers []Enricher
+	enabled := cs.getRoom(msg.Room).Enrichers
+	for _, enricher := range cs.Enrichers {
+		if enabled[enricher.Name()] {
+			enrichers = append(enrichers, enricher)
+		}
+	}
+	cs.Mutex.Unlock()
+
+	for _, enricher := range enrichers {
+		if err := enricher.Enrich(client, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetRoomEnricher enables or disables an enricher in a room
+func (cs *ChatServer) SetRoomEnricher(client *Client, room, name string, enable bool) error {
+	cs.Mutex.Lock()
+	found := cs.findEnricher(name) != nil
+	cs.Mutex.Unlock()
+	if !found {
+		return errors.New("unknown enricher: " + name)
+	}
+
+	ev := Event{Type: EventEnricherDisable, Room: room, User: client.Name, Body: name}
+	if enable {
+		ev.Type = EventEnricherEnable
+	}
+	cs.Record(ev)
+	action := "enricher.off"
+	if enable {
+		action = "enricher.on"
+	}
+	cs.Audit(client, action, room, name, "")
+	return nil
+}
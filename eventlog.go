@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Event types recorded in the event log
+const (
+	EventJoin    = "join"
+	EventLeave   = "leave"
+	EventMessage = "message"
+
+	EventFilterEnable  = "filter.enable"
+	EventFilterDisable = "filter.disable"
+	EventFilterShadow  = "filter.shadow"
+
+	EventEnricherEnable  = "enricher.enable"
+	EventEnricherDisable = "enricher.disable"
+
+	EventRoomEventCreate = "event.create"
+	EventRoomEventRSVP   = "event.rsvp"
+	EventRoomEventRemind = "event.remind"
+	EventRoomEventCancel = "event.cancel"
+
+	EventRoomPin   = "room.pin"
+	EventRoomUnpin = "room.unpin"
+
+	EventPollCreate = "poll.create"
+	EventPollVote   = "poll.vote"
+	EventPollClose  = "poll.close"
+
+	EventWebhookAdd    = "webhook.add"
+	EventWebhookRemove = "webhook.remove"
+
+	EventInviteCreate = "invite.create"
+	EventInviteUse    = "invite.use"
+	EventInviteRevoke = "invite.revoke"
+	EventRoleGrant    = "role.grant"
+
+	EventRoomPolicy     = "room.policy"
+	EventRoomVisibility = "room.visibility"
+	EventRoomInvite     = "room.invite"
+	EventRoomUninvite   = "room.uninvite"
+
+	EventRoomTopic       = "room.topic"
+	EventRoomTopicLock   = "room.topic_lock"
+	EventRoomDescription = "room.description"
+	EventRoomPersist     = "room.persist"
+	EventRoomExpire      = "room.expire"
+	EventRoomRetention   = "room.retention"
+	EventRoomFormat      = "room.format"
+
+	EventBlock   = "block"
+	EventUnblock = "unblock"
+	EventProfile = "profile"
+
+	EventPushRegister   = "push.register"
+	EventPushUnregister = "push.unregister"
+	EventDigestEmail    = "digest.email"
+	EventTOTPEnable     = "totp.enable"
+	EventTOTPDisable    = "totp.disable"
+
+	EventDelayedCreate = "delayed.create"
+	EventDelayedDone   = "delayed.done"
+	EventDelayedCancel = "delayed.cancel"
+
+	EventAutomationSet    = "automation.set"
+	EventAutomationDelete = "automation.delete"
+
+	EventEmojiAdd    = "emoji.add"
+	EventEmojiRemove = "emoji.remove"
+)
+
+// Event is a single state change on the server. Target names the object the
+// change applies to, such as a room event ID, and Data carries structured
+// details when Body is not enough.
+type Event struct {
+	Type   string          `json:"type"`
+	Time   time.Time       `json:"time"`
+	Room   string          `json:"room,omitempty"`
+	User   string          `json:"user,omitempty"`
+	Target string          `json:"target,omitempty"`
+	Body   string          `json:"body,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"`
+	Sealed string          `json:"sealed,omitempty"`
+	Seq    uint64          `json:"seq,omitempty"`
+}
+
+// EventLog is an append-only file of JSON encoded events, one per line
+type EventLog struct {
+	mu     sync.Mutex
+	path   string
+	file   *os.File
+	enc    *json.Encoder
+	cipher *historyCipher
+}
+
+// Append writes an event to the end of the log, encrypting message bodies
+// when a history key is configured
+func (l *EventLog) Append(ev Event) error {
+	if l.cipher != nil {
+		if err := l.cipher.Seal(&ev); err != nil {
+			return err
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.enc.Encode(ev)
+}
+
+// Close closes the underlying file
+func (l *EventLog) Close() error {
+	return l.file.Close()
+}
+
+// Messages calls fn for each message logged in room with a sequence number
+// from since to until, inclusive, in order. Zero until means no upper bound.
+func (l *EventLog) Messages(room string, since, until uint64, fn func(*Message)) error {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Messages logged before they were numbered are counted as on replay
+	var seq uint64
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var ev Event
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if ev.Type != EventMessage || ev.Room != room {
+			continue
+		}
+		if ev.Seq == 0 {
+			ev.Seq = seq + 1
+		}
+		seq = max(seq, ev.Seq)
+		if ev.Seq < since {
+			continue
+		}
+		if until != 0 && ev.Seq > until {
+			break
+		}
+		if err := l.cipher.Open(&ev); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		fn(&Message{Type: MessageChat, Room: ev.Room, From: ev.User, Body: ev.Body, ID: ev.Target, Time: &ev.Time, Seq: ev.Seq})
+	}
+	return scanner.Err()
+}
+
+// PruneMessages rewrites the log without the message events keep returns
+// false for, and returns how many were dropped. keep is also given the number
+// of messages logged after ev in the same room. Kept messages are numbered
+// first, so dropping earlier ones does not change their sequence numbers.
+func (l *EventLog) PruneMessages(keep func(ev Event, newer int) bool) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	events, err := ReadEvents(l.path)
+	if err != nil {
+		return 0, err
+	}
+
+	remaining := make(map[string]int)
+	for _, ev := range events {
+		if ev.Type == EventMessage {
+			remaining[ev.Room]++
+		}
+	}
+	seqs := make(map[string]uint64)
+	kept := events[:0]
+	for _, ev := range events {
+		if ev.Type == EventMessage {
+			remaining[ev.Room]--
+			if ev.Seq == 0 {
+				ev.Seq = seqs[ev.Room] + 1
+			}
+			seqs[ev.Room] = max(seqs[ev.Room], ev.Seq)
+			if !keep(ev, remaining[ev.Room]) {
+				continue
+			}
+		}
+		kept = append(kept, ev)
+	}
+	removed := len(events) - len(kept)
+	if removed == 0 {
+		return 0, nil
+	}
+
+	if err := writeEvents(l.path, kept); err != nil {
+		return 0, err
+	}
+	file, err := os.OpenFile(l.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return removed, err
+	}
+	l.file.Close()
+	l.file, l.enc = file, json.NewEncoder(file)
+	return removed, nil
+}
+
+// Rewrite rewrites the log with edit applied to each event, dropping the
+// events it returns false for, and returns how many events were changed or
+// dropped. Sealed bodies are decrypted for edit and sealed again if the event
+// changed.
+func (l *EventLog) Rewrite(edit func(ev *Event) bool) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	events, err := ReadEvents(l.path)
+	if err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	kept := events[:0]
+	for i, ev := range events {
+		opened := ev
+		if err := l.cipher.Open(&opened); err != nil {
+			return 0, fmt.Errorf("event %d: %w", i+1, err)
+		}
+		before := opened
+		if !edit(&opened) {
+			changed++
+			continue
+		}
+		if opened.Type != before.Type || opened.Room != before.Room || opened.User != before.User ||
+			opened.Target != before.Target || opened.Body != before.Body || !bytes.Equal(opened.Data, before.Data) {
+			if l.cipher != nil {
+				if err := l.cipher.Seal(&opened); err != nil {
+					return 0, err
+				}
+			}
+			ev = opened
+			changed++
+		}
+		kept = append(kept, ev)
+	}
+	if changed == 0 {
+		return 0, nil
+	}
+
+	if err := writeEvents(l.path, kept); err != nil {
+		return 0, err
+	}
+	file, err := os.OpenFile(l.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return changed, err
+	}
+	l.file.Close()
+	l.file, l.enc = file, json.NewEncoder(file)
+	return changed, nil
+}
+
+// ReadEvents reads every event in the log at path. A missing file is an empty log.
+func ReadEvents(path string) ([]Event, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var events []Event
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var ev Event
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		events = append(events, ev)
+	}
+	return events, scanner.Err()
+}
+
+// writeEvents replaces the log at path with the given events
+func writeEvents(path string, events []Event) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(file)
+	for _, ev := range events {
+		if err := enc.Encode(ev); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// OpenEventLog replays the log at path to rebuild server state and then
+// appends all further events to it. If until is non-zero, only events up to
+// that time are replayed and the rest are moved to a backup file, recovering
+// the server to that point in time.
+func (cs *ChatServer) OpenEventLog(path string, until time.Time) error {
+	hc, err := loadHistoryCipher()
+	if err != nil {
+		return err
+	}
+	events, err := ReadEvents(path)
+	if err != nil {
+		return err
+	}
+
+	if !until.IsZero() {
+		kept := events
+		for i, ev := range events {
+			if ev.Time.After(until) {
+				kept = events[:i]
+				break
+			}
+		}
+		if len(kept) < len(events) {
+			backup := fmt.Sprintf("%s.%d.bak", path, time.Now().Unix())
+			if err := os.Rename(path, backup); err != nil {
+				return err
+			}
+			if err := writeEvents(path, kept); err != nil {
+				return err
+			}
+			events = kept
+		}
+	}
+
+	// Bodies are decrypted for replay only, so a rewritten log stays sealed
+	for i, ev := range events {
+		if err := hc.Open(&ev); err != nil {
+			return fmt.Errorf("event %d: %w", i+1, err)
+		}
+		events[i] = ev
+	}
+	cs.Mutex.Lock()
+	for _, ev := range events {
+		cs.applyEvent(ev)
+	}
+	cs.Mutex.Unlock()
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	cs.EventLog = &EventLog{path: path, file: file, enc: json.NewEncoder(file), cipher: hc}
+	return nil
+}
+
+// Record applies an event to the in-memory state and appends it to the event
+// log. Events without a time are stamped with the current time.
+func (cs *ChatServer) Record(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+
+	cs.Mutex.Lock()
+	cs.applyEvent(ev)
+	cs.Mutex.Unlock()
+	cs.appendEvent(ev)
+}
+
+// appendEvent appends an event that has already been applied to the event
+// log, for changes that must be applied in the same critical section as the
+// checks that allow them
+func (cs *ChatServer) appendEvent(ev Event) {
+	if cs.EventLog != nil {
+		if err := cs.EventLog.Append(ev); err != nil {
+			log.Println("Event log error:", err)
+		}
+	}
+}
+
+// applyEvent updates the in-memory state for an event. Caller must hold cs.Mutex.
+func (cs *ChatServer) applyEvent(ev Event) {
+	switch ev.Type {
+	case EventJoin:
+		cs.getRoom(ev.Room)
+	case EventMessage:
+		room := cs.getRoom(ev.Room)
+		// Logs written before messages were numbered continue the count
+		if ev.Seq == 0 {
+			ev.Seq = room.Seq + 1
+		}
+		if !room.Retention.None {
+			msg := &Message{Type: MessageChat, Room: ev.Room, From: ev.User, Body: ev.Body, ID: ev.Target, Time: &ev.Time, Seq: ev.Seq}
+			renderFormat(msg, room.formatName())
+			room.Replay.Add(msg)
+		}
+		room.Updated = ev.Time
+		room.Seq = max(room.Seq, ev.Seq)
+	case EventFilterEnable:
+		cs.getRoom(ev.Room).Filters[ev.Body] = true
+		delete(cs.getRoom(ev.Room).ShadowFilters, ev.Body)
+	case EventFilterDisable:
+		delete(cs.getRoom(ev.Room).Filters, ev.Body)
+		delete(cs.getRoom(ev.Room).ShadowFilters, ev.Body)
+	case EventFilterShadow:
+		delete(cs.getRoom(ev.Room).Filters, ev.Body)
+		cs.getRoom(ev.Room).ShadowFilters[ev.Body] = true
+	case EventEnricherEnable:
+		cs.getRoom(ev.Room).Enrichers[ev.Body] = true
+	case EventEnricherDisable:
+		delete(cs.getRoom(ev.Room).Enrichers, ev.Body)
+	case EventRoomEventCreate, EventRoomEventRSVP, EventRoomEventRemind, EventRoomEventCancel:
+		cs.applyRoomEvent(ev)
+	case EventWebhookAdd, EventWebhookRemove:
+		cs.applyWebhookEvent(ev)
+	case EventInviteCreate, EventInviteUse, EventInviteRevoke, EventRoleGrant:
+		cs.applyInviteEvent(ev)
+	case EventRoomPolicy, EventRoomVisibility, EventRoomInvite, EventRoomUninvite:
+		cs.applyAccessEvent(ev)
+	case EventRoomTopic, EventRoomTopicLock, EventRoomDescription:
+		cs.applyRoomInfoEvent(ev)
+	case EventRoomPersist:
+		cs.getRoom(ev.Room).Persistent = ev.Body == "on"
+	case EventRoomExpire:
+		cs.deleteRoom(ev.Room)
+	case EventRoomRetention:
+		cs.applyRetentionEvent(ev)
+	case EventRoomFormat:
+		cs.getRoom(ev.Room).Format = ev.Body
+	case EventBlock, EventUnblock:
+		cs.applyBlockEvent(ev)
+	case EventProfile:
+		cs.applyProfileEvent(ev)
+	case EventPushRegister, EventPushUnregister:
+		cs.applyPushEvent(ev)
+	case EventTOTPEnable, EventTOTPDisable:
+		cs.applyTOTPEvent(ev)
+	case EventRoomPin, EventRoomUnpin:
+		cs.applyPinEvent(ev)
+	case EventPollCreate, EventPollVote, EventPollClose:
+		cs.applyPollEvent(ev)
+	case EventDelayedCreate, EventDelayedDone, EventDelayedCancel:
+		cs.applyDelayedEvent(ev)
+	case EventAutomationSet, EventAutomationDelete:
+		cs.applyAutomationEvent(ev)
+	case EventEmojiAdd, EventEmojiRemove:
+		cs.applyEmojiEvent(ev)
+	case EventDigestEmail:
+		if ev.Body == "" {
+			delete(cs.DigestEmails, ev.User)
+		} else {
+			cs.DigestEmails[ev.User] = ev.Body
+		}
+	}
+}
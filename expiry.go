@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// RunRoomExpiry deletes rooms that have been empty for ROOM_EXPIRY, so rooms
+// people try once do not pile up. The default room and rooms marked
+// persistent are kept, as are rooms with upcoming events. A zero
+// ROOM_EXPIRY keeps every room.
+func (cs *ChatServer) RunRoomExpiry() {
+	expiry := envDuration("ROOM_EXPIRY", 24*time.Hour)
+	if expiry <= 0 {
+		return
+	}
+	interval := min(expiry/4, time.Minute)
+	for {
+		time.Sleep(interval)
+		for _, name := range cs.expiredRooms(time.Now(), expiry) {
+			log.Printf("Room %s expired after being empty for %s", name, expiry)
+			cs.Record(Event{Type: EventRoomExpire, Room: name})
+			cs.auditServer("room.expire", name, "", "empty for "+expiry.String())
+		}
+	}
+}
+
+// expiredRooms marks when rooms became empty and returns those that have
+// been empty for longer than expiry
+func (cs *ChatServer) expiredRooms(now time.Time, expiry time.Duration) []string {
+	cs.Mutex.Lock()
+	defer cs.Mutex.Unlock()
+	var expired []string
+	for name, room := range cs.Rooms {
+		if name == defaultRoom || room.Persistent || len(cs.Clients.InRoom(name)) > 0 || room.hasUpcomingEvents(now) {
+			room.Emptied = time.Time{}
+			continue
+		}
+		if room.Emptied.IsZero() {
+			room.Emptied = now
+			continue
+		}
+		if now.Sub(room.Emptied) >= expiry {
+			expired = append(expired, name)
+		}
+	}
+	return expired
+}
+
+// hasUpcomingEvents reports whether any scheduled event in the room has yet to start
+func (r *Room) hasUpcomingEvents(now time.Time) bool {
+	for _, event := range r.Events {
+		if event.Start.After(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// deleteRoom removes a room and its invites. Rooms someone has joined since
+// they expired are kept. Caller must hold cs.Mutex.
+func (cs *ChatServer) deleteRoom(name string) {
+	if len(cs.Clients.InRoom(name)) > 0 {
+		return
+	}
+	delete(cs.Rooms, name)
+	cs.Throughput.ForgetRoom(name)
+	for code, invite := range cs.Invites {
+		if invite.Room == name {
+			delete(cs.Invites, code)
+		}
+	}
+}
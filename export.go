@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// History export formats
+const (
+	ExportJSONLines = "jsonl"
+	ExportCSV       = "csv"
+)
+
+// ExportRecord is one message in a history export
+type ExportRecord struct {
+	ID   string    `json:"id"`
+	Room string    `json:"room"`
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	From string    `json:"from"`
+	Body string    `json:"body"`
+}
+
+// exportRequest is a history export a moderator asked for with /export,
+// waiting to be downloaded once
+type exportRequest struct {
+	room    string
+	format  string
+	since   time.Time
+	until   time.Time
+	expires time.Time
+}
+
+// exportContentType returns the media type of an export format
+func exportContentType(format string) (string, bool) {
+	switch format {
+	case ExportJSONLines:
+		return "application/x-ndjson", true
+	case ExportCSV:
+		return "text/csv; charset=utf-8", true
+	}
+	return "", false
+}
+
+// parseExportTime reads an RFC 3339 time or a YYYY-MM-DD date
+func parseExportTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("%s is not a date (YYYY-MM-DD) or an RFC 3339 time", s)
+}
+
+// csvCell keeps text that a spreadsheet would run as a formula from being
+// run, by prefixing it with a quote
+func csvCell(s string) string {
+	if s != "" && strings.ContainsRune("=+-@", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// ExportHistory writes the messages of a room posted in [since, until) to w,
+// streaming them from the event log. A zero since or until leaves that end
+// of the range open.
+func (cs *ChatServer) ExportHistory(w io.Writer, room, format string, since, until time.Time) error {
+	out := bufio.NewWriter(w)
+	var write func(ExportRecord) error
+	flush := func() error { return nil }
+	switch format {
+	case ExportJSONLines:
+		enc := json.NewEncoder(out)
+		write = func(rec ExportRecord) error { return enc.Encode(rec) }
+	case ExportCSV:
+		cw := csv.NewWriter(out)
+		if err := cw.Write([]string{"id", "room", "seq", "time", "from", "body"}); err != nil {
+			return err
+		}
+		write = func(rec ExportRecord) error {
+			return cw.Write([]string{rec.ID, csvCell(rec.Room), strconv.FormatUint(rec.Seq, 10), rec.Time.Format(time.RFC3339Nano), csvCell(rec.From), csvCell(rec.Body)})
+		}
+		flush = func() error {
+			cw.Flush()
+			return cw.Error()
+		}
+	default:
+		return fmt.Errorf("unknown export format: %s", format)
+	}
+
+	var err error
+	each := func(msg *Message) {
+		if err != nil || msg.Time == nil || (!since.IsZero() && msg.Time.Before(since)) || (!until.IsZero() && !msg.Time.Before(until)) {
+			return
+		}
+		err = write(ExportRecord{ID: msg.ID, Room: room, Seq: msg.Seq, Time: *msg.Time, From: msg.From, Body: msg.Body})
+	}
+	if cs.EventLog != nil {
+		if logErr := cs.EventLog.Messages(room, 1, 0, each); logErr != nil {
+			return logErr
+		}
+	} else {
+		// Without an event log only the replay buffer is left
+		cs.Mutex.Lock()
+		var recent []*Message
+		if r, ok := cs.Rooms[room]; ok {
+			recent = r.Replay.Items()
+		}
+		cs.Mutex.Unlock()
+		for _, msg := range recent {
+			each(msg)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// serveExport streams an export as a download
+func (cs *ChatServer) serveExport(w http.ResponseWriter, room, format string, since, until time.Time) {
+	contentType, _ := exportContentType(format)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fmt.Sprintf("%s-%s.%s", strings.TrimPrefix(room, "#"), time.Now().UTC().Format("20060102T150405Z"), format)))
+	if err := cs.ExportHistory(w, room, format, since, until); err != nil {
+		// The status has been sent, so the download is cut short
+		log.Printf("Error exporting %s: %v", room, err)
+	}
+}
+
+// exportQuery reads the format and time range of an export request
+func exportQuery(r *http.Request) (format string, since, until time.Time, err error) {
+	query := r.URL.Query()
+	format = query.Get("format")
+	if format == "" {
+		format = ExportJSONLines
+	}
+	if _, ok := exportContentType(format); !ok {
+		return "", since, until, errors.New("format must be jsonl or csv")
+	}
+	if v := query.Get("since"); v != "" {
+		if since, err = parseExportTime(v); err != nil {
+			return "", since, until, err
+		}
+	}
+	if v := query.Get("until"); v != "" {
+		if until, err = parseExportTime(v); err != nil {
+			return "", since, until, err
+		}
+	}
+	return format, since, until, nil
+}
+
+// HandleExportRoom streams the history of a room to an admin token, as JSON
+// Lines or CSV, optionally limited to a time range with since and until
+func (cs *ChatServer) HandleExportRoom(w http.ResponseWriter, r *http.Request) {
+	token := cs.AdminTokens.Authenticate(r)
+	if token == nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, "missing or invalid token")
+		return
+	}
+	format, since, until, err := exportQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	room := r.PathValue("room")
+	cs.Mutex.Lock()
+	_, ok := cs.Rooms[room]
+	cs.Mutex.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "room not found")
+		return
+	}
+	cs.auditAdmin(token, "room.export", room)
+	cs.serveExport(w, room, format, since, until)
+}
+
+// HandleDownloadExport serves an export requested with /export. Each link
+// works once.
+func (cs *ChatServer) HandleDownloadExport(w http.ResponseWriter, r *http.Request) {
+	cs.Mutex.Lock()
+	export, ok := cs.Exports[r.PathValue("id")]
+	delete(cs.Exports, r.PathValue("id"))
+	cs.Mutex.Unlock()
+	if !ok || time.Now().After(export.expires) {
+		writeError(w, http.StatusNotFound, "no such export")
+		return
+	}
+	cs.serveExport(w, export.room, export.format, export.since, export.until)
+}
+
+// exportURL returns the download link of an export
+func exportURL(id string) string {
+	return strings.TrimRight(os.Getenv("EXPORT_BASE_URL"), "/") + "/exports/" + id
+}
+
+// exportCommand gives a moderator a link to download the history of their room
+func (cs *ChatServer) exportCommand(client *Client, args []string) {
+	if !cs.IsModerator(client, client.Room) {
+		client.Fail(CodePermissionDenied, "Permission denied")
+		return
+	}
+	format := ExportJSONLines
+	if len(args) > 0 {
+		if _, ok := exportContentType(args[0]); ok {
+			format, args = args[0], args[1:]
+		}
+	}
+	if len(args) > 2 {
+		client.Fail(CodeUsage, "Usage: /export [jsonl|csv] [since] [until]")
+		return
+	}
+	var since, until time.Time
+	var err error
+	if len(args) > 0 {
+		if since, err = parseExportTime(args[0]); err != nil {
+			client.Notice(err.Error())
+			return
+		}
+	}
+	if len(args) > 1 {
+		if until, err = parseExportTime(args[1]); err != nil {
+			client.Notice(err.Error())
+			return
+		}
+	}
+
+	id, err := newID(24)
+	if err != nil {
+		log.Println("Error creating export:", err)
+		client.Notice("Could not create export")
+		return
+	}
+	now := time.Now()
+	ttl := envDuration("EXPORT_TTL", 10*time.Minute)
+	cs.Mutex.Lock()
+	for key, e := range cs.Exports {
+		if now.After(e.expires) {
+			delete(cs.Exports, key)
+		}
+	}
+	cs.Exports[id] = &exportRequest{room: client.Room, format: format, since: since, until: until, expires: now.Add(ttl)}
+	cs.Mutex.Unlock()
+	cs.Audit(client, "room.export", client.Room, format, "")
+	client.Noticef("Download the history of %s within %s: %s", client.Room, ttl, exportURL(id))
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Default number of recipients below which a broadcast is sent without the worker pool
+const defaultFanoutMinBatch = 64
+
+// Buffers larger than this are not returned to the pool, so one huge
+// message does not pin its memory
+const maxPooledBuffer = 64 * 1024
+
+// bufferPool holds the buffers broadcasts are encoded into
+var bufferPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// recipientPool holds the slices Broadcast collects recipients in
+var recipientPool = sync.Pool{New: func() interface{} { return new([]*Client) }}
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+// Upper bounds of the fan-out latency histogram buckets
+var fanoutBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	25 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+}
+
+// fanoutPool delivers broadcasts to large rooms by splitting the recipients
+// among a fixed set of workers, so one slow connection does not hold up
+// everyone after it
+type fanoutPool struct {
+	jobs     chan func()
+	workers  int
+	minBatch int
+
+	// order serializes deliveries, so every client receives broadcasts in the same order
+	order sync.Mutex
+	stats fanoutStats
+}
+
+// fanoutStats records how long deliveries take
+type fanoutStats struct {
+	mu      sync.Mutex
+	count   int
+	total   time.Duration
+	max     time.Duration
+	buckets []int // counts per fanoutBuckets entry, plus one for slower deliveries
+}
+
+// newFanoutPool starts FANOUT_WORKERS workers, defaulting to one per CPU
+func newFanoutPool() *fanoutPool {
+	p := &fanoutPool{
+		workers:  envInt("FANOUT_WORKERS", runtime.NumCPU()),
+		minBatch: envInt("FANOUT_MIN_BATCH", defaultFanoutMinBatch),
+		stats:    fanoutStats{buckets: make([]int, len(fanoutBuckets)+1)},
+	}
+	p.jobs = make(chan func(), p.workers)
+	for i := 0; i < p.workers; i++ {
+		go func() {
+			for job := range p.jobs {
+				job()
+			}
+		}()
+	}
+	return p
+}
+
+// Deliver sends a message to each client, closing the connections that fail
+func (p *fanoutPool) Deliver(clients []*Client, msg *Message) {
+	if len(clients) == 0 {
+		return
+	}
+	start := time.Now()
+	p.order.Lock()
+	defer p.order.Unlock()
+
+	// Most clients read the same JSON and TCP clients the same text line,
+	// plain or colored, so each is encoded once into a pooled buffer
+	jsonBuf := getBuffer()
+	defer putBuffer(jsonBuf)
+	if err := json.NewEncoder(jsonBuf).Encode(msg); err != nil {
+		log.Println("Error encoding broadcast:", err)
+		return
+	}
+	data := bytes.TrimSuffix(jsonBuf.Bytes(), []byte{'\n'})
+	var text, colorText []byte
+	for _, client := range clients {
+		t, ok := client.Transport.(*tcpTransport)
+		if !ok {
+			continue
+		}
+		if color := t.color.Load(); color && colorText == nil {
+			textBuf := getBuffer()
+			defer putBuffer(textBuf)
+			textBuf.WriteString(msg.ANSIText())
+			textBuf.WriteByte('\n')
+			colorText = textBuf.Bytes()
+		} else if !color && text == nil {
+			textBuf := getBuffer()
+			defer putBuffer(textBuf)
+			textBuf.WriteString(msg.Text())
+			textBuf.WriteByte('\n')
+			text = textBuf.Bytes()
+		}
+		if text != nil && colorText != nil {
+			break
+		}
+	}
+
+	send := func(batch []*Client) {
+		for _, client := range batch {
+			var err error
+			// Server messages are encoded again for clients reading another language
+			if local := client.localize(msg); local != msg {
+				if err := client.Send(local); err != nil {
+					log.Printf("Broadcast to %s error: %v", client.Address, err)
+					client.Transport.Close()
+				}
+				continue
+			}
+			switch t := client.Transport.(type) {
+			case *tcpTransport:
+				if t.color.Load() {
+					err = client.write(colorText)
+				} else {
+					err = client.write(text)
+				}
+			case messageEncoder:
+				err = client.write(t.Encode(msg))
+			default:
+				err = client.write(data)
+			}
+			// Closing the connection makes its handler remove the client
+			if err != nil {
+				log.Printf("Broadcast to %s error: %v", client.Address, err)
+				client.Transport.Close()
+			}
+		}
+	}
+
+	if p.workers < 2 || len(clients) < p.minBatch {
+		send(clients)
+	} else {
+		size := (len(clients) + p.workers - 1) / p.workers
+		var wg sync.WaitGroup
+		for i := 0; i < len(clients); i += size {
+			batch := clients[i:min(i+size, len(clients))]
+			wg.Add(1)
+			p.jobs <- func() {
+				defer wg.Done()
+				send(batch)
+			}
+		}
+		wg.Wait()
+	}
+	p.stats.observe(time.Since(start))
+}
+
+func (s *fanoutStats) observe(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.count++
+	s.total += d
+	s.max = max(s.max, d)
+	i := 0
+	for i < len(fanoutBuckets) && d > fanoutBuckets[i] {
+		i++
+	}
+	s.buckets[i]++
+}
+
+// snapshot reports the statistics for the debug server, with times in microseconds
+func (s *fanoutStats) snapshot() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	buckets := make(map[string]int, len(s.buckets))
+	for i, n := range s.buckets {
+		le := "+Inf"
+		if i < len(fanoutBuckets) {
+			le = fanoutBuckets[i].String()
+		}
+		buckets["le_"+le] = n
+	}
+	var avg time.Duration
+	if s.count > 0 {
+		avg = s.total / time.Duration(s.count)
+	}
+	return map[string]interface{}{
+		"count":   s.count,
+		"avg_us":  avg.Microseconds(),
+		"max_us":  s.max.Microseconds(),
+		"buckets": buckets,
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+// discardTransport accepts and drops every message, like a client that reads instantly
+type discardTransport struct{}
+
+func (discardTransport) Send([]byte) error { return nil }
+func (discardTransport) Close() error      { return nil }
+func (discardTransport) Remote() string    { return "discard" }
+
+// discardConn is a network connection that drops everything written to it
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(p []byte) (int, error) { return len(p), nil }
+func (discardConn) Close() error                { return nil }
+func (discardConn) LocalAddr() net.Addr         { return &net.TCPAddr{} }
+func (discardConn) RemoteAddr() net.Addr        { return &net.TCPAddr{} }
+
+// benchServer returns a server with n discarding clients in one room
+func benchServer(n int, transport func(i int) Transport) *ChatServer {
+	cs := NewChatServer()
+	for i := 0; i < n; i++ {
+		client := &Client{Transport: transport(i), Name: fmt.Sprintf("user%d", i), Room: "bench"}
+		cs.Clients.Add(client)
+		cs.Clients.Move(client, "bench")
+	}
+	return cs
+}
+
+func benchmarkBroadcast(b *testing.B, n int, transport func(i int) Transport) {
+	cs := benchServer(n, transport)
+	msg := &Message{Type: MessageChat, Room: "bench", From: "alice", Body: "hello, everyone in the room"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cs.Broadcast("bench", msg, 0)
+	}
+}
+
+func jsonTransport(int) Transport { return discardTransport{} }
+
+func mixedTransport(i int) Transport {
+	if i%2 == 0 {
+		return &tcpTransport{conn: discardConn{}}
+	}
+	return discardTransport{}
+}
+
+func BenchmarkBroadcast10(b *testing.B)        { benchmarkBroadcast(b, 10, jsonTransport) }
+func BenchmarkBroadcast1000(b *testing.B)      { benchmarkBroadcast(b, 1000, jsonTransport) }
+func BenchmarkBroadcastMixed1000(b *testing.B) { benchmarkBroadcast(b, 1000, mixedTransport) }
+
+// BenchmarkBroadcastParallel broadcasts into 10 rooms of 100 clients at once,
+// measuring contention between rooms
+func BenchmarkBroadcastParallel(b *testing.B) {
+	cs := NewChatServer()
+	for i := 0; i < 1000; i++ {
+		room := fmt.Sprintf("bench%d", i%10)
+		client := &Client{Transport: discardTransport{}, Name: fmt.Sprintf("user%d", i), Room: room}
+		cs.Clients.Add(client)
+		cs.Clients.Move(client, room)
+	}
+	var next atomic.Int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		room := fmt.Sprintf("bench%d", next.Add(1)%10)
+		msg := &Message{Type: MessageChat, Room: room, From: "alice", Body: "hello, everyone in the room"}
+		for pb.Next() {
+			cs.Broadcast(room, msg, 0)
+		}
+	})
+}
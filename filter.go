@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// MessageFilter inspects a chat message before it is broadcast. It returns
+// the text to send, which may be modified, or an error to reject the message.
+// The client is nil for messages posted through the HTTP API.
+type MessageFilter interface {
+	Name() string
+	Filter(client *Client, room, text string) (string, error)
+}
+
+// Words masked by the profanity filter when no word list is configured
+var defaultProfanity = []string{"fuck", "fucking", "shit", "bitch", "asshole", "bastard", "cunt", "dick"}
+
+// ProfanityFilter masks or rejects messages containing words from a list
+type ProfanityFilter struct {
+	pattern *regexp.Regexp // nil when the list is empty
+	reject  bool
+}
+
+// NewProfanityFilter creates a filter for the given words. If reject is true
+// messages are rejected instead of masked. With no words the filter lets
+// every message through.
+func NewProfanityFilter(words []string, reject bool) *ProfanityFilter {
+	quoted := make([]string, 0, len(words))
+	for _, w := range words {
+		if w = strings.TrimSpace(w); w != "" {
+			quoted = append(quoted, regexp.QuoteMeta(w))
+		}
+	}
+	if len(quoted) == 0 {
+		return &ProfanityFilter{reject: reject}
+	}
+	pattern := regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`)
+	return &ProfanityFilter{pattern: pattern, reject: reject}
+}
+
+func (f *ProfanityFilter) Name() string {
+	return "profanity"
+}
+
+func (f *ProfanityFilter) Filter(client *Client, room, text string) (string, error) {
+	if f.pattern == nil || !f.pattern.MatchString(text) {
+		return text, nil
+	}
+	if f.reject {
+		return "", errors.New("message contains blocked words")
+	}
+	return f.pattern.ReplaceAllStringFunc(text, func(word string) string {
+		return strings.Repeat("*", utf8.RuneCountInString(word))
+	}), nil
+}
+
+// Matches http(s) URLs and bare www. hosts
+var linkPattern = regexp.MustCompile(`(?i)\b(https?://|www\.)\S+`)
+
+// LinkFilter removes links from messages
+type LinkFilter struct{}
+
+func (f *LinkFilter) Name() string {
+	return "links"
+}
+
+func (f *LinkFilter) Filter(client *Client, room, text string) (string, error) {
+	return linkPattern.ReplaceAllString(text, "[link removed]"), nil
+}
+
+// loadWordList reads one word per line, ignoring blank lines and # comments
+func loadWordList(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var words []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			words = append(words, line)
+		}
+	}
+	return words, scanner.Err()
+}
+
+// defaultFilters builds the filters shipped with the server
+func defaultFilters() []MessageFilter {
+	filters, err := loadDefaultFilters()
+	if err != nil {
+		log.Fatalf("Error loading profanity word list: %v", err)
+	}
+	return filters
+}
+
+// loadDefaultFilters builds the filters shipped with the server from the
+// current configuration
+func loadDefaultFilters() ([]MessageFilter, error) {
+	words := defaultProfanity
+	if path := os.Getenv("PROFANITY_WORDS_FILE"); path != "" {
+		list, err := loadWordList(path)
+		if err != nil {
+			return nil, err
+		}
+		words = list
+	}
+	return []MessageFilter{
+		NewProfanityFilter(words, os.Getenv("PROFANITY_MODE") == "reject"),
+		&LinkFilter{},
+	}, nil
+}
+
+// RegisterFilter makes a filter available for rooms to enable
+func (cs *ChatServer) RegisterFilter(filter MessageFilter) {
+	cs.Mutex.Lock()
+	defer cs.Mutex.Unlock()
+	cs.Filters = append(cs.Filters, filter)
+}
+
+// findFilter returns the registered filter with the given name. Caller must hold cs.Mutex.
+func (cs *ChatServer) findFilter(name string) MessageFilter {
+	for _, filter := range cs.Filters {
+		if filter.Name() == name {
+			return filter
+		}
+	}
+	return nil
+}
+
+// roomFilterDefaults reads the filters enabled in new rooms from ROOM_FILTERS
+func roomFilterDefaults() map[string]bool {
+	enabled := make(map[string]bool)
+	for _, name := range envList("ROOM_FILTERS") {
+		enabled[name] = true
+	}
+	return enabled
+}
+
+// ApplyFilters runs the filters enabled in a room over a message, in
+// registration order. Filters in shadow mode see the message too, but what
+// they would have done is only reported to moderators.
+func (cs *ChatServer) ApplyFilters(client *Client, room, text string) (string, error) {
+	// Every message is made safe for terminals, whatever filters the room has
+	if !utf8.ValidString(text) {
+		return "", errInvalidUTF8
+	}
+	text = sanitizeText(text)
+
+	cs.Mutex.Lock()
+	var filters []MessageFilter
+	r := cs.getRoom(room)
+	for _, filter := range cs.Filters {
+		if r.Filters[filter.Name()] || r.ShadowFilters[filter.Name()] {
+			filters = append(filters, filter)
+		}
+	}
+	shadow := make(map[string]bool, len(r.ShadowFilters))
+	for name := range r.ShadowFilters {
+		shadow[name] = true
+	}
+	cs.Mutex.Unlock()
+
+	for _, filter := range filters {
+		out, err := filter.Filter(client, room, text)
+		if shadow[filter.Name()] {
+			switch {
+			case err != nil:
+				cs.ReportShadow(client, room, "filter "+filter.Name(), "would reject: "+err.Error())
+			case out != text:
+				cs.ReportShadow(client, room, "filter "+filter.Name(), "would change the message to: "+out)
+			}
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		text = out
+	}
+	return text, nil
+}
+
+// SetRoomFilter turns a filter on, off, or to shadow mode in a room
+func (cs *ChatServer) SetRoomFilter(client *Client, room, name, mode string) error {
+	cs.Mutex.Lock()
+	found := cs.findFilter(name) != nil
+	cs.Mutex.Unlock()
+	if !found {
+		return errors.New("unknown filter: " + name)
+	}
+
+	ev := Event{Room: room, User: client.Name, Body: name}
+	switch mode {
+	case "on":
+		ev.Type = EventFilterEnable
+	case "off":
+		ev.Type = EventFilterDisable
+	case "shadow":
+		ev.Type = EventFilterShadow
+	default:
+		return errors.New("unknown filter mode: " + mode)
+	}
+	cs.Record(ev)
+	cs.Audit(client, "filter."+mode, room, name, "")
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+)
+
+// Default number of messages held for a WebSocket client that has run out of credit
+const defaultFlowBuffer = 500
+
+// flowControl paces messages to WebSocket clients that opt in by granting
+// credits. Each message sent uses one credit; messages beyond the client's
+// credit wait in a buffer until more is granted. Guarded by Client.writeMu.
+type flowControl struct {
+	enabled bool
+	credits int
+	pending [][]byte
+	dropped int
+}
+
+// send writes a message if the client has credit, otherwise buffers it
+func (f *flowControl) send(conn *websocket.Conn, data []byte) error {
+	if f.credits > 0 && len(f.pending) == 0 && f.dropped == 0 {
+		f.credits--
+		return conn.WriteMessage(websocket.TextMessage, data)
+	}
+	f.pending = append(f.pending, append([]byte(nil), data...))
+	if max := envInt("FLOW_CONTROL_BUFFER", defaultFlowBuffer); len(f.pending) > max {
+		f.dropped += len(f.pending) - max
+		f.pending = f.pending[len(f.pending)-max:]
+	}
+	return nil
+}
+
+// flush writes buffered messages while credit remains, starting with a
+// notice about any messages dropped because the buffer overflowed
+func (f *flowControl) flush(conn *websocket.Conn) error {
+	if f.dropped > 0 && f.credits > 0 {
+		f.credits--
+		notice, err := json.Marshal(&Message{Type: MessageSystem, Body: fmt.Sprintf("%d messages were dropped while you were out of credit", f.dropped)})
+		if err != nil {
+			return err
+		}
+		f.dropped = 0
+		if err := conn.WriteMessage(websocket.TextMessage, notice); err != nil {
+			return err
+		}
+	}
+	for len(f.pending) > 0 && f.credits > 0 {
+		data := f.pending[0]
+		f.pending[0] = nil
+		f.pending = f.pending[1:]
+		f.credits--
+		if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GrantCredits lets the server send n more messages to a WebSocket client.
+// The first grant switches the client to flow control.
+func (c *Client) GrantCredits(n int) error {
+	ws, ok := c.Transport.(*wsTransport)
+	if !ok {
+		return nil
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	// Messages already batched go out before credits start counting
+	if err := c.flushCoalescedLocked(); err != nil {
+		return err
+	}
+	ws.flow.enabled = true
+	ws.flow.credits += n
+	return ws.flow.flush(ws.conn)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// Guest access levels set by GUEST_ACCESS. Guest mode is off unless it is set.
+const (
+	GuestReadOnly = "read"
+	GuestLimited  = "limited"
+)
+
+// guestAccess returns the configured guest access level, or "" when
+// WebSocket clients must log in
+func guestAccess() string {
+	switch access := os.Getenv("GUEST_ACCESS"); access {
+	case GuestReadOnly, GuestLimited:
+		return access
+	}
+	return ""
+}
+
+// guestName picks a nickname no connected client is using
+func (cs *ChatServer) guestName() string {
+	for {
+		id, err := newID(2)
+		if err != nil {
+			continue
+		}
+		name := "guest-" + id
+		taken := false
+		for _, c := range cs.Clients.All() {
+			if c.Name == name {
+				taken = true
+				break
+			}
+		}
+		if !taken {
+			return name
+		}
+	}
+}
+
+// AdmitGuest gives a WebSocket client that chose to continue without an
+// account a generated nickname
+func (cs *ChatServer) AdmitGuest(client *Client) {
+	client.Name = cs.guestName()
+	cs.limitGuest(client)
+}
+
+// limitGuest marks a client as a guest and, with limited guest access, gives
+// it the guest rate limit
+func (cs *ChatServer) limitGuest(client *Client) {
+	client.Guest = true
+	if guestAccess() == GuestLimited {
+		perMinute := envInt("GUEST_RATE", 4)
+		client.guestLimiter = NewRateLimiter(float64(perMinute)/60, perMinute)
+	}
+}
+
+// guestWelcome tells a guest what it can do and how to get a full account
+func (cs *ChatServer) guestWelcome(client *Client) {
+	can := "read along"
+	if guestAccess() == GuestLimited {
+		can = fmt.Sprintf("send up to %d messages a minute", envInt("GUEST_RATE", 4))
+	}
+	client.Noticef("You are visiting as %s and can %s. Register to pick your own name, create rooms and chat without limits.", client.Name, can)
+}
+
+// guestRestriction returns an error saying why a guest may not send a chat
+// message now, or nil if it may
+func (cs *ChatServer) guestRestriction(client *Client) *Message {
+	switch {
+	case !client.Guest:
+		return nil
+	case client.guestLimiter == nil:
+		return errorMessage(CodeGuest, client.T("Guests can only read. Register to join the conversation."))
+	case !client.guestLimiter.Allow():
+		msg := errorMessage(CodeRateLimited, client.T("Guests can send %d messages a minute. Register to chat without limits.", envInt("GUEST_RATE", 4)))
+		return msg.retryIn(client.guestLimiter.Delay())
+	}
+	return nil
+}
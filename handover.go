@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Environment variables a process started by a handover inherits:
+// handoverListenersEnv lists its listening sockets as comma separated
+// network:addr=fd entries, and handoverGoEnv is a pipe it waits on before
+// loading state, until the old process has let go of it.
+const (
+	handoverListenersEnv = "HANDOVER_LISTENERS"
+	handoverGoEnv        = "HANDOVER_GO"
+)
+
+// fileListener is a listener whose socket can be passed to another process
+type fileListener interface {
+	net.Listener
+	File() (*os.File, error)
+}
+
+// listeners holds the sockets the server listens on, by network:addr, and
+// the ones inherited from the process it replaced
+var listeners = struct {
+	sync.Mutex
+	open      map[string]fileListener
+	inherited map[string]int
+}{open: make(map[string]fileListener)}
+
+// inheritedListeners parses HANDOVER_LISTENERS
+func inheritedListeners() map[string]int {
+	fds := make(map[string]int)
+	for _, entry := range envList(handoverListenersEnv) {
+		key, fd, ok := strings.Cut(entry, "=")
+		n, err := strconv.Atoi(fd)
+		if !ok || err != nil {
+			log.Printf("Invalid %s entry %q", handoverListenersEnv, entry)
+			continue
+		}
+		fds[key] = n
+	}
+	return fds
+}
+
+// listen is net.Listen, except that it takes over the socket when the
+// process it replaced was already listening on the same address. The
+// listener is remembered so it can be passed on at the next handover.
+func listen(network, addr string) (net.Listener, bool, error) {
+	key := network + ":" + addr
+	listeners.Lock()
+	defer listeners.Unlock()
+	if listeners.inherited == nil {
+		listeners.inherited = inheritedListeners()
+	}
+
+	var l net.Listener
+	var err error
+	fd, inherited := listeners.inherited[key]
+	if inherited {
+		delete(listeners.inherited, key)
+		file := os.NewFile(uintptr(fd), key)
+		l, err = net.FileListener(file)
+		file.Close()
+	} else {
+		l, err = net.Listen(network, addr)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	fl, ok := l.(fileListener)
+	if !ok {
+		return l, inherited, nil
+	}
+	if _, exists := listeners.open[key]; exists {
+		l.Close()
+		return nil, false, fmt.Errorf("already listening on %s", key)
+	}
+	listeners.open[key] = fl
+	return fl, inherited, nil
+}
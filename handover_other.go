@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+// Handing over listening sockets to a new process is only implemented for
+// Unix. Elsewhere a deploy restarts the server as usual.
+
+func (cs *ChatServer) WatchHandover() {}
+
+func waitForHandover() {}
@@ -0,0 +1,121 @@
+//go:build unix
+
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// WatchHandover hands the server over to a new copy of its executable on
+// SIGUSR2, for deploys that replace the binary in place
+func (cs *ChatServer) WatchHandover() {
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	for range usr2 {
+		if err := cs.Handover(); err != nil {
+			log.Println("Handover failed, still serving:", err)
+		}
+	}
+}
+
+// Handover starts a new server process that inherits the listening sockets,
+// then steps aside: it stops accepting, saves a state snapshot, asks
+// connected clients to reconnect, closes its logs and exits. Listening sockets stay open throughout, so
+// connections made during the deploy wait in the accept queue instead of
+// being refused. The new process only loads state once this one is done
+// writing it, so nothing recorded during the switch is lost.
+func (cs *ChatServer) Handover() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	listeners.Lock()
+	keys := make([]string, 0, len(listeners.open))
+	for key := range listeners.open {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var files []*os.File
+	var entries []string
+	for _, key := range keys {
+		file, err := listeners.open[key].File()
+		if err != nil {
+			listeners.Unlock()
+			closeFiles(files)
+			return err
+		}
+		files = append(files, file)
+		// ExtraFiles start at descriptor 3
+		entries = append(entries, key+"="+strconv.Itoa(2+len(files)))
+	}
+	listeners.Unlock()
+	defer closeFiles(files)
+
+	goRead, goWrite, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer goRead.Close()
+	defer goWrite.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, goRead)
+	cmd.Env = append(os.Environ(),
+		handoverListenersEnv+"="+strings.Join(entries, ","),
+		handoverGoEnv+"="+strconv.Itoa(2+len(cmd.ExtraFiles)),
+	)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	log.Printf("Handing over to process %d", cmd.Process.Pid)
+
+	// From here on the new process owns the sockets
+	listeners.Lock()
+	for _, l := range listeners.open {
+		if unix, ok := l.(*net.UnixListener); ok {
+			unix.SetUnlinkOnClose(false)
+		}
+		l.Close()
+	}
+	listeners.Unlock()
+
+	cs.stepDown(envDuration("HANDOVER_DRAIN", 5*time.Second))
+	goWrite.Write([]byte{1})
+	log.Println("Handover complete")
+	os.Exit(0)
+	return nil
+}
+
+// closeFiles closes the files duplicated for a handover
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
+
+// waitForHandover blocks a process started by a handover until the process
+// it replaces has closed its logs. The old process exiting counts too.
+func waitForHandover() {
+	fd, err := strconv.Atoi(os.Getenv(handoverGoEnv))
+	if err != nil {
+		return
+	}
+	os.Unsetenv(handoverGoEnv)
+	pipe := os.NewFile(uintptr(fd), "handover")
+	defer pipe.Close()
+	if _, err := pipe.Read(make([]byte, 1)); err != nil && err != io.EOF {
+		log.Println("Error waiting for handover:", err)
+	}
+}
@@ -0,0 +1,55 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+func TestListenInherited(t *testing.T) {
+	old, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := old.Addr().String()
+	file, err := old.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The new listener gets its own descriptor, as after an exec
+	fd, err := syscall.Dup(int(file.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	// Clients connecting while the socket changes hands wait to be accepted
+	old.Close()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	t.Setenv(handoverListenersEnv, "tcp:"+addr+"="+strconv.Itoa(fd))
+	listeners.Lock()
+	listeners.inherited = nil
+	listeners.Unlock()
+	l, inherited, err := listen("tcp", addr)
+	if err != nil || !inherited {
+		t.Fatalf("listen = %v, %v", inherited, err)
+	}
+	defer func() {
+		listeners.Lock()
+		delete(listeners.open, "tcp:"+addr)
+		listeners.Unlock()
+		l.Close()
+	}()
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted.Close()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// ProtocolVersion is the version of the typed WebSocket protocol. Clients
+// that negotiate jsonSubprotocol exchange hello messages naming the version
+// and features they use before anything else is sent.
+const ProtocolVersion = 1
+
+// supportedVersions are the protocol versions the server speaks
+var supportedVersions = []int{1}
+
+// Features the server can advertise and clients select in their hello
+const (
+	FeatureCompression = "compression"
+	FeatureBatch       = "batch"
+	FeatureE2EE        = "e2ee"
+	FeatureAttachments = "attachments"
+	FeatureFlowControl = "flow_control"
+	FeatureHistory     = "history"
+	FeatureCalls       = "calls"
+	FeatureTURN        = "turn"
+)
+
+// Codes of hello errors
+const (
+	CodeHelloExpected      = "hello.expected"
+	CodeVersionUnsupported = "hello.version"
+)
+
+// Hello is the body of hello messages. The server's lists the versions it
+// speaks and its capabilities; the client's names the version and the
+// features it selected, which the server's reply confirms.
+type Hello struct {
+	Version      int      `json:"version"`
+	Versions     []int    `json:"versions,omitempty"`
+	Capabilities []string `json:"capabilities,omitempty"`
+	Features     []string `json:"features,omitempty"`
+}
+
+// compressionEnabled reports whether WebSocket clients may negotiate
+// per-message compression, set with WS_COMPRESSION
+func compressionEnabled() bool {
+	return envBool("WS_COMPRESSION", false)
+}
+
+// Capabilities lists the features this server offers
+func (cs *ChatServer) Capabilities() []string {
+	caps := []string{FeatureE2EE, FeatureAttachments, FeatureFlowControl, FeatureHistory, FeatureCalls}
+	if turnConfigured() {
+		caps = append(caps, FeatureTURN)
+	}
+	if compressionEnabled() {
+		caps = append(caps, FeatureCompression)
+	}
+	if coalesceWindow() > 0 {
+		caps = append(caps, FeatureBatch)
+	}
+	slices.Sort(caps)
+	return caps
+}
+
+// exchangeHello greets a client that negotiated jsonSubprotocol and reads
+// its hello, recording the features it selected on its transport. Clients
+// that answer with anything else, or ask for a version the server does not
+// speak, get an error and false.
+func (cs *ChatServer) exchangeHello(transport *wsTransport) bool {
+	conn := transport.conn
+	caps := cs.Capabilities()
+	hello := &Message{Type: MessageHello, Hello: &Hello{Version: ProtocolVersion, Versions: supportedVersions, Capabilities: caps}}
+	if err := conn.WriteJSON(hello); err != nil {
+		return false
+	}
+
+	conn.SetReadDeadline(time.Now().Add(envDuration("HELLO_TIMEOUT", 10*time.Second)))
+	_, data, err := conn.ReadMessage()
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return false
+	}
+	var req Request
+	if json.Unmarshal(data, &req) != nil || req.Type != MessageHello {
+		conn.WriteJSON(&Message{Type: MessageError, Code: CodeHelloExpected, Body: "Expected a hello message"})
+		return false
+	}
+	if req.Version == 0 {
+		req.Version = ProtocolVersion
+	}
+	if !slices.Contains(supportedVersions, req.Version) {
+		conn.WriteJSON(&Message{Type: MessageError, Code: CodeVersionUnsupported, Body: fmt.Sprintf("Protocol version %d is not supported", req.Version)})
+		return false
+	}
+
+	transport.features = make(map[string]bool)
+	selected := []string{}
+	for _, feature := range req.Features {
+		if slices.Contains(caps, feature) && !transport.features[feature] {
+			transport.features[feature] = true
+			selected = append(selected, feature)
+		}
+	}
+	// Messages are compressed only for clients that asked, even when their
+	// WebSocket library negotiated it
+	conn.EnableWriteCompression(transport.features[FeatureCompression])
+	return conn.WriteJSON(&Message{Type: MessageHello, Hello: &Hello{Version: req.Version, Features: selected}}) == nil
+}
+
+// selected reports whether the client chose a feature in its hello. Clients
+// that did not exchange hellos get every feature the server has turned on.
+func (t *wsTransport) selected(feature string) bool {
+	return t.features == nil || t.features[feature]
+}
+
+// helloTransport creates the transport of a WebSocket client, exchanging
+// hellos first if it negotiated jsonSubprotocol
+func (cs *ChatServer) helloTransport(conn *websocket.Conn, remote string) (*wsTransport, bool) {
+	transport := &wsTransport{conn: conn, remote: remote}
+	if conn.Subprotocol() != jsonSubprotocol {
+		return transport, true
+	}
+	return transport, cs.exchangeHello(transport)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Default number of history messages let out to a client before the stream
+// waits for it to catch up
+const defaultHistoryChunk = 100
+
+var (
+	errHistoryStalled = errors.New("client is not reading its history")
+	errClientGone     = errors.New("client disconnected")
+)
+
+// backlog returns how many messages are waiting to be written to a client
+// and how many can wait before some are dropped, or zero if there is no
+// limit. Messages wait in the send queue, for flow control credit, or for
+// the next long poll.
+func (c *Client) backlog() (int, int) {
+	if c.queue != nil {
+		n, _ := c.queue.depth()
+		return n, c.queue.limit
+	}
+	switch t := c.Transport.(type) {
+	case *wsTransport:
+		c.writeMu.Lock()
+		defer c.writeMu.Unlock()
+		if !t.flow.enabled {
+			return 0, 0
+		}
+		return len(t.flow.pending), envInt("FLOW_CONTROL_BUFFER", defaultFlowBuffer)
+	case *pollQueue:
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		return len(t.msgs), envInt("POLL_BUFFER", defaultPollBuffer)
+	}
+	return 0, 0
+}
+
+// historyStream sends history to a client in chunks of HISTORY_CHUNK
+// messages, waiting after each chunk until the client's backlog is down to
+// half a chunk, so a long history is neither buffered in full nor dropped
+// by the slow consumer policy. A client that makes no progress for
+// HISTORY_STALL_TIMEOUT is given up on.
+type historyStream struct {
+	client *Client
+	chunk  int
+	stall  time.Duration
+	last   uint64
+	err    error
+}
+
+func newHistoryStream(client *Client) *historyStream {
+	chunk := max(envInt("HISTORY_CHUNK", defaultHistoryChunk), 1)
+	if _, limit := client.backlog(); limit > 0 {
+		// Leave room in the backlog for live messages
+		chunk = max(min(chunk, limit/2), 1)
+	}
+	return &historyStream{client: client, chunk: chunk, stall: envDuration("HISTORY_STALL_TIMEOUT", 30*time.Second)}
+}
+
+// send writes a message once the client has room for it. After an error
+// it does nothing.
+func (h *historyStream) send(msg *Message) {
+	if h.err != nil {
+		return
+	}
+	if h.err = h.wait(); h.err != nil {
+		return
+	}
+	if h.err = h.client.Send(msg); h.err == nil {
+		h.last = max(h.last, msg.Seq)
+	}
+}
+
+// wait blocks while a chunk or more is waiting to be written to the client
+func (h *historyStream) wait() error {
+	n, _ := h.client.backlog()
+	if n < h.chunk {
+		return nil
+	}
+	progress := time.Now()
+	for n > h.chunk/2 {
+		if h.client.kicked.Load() != nil {
+			return errClientGone
+		}
+		if time.Since(progress) > h.stall {
+			return errHistoryStalled
+		}
+		time.Sleep(10 * time.Millisecond)
+		next, _ := h.client.backlog()
+		if next < n {
+			progress = time.Now()
+		}
+		n = next
+	}
+	return nil
+}
+
+// streamHistory sends the messages of a room numbered since to end from the
+// event log, then the buffered messages, then a history.end message
+func (cs *ChatServer) streamHistory(client *Client, name string, since, end uint64, buffered []*Message, latest uint64) {
+	h := newHistoryStream(client)
+	if since <= end {
+		// The event log keeps only the text, so messages from it are rendered
+		// in the room's current format
+		format := FormatPlain
+		cs.Mutex.Lock()
+		if room, ok := cs.Rooms[name]; ok {
+			format = room.formatName()
+		}
+		cs.Mutex.Unlock()
+
+		var found uint64
+		if cs.EventLog != nil {
+			err := cs.EventLog.Messages(name, since, end, func(msg *Message) {
+				found++
+				renderFormat(msg, format)
+				h.send(msg)
+			})
+			if err != nil {
+				log.Println("Error reading history:", err)
+			}
+		}
+		if h.err == nil && found < end-since+1 {
+			client.Noticef("Some messages from %d to %d in %s are no longer available", since, end, name)
+		}
+	}
+	for _, msg := range buffered {
+		h.send(msg)
+	}
+	switch h.err {
+	case nil:
+		h.send(&Message{Type: MessageHistoryEnd, Room: name, Seq: latest, Body: fmt.Sprintf("End of history for %s", name)})
+	case errHistoryStalled:
+		client.Noticef("Stopped sending the history of %s after message %d because you fell behind, ask again from there", name, h.last)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// historyCipher encrypts message bodies in the event log with AES-256-GCM.
+// Each sealed body is tagged with the ID of its key, so old keys listed in
+// HISTORY_OLD_KEYS can still decrypt history after the key is rotated.
+type historyCipher struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// loadHistoryCipher reads the base64 encoded 32 byte key in HISTORY_KEY, or
+// in the file named by HISTORY_KEY_FILE. It returns nil if neither is set.
+func loadHistoryCipher() (*historyCipher, error) {
+	key := os.Getenv("HISTORY_KEY")
+	if path := os.Getenv("HISTORY_KEY_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key = strings.TrimSpace(string(data))
+	}
+	if key == "" {
+		return nil, nil
+	}
+
+	hc := &historyCipher{keys: make(map[string]cipher.AEAD)}
+	for i, encoded := range append([]string{key}, envList("HISTORY_OLD_KEYS")...) {
+		id, aead, err := newHistoryAEAD(encoded)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			hc.current = id
+		}
+		hc.keys[id] = aead
+	}
+	return hc, nil
+}
+
+// newHistoryAEAD builds an AES-GCM cipher from a base64 key and returns it with the key's ID
+func newHistoryAEAD(encoded string) (string, cipher.AEAD, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		return "", nil, errors.New("history keys must be 32 bytes, base64 encoded")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", nil, err
+	}
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4]), aead, nil
+}
+
+// additionalData binds a sealed body to the event it belongs to, so it cannot
+// be moved to another room, user or time
+func additionalData(ev *Event) []byte {
+	return []byte(ev.Type + "\x00" + ev.Room + "\x00" + ev.User + "\x00" + ev.Time.Format(time.RFC3339Nano))
+}
+
+// Seal moves the body of a message event into Sealed, encrypted
+func (hc *historyCipher) Seal(ev *Event) error {
+	if ev.Type != EventMessage || ev.Body == "" {
+		return nil
+	}
+	aead := hc.keys[hc.current]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(ev.Body), additionalData(ev))
+	ev.Sealed = hc.current + ":" + base64.StdEncoding.EncodeToString(sealed)
+	ev.Body = ""
+	return nil
+}
+
+// Open decrypts a sealed body back into Body. Events that were never sealed
+// are left alone, so logs written before encryption was enabled still load.
+func (hc *historyCipher) Open(ev *Event) error {
+	if ev.Sealed == "" {
+		return nil
+	}
+	if hc == nil {
+		return errors.New("event log is encrypted, set HISTORY_KEY to read it")
+	}
+	id, encoded, _ := strings.Cut(ev.Sealed, ":")
+	aead, ok := hc.keys[id]
+	if !ok {
+		return fmt.Errorf("no history key with ID %s", id)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return errors.New("malformed sealed body")
+	}
+	body, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additionalData(ev))
+	if err != nil {
+		return err
+	}
+	ev.Body = string(body)
+	ev.Sealed = ""
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+// Hooks lets code embedding the server customize what happens as clients
+// connect, log in, join rooms, chat and leave, for custom greetings,
+// analytics or policy checks, without changing the hub. An error returned
+// by OnConnect, OnAuthenticated, OnJoinRoom or OnMessage refuses the
+// connection, login, join or message and is shown to the client. Embed
+// NopHooks to implement only some of them.
+type Hooks interface {
+	// OnConnect runs when a client connects. TCP clients have not picked a
+	// nickname yet.
+	OnConnect(client *Client) error
+	// OnAuthenticated runs when a client has logged in to an account
+	OnAuthenticated(client *Client) error
+	// OnJoinRoom runs before a client joins a room, including the lobby it
+	// joins on connecting
+	OnJoinRoom(client *Client, room string) error
+	// OnMessage runs on a chat message that passed filtering, before it is
+	// posted. It may change the message.
+	OnMessage(client *Client, msg *Message) error
+	// OnDisconnect runs when a client has disconnected
+	OnDisconnect(client *Client)
+}
+
+// NopHooks implements Hooks by doing nothing
+type NopHooks struct{}
+
+func (NopHooks) OnConnect(*Client) error           { return nil }
+func (NopHooks) OnAuthenticated(*Client) error     { return nil }
+func (NopHooks) OnJoinRoom(*Client, string) error  { return nil }
+func (NopHooks) OnMessage(*Client, *Message) error { return nil }
+func (NopHooks) OnDisconnect(*Client)              {}
+
+// RegisterHooks adds hooks, which run after those registered before them
+func (cs *ChatServer) RegisterHooks(hooks Hooks) {
+	cs.Mutex.Lock()
+	defer cs.Mutex.Unlock()
+	cs.Hooks = append(cs.Hooks, hooks)
+}
+
+// runHooks calls each registered hook until one returns an error
+func (cs *ChatServer) runHooks(call func(Hooks) error) error {
+	cs.Mutex.Lock()
+	hooks := cs.Hooks
+	cs.Mutex.Unlock()
+	for _, h := range hooks {
+		if err := call(h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Authenticated runs the hooks for a client that has logged in and reports
+// whether they let it in
+func (cs *ChatServer) Authenticated(client *Client) bool {
+	if err := cs.runHooks(func(h Hooks) error { return h.OnAuthenticated(client) }); err != nil {
+		client.Fail(CodeLoginRefused, "Login refused: %s", err.Error())
+		return false
+	}
+	return true
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"time"
+)
+
+// Reasons a client left the chat, sent with leave messages
+const (
+	LeaveQuit  = "quit"
+	LeaveError = "error"
+	LeaveIdle  = "idle"
+	LeaveSlow  = "slow"
+)
+
+// touch records that a client sent something
+func (c *Client) touch() {
+	c.lastActive.Store(time.Now().UnixNano())
+	c.idleWarned.Store(false)
+}
+
+// idleFor returns how long it has been since a client last sent something
+func (c *Client) idleFor(now time.Time) time.Duration {
+	last := c.lastActive.Load()
+	if last == 0 {
+		return 0
+	}
+	return now.Sub(time.Unix(0, last))
+}
+
+// kick disconnects a client for a reason given in its leave message. It
+// reports false if the client was already kicked.
+func (c *Client) kick(reason string) bool {
+	if !c.kicked.CompareAndSwap(nil, &reason) {
+		return false
+	}
+	c.disconnect()
+	return true
+}
+
+// leaveReason tells why a client disconnected, given the error that ended
+// its connection, if any
+func (c *Client) leaveReason(err error) string {
+	if reason := c.kicked.Load(); reason != nil {
+		return *reason
+	}
+	if err != nil {
+		return LeaveError
+	}
+	return LeaveQuit
+}
+
+// leaveMessage announces that a client left the chat, and why
+func leaveMessage(client *Client, reason string) *Message {
+	msg := &Message{Type: MessageLeave, Room: client.Room, From: client.Name, Reason: reason}
+	switch reason {
+	case LeaveIdle:
+		return msg.setText("%s was disconnected for being idle.", client.Name)
+	case LeaveSlow:
+		return msg.setText("%s was disconnected for falling behind.", client.Name)
+	case LeaveError:
+		return msg.setText("%s has left the chat (connection lost).", client.Name)
+	}
+	return msg.setText("%s has left the chat.", client.Name)
+}
+
+// checkIdle warns clients that have been idle for IDLE_TIMEOUT less
+// IDLE_WARNING and disconnects those idle for IDLE_TIMEOUT. Bots are never
+// disconnected.
+func (cs *ChatServer) checkIdle(now time.Time, timeout, warning time.Duration) {
+	for _, client := range cs.Clients.All() {
+		if client.Bot {
+			continue
+		}
+		idle := client.idleFor(now)
+		switch {
+		case idle >= timeout:
+			if client.kicked.Load() == nil {
+				client.Noticef("Disconnected after %s without activity", timeout)
+				client.kick(LeaveIdle)
+			}
+		case warning > 0 && idle >= timeout-warning && !client.idleWarned.Load():
+			client.idleWarned.Store(true)
+			client.Noticef("You will be disconnected for inactivity in %s unless you send something", (timeout - idle).Round(time.Second))
+		}
+	}
+}
+
+// RunIdleTimeout disconnects idle clients when IDLE_TIMEOUT is set
+func (cs *ChatServer) RunIdleTimeout() {
+	timeout := envDuration("IDLE_TIMEOUT", 0)
+	if timeout <= 0 {
+		return
+	}
+	warning := envDuration("IDLE_WARNING", time.Minute)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		cs.checkIdle(now, timeout, warning)
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Import formats
+const (
+	ImportSlack   = "slack"
+	ImportDiscord = "discord"
+	ImportIRC     = "irc"
+)
+
+// ImportedMessage is a message read from another platform's export
+type ImportedMessage struct {
+	// ID identifies the message on its platform, so importing the same
+	// export twice does not duplicate it
+	ID      string
+	Channel string
+	User    string
+	Time    time.Time
+	Text    string
+}
+
+// importMapping renames users and channels on the way in
+type importMapping struct {
+	users map[string]string
+	rooms map[string]string
+}
+
+// readMapping reads a file of external=local lines
+func readMapping(path string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	if path == "" {
+		return mapping, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		from, to, ok := strings.Cut(line, "=")
+		if !ok || strings.TrimSpace(from) == "" || strings.TrimSpace(to) == "" {
+			return nil, fmt.Errorf("%s:%d: expected external=local", path, i+1)
+		}
+		mapping[strings.TrimSpace(from)] = strings.TrimSpace(to)
+	}
+	return mapping, nil
+}
+
+// user returns the local account for an external user
+func (m importMapping) user(name string) string {
+	if local, ok := m.users[name]; ok {
+		return local
+	}
+	return name
+}
+
+// room returns the local room for an external channel
+func (m importMapping) room(channel string) string {
+	if local, ok := m.rooms[channel]; ok {
+		return local
+	}
+	return strings.TrimLeft(channel, "#")
+}
+
+// readSlackExport reads a Slack workspace export, unzipped: users.json,
+// channels.json and a directory of daily JSON files per channel
+func readSlackExport(dir string) ([]ImportedMessage, error) {
+	var users []struct {
+		ID      string `json:"id"`
+		Name    string `json:"name"`
+		Profile struct {
+			DisplayName string `json:"display_name"`
+		} `json:"profile"`
+	}
+	if err := readJSONFile(filepath.Join(dir, "users.json"), &users); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	names := make(map[string]string)
+	for _, u := range users {
+		names[u.ID] = u.Name
+	}
+	var channels []struct {
+		Name string `json:"name"`
+	}
+	if err := readJSONFile(filepath.Join(dir, "channels.json"), &channels); err != nil {
+		return nil, err
+	}
+
+	mention := regexp.MustCompile(`<@(U[A-Z0-9]+)>`)
+	var messages []ImportedMessage
+	for _, channel := range channels {
+		days, err := filepath.Glob(filepath.Join(dir, channel.Name, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		for _, day := range days {
+			var entries []struct {
+				Type     string `json:"type"`
+				Subtype  string `json:"subtype"`
+				User     string `json:"user"`
+				Username string `json:"username"`
+				Text     string `json:"text"`
+				TS       string `json:"ts"`
+			}
+			if err := readJSONFile(day, &entries); err != nil {
+				return nil, err
+			}
+			for _, e := range entries {
+				// Joins, topic changes and the like are not messages
+				if e.Type != "message" || (e.Subtype != "" && e.Subtype != "bot_message" && e.Subtype != "thread_broadcast") {
+					continue
+				}
+				ts, err := strconv.ParseFloat(e.TS, 64)
+				if err != nil {
+					return nil, fmt.Errorf("%s: invalid ts %q", day, e.TS)
+				}
+				user := names[e.User]
+				if user == "" {
+					user = e.Username
+				}
+				if user == "" {
+					user = e.User
+				}
+				text := mention.ReplaceAllStringFunc(e.Text, func(m string) string {
+					id := mention.FindStringSubmatch(m)[1]
+					if name, ok := names[id]; ok {
+						return "<@" + id + "|" + name + ">"
+					}
+					return m
+				})
+				messages = append(messages, ImportedMessage{
+					ID:      channel.Name + "/" + e.TS,
+					Channel: channel.Name,
+					User:    user,
+					Time:    time.Unix(0, int64(ts*1e6)*1e3).UTC(),
+					Text:    slackText(text),
+				})
+			}
+		}
+	}
+	return messages, nil
+}
+
+// readDiscordExport reads a channel exported as JSON by DiscordChatExporter
+func readDiscordExport(path string) ([]ImportedMessage, error) {
+	var export struct {
+		Channel struct {
+			Name string `json:"name"`
+		} `json:"channel"`
+		Messages []struct {
+			ID        string    `json:"id"`
+			Type      string    `json:"type"`
+			Timestamp time.Time `json:"timestamp"`
+			Content   string    `json:"content"`
+			Author    struct {
+				Name     string `json:"name"`
+				Nickname string `json:"nickname"`
+			} `json:"author"`
+			Attachments []struct {
+				URL string `json:"url"`
+			} `json:"attachments"`
+		} `json:"messages"`
+	}
+	if err := readJSONFile(path, &export); err != nil {
+		return nil, err
+	}
+	var messages []ImportedMessage
+	for _, m := range export.Messages {
+		if m.Type != "" && m.Type != "Default" && m.Type != "Reply" {
+			continue
+		}
+		text := m.Content
+		for _, a := range m.Attachments {
+			text = strings.TrimSpace(text + " " + a.URL)
+		}
+		if text == "" {
+			continue
+		}
+		messages = append(messages, ImportedMessage{
+			ID:      m.ID,
+			Channel: export.Channel.Name,
+			User:    m.Author.Name,
+			Time:    m.Timestamp.UTC(),
+			Text:    text,
+		})
+	}
+	return messages, nil
+}
+
+var (
+	// 2024-01-02 15:04:05 <nick> text, as logged by most clients with full timestamps
+	ircFullLine = regexp.MustCompile(`^\[?(\d{4}-\d{2}-\d{2})[ T](\d{2}:\d{2}(?::\d{2})?)\]?\s+<[ @+%&~]?([^>\s]+)>\s?(.*)$`)
+	// [15:04] <nick> text, dated by irssi's "Log opened" and "Day changed" lines
+	ircTimeLine = regexp.MustCompile(`^\[?(\d{2}:\d{2}(?::\d{2})?)\]?\s+<[ @+%&~]?([^>\s]+)>\s?(.*)$`)
+	ircDayLine  = regexp.MustCompile(`^--- (?:Log opened|Day changed) \w{3} (\w{3} \d{2}) (?:[\d:]+ )?(\d{4})`)
+)
+
+// readIRCLog reads a plain text IRC log of one channel. Lines without a
+// date take it from the last "Log opened" or "Day changed" line.
+func readIRCLog(path, channel string) ([]ImportedMessage, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var messages []ImportedMessage
+	var day string
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		var date, clock, nick, body string
+		if m := ircDayLine.FindStringSubmatch(text); m != nil {
+			t, err := time.Parse("Jan 02 2006", m[1]+" "+m[2])
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+			day = t.Format("2006-01-02")
+			continue
+		} else if m := ircFullLine.FindStringSubmatch(text); m != nil {
+			date, clock, nick, body = m[1], m[2], m[3], m[4]
+		} else if m := ircTimeLine.FindStringSubmatch(text); m != nil && day != "" {
+			date, clock, nick, body = day, m[1], m[2], m[3]
+		} else {
+			// Joins, parts, actions and other events
+			continue
+		}
+		if len(clock) == 5 {
+			clock += ":00"
+		}
+		t, err := time.ParseInLocation("2006-01-02 15:04:05", date+" "+clock, time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		messages = append(messages, ImportedMessage{
+			ID:      fmt.Sprintf("%s:%d", filepath.Base(path), line),
+			Channel: channel,
+			User:    nick,
+			Time:    t.UTC(),
+			Text:    body,
+		})
+	}
+	return messages, scanner.Err()
+}
+
+// readJSONFile decodes a JSON file
+func readJSONFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// importID turns the platform ID of a message into its local message ID
+func importID(format, id string) string {
+	sum := sha256.Sum256([]byte(format + "\x00" + id))
+	return "import-" + hex.EncodeToString(sum[:8])
+}
+
+// ImportMessages appends messages to the event log in time order, mapping
+// users and channels to local accounts and rooms. Messages imported before
+// are skipped. It returns the number imported.
+func (cs *ChatServer) ImportMessages(format string, messages []ImportedMessage, mapping importMapping, existing map[string]bool) int {
+	sort.SliceStable(messages, func(i, j int) bool { return messages[i].Time.Before(messages[j].Time) })
+	imported := 0
+	for _, m := range messages {
+		id := importID(format, m.ID)
+		text := strings.TrimSpace(m.Text)
+		if existing[id] || text == "" || m.User == "" {
+			continue
+		}
+		existing[id] = true
+		room := mapping.room(m.Channel)
+		cs.Mutex.Lock()
+		seq := cs.getRoom(room).Seq + 1
+		cs.Mutex.Unlock()
+		cs.Record(Event{Type: EventMessage, Time: m.Time, Room: room, User: mapping.user(m.User), Target: id, Body: text, Seq: seq})
+		imported++
+	}
+	return imported
+}
+
+// runImport implements the import subcommand, which reads exports from other
+// platforms into the event log. The server should not be running, since it
+// would not see the imported messages until it restarts.
+func runImport(args []string, stderr io.Writer) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	format := fs.String("format", "", "export format: slack (an unzipped export directory), discord (DiscordChatExporter JSON files) or irc (log files)")
+	eventLog := fs.String("event-log", os.Getenv("EVENT_LOG"), "event log to import into")
+	channel := fs.String("channel", "", "channel of IRC logs, by default the file name")
+	usersFile := fs.String("users", "", "file of external=local lines mapping users to local accounts")
+	roomsFile := fs.String("rooms", "", "file of external=local lines mapping channels to rooms")
+	dryRun := fs.Bool("dry-run", false, "count the messages without importing them")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: app import -format slack|discord|irc [options] path...")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 || (*eventLog == "" && !*dryRun) {
+		fs.Usage()
+		return 2
+	}
+
+	var messages []ImportedMessage
+	for _, path := range fs.Args() {
+		var read []ImportedMessage
+		var err error
+		switch *format {
+		case ImportSlack:
+			read, err = readSlackExport(path)
+		case ImportDiscord:
+			read, err = readDiscordExport(path)
+		case ImportIRC:
+			name := *channel
+			if name == "" {
+				name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+			}
+			read, err = readIRCLog(path, name)
+		default:
+			fs.Usage()
+			return 2
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, "Error reading export:", err)
+			return 1
+		}
+		messages = append(messages, read...)
+	}
+
+	var mapping importMapping
+	var err error
+	if mapping.users, err = readMapping(*usersFile); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if mapping.rooms, err = readMapping(*roomsFile); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if *dryRun {
+		rooms := make(map[string]int)
+		for _, m := range messages {
+			rooms[mapping.room(m.Channel)]++
+		}
+		for room, n := range rooms {
+			fmt.Fprintf(stderr, "%s: %d messages\n", room, n)
+		}
+		return 0
+	}
+
+	existing := make(map[string]bool)
+	events, err := ReadEvents(*eventLog)
+	if err != nil {
+		fmt.Fprintln(stderr, "Error reading event log:", err)
+		return 1
+	}
+	for _, ev := range events {
+		if ev.Type == EventMessage {
+			existing[ev.Target] = true
+		}
+	}
+	cs := NewChatServer()
+	if err := cs.OpenEventLog(*eventLog, time.Time{}); err != nil {
+		fmt.Fprintln(stderr, "Error opening event log:", err)
+		return 1
+	}
+	defer cs.EventLog.Close()
+	n := cs.ImportMessages(*format, messages, mapping, existing)
+	log.Printf("Imported %d of %d messages into %s", n, len(messages), *eventLog)
+	return 0
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestImport(t *testing.T) {
+	dir := t.TempDir()
+	eventLog := filepath.Join(dir, "events.log")
+	writeFiles(t, dir, map[string]string{
+		"slack/users.json":    `[{"id":"U1","name":"alice"},{"id":"U2","name":"bob"}]`,
+		"slack/channels.json": `[{"name":"general"}]`,
+		"slack/general/2024-01-02.json": `[
+			{"type":"message","user":"U1","text":"hi <@U2> &amp; see <https://example.com|example>","ts":"1704200000.000100"},
+			{"type":"message","subtype":"channel_join","user":"U2","text":"<@U2> has joined","ts":"1704199000.000100"},
+			{"type":"message","user":"U2","text":"hello","ts":"1704200100.000200"}
+		]`,
+		"discord.json": `{"channel":{"name":"dev"},"messages":[
+			{"id":"10","type":"Default","timestamp":"2024-01-03T10:00:00+00:00","content":"ship it","author":{"name":"carol"}},
+			{"id":"11","type":"ChannelPinnedMessage","timestamp":"2024-01-03T10:01:00+00:00","content":"","author":{"name":"carol"}}
+		]}`,
+		"ops.log":   "--- Log opened Wed Jan 03 09:00:00 2024\n[09:15] <@dave> deploying\n[09:16] * dave waves\n2024-01-04 08:00:00 <erin> done\n",
+		"users.map": "dave=david\n",
+		"rooms.map": "general=lobby\n",
+	})
+
+	run := func(args ...string) {
+		t.Helper()
+		if code := runImport(append([]string{"-event-log", eventLog, "-users", filepath.Join(dir, "users.map"), "-rooms", filepath.Join(dir, "rooms.map")}, args...), io.Discard); code != 0 {
+			t.Fatalf("import %v exited %d", args, code)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		// The second round imports nothing new
+		run("-format", "slack", filepath.Join(dir, "slack"))
+		run("-format", "discord", filepath.Join(dir, "discord.json"))
+		run("-format", "irc", filepath.Join(dir, "ops.log"))
+	}
+
+	events, err := ReadEvents(eventLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, ev := range events {
+		got = append(got, ev.Room+" "+ev.User+": "+ev.Body)
+	}
+	want := []string{
+		"lobby alice: hi @bob & see example (https://example.com)",
+		"lobby bob: hello",
+		"dev carol: ship it",
+		"ops david: deploying",
+		"ops erin: done",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("imported\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if events[1].Seq != 2 || events[3].Seq != 1 || events[4].Seq != 2 {
+		t.Errorf("messages numbered %d, %d, %d", events[1].Seq, events[3].Seq, events[4].Seq)
+	}
+}
@@ -0,0 +1,2311 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// How long a test waits for an expected message
+const testTimeout = 5 * time.Second
+
+// testServer is a chat server listening on ephemeral ports
+type testServer struct {
+	cs      *ChatServer
+	tcpAddr string
+	wsURL   string
+}
+
+// startServer starts a chat server with a fake auth service that accepts
+// any login except with the password "wrong"
+func startServer(t *testing.T) *testServer {
+	t.Helper()
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var login LoginRequest
+		if json.NewDecoder(r.Body).Decode(&login); login.Password == "wrong" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/register" {
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		json.NewEncoder(w).Encode(LoginResponse{Token: "test"})
+	}))
+	t.Cleanup(auth.Close)
+	t.Setenv("AUTH_URL", auth.URL)
+
+	cs := NewChatServer()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go cs.serveTCP(listener, false)
+
+	mux := http.NewServeMux()
+	cs.Routes(mux)
+	web := httptest.NewServer(mux)
+	t.Cleanup(web.Close)
+
+	return &testServer{
+		cs:      cs,
+		tcpAddr: listener.Addr().String(),
+		wsURL:   "ws" + strings.TrimPrefix(web.URL, "http") + "/ws",
+	}
+}
+
+// testClient is a connected client whose incoming messages are read as text lines
+type testClient struct {
+	t     *testing.T
+	name  string
+	lines chan string
+	send  func(string) error
+	close func() error
+}
+
+// dialTCP connects a TCP client and waits until it has joined the lobby
+func (s *testServer) dialTCP(t *testing.T, name string) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.tcpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	prompt := make([]byte, len("Please enter your nickname: "))
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	if _, err := conn.Read(prompt); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	c := &testClient{
+		t:     t,
+		name:  name,
+		lines: make(chan string, 100),
+		send: func(text string) error {
+			_, err := conn.Write([]byte(text + "\n"))
+			return err
+		},
+		close: conn.Close,
+	}
+	go func() {
+		defer close(c.lines)
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			c.lines <- scanner.Text()
+		}
+	}()
+	c.Send(name)
+	s.waitForClient(t, name)
+	return c
+}
+
+// dialWebSocket connects a WebSocket client through the login prompts and
+// waits until it has joined the lobby. Messages are read as their Text form.
+func (s *testServer) dialWebSocket(t *testing.T, name string) *testClient {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(s.wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	for _, reply := range []string{"1", name, "secret"} {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(reply)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, result, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(result), "logged in successfully") {
+		t.Fatalf("login failed: %s", result)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	var mu sync.Mutex
+	c := &testClient{
+		t:     t,
+		name:  name,
+		lines: make(chan string, 100),
+		send: func(text string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			return conn.WriteMessage(websocket.TextMessage, []byte(text))
+		},
+		close: conn.Close,
+	}
+	go func() {
+		defer close(c.lines)
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var msg Message
+			if err := json.Unmarshal(data, &msg); err != nil {
+				c.lines <- string(data)
+				continue
+			}
+			c.lines <- msg.Text()
+		}
+	}()
+	s.waitForClient(t, name)
+	return c
+}
+
+// waitForClient waits until a client of the given name is in the lobby
+func (s *testServer) waitForClient(t *testing.T, name string) *Client {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for time.Now().Before(deadline) {
+		for _, client := range s.cs.Clients.InRoom(defaultRoom) {
+			if client.Name == name {
+				return client
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("%s did not join %s", name, defaultRoom)
+	return nil
+}
+
+func (c *testClient) Send(text string) {
+	c.t.Helper()
+	if err := c.send(text); err != nil {
+		c.t.Fatalf("%s: send: %v", c.name, err)
+	}
+}
+
+// Expect reads lines until one contains want
+func (c *testClient) Expect(want string) {
+	c.t.Helper()
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case line, ok := <-c.lines:
+			if !ok {
+				c.t.Fatalf("%s: connection closed waiting for %q", c.name, want)
+			}
+			if strings.Contains(line, want) {
+				return
+			}
+		case <-timeout:
+			c.t.Fatalf("%s: timed out waiting for %q", c.name, want)
+		}
+	}
+}
+
+// ExpectNone fails if a line containing unwanted arrives within wait
+func (c *testClient) ExpectNone(unwanted string, wait time.Duration) {
+	c.t.Helper()
+	timeout := time.After(wait)
+	for {
+		select {
+		case line, ok := <-c.lines:
+			if !ok {
+				return
+			}
+			if strings.Contains(line, unwanted) {
+				c.t.Fatalf("%s: unexpected %q", c.name, line)
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+func TestTCPJoinBroadcastDisconnect(t *testing.T) {
+	s := startServer(t)
+	alice := s.dialTCP(t, "alice")
+	bob := s.dialTCP(t, "bob")
+	alice.Expect("bob has joined the chat!")
+
+	alice.Send("hello bob")
+	bob.Expect("alice: hello bob")
+
+	alice.close()
+	bob.Expect("alice has left the chat.")
+	deadline := time.Now().Add(testTimeout)
+	for len(s.cs.Clients.All()) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d clients registered after disconnect, want 1", len(s.cs.Clients.All()))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWebSocketAndTCPExchange(t *testing.T) {
+	s := startServer(t)
+	ws := s.dialWebSocket(t, "wendy")
+	tcp := s.dialTCP(t, "terry")
+	ws.Expect("terry has joined the chat!")
+
+	tcp.Send("hi from tcp")
+	ws.Expect("terry: hi from tcp")
+	ws.Send("hi from ws")
+	tcp.Expect("wendy: hi from ws")
+}
+
+func TestSenderDoesNotReceiveOwnMessage(t *testing.T) {
+	s := startServer(t)
+	alice := s.dialTCP(t, "alice")
+	bob := s.dialTCP(t, "bob")
+	alice.Expect("bob has joined the chat!")
+
+	alice.Send("echo?")
+	bob.Expect("alice: echo?")
+	alice.ExpectNone("alice: echo?", 200*time.Millisecond)
+}
+
+func TestRoomsAreIsolated(t *testing.T) {
+	s := startServer(t)
+	alice := s.dialTCP(t, "alice")
+	bob := s.dialWebSocket(t, "bob")
+	carol := s.dialTCP(t, "carol")
+	carol.Send("/join dev")
+	alice.Expect("carol has left the room.")
+
+	alice.Send("lobby only")
+	bob.Expect("alice: lobby only")
+	carol.ExpectNone("lobby only", 200*time.Millisecond)
+
+	bob.Send("/join dev")
+	carol.Expect("bob has joined the chat!")
+	carol.Send("dev only")
+	bob.Expect("carol: dev only")
+	alice.ExpectNone("dev only", 200*time.Millisecond)
+}
+
+// TestBroadcastOrder checks that concurrent senders' messages reach every
+// client in the same order
+func TestBroadcastOrder(t *testing.T) {
+	const senders, perSender = 4, 5
+	s := startServer(t)
+	var clients []*testClient
+	for i := 0; i < senders; i++ {
+		clients = append(clients, s.dialWebSocket(t, fmt.Sprintf("user%d", i)))
+	}
+	listener := s.dialWebSocket(t, "listener")
+	other := s.dialTCP(t, "other")
+
+	var wg sync.WaitGroup
+	for i, c := range clients {
+		wg.Add(1)
+		go func(i int, c *testClient) {
+			defer wg.Done()
+			for j := 0; j < perSender; j++ {
+				c.send(fmt.Sprintf("msg-%d-%d", i, j))
+			}
+		}(i, c)
+	}
+	wg.Wait()
+
+	order := func(c *testClient) []string {
+		var got []string
+		timeout := time.After(testTimeout)
+		for len(got) < senders*perSender {
+			select {
+			case line := <-c.lines:
+				if _, body, ok := strings.Cut(line, ": msg-"); ok {
+					got = append(got, body)
+				}
+			case <-timeout:
+				t.Fatalf("%s received %d of %d messages", c.name, len(got), senders*perSender)
+			}
+		}
+		return got
+	}
+	want := order(listener)
+	if got := order(other); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("clients saw different orders:\n%v\n%v", want, got)
+	}
+}
+
+func TestWebSocketEchoesOwnMessage(t *testing.T) {
+	s := startServer(t)
+	wendy := s.dialWebSocket(t, "wendy")
+	wendy.Send("mine")
+	wendy.Expect("wendy: mine")
+
+	wendy.Send("/echo off")
+	wendy.Expect("Echo of your own messages turned off")
+	wendy.Send("not echoed")
+	wendy.ExpectNone("wendy: not echoed", 200*time.Millisecond)
+}
+
+func TestReplayBySequence(t *testing.T) {
+	s := startServer(t)
+	alice := s.dialTCP(t, "alice")
+	bob := s.dialTCP(t, "bob")
+	for _, body := range []string{"one", "two", "three"} {
+		alice.Send(body)
+		bob.Expect("alice: " + body)
+	}
+
+	bob.Send("/replay 2 2")
+	bob.Expect("alice: two")
+	bob.ExpectNone("alice: three", 200*time.Millisecond)
+}
+
+func TestHistoryRangeReadsEventLog(t *testing.T) {
+	t.Setenv("ROOM_REPLAY_SIZE", "2")
+	s := startServer(t)
+	if err := s.cs.OpenEventLog(filepath.Join(t.TempDir(), "events.log"), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	alice := s.dialTCP(t, "alice")
+	wendy := s.dialWebSocket(t, "wendy")
+	for _, body := range []string{"one", "two", "three", "four"} {
+		alice.Send(body)
+		wendy.Expect("alice: " + body)
+	}
+
+	wendy.Send(`{"type":"history.range","room":"lobby","from_seq":1,"to_seq":3}`)
+	for _, body := range []string{"one", "two", "three"} {
+		wendy.Expect("alice: " + body)
+	}
+	wendy.Expect("End of history for lobby")
+}
+
+func TestRoomJoinPolicies(t *testing.T) {
+	t.Setenv("ADMIN_USERS", "root")
+	s := startServer(t)
+	root := s.dialWebSocket(t, "root")
+	bob := s.dialWebSocket(t, "bob")
+
+	root.Send("/join vault")
+	root.Send("/room")
+	root.Expect("vault is public and open to join")
+	root.Send("/room policy password hunter2")
+	root.Expect("vault is now password to join")
+
+	bob.Send("/join vault")
+	bob.Expect("vault needs a password")
+	bob.Send("/join vault wrong")
+	bob.Expect("Wrong password for vault")
+	bob.Send("/join vault hunter2")
+	root.Expect("bob has joined the chat!")
+	bob.Send("/join lobby")
+	root.Expect("bob has left the room.")
+
+	root.Send("/room policy invite")
+	root.Expect("vault is now invite to join")
+	bob.Send("/join vault")
+	bob.Expect("vault is invite-only")
+	root.Send("/invite add bob")
+	root.Expect("bob may now join vault")
+	bob.Send("/join vault")
+	root.Expect("bob has joined the chat!")
+}
+
+func TestRoomTopic(t *testing.T) {
+	s := startServer(t)
+	alice := s.dialTCP(t, "alice")
+	bob := s.dialTCP(t, "bob")
+
+	alice.Send("/join den")
+	alice.Expect("No topic is set for den")
+	alice.Send("/topic Board games on Friday")
+	alice.Expect("alice changed the topic to: Board games on Friday")
+
+	bob.Send("/join den")
+	bob.Expect("Topic for den: Board games on Friday")
+	bob.Send("/rooms")
+	bob.Expect("den (2 online) - Board games on Friday")
+}
+
+func TestListRoomsPaginates(t *testing.T) {
+	s := startServer(t)
+	alice := s.dialTCP(t, "alice")
+	for _, room := range []string{"alpha", "bravo", "charlie"} {
+		alice.Send("/join " + room)
+		alice.Expect("No topic is set for " + room)
+	}
+
+	url := "http" + strings.TrimSuffix(strings.TrimPrefix(s.wsURL, "ws"), "/ws") + "/rooms?limit=2"
+	var page struct {
+		Rooms []RoomInfo `json:"rooms"`
+		Next  string     `json:"next"`
+	}
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Rooms) != 2 || page.Rooms[0].Name != "alpha" || page.Next != "bravo" {
+		t.Fatalf("first page = %+v", page)
+	}
+
+	alice.Send("/list bravo")
+	alice.Expect("charlie (1 online)")
+}
+
+func TestEmptyRoomsExpire(t *testing.T) {
+	t.Setenv("ADMIN_USERS", "root")
+	s := startServer(t)
+	root := s.dialWebSocket(t, "root")
+	for _, room := range []string{"scratch", "archive"} {
+		root.Send("/join " + room)
+		root.Expect("No topic is set for " + room)
+	}
+	root.Send("/room persist on")
+	root.Expect("archive will be kept when empty")
+	root.Send("/join lobby")
+	root.Expect("No topic is set for lobby")
+
+	now := time.Now()
+	if expired := s.cs.expiredRooms(now, time.Hour); len(expired) != 0 {
+		t.Fatalf("rooms expired as soon as they emptied: %v", expired)
+	}
+	expired := s.cs.expiredRooms(now.Add(2*time.Hour), time.Hour)
+	if len(expired) != 1 || expired[0] != "scratch" {
+		t.Fatalf("expired = %v, want [scratch]", expired)
+	}
+	s.cs.Record(Event{Type: EventRoomExpire, Room: "scratch"})
+	if _, ok := s.cs.RoomInfo("scratch"); ok {
+		t.Fatal("scratch still exists after expiring")
+	}
+}
+
+func TestRetentionPrunesHistory(t *testing.T) {
+	t.Setenv("ADMIN_USERS", "root")
+	s := startServer(t)
+	path := filepath.Join(t.TempDir(), "events.log")
+	if err := s.cs.OpenEventLog(path, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	root := s.dialWebSocket(t, "root")
+	root.Send("/room retention messages 2")
+	root.Expect("Messages in lobby are now kept for: 2 messages")
+	for _, body := range []string{"one", "two", "three"} {
+		root.Send(body)
+		root.Expect("root: " + body)
+	}
+	s.cs.PruneHistory(time.Now())
+
+	var logged []string
+	events, err := ReadEvents(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ev := range events {
+		if ev.Type == EventMessage {
+			logged = append(logged, fmt.Sprintf("%d:%s", ev.Seq, ev.Body))
+		}
+	}
+	if got := strings.Join(logged, " "); got != "2:two 3:three" {
+		t.Fatalf("logged messages = %q, want %q", got, "2:two 3:three")
+	}
+
+	root.Send("/replay 1")
+	root.Expect("Some messages from 1 to 1 in lobby are no longer available")
+	root.Expect("root: two")
+}
+
+func TestBlockedUsersAreNotDelivered(t *testing.T) {
+	s := startServer(t)
+	alice := s.dialTCP(t, "alice")
+	bob := s.dialTCP(t, "bob")
+	carol := s.dialTCP(t, "carol")
+
+	bob.Send("/block alice")
+	bob.Expect("You will no longer receive messages from alice")
+	alice.Send("can you hear me")
+	carol.Expect("alice: can you hear me")
+	bob.ExpectNone("alice: can you hear me", 200*time.Millisecond)
+
+	bob.Send("/unblock alice")
+	bob.Expect("alice is no longer blocked")
+	alice.Send("now?")
+	bob.Expect("alice: now?")
+}
+
+func TestProfilesInWho(t *testing.T) {
+	s := startServer(t)
+	wendy := s.dialWebSocket(t, "wendy")
+	guest := s.dialTCP(t, "guest")
+
+	guest.Send("/profile status hi")
+	guest.Expect("log in to set up a profile")
+	wendy.Send("/profile avatar ftp://example.com/a.png")
+	wendy.Expect("avatar must be an http or https URL")
+	wendy.Send("/profile name Wendy Darling")
+	wendy.Expect("Profile updated")
+	wendy.Send("/profile status out flying")
+	wendy.Expect("Profile updated")
+
+	guest.Send("/who")
+	guest.Expect("wendy (Wendy Darling) - out flying")
+}
+
+func TestDoNotDisturbSuppressesMentions(t *testing.T) {
+	s := startServer(t)
+	alice := s.dialTCP(t, "alice")
+	bob := s.dialTCP(t, "bob")
+	bob.Send("/join den")
+	bob.Expect("No topic is set for den")
+
+	alice.Send("hey @bob, lunch?")
+	bob.Expect("alice mentioned you in lobby: hey @bob, lunch?")
+
+	bob.Send("/dnd focusing")
+	bob.Expect("Do not disturb is on")
+	alice.Send("@bob are you there")
+	alice.Expect("bob is busy (do not disturb): focusing")
+	bob.ExpectNone("mentioned you", 200*time.Millisecond)
+}
+
+func TestDigestEmailsMissedMentions(t *testing.T) {
+	t.Setenv("SMTP_ADDR", "127.0.0.1:25")
+	t.Setenv("SMTP_FROM", "chat@example.com")
+	s := startServer(t)
+	var sent []string
+	s.cs.Digest.send = func(addr string, auth smtp.Auth, from string, to []string, msg []byte) error {
+		sent = append(sent, strings.Join(to, ",")+"\n"+string(msg))
+		return nil
+	}
+
+	wendy := s.dialWebSocket(t, "wendy")
+	wendy.Send("/digest email wendy@example.com")
+	wendy.Expect("A confirmation code was emailed to wendy@example.com")
+	if len(sent) != 1 || !strings.HasPrefix(sent[0], "wendy@example.com\n") {
+		t.Fatalf("confirmation sent = %q", sent)
+	}
+	code := regexp.MustCompile(`/digest confirm ([0-9a-f]+)`).FindStringSubmatch(sent[0])
+	if code == nil {
+		t.Fatalf("no code in %q", sent[0])
+	}
+	sent = nil
+	wendy.Send("/digest")
+	wendy.Expect("Email digests are off")
+	wendy.Send("/digest confirm 00000000")
+	wendy.Expect("wrong confirmation code")
+	wendy.Send("/digest confirm " + code[1])
+	wendy.Expect("Email digests will be sent to wendy@example.com")
+	wendy.close()
+	deadline := time.Now().Add(testTimeout)
+	for s.cs.online("wendy") && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	alice := s.dialTCP(t, "alice")
+	alice.Send("@wendy the build is green")
+	for time.Now().Before(deadline) {
+		s.cs.Digest.mu.Lock()
+		missed := len(s.cs.Digest.missed["wendy"])
+		s.cs.Digest.mu.Unlock()
+		if missed > 0 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	s.cs.SendDigests(time.Now())
+	if len(sent) != 0 {
+		t.Fatal("digest sent before the offline period passed")
+	}
+	s.cs.SendDigests(time.Now().Add(2 * time.Hour))
+	if len(sent) != 1 || !strings.HasPrefix(sent[0], "wendy@example.com\n") || !strings.Contains(sent[0], "alice in lobby: @wendy the build is green") {
+		t.Fatalf("sent = %q", sent)
+	}
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	t.Setenv("LOGIN_BACKOFF", "1ns")
+	s := startServer(t)
+	tara := s.dialWebSocket(t, "tara")
+	tara.Send("/2fa setup")
+	tara.Expect("otpauth://totp/go-websocket:tara?")
+	s.cs.Mutex.Lock()
+	secret := s.cs.totpPending["tara"]
+	s.cs.Mutex.Unlock()
+	step := time.Now().Unix() / int64(totpPeriod.Seconds())
+	tara.Send("/2fa confirm " + totpCode(secret, step))
+	tara.Expect("Two-factor authentication is on")
+
+	login := func(code string) string {
+		conn, _, err := websocket.DefaultDialer.Dial(s.wsURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(testTimeout))
+		for _, reply := range []string{"1", "tara", "secret", code} {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				t.Fatal(err)
+			}
+			conn.WriteMessage(websocket.TextMessage, []byte(reply))
+		}
+		_, result, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(result)
+	}
+	if result := login("000000"); !strings.Contains(result, "Invalid two-factor code") && totpCode(secret, step+1) != "000000" {
+		t.Fatalf("wrong code: %s", result)
+	}
+	if result := login(totpCode(secret, step+1)); !strings.Contains(result, "logged in successfully") {
+		t.Fatalf("valid code: %s", result)
+	}
+	if result := login(totpCode(secret, step+1)); !strings.Contains(result, "Invalid two-factor code") {
+		t.Fatalf("replayed code: %s", result)
+	}
+}
+
+func TestMultipleDevices(t *testing.T) {
+	s := startServer(t)
+	alice := s.dialTCP(t, "alice")
+	phone := s.dialWebSocket(t, "sam")
+	alice.Expect("sam has joined the chat!")
+	laptop := s.dialWebSocket(t, "sam")
+	alice.ExpectNone("sam has joined", 200*time.Millisecond)
+
+	phone.Send("on my way")
+	laptop.Expect("sam: on my way")
+	alice.Expect("sam: on my way")
+
+	phone.Send("/sessions")
+	phone.Expect("(this session)")
+	phone.Send("/away")
+	alice.Expect("sam is away")
+	for _, c := range s.cs.sessionsOf("sam") {
+		if c.presence().Mode != PresenceAway {
+			t.Fatalf("session %d is %s", c.ID, c.presence().Mode)
+		}
+	}
+	deadline := time.Now().Add(testTimeout)
+
+	phone.Send("/sessions revoke others")
+	phone.Expect("Closed 1 session")
+	laptop.Expect("This session was closed from another device")
+	for time.Now().Before(deadline) && len(s.cs.sessionsOf("sam")) > 1 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	alice.ExpectNone("sam has left", 200*time.Millisecond)
+}
+
+// dialGuest connects a WebSocket client that continues as a guest
+func (s *testServer) dialGuest(t *testing.T) *testClient {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(s.wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	if _, menu, err := conn.ReadMessage(); err != nil || !strings.Contains(string(menu), "3. Continue as guest") {
+		t.Fatalf("menu = %q, %v", menu, err)
+	}
+	conn.SetReadDeadline(time.Time{})
+	conn.WriteMessage(websocket.TextMessage, []byte("3"))
+	guest := &testClient{t: t, name: "guest", lines: make(chan string, 100), send: func(text string) error {
+		return conn.WriteMessage(websocket.TextMessage, []byte(text))
+	}, close: conn.Close}
+	go func() {
+		defer close(guest.lines)
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var msg Message
+			json.Unmarshal(data, &msg)
+			guest.lines <- msg.Text()
+		}
+	}()
+	return guest
+}
+
+func TestGuestMode(t *testing.T) {
+	t.Setenv("GUEST_ACCESS", "limited")
+	t.Setenv("GUEST_RATE", "1")
+	s := startServer(t)
+	alice := s.dialTCP(t, "alice")
+	guest := s.dialGuest(t)
+	guest.Expect("can send up to 1 messages a minute. Register")
+	alice.Expect("guest-")
+
+	guest.Send("hello from a guest")
+	alice.Expect("hello from a guest")
+	guest.Send("and again")
+	guest.Expect("Guests can send 1 messages a minute")
+	guest.Send("/join secret-lair")
+	guest.Expect("secret-lair does not exist. Register to create your own rooms.")
+	alice.ExpectNone("and again", 100*time.Millisecond)
+}
+
+func TestGuestReadOnly(t *testing.T) {
+	t.Setenv("GUEST_ACCESS", "read")
+	s := startServer(t)
+	alice := s.dialWebSocket(t, "alice")
+	alice.Send("hello")
+	guest := s.dialGuest(t)
+	guest.Expect("can read along")
+	alice.Expect("guest-")
+
+	for _, req := range []string{
+		"hi there",
+		"/poll \"Lunch?\" pizza soup",
+		"/event \"Game night\" tomorrow 20:00",
+		"/rsvp ev1 yes",
+		"/schedule 1s later",
+		"/react last 👍",
+		`{"type":"snippet","body":"package main","language":"go"}`,
+		`{"type":"location","lat":52.5,"lon":13.4}`,
+		`{"type":"encrypted","ciphertext":"aGVsbG8="}`,
+		`{"type":"key","key":"aGVsbG8="}`,
+		`{"type":"reaction","id":"last","body":"👍"}`,
+		`{"type":"call.offer","call":"c1","signal":{"type":"offer"}}`,
+	} {
+		guest.Send(req)
+		guest.Expect("Guests can only read")
+	}
+	alice.ExpectNone("guest-", 200*time.Millisecond)
+}
+
+func TestLoginThrottling(t *testing.T) {
+	t.Setenv("LOGIN_MAX_FAILURES", "2")
+	t.Setenv("LOGIN_BACKOFF", "1ns")
+	s := startServer(t)
+	httpURL := "http" + strings.TrimSuffix(strings.TrimPrefix(s.wsURL, "ws"), "/ws")
+	login := func(password string) *http.Response {
+		body, _ := json.Marshal(map[string]string{"username": "victor", "password": password})
+		resp, err := http.Post(httpURL+"/tickets", "application/json", strings.NewReader(string(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	for i := 0; i < 2; i++ {
+		if resp := login("wrong"); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: status %d", i, resp.StatusCode)
+		}
+	}
+	resp := login("secret")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("locked out login: status %d", resp.StatusCode)
+	}
+	if entries := s.cs.AuditLog.Query(AuditEntry{Action: "login.locked", Target: "victor"}, time.Time{}, 10); len(entries) != 1 {
+		t.Fatalf("lockout audit entries = %v", entries)
+	}
+
+	// The WebSocket login is locked out for the same address
+	conn, _, err := websocket.DefaultDialer.Dial(s.wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	for _, reply := range []string{"1", "someone"} {
+		conn.ReadMessage()
+		conn.WriteMessage(websocket.TextMessage, []byte(reply))
+	}
+	if _, result, err := conn.ReadMessage(); err != nil || !strings.Contains(string(result), "Too many failed attempts") {
+		t.Fatalf("WebSocket login: %q, %v", result, err)
+	}
+}
+
+func TestLoginReservations(t *testing.T) {
+	t.Setenv("LOGIN_MAX_FAILURES", "2")
+	t.Setenv("LOGIN_BACKOFF", "1ns")
+	s := startServer(t)
+
+	// A second attempt waits while the first is being checked
+	done, wait := s.cs.Logins.Begin("10.0.0.1:1000", "victor")
+	if wait != 0 {
+		t.Fatalf("first attempt waits %s", wait)
+	}
+	if _, wait := s.cs.Logins.Begin("10.0.0.2:1000", "Victor"); wait == 0 {
+		t.Fatal("parallel attempt for the same username was not held back")
+	}
+	if _, wait := s.cs.Logins.Begin("10.0.0.1:2000", "walter"); wait == 0 {
+		t.Fatal("parallel attempt from the same address was not held back")
+	}
+	done()
+	done, wait = s.cs.Logins.Begin("10.0.0.2:1000", "victor")
+	if wait != 0 {
+		t.Fatalf("attempt after the first finished waits %s", wait)
+	}
+	done()
+
+	// Failed registrations do not lock the username out
+	for i := 0; i < 3; i++ {
+		s.cs.LoginFailed("register", "10.0.0.3:1000", "victor", "challenge failed")
+	}
+	if wait := s.cs.Logins.Wait("10.0.0.4:1000", "victor"); wait != 0 {
+		t.Fatalf("registration failures locked out the username for %s", wait)
+	}
+	if wait := s.cs.Logins.Wait("10.0.0.3:1000", ""); wait == 0 {
+		t.Fatal("registration failures were not counted against the address")
+	}
+}
+
+func TestRegistrationChallenge(t *testing.T) {
+	verifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		ok := r.Form.Get("secret") == "s3cret" && r.Form.Get("response") == "human"
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": ok, "error-codes": []string{"invalid-input-response"}})
+	}))
+	t.Cleanup(verifier.Close)
+	t.Setenv("CAPTCHA_PROVIDER", "turnstile")
+	t.Setenv("CAPTCHA_SECRET", "s3cret")
+	t.Setenv("CAPTCHA_VERIFY_URL", verifier.URL)
+	t.Setenv("LOGIN_BACKOFF", "1ns")
+	s := startServer(t)
+
+	register := func(name, token string) string {
+		conn, _, err := websocket.DefaultDialer.Dial(s.wsURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(testTimeout))
+		for _, reply := range []string{"2", name, "secret", token} {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				t.Fatal(err)
+			}
+			conn.WriteMessage(websocket.TextMessage, []byte(reply))
+		}
+		_, result, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(result)
+	}
+	if result := register("spambot", "robot"); !strings.Contains(result, "Challenge failed") {
+		t.Fatalf("failed challenge: %s", result)
+	}
+	if result := register("hannah", "human"); !strings.Contains(result, "hannah created successfully") {
+		t.Fatalf("passed challenge: %s", result)
+	}
+}
+
+func TestWebClientServed(t *testing.T) {
+	s := startServer(t)
+	httpURL := "http" + strings.TrimSuffix(strings.TrimPrefix(s.wsURL, "ws"), "/ws")
+	resp, err := http.Get(httpURL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	page, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") || !strings.Contains(string(page), `fetch("/tickets"`) {
+		t.Fatalf("GET / = %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if resp, err := http.Get(httpURL + "/index.html"); err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("GET /index.html = %v, %v", resp.StatusCode, err)
+	}
+}
+
+func TestTCPColors(t *testing.T) {
+	s := startServer(t)
+	alice := s.dialTCP(t, "alice")
+	bob := s.dialTCP(t, "bob")
+	bob.Send("/color on")
+	bob.Expect("Colors turned on")
+	alice.Send("hi")
+	bob.Expect(ansiNick("alice") + ": hi")
+
+	// A telnet client negotiating window size gets colors without asking
+	conn, err := net.Dial("tcp", s.tcpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(testTimeout))
+	conn.Write([]byte("\xff\xfb\x1f\xff\xfa\x1f\x00\x50\x00\x18\xff\xf0carol\r\n"))
+	s.waitForClient(t, "carol")
+	alice.Send("hello carol")
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		if strings.Contains(scanner.Text(), ansiNick("alice")+": hello carol") {
+			return
+		}
+	}
+	t.Fatalf("telnet client did not get colored text: %v", scanner.Err())
+}
+
+// recordingHooks records the hooks it is called for and refuses one room
+// and one word
+type recordingHooks struct {
+	NopHooks
+	mu     sync.Mutex
+	called []string
+}
+
+func (h *recordingHooks) record(event string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.called = append(h.called, event)
+}
+
+func (h *recordingHooks) recorded(event string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, e := range h.called {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *recordingHooks) OnAuthenticated(client *Client) error {
+	h.record("authenticated " + client.Name)
+	client.Notice("Welcome aboard")
+	return nil
+}
+
+func (h *recordingHooks) OnJoinRoom(client *Client, room string) error {
+	if room == "vault" {
+		return errors.New("closed for maintenance")
+	}
+	h.record("join " + client.Name + " " + room)
+	return nil
+}
+
+func (h *recordingHooks) OnMessage(client *Client, msg *Message) error {
+	if strings.Contains(msg.Body, "forbidden") {
+		return errors.New("that word is not allowed")
+	}
+	msg.Body = strings.ReplaceAll(msg.Body, "darn", "d**n")
+	return nil
+}
+
+func (h *recordingHooks) OnDisconnect(client *Client) {
+	h.record("disconnect " + client.Name)
+}
+
+func TestHooks(t *testing.T) {
+	s := startServer(t)
+	hooks := &recordingHooks{}
+	s.cs.RegisterHooks(hooks)
+
+	alice := s.dialWebSocket(t, "alice")
+	alice.Expect("Welcome aboard")
+	bob := s.dialTCP(t, "bob")
+	if !hooks.recorded("authenticated alice") || hooks.recorded("authenticated bob") {
+		t.Errorf("authenticated hooks: %v", hooks.called)
+	}
+	if !hooks.recorded("join bob lobby") {
+		t.Errorf("join hooks: %v", hooks.called)
+	}
+
+	bob.Send("/join vault")
+	bob.Expect("Cannot join vault: closed for maintenance")
+	bob.Send("this is forbidden")
+	bob.Expect("Message rejected: that word is not allowed")
+	bob.Send("darn it")
+	alice.Expect("bob: d**n it")
+
+	bob.close()
+	deadline := time.Now().Add(testTimeout)
+	for !hooks.recorded("disconnect bob") {
+		if time.Now().After(deadline) {
+			t.Fatalf("disconnect hook not called: %v", hooks.called)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAutomations(t *testing.T) {
+	t.Setenv("ADMIN_TOKENS", "ops:s3cret")
+	s := startServer(t)
+	httpURL := "http" + strings.TrimSuffix(strings.TrimPrefix(s.wsURL, "ws"), "/ws")
+	admin := func(method, name, body, token string) int {
+		t.Helper()
+		req, err := http.NewRequest(method, httpURL+"/admin/automations/"+name, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := admin("PUT", "faq", `{"trigger":"command","match":"/faq","script":"x"}`, "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("wrong token got %d", code)
+	}
+	if code := admin("PUT", "broken", `{"trigger":"message","script":"{{.User"}`, "s3cret"); code != http.StatusBadRequest {
+		t.Errorf("invalid script got %d", code)
+	}
+	faq := `{"trigger":"command","match":"/faq","script":"Docs for {{join .Args \" \"}}: https://example.com/{{index .Args 0}}","private":true}`
+	if code := admin("PUT", "faq", faq, "s3cret"); code != http.StatusOK {
+		t.Fatalf("creating faq got %d", code)
+	}
+	pong := `{"trigger":"message","match":"^ping (\\w+)$","script":"pong {{index .Match 1}} for {{.User}}"}`
+	if code := admin("PUT", "pong", pong, "s3cret"); code != http.StatusOK {
+		t.Fatalf("creating pong got %d", code)
+	}
+
+	alice := s.dialTCP(t, "alice")
+	bob := s.dialTCP(t, "bob")
+	alice.Send("/faq deploy")
+	alice.Expect("Docs for deploy: https://example.com/deploy")
+	alice.Send("ping server")
+	bob.Expect("pong [bot]: pong server for alice")
+	bob.ExpectNone("Docs for deploy", 100*time.Millisecond)
+
+	if code := admin("DELETE", "pong", "", "s3cret"); code != http.StatusNoContent {
+		t.Fatalf("deleting pong got %d", code)
+	}
+	alice.Send("ping again")
+	bob.Expect("alice: ping again")
+	bob.ExpectNone("pong again", 200*time.Millisecond)
+
+	entries := s.cs.AuditLog.Query(AuditEntry{Actor: "token:ops"}, time.Time{}, 10)
+	if len(entries) != 3 {
+		t.Errorf("audited %d admin actions, want 3", len(entries))
+	}
+}
+
+func TestAuditRoomChanges(t *testing.T) {
+	s := startServer(t)
+	alice := s.dialTCP(t, "alice")
+	bob := s.dialTCP(t, "bob")
+	s.cs.Mutex.Lock()
+	for _, c := range s.cs.Clients.All() {
+		c.Admin = c.Name == "alice"
+	}
+	s.cs.Mutex.Unlock()
+
+	alice.Send("/topic release on friday")
+	bob.Expect("release on friday")
+	alice.Send("/room description where releases happen")
+	alice.Expect("Description of lobby updated")
+	bob.Send("WHY IS EVERYONE SHOUTING IN HERE")
+	bob.Expect("You have been muted")
+
+	for _, want := range []AuditEntry{
+		{Actor: "alice", Action: "room.topic", Room: "lobby", Target: "release on friday"},
+		{Actor: "alice", Action: "room.description", Room: "lobby", Target: "where releases happen"},
+		{Actor: "server", Action: "spam.mute", Room: "lobby", Target: "bob"},
+	} {
+		if entries := s.cs.AuditLog.Query(want, time.Time{}, 10); len(entries) != 1 {
+			t.Errorf("audit entries for %+v: %v", want, entries)
+		}
+	}
+}
+
+func TestDelayedMessages(t *testing.T) {
+	s := startServer(t)
+	go s.cs.RunDelayedMessages()
+
+	alice := s.dialTCP(t, "alice")
+	bob := s.dialTCP(t, "bob")
+	alice.Send("/schedule 1s hello later")
+	alice.Expect("will be posted to")
+	alice.Send("/remind 1s stretch")
+	alice.Expect("Reminder")
+	alice.Send("/remind 1h never mind")
+	alice.Expect("Reminder")
+
+	s.cs.Mutex.Lock()
+	var cancel string
+	for id, d := range s.cs.Delayed {
+		if d.Body == "never mind" {
+			cancel = id
+		}
+	}
+	s.cs.Mutex.Unlock()
+	alice.Send("/remind cancel " + cancel)
+	alice.Expect("Cancelled " + cancel)
+
+	bob.Expect("alice: hello later")
+	alice.Expect("Reminder: stretch")
+	bob.ExpectNone("stretch", 200*time.Millisecond)
+	alice.Send("/remind list")
+	alice.Expect("Nothing scheduled")
+
+	// A scheduled message is checked again when it falls due
+	alice.Send("/schedule 1s posted while muted")
+	alice.Expect("will be posted to")
+	alice.Send("STOP SHOUTING AT EVERYONE IN HERE")
+	alice.Expect("You have been muted")
+	alice.Expect("was not posted to " + defaultRoom + ": You are muted")
+	bob.ExpectNone("posted while muted", 200*time.Millisecond)
+}
+
+func TestPolls(t *testing.T) {
+	s := startServer(t)
+	go s.cs.RunPolls()
+
+	alice := s.dialTCP(t, "alice")
+	bob := s.dialTCP(t, "bob")
+	alice.Send(`/poll 1s "Lunch?" pizza sushi`)
+	bob.Expect("alice started poll")
+
+	s.cs.Mutex.Lock()
+	var id string
+	for pid := range s.cs.Rooms[defaultRoom].Polls {
+		id = pid
+	}
+	s.cs.Mutex.Unlock()
+
+	bob.Send("/vote " + id + " 2")
+	bob.Expect("You voted for sushi")
+	bob.Send("/vote " + id + " pizza")
+	bob.Expect("You already voted in poll " + id)
+	alice.Send("/vote " + id + " Pizza")
+	alice.Expect("You voted for pizza")
+	bob.Send("/poll close " + id)
+	bob.Expect("Permission denied")
+
+	bob.Expect("Poll " + id + " closed: Lunch?")
+	bob.Expect("1. pizza (1)")
+	bob.Expect("2. sushi (1)")
+	alice.Send("/vote " + id + " 1")
+	alice.Expect("No such poll: " + id)
+}
+
+func TestPins(t *testing.T) {
+	s := startServer(t)
+	alice := s.dialTCP(t, "alice")
+	bob := s.dialTCP(t, "bob")
+	s.cs.Mutex.Lock()
+	for _, c := range s.cs.Clients.All() {
+		c.Admin = c.Name == "alice"
+	}
+	s.cs.Mutex.Unlock()
+
+	bob.Send("read the rules first")
+	alice.Expect("bob: read the rules first")
+	bob.Send("/pin last")
+	bob.Expect("Permission denied")
+	alice.Send("/pin last")
+	bob.Expect("alice pinned a message from bob: read the rules first")
+
+	carol := s.dialTCP(t, "carol")
+	carol.Expect("Pinned in " + defaultRoom + ":")
+	carol.Expect("bob: read the rules first")
+
+	id := s.cs.Pins(defaultRoom)[0].ID
+	alice.Send("/unpin " + id)
+	carol.Expect("alice unpinned a message")
+	carol.Send("/pins")
+	carol.Expect("No pinned messages in " + defaultRoom)
+}
+
+func TestExportHistory(t *testing.T) {
+	t.Setenv("ADMIN_TOKENS", "ops:s3cret")
+	s := startServer(t)
+	httpURL := "http" + strings.TrimSuffix(strings.TrimPrefix(s.wsURL, "ws"), "/ws")
+	alice := s.dialTCP(t, "alice")
+	bob := s.dialTCP(t, "bob")
+	alice.Send("first, with a comma")
+	bob.Expect("alice: first, with a comma")
+	alice.Send("second")
+	bob.Expect("alice: second")
+
+	export := func(query string) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest("GET", httpURL+"/admin/rooms/"+url.PathEscape(defaultRoom)+"/export?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer s3cret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	code, body := export("")
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	if code != http.StatusOK || len(lines) != 2 || !strings.Contains(lines[0], `"body":"first, with a comma"`) {
+		t.Fatalf("jsonl export got %d %q", code, body)
+	}
+	alice.Send("=1+2")
+	bob.Expect("alice: =1+2")
+	code, body = export("format=csv")
+	if code != http.StatusOK || !strings.HasPrefix(body, "id,room,seq,time,from,body\n") || !strings.Contains(body, `,alice,"first, with a comma"`) {
+		t.Fatalf("csv export got %d %q", code, body)
+	}
+	if !strings.Contains(body, ",alice,'=1+2\n") {
+		t.Fatalf("csv export runs formulas: %q", body)
+	}
+	code, body = export("since=" + url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339)))
+	if code != http.StatusOK || body != "" {
+		t.Fatalf("future export got %d %q", code, body)
+	}
+	if code, _ = export("format=xml"); code != http.StatusBadRequest {
+		t.Errorf("xml export got %d", code)
+	}
+
+	alice.Send("/export csv")
+	alice.Expect("Permission denied")
+}
+
+func TestEraseUser(t *testing.T) {
+	t.Setenv("ADMIN_TOKENS", "ops:s3cret")
+	t.Setenv("HISTORY_KEY", base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	snippetDir := t.TempDir()
+	t.Setenv("SNIPPET_DIR", snippetDir)
+	s := startServer(t)
+	path := filepath.Join(t.TempDir(), "events.log")
+	if err := s.cs.OpenEventLog(path, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	httpURL := "http" + strings.TrimSuffix(strings.TrimPrefix(s.wsURL, "ws"), "/ws")
+	admin := func(method, path string) (int, []byte) {
+		t.Helper()
+		req, err := http.NewRequest(method, httpURL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer s3cret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, body
+	}
+
+	alice := s.dialTCP(t, "alice")
+	bob := s.dialTCP(t, "bob")
+	alice.Send("my secret plans")
+	bob.Expect("alice: my secret plans")
+	bob.Send("sounds good")
+	alice.Expect("bob: sounds good")
+	s.cs.ShareSnippet(s.waitForClient(t, "alice"), &Request{Body: "func plan() {}", Language: "go"}, 0)
+	bob.Expect("func plan() {}")
+	s.cs.Mutex.Lock()
+	s.cs.PublicKeys["alice"] = "YWxpY2U="
+	s.cs.Mutex.Unlock()
+
+	code, body := admin("GET", "/admin/users/alice/export")
+	var data UserData
+	if err := json.Unmarshal(body, &data); err != nil || code != http.StatusOK {
+		t.Fatalf("export got %d %s", code, body)
+	}
+	if len(data.Messages) != 1 || data.Messages[0].Body != "my secret plans" {
+		t.Fatalf("exported messages %+v", data.Messages)
+	}
+	if len(data.Snippets) != 1 || data.Snippets[0].Body != "func plan() {}" || data.PublicKey != "YWxpY2U=" {
+		t.Fatalf("exported snippets %+v, public key %q", data.Snippets, data.PublicKey)
+	}
+
+	if code, body = admin("DELETE", "/admin/users/alice?messages=anonymize"); code != http.StatusOK {
+		t.Fatalf("anonymize got %d %s", code, body)
+	}
+	var erased struct{ Pseudonym string }
+	json.Unmarshal(body, &erased)
+	snippets, err := s.cs.Snippets.Of(erased.Pseudonym)
+	if err != nil || len(snippets) != 1 || snippets[0].Body != "func plan() {}" {
+		t.Fatalf("anonymized snippets %+v, %v", snippets, err)
+	}
+	if snippets, _ := s.cs.Snippets.Of("alice"); len(snippets) != 0 {
+		t.Fatalf("snippets still name alice: %+v", snippets)
+	}
+	s.cs.Mutex.Lock()
+	_, kept := s.cs.PublicKeys["alice"]
+	s.cs.Mutex.Unlock()
+	if kept {
+		t.Fatal("public key was not erased")
+	}
+
+	// The log is still readable and no longer names alice
+	s.cs.EventLog.Close()
+	replayed := NewChatServer()
+	if err := replayed.OpenEventLog(path, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	defer replayed.EventLog.Close()
+	var got []string
+	for _, msg := range replayed.Rooms[defaultRoom].Replay.Items() {
+		got = append(got, msg.From+": "+msg.Body)
+	}
+	if want := erased.Pseudonym + ": my secret plans\nbob: sounds good"; strings.Join(got, "\n") != want {
+		t.Fatalf("history after anonymizing:\n%s\nwant\n%s", strings.Join(got, "\n"), want)
+	}
+	events, _ := ReadEvents(path)
+	for _, ev := range events {
+		if ev.User == "alice" || strings.Contains(string(ev.Data), "alice") {
+			t.Errorf("event still names alice: %+v", ev)
+		}
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	t.Setenv("ADMIN_TOKENS", "ops:s3cret")
+	t.Setenv("SPAM_DETECTION", "true")
+	t.Setenv("MOTD", "old news")
+	s := startServer(t)
+	dir, _ := os.Getwd()
+	os.Chdir(t.TempDir())
+	t.Cleanup(func() { os.Chdir(dir) })
+	os.WriteFile(envFile, []byte("SPAM_DETECTION=false\nMOTD=fresh news\nADMIN_TOKENS=ops:s3cret\n"), 0o600)
+
+	httpURL := "http" + strings.TrimSuffix(strings.TrimPrefix(s.wsURL, "ws"), "/ws")
+	req, _ := http.NewRequest("POST", httpURL+"/admin/config/reload", nil)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var result struct{ Changed []string }
+	json.NewDecoder(resp.Body).Decode(&result)
+	if resp.StatusCode != http.StatusOK || strings.Join(result.Changed, ",") != "MOTD,SPAM_DETECTION" {
+		t.Fatalf("reload returned %d, changed %v", resp.StatusCode, result.Changed)
+	}
+	s.cs.Mutex.Lock()
+	enabled := s.cs.Spam.Enabled
+	s.cs.Mutex.Unlock()
+	if enabled {
+		t.Error("spam detection still enabled after reload")
+	}
+	alice := s.dialTCP(t, "alice")
+	alice.Expect("fresh news")
+}
+
+func TestStateSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	before := startServer(t)
+	httpURL := "http" + strings.TrimSuffix(strings.TrimPrefix(before.wsURL, "ws"), "/ws")
+	resp, err := http.Post(httpURL+"/poll/sessions?name=pat", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var session struct{ Session string }
+	json.NewDecoder(resp.Body).Decode(&session)
+	resp.Body.Close()
+	alice := before.dialTCP(t, "alice")
+	alice.Send("anyone polling?")
+	wendy := before.dialWebSocket(t, "wendy")
+	wendy.Send("/join dev")
+	deadline := time.Now().Add(testTimeout)
+	for len(before.cs.Clients.InRoom("dev")) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	before.cs.Mutex.Lock()
+	before.cs.Sessions[session.Session].Authenticated = true
+	before.cs.Mutex.Unlock()
+	if err := before.cs.SaveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	after := startServer(t)
+	after.cs.Mutex.Lock()
+	after.cs.Blocks["pat"] = map[string]bool{"mallory": true}
+	after.cs.Mutex.Unlock()
+	if err := after.cs.RestoreSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	if room := after.cs.startRoom(&Client{Name: "wendy", Authenticated: true}); room != "dev" {
+		t.Errorf("wendy rejoins %s, want dev", room)
+	}
+	if room := after.cs.startRoom(&Client{Name: "wendy", Authenticated: true}); room != defaultRoom {
+		t.Errorf("wendy rejoins %s a second time", room)
+	}
+
+	// The long-poll session carries on with the messages it had not fetched
+	httpURL = "http" + strings.TrimSuffix(strings.TrimPrefix(after.wsURL, "ws"), "/ws")
+	resp, err = http.Get(httpURL + "/poll?cursor=0&session=" + session.Session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "anyone polling?") {
+		t.Fatalf("poll after restore returned %d: %s", resp.StatusCode, body)
+	}
+	after.cs.Mutex.Lock()
+	pat := after.cs.Sessions[session.Session]
+	after.cs.Mutex.Unlock()
+	if !pat.Authenticated || pat.Admin || pat.Guest {
+		t.Errorf("restored session: authenticated %v, admin %v, guest %v", pat.Authenticated, pat.Admin, pat.Guest)
+	}
+	if !pat.blocksMessage(&Message{Type: MessageChat, Room: defaultRoom, From: "mallory", Body: "hi"}) {
+		t.Error("restored session does not block the users pat blocked")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	s := startServer(t)
+	alice := s.dialTCP(t, "alice")
+	bob := s.dialWebSocket(t, "bob")
+	alice.Expect("bob has joined the chat!")
+
+	// bob is warned a minute before the timeout, and sending resets it
+	now := time.Now()
+	s.cs.checkIdle(now.Add(4*time.Minute), 5*time.Minute, time.Minute)
+	bob.Expect("You will be disconnected for inactivity in 1m0s unless you send something")
+	bob.Send("still here")
+	alice.Expect("bob: still here")
+	s.cs.checkIdle(now.Add(5*time.Minute), 5*time.Minute, time.Minute)
+	alice.Expect("Disconnected after 5m0s without activity")
+	bob.Expect("alice was disconnected for being idle.")
+
+	bob.close()
+	deadline := time.Now().Add(testTimeout)
+	for len(s.cs.Clients.All()) != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	carol := s.dialTCP(t, "carol")
+	dave := s.dialTCP(t, "dave")
+	carol.Expect("dave has joined the chat!")
+	dave.close()
+	carol.Expect("dave has left the chat")
+}
+
+// stalledTransport is a connection whose writes wait until it is released
+type stalledTransport struct {
+	release chan struct{}
+	mu      sync.Mutex
+	sent    []string
+	closed  bool
+}
+
+func (t *stalledTransport) Send(data []byte) error {
+	<-t.release
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sent = append(t.sent, string(data))
+	return nil
+}
+
+func (t *stalledTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	return nil
+}
+
+func (t *stalledTransport) Remote() string { return "stalled" }
+
+func TestSlowConsumer(t *testing.T) {
+	t.Setenv("SEND_QUEUE_SIZE", "3")
+	cs := NewChatServer()
+	stalled := &stalledTransport{release: make(chan struct{})}
+	client := &Client{Name: "snail", Transport: stalled}
+	cs.AddClient(client)
+	for i := 1; i <= 10; i++ {
+		client.write([]byte(strconv.Itoa(i)))
+	}
+	close(stalled.release)
+	deadline := time.Now().Add(testTimeout)
+	for {
+		stalled.mu.Lock()
+		sent := strings.Join(stalled.sent, ",")
+		stalled.mu.Unlock()
+		if strings.HasSuffix(sent, "8,9,10") {
+			// At most the message being written when the queue filled gets through early
+			if n := len(strings.Split(sent, ",")); n > 4 {
+				t.Fatalf("sent %s, want the oldest dropped", sent)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("sent %s, want the last three", sent)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if dropped := cs.SlowConsumers.dropped.Load(); dropped < 6 {
+		t.Errorf("dropped %d messages, want at least 6", dropped)
+	}
+
+	t.Setenv("SLOW_CONSUMER_POLICY", "close")
+	stalled = &stalledTransport{release: make(chan struct{})}
+	client = &Client{Name: "snail", Transport: stalled}
+	cs.AddClient(client)
+	for i := 1; i <= 5; i++ {
+		client.write([]byte(strconv.Itoa(i)))
+	}
+	stalled.mu.Lock()
+	closed := stalled.closed
+	stalled.mu.Unlock()
+	if !closed || client.leaveReason(nil) != LeaveSlow || cs.SlowConsumers.disconnected.Load() != 1 {
+		t.Errorf("slow consumer closed %v, leave reason %s", closed, client.leaveReason(nil))
+	}
+	close(stalled.release)
+	cs.RemoveClient(client)
+}
+
+func TestThroughputQuota(t *testing.T) {
+	t.Setenv("ROOM_MESSAGE_RATE", "1")
+	t.Setenv("API_TOKENS", "ci:t0ken")
+	s := startServer(t)
+	alice := s.dialTCP(t, "alice")
+	bob := s.dialWebSocket(t, "bob")
+	alice.Expect("bob has joined")
+
+	alice.Send("first")
+	bob.Expect("first")
+	alice.Send("second")
+	alice.Expect("Too many messages in lobby right now")
+	bob.ExpectNone("second", 200*time.Millisecond)
+
+	bob.Send("third")
+	bob.Expect("Too many messages in lobby right now")
+
+	httpURL := "http" + strings.TrimSuffix(strings.TrimPrefix(s.wsURL, "ws"), "/ws")
+	req, _ := http.NewRequest("POST", httpURL+"/rooms/lobby/messages", strings.NewReader(`{"body":"from ci"}`))
+	req.Header.Set("Authorization", "Bearer t0ken")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("API post returned %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	// Every way of posting counts against the caps
+	for _, req := range []string{
+		`/poll "Lunch?" pizza soup`,
+		`{"type":"snippet","body":"package main","language":"go"}`,
+		`{"type":"location","lat":52.5,"lon":13.4}`,
+	} {
+		bob.Send(req)
+		bob.Expect("Too many messages in lobby right now")
+	}
+	var throttle *throttleError
+	if err := s.cs.PostMessage(&Message{Type: MessageChat, Room: "lobby", From: "bridge", Body: "relayed"}, 0); !errors.As(err, &throttle) {
+		t.Fatalf("PostMessage over the caps returned %v", err)
+	}
+	alice.ExpectNone("relayed", 200*time.Millisecond)
+}
+
+func TestHistoryBackpressure(t *testing.T) {
+	t.Setenv("SEND_QUEUE_SIZE", "4")
+	cs := NewChatServer()
+	stalled := &stalledTransport{release: make(chan struct{})}
+	client := &Client{Name: "snail", Transport: stalled}
+	cs.AddClient(client)
+	defer cs.RemoveClient(client)
+
+	var history []*Message
+	for seq := uint64(1); seq <= 50; seq++ {
+		history = append(history, &Message{Type: MessageChat, Room: "lobby", From: "alice", Body: "old news", Seq: seq})
+	}
+	done := make(chan struct{})
+	go func() {
+		cs.streamHistory(client, "lobby", 1, 0, history, 50)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if n, _ := client.backlog(); n > 4 {
+		t.Fatalf("%d messages queued for a stalled client", n)
+	}
+	close(stalled.release)
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatal("history stream did not finish")
+	}
+	deadline := time.Now().Add(testTimeout)
+	for {
+		stalled.mu.Lock()
+		sent := len(stalled.sent)
+		stalled.mu.Unlock()
+		if sent == 51 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("sent %d messages, want 50 and history.end", sent)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if dropped := cs.SlowConsumers.dropped.Load(); dropped != 0 {
+		t.Errorf("dropped %d history messages", dropped)
+	}
+}
+
+func TestTypedHandshake(t *testing.T) {
+	s := startServer(t)
+	dialer := websocket.Dialer{Subprotocols: []string{jsonSubprotocol}}
+	login := func(password string) []Message {
+		conn, _, err := dialer.Dial(s.wsURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(testTimeout))
+		var got []Message
+		read := func() {
+			var msg Message
+			if err := conn.ReadJSON(&msg); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, msg)
+		}
+		read()
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"hello","version":1,"features":["e2ee","teleport"]}`))
+		read()
+		for _, reply := range []string{"1", "alice", password} {
+			read()
+			conn.WriteMessage(websocket.TextMessage, []byte(reply))
+		}
+		read()
+		return got
+	}
+
+	codes := func(msgs []Message) string {
+		var s []string
+		for _, msg := range msgs {
+			s = append(s, msg.Type+":"+msg.Code)
+		}
+		return strings.Join(s, ",")
+	}
+	msgs := login("secret")
+	if got := codes(msgs); got != "hello:,hello:,prompt:prompt.menu,prompt:prompt.username,prompt:prompt.password,system:login.ok" {
+		t.Errorf("login sent %s", got)
+	}
+	if hello := msgs[0].Hello; hello.Version != ProtocolVersion || !slices.Contains(hello.Capabilities, FeatureE2EE) {
+		t.Errorf("server hello %+v", hello)
+	}
+	if features := msgs[1].Hello.Features; !slices.Equal(features, []string{FeatureE2EE}) {
+		t.Errorf("selected features %v, want only e2ee", features)
+	}
+
+	// Versions the server does not speak are refused
+	conn, _, err := dialer.Dial(s.wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	conn.ReadMessage()
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"hello","version":99}`))
+	var refused Message
+	if err := conn.ReadJSON(&refused); err != nil || refused.Code != CodeVersionUnsupported {
+		t.Errorf("version 99 got %+v, %v", refused, err)
+	}
+	conn.Close()
+
+	// After login errors carry codes for every client
+	conn, _, err = websocket.DefaultDialer.Dial(s.wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	for _, reply := range []string{"1", "bob", "secret", "/frobnicate"} {
+		conn.ReadMessage()
+		conn.WriteMessage(websocket.TextMessage, []byte(reply))
+	}
+	for {
+		var msg Message
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type == MessageError {
+			if msg.Code != CodeUnknownCommand {
+				t.Errorf("unknown command sent code %q", msg.Code)
+			}
+			break
+		}
+	}
+
+	if got := codes(login("wrong")); !strings.HasSuffix(got, "error:login.failed") {
+		t.Errorf("failed login sent %s", got)
+	}
+}
+
+func TestErrorFrames(t *testing.T) {
+	t.Setenv("ROOM_MESSAGE_RATE", "1")
+	s := startServer(t)
+	dialer := websocket.Dialer{Subprotocols: []string{jsonSubprotocol}}
+	dial := func(replies ...string) *websocket.Conn {
+		conn, _, err := dialer.Dial(s.wsURL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetReadDeadline(time.Now().Add(testTimeout))
+		conn.ReadMessage()
+		conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"hello","version":1}`))
+		conn.ReadMessage()
+		for _, reply := range replies {
+			conn.ReadMessage()
+			conn.WriteMessage(websocket.TextMessage, []byte(reply))
+		}
+		return conn
+	}
+	nextError := func(conn *websocket.Conn) Message {
+		t.Helper()
+		for {
+			var msg Message
+			if err := conn.ReadJSON(&msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type == MessageError {
+				return msg
+			}
+		}
+	}
+
+	// A menu answer that is not an option is refused before the connection closes
+	conn := dial("7")
+	if msg := nextError(conn); msg.Code != CodeMalformed || msg.Retryable {
+		t.Errorf("bad menu answer got %+v", msg)
+	}
+
+	conn = dial("1", "alice", "secret")
+	conn.WriteMessage(websocket.TextMessage, []byte("not a request"))
+	if msg := nextError(conn); msg.Code != CodeMalformed || msg.Retryable {
+		t.Errorf("plain text got %+v", msg)
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"chat","body":"one"}`))
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"chat","body":"two"}`))
+	if msg := nextError(conn); msg.Code != CodeThrottled || !msg.Retryable || msg.RetryAfter < 1 {
+		t.Errorf("throttled message got %+v", msg)
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"room.info","room":"nowhere"}`))
+	if msg := nextError(conn); msg.Code != CodeNoSuchRoom || msg.Retryable {
+		t.Errorf("unknown room got %+v", msg)
+	}
+}
+
+func TestInputSanitizing(t *testing.T) {
+	t.Setenv("ADMIN_USERS", "root")
+	s := startServer(t)
+
+	// Invalid and reserved nicknames are asked for again
+	conn, err := net.Dial("tcp", s.tcpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(testTimeout))
+	fmt.Fprint(conn, "mal lory\nroot\nmallory\n")
+	reader := bufio.NewReader(conn)
+	var got strings.Builder
+	for !strings.Contains(got.String(), "online") {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("%v after %q", err, got.String())
+		}
+		got.WriteString(line)
+	}
+	if n := strings.Count(got.String(), "Invalid nickname"); n != 2 {
+		t.Errorf("got %d invalid nickname notices in %q", n, got.String())
+	}
+
+	alice := s.dialTCP(t, "alice")
+	wendy := s.dialWebSocket(t, "wendy")
+	alice.Expect("wendy has joined")
+	wendy.Send("\x1b]0;pwned\x07hello \x1b[31mred\x1b[0m\x07")
+	alice.Expect("wendy: hello red")
+	wendy.Send(`{"type":"chat","body":"json \u001b[1mbold"}`)
+	alice.Expect("wendy: json bold")
+	wendy.Send("bad \xff utf-8")
+	wendy.Expect("valid UTF-8")
+	alice.ExpectNone("bad", 200*time.Millisecond)
+
+	httpURL := "http" + strings.TrimSuffix(strings.TrimPrefix(s.wsURL, "ws"), "/ws")
+	resp, err := http.Post(httpURL+"/poll/sessions?name=guest-1234", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("guest name for a poll session returned %d", resp.StatusCode)
+	}
+}
+
+func TestMarkdownRooms(t *testing.T) {
+	t.Setenv("ADMIN_USERS", "root")
+	s := startServer(t)
+	root := s.dialWebSocket(t, "root")
+	alice := s.dialTCP(t, "alice")
+	root.Expect("alice has joined")
+
+	lastHTML := func() string {
+		s.cs.Mutex.Lock()
+		defer s.cs.Mutex.Unlock()
+		items := s.cs.getRoom("lobby").Replay.Items()
+		return items[len(items)-1].HTML
+	}
+	alice.Send("**plain** text")
+	root.Expect("alice: **plain** text")
+	if html := lastHTML(); html != "" {
+		t.Errorf("plain room rendered %q", html)
+	}
+
+	alice.Send("/room format markdown")
+	alice.Expect("Permission denied")
+	root.Send("/room format markdown")
+	root.Expect("Messages in lobby are now shown as markdown")
+	if info, _ := s.cs.RoomInfo("lobby"); info.Format != FormatMarkdown {
+		t.Errorf("room format = %q", info.Format)
+	}
+
+	alice.Send("**bold** <script>alert(1)</script> [x](javascript:alert(1)) [docs](https://example.com/a_b_c)")
+	root.Expect("alice: **bold**")
+	want := `<p><strong>bold</strong> &lt;script&gt;alert(1)&lt;/script&gt; [x](javascript:alert(1)) <a href="https://example.com/a_b_c" rel="nofollow noopener" target="_blank">docs</a></p>`
+	if html := lastHTML(); html != want {
+		t.Errorf("rendered %q, want %q", html, want)
+	}
+
+	for text, want := range map[string]string{
+		"`*not* <b>`":          "<p><code>*not* &lt;b&gt;</code></p>",
+		"- one\n- _two_":       "<ul><li>one</li><li><em>two</em></li></ul>",
+		"> quoted\n\n~~gone~~": "<blockquote>quoted</blockquote><p><del>gone</del></p>",
+		"```\n<a>\n```":        "<pre><code>&lt;a&gt;</code></pre>",
+		`[a "b"](http://x/")`:  `<p><a href="http://x/&#34;" rel="nofollow noopener" target="_blank">a &#34;b&#34;</a></p>`,
+	} {
+		if got := renderMarkdown(text); got != want {
+			t.Errorf("renderMarkdown(%q) = %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestCustomEmoji(t *testing.T) {
+	t.Setenv("ADMIN_TOKENS", "ops:s3cret")
+	s := startServer(t)
+	httpURL := "http" + strings.TrimSuffix(strings.TrimPrefix(s.wsURL, "ws"), "/ws")
+	admin := func(method, name, body, token string) int {
+		t.Helper()
+		req, err := http.NewRequest(method, httpURL+"/admin/emoji/"+name, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 32)
+	if code := admin("PUT", "party", png, "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("wrong token got %d", code)
+	}
+	if code := admin("PUT", "Bad Name", png, "s3cret"); code != http.StatusBadRequest {
+		t.Errorf("invalid name got %d", code)
+	}
+	if code := admin("PUT", "script", "<script>alert(1)</script>", "s3cret"); code != http.StatusUnsupportedMediaType {
+		t.Errorf("HTML image got %d", code)
+	}
+	if code := admin("PUT", "party", png, "s3cret"); code != http.StatusOK {
+		t.Fatalf("uploading party got %d", code)
+	}
+	resp, err := http.Get(httpURL + "/emoji/party")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("emoji image got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	alice := s.dialTCP(t, "alice")
+	bob := s.dialWebSocket(t, "bob")
+	alice.Expect("bob has joined")
+	bob.Send(`{"type":"emoji.list"}`)
+	bob.Expect("Custom emoji: :party:")
+
+	alice.Send("ship it")
+	bob.Expect("alice: ship it")
+	bob.Send(`{"type":"reaction","id":"last","body":":party:"}`)
+	alice.Expect("bob reacted :party: to a message from alice")
+	alice.Send("/react last 👍🏽")
+	bob.Expect("alice reacted 👍🏽 to a message from alice")
+	alice.Send("/react last :nope:")
+	alice.Expect("Cannot react with :nope:")
+	alice.Send("/react last lol")
+	alice.Expect("Cannot react with lol")
+
+	if code := admin("DELETE", "party", "", "s3cret"); code != http.StatusNoContent {
+		t.Fatalf("deleting party got %d", code)
+	}
+	bob.Send(`{"type":"reaction","id":"last","body":":party:"}`)
+	bob.Expect("Cannot react with :party:")
+	bob.Send("/emoji")
+	bob.Expect("No custom emoji")
+}
+
+func TestCallSignaling(t *testing.T) {
+	t.Setenv("TURN_URLS", "turn:turn.example.com:3478")
+	t.Setenv("TURN_SECRET", "shared")
+	t.Setenv("TURN_TTL", "1h")
+	s := startServer(t)
+	alice := s.dialWebSocket(t, "alice")
+	bob := s.dialWebSocket(t, "bob")
+	carol := s.dialTCP(t, "carol")
+	alice.Expect("carol has joined")
+
+	offer := `{"type":"call.offer","call":"c1","signal":{"type":"offer","sdp":"v=0"}}`
+	alice.Send(offer)
+	bob.Expect("alice started call c1")
+	carol.ExpectNone("call c1", 200*time.Millisecond)
+	bob.Send(`{"type":"call.answer","call":"c1","to":"alice","signal":{"type":"answer","sdp":"v=0"}}`)
+	alice.Expect("bob answered call c1")
+	bob.Send(`{"type":"call.candidate","call":"c1","to":"alice","signal":{"candidate":"candidate:1 1 udp 1 10.0.0.1 5000 typ host"}}`)
+	alice.Expect("bob sent a connection candidate for call c1")
+	alice.Send(`{"type":"call.hangup","call":"c1"}`)
+	bob.Expect("alice left call c1")
+
+	alice.Send(`{"type":"call.offer","call":"c2"}`)
+	alice.Expect("Call signals need a signal")
+	alice.Send(`{"type":"call.offer","call":"c2","to":"carol","signal":{}}`)
+	alice.Expect("carol cannot take calls right now")
+
+	alice.Send(`{"type":"call.turn"}`)
+	alice.Expect("TURN credentials valid until")
+
+	now := time.Unix(1700000000, 0)
+	config, err := TURNCredentials("alice", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	turn := config.Servers[len(config.Servers)-1]
+	mac := hmac.New(sha1.New, []byte("shared"))
+	mac.Write([]byte("1700003600:alice"))
+	if turn.Username != "1700003600:alice" || turn.Credential != base64.StdEncoding.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("TURN credentials = %+v", turn)
+	}
+}
+
+func TestStreamAnnouncements(t *testing.T) {
+	s := startServer(t)
+	alice := s.dialWebSocket(t, "alice")
+	bob := s.dialTCP(t, "bob")
+	carol := s.dialTCP(t, "carol")
+	alice.Expect("carol has joined")
+	carol.Send("/join garage")
+	carol.Expect("No topic is set for garage")
+	carol.Send("/streams follow lobby")
+	carol.Expect("You will be told when someone in lobby starts streaming")
+
+	bob.Send("/stream")
+	bob.Expect("Usage: /stream")
+	bob.Send("/stream javascript:alert(1)")
+	bob.Expect("Invalid stream: streams need an http or https URL")
+	bob.Send("/stream screen https://example.com/live/bob Fixing the \x1b[31mbuild")
+	bob.Expect("Your stream is announced")
+	alice.Expect("bob is sharing their screen: Fixing the build https://example.com/live/bob")
+	carol.Expect("bob is sharing their screen: Fixing the build https://example.com/live/bob")
+
+	alice.Send(`{"type":"stream.start","stream":{"url":"https://example.com/live/alice","title":"Demo"}}`)
+	bob.Expect("alice is streaming: Demo https://example.com/live/alice")
+	carol.Send("/streams lobby")
+	carol.Expect("  bob is sharing their screen: Fixing the build https://example.com/live/bob")
+	carol.Expect("  alice is streaming: Demo https://example.com/live/alice")
+
+	// A stream outlives presence changes
+	bob.Send("/away lunch")
+	bob.Send("/streams")
+	bob.Expect("  bob is sharing their screen")
+
+	carol.Send("/streams unfollow lobby")
+	carol.Expect("You will no longer be told about streams in lobby")
+	bob.Send("/stream off")
+	bob.Expect("Your stream has ended")
+	alice.Expect("bob stopped streaming")
+	carol.ExpectNone("bob stopped streaming", 200*time.Millisecond)
+	bob.Send("/stream off")
+	bob.Expect("You are not streaming")
+
+	// Followers stop hearing about a room they can no longer see
+	carol.Send("/streams follow lobby")
+	carol.Expect("You will be told when someone in lobby starts streaming")
+	s.cs.Record(Event{Type: EventRoomVisibility, Room: "lobby", User: "alice", Body: VisibilityPrivate})
+	bob.Send("/stream https://example.com/live/bob2")
+	alice.Expect("bob is streaming https://example.com/live/bob2")
+	carol.ExpectNone("bob is streaming", 200*time.Millisecond)
+}
+
+func TestCalendarDuringRSVPs(t *testing.T) {
+	s := startServer(t)
+	httpURL := "http" + strings.TrimSuffix(strings.TrimPrefix(s.wsURL, "ws"), "/ws")
+	data, _ := json.Marshal(&ScheduledEvent{ID: "ev1", Room: "lobby", Title: "Game night", Start: time.Now().Add(time.Hour), Creator: "alice"})
+	s.cs.Record(Event{Type: EventRoomEventCreate, Room: "lobby", User: "alice", Target: "ev1", Data: data})
+
+	// RSVPs keep arriving while the calendar and the event list are read
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			s.cs.Record(Event{Type: EventRoomEventRSVP, Room: "lobby", User: fmt.Sprintf("user%d", i%200), Target: "ev1", Body: "yes"})
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		resp, err := http.Get(httpURL + "/rooms/lobby/events.ics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		for _, event := range s.cs.UpcomingEvents("lobby") {
+			event.Going()
+		}
+	}
+	close(stop)
+	<-done
+	for i := 0; i < 200; i++ {
+		s.cs.Record(Event{Type: EventRoomEventRSVP, Room: "lobby", User: fmt.Sprintf("user%d", i), Target: "ev1", Body: "yes"})
+	}
+
+	resp, err := http.Get(httpURL + "/rooms/lobby/events.ics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "200 going") {
+		t.Errorf("calendar = %s", body)
+	}
+
+	s.cs.Record(Event{Type: EventRoomVisibility, Room: "lobby", User: "alice", Body: VisibilityPrivate})
+	resp, err = http.Get(httpURL + "/rooms/lobby/events.ics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("calendar of a private room: status %d", resp.StatusCode)
+	}
+}
+
+func TestProfanityFilter(t *testing.T) {
+	if out, err := NewProfanityFilter(nil, true).Filter(nil, defaultRoom, "hello there"); err != nil || out != "hello there" {
+		t.Fatalf("empty word list: %q, %v", out, err)
+	}
+	if out, _ := NewProfanityFilter([]string{"smörgås"}, false).Filter(nil, defaultRoom, "a Smörgås please"); out != "a ******* please" {
+		t.Fatalf("masked to %q", out)
+	}
+}
+
+func TestAPISenderNames(t *testing.T) {
+	t.Setenv("API_TOKENS", "ci:t0ken")
+	s := startServer(t)
+	bob := s.dialWebSocket(t, "bob")
+	httpURL := "http" + strings.TrimSuffix(strings.TrimPrefix(s.wsURL, "ws"), "/ws")
+
+	post := func(path, body string) int {
+		req, _ := http.NewRequest("POST", httpURL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer t0ken")
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := post("/rooms/lobby/messages", `{"body":"hi","from":"admin"}`); status != http.StatusBadRequest {
+		t.Fatalf("posting as admin: status %d", status)
+	}
+	if status := post("/rooms/lobby/messages", `{"body":"hi","from":"bob\u001b[2J"}`); status != http.StatusBadRequest {
+		t.Fatalf("posting with escapes in the name: status %d", status)
+	}
+	if status := post("/rooms/lobby/messages", `{"body":"\u001b[2J"}`); status != http.StatusBadRequest {
+		t.Fatalf("posting only escapes: status %d", status)
+	}
+	if status := post("/hooks/slack/t0ken", `{"text":"hi","username":"root"}`); status != http.StatusBadRequest {
+		t.Fatalf("Slack post as root: status %d", status)
+	}
+	if status := post("/hooks/slack/t0ken", `{"text":"deployed","username":"deploy"}`); status != http.StatusOK {
+		t.Fatalf("Slack post: status %d", status)
+	}
+	bob.Expect("deploy: deployed")
+}
+
+func TestInviteUsesUnderContention(t *testing.T) {
+	s := startServer(t)
+	invite, err := s.cs.CreateInvite(&Client{Name: "alice", Authenticated: true}, "lobby", RoleMember, 1, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	var used atomic.Int32
+	start := make(chan struct{})
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			if s.cs.UseInvite(&Client{Name: fmt.Sprintf("user%d", i)}, "lobby", invite.Code) == nil {
+				used.Add(1)
+			}
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	if used.Load() != 1 {
+		t.Fatalf("a single-use invite was used %d times", used.Load())
+	}
+}
+
+func TestAnnounceSkipsLogins(t *testing.T) {
+	s := startServer(t)
+	alice := s.dialTCP(t, "alice")
+	bob := s.dialWebSocket(t, "bob")
+	alice.Expect("bob has joined the chat!")
+	bob.Send("/join dev")
+	alice.Expect("bob has left the room.")
+
+	conn, _, err := websocket.DefaultDialer.Dial(s.wsURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	if _, _, err := conn.ReadMessage(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.cs.Announce("alice", "restarting soon")
+	alice.Expect("restarting soon")
+	bob.Expect("restarting soon")
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, data, err := conn.ReadMessage(); err == nil {
+		t.Fatalf("client at the login prompt got %q", data)
+	}
+}
+
+func TestLocationTTL(t *testing.T) {
+	lat, lon := 52.5, 13.4
+	for _, ttl := range []int{-1, 8*3600 + 1, math.MaxInt64 / 1000, math.MaxInt} {
+		if err := validateLocation(&Request{Lat: &lat, Lon: &lon, TTL: ttl}, 8*time.Hour); err == nil {
+			t.Errorf("ttl %d was accepted", ttl)
+		}
+	}
+	if err := validateLocation(&Request{Lat: &lat, Lon: &lon, TTL: 8 * 3600}, 8*time.Hour); err != nil {
+		t.Errorf("ttl of 8h: %v", err)
+	}
+}
+
+func TestIRCTopicVisibility(t *testing.T) {
+	cs := NewChatServer()
+	cs.Record(Event{Type: EventRoomTopic, Room: "staff", User: "alice", Body: "secret plans"})
+	cs.Record(Event{Type: EventRoomVisibility, Room: "staff", User: "alice", Body: VisibilityPrivate})
+	client := &Client{Name: "mallory"}
+	session := &ircSession{server: "chat", nick: "mallory"}
+	var out strings.Builder
+	cs.handleIRCCommand(client, session, "TOPIC", []string{"#staff"}, func(line string) { out.WriteString(line) })
+	if got := out.String(); !strings.Contains(got, " 403 ") || strings.Contains(got, "secret plans") {
+		t.Fatalf("topic of a private room: %q", got)
+	}
+}
+
+func TestIRCNickValidation(t *testing.T) {
+	cs := NewChatServer()
+	server, conn := net.Pipe()
+	go cs.HandleIRCConnection(server)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(testTimeout))
+	lines := bufio.NewScanner(conn)
+
+	for _, nick := range []string{"[bot]", "admin"} {
+		fmt.Fprintf(conn, "NICK %s\r\n", nick)
+		if !lines.Scan() || !strings.Contains(lines.Text(), " 432 ") {
+			t.Fatalf("NICK %s: %q", nick, lines.Text())
+		}
+	}
+}
+
+func TestSpamCheckDuringReload(t *testing.T) {
+	cs := NewChatServer()
+	client := &Client{Name: "loud", Room: defaultRoom}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			cs.Mutex.Lock()
+			cs.Spam = NewSpamDetector()
+			cs.Mutex.Unlock()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		cs.Mutex.Lock()
+		client.spam.mutedUntil = time.Time{}
+		cs.Mutex.Unlock()
+		if refused := cs.CheckSpam(client, "THIS IS SHOUTING VERY LOUDLY"); refused == nil {
+			t.Fatal("shouting was not refused")
+		}
+	}
+	<-done
+}
+
+func TestAutomationOutputLimit(t *testing.T) {
+	a := &Automation{Name: "long", Trigger: TriggerJoin, Script: "x" + strings.Repeat("é", maxAutomationOutput)}
+	if err := a.compile(); err != nil {
+		t.Fatal(err)
+	}
+	out := a.run(automationInput{})
+	if !utf8.ValidString(out) || utf8.RuneCountInString(out) != maxAutomationOutput || !strings.HasSuffix(out, "é…") {
+		t.Fatalf("output of %d bytes, valid %v", len(out), utf8.ValidString(out))
+	}
+}
+
+func TestEnvMillis(t *testing.T) {
+	for value, want := range map[string]time.Duration{"": 10 * time.Second, "2500": 2500 * time.Millisecond, "10s": 10 * time.Second, "0": 10 * time.Second} {
+		t.Setenv("OTEL_EXPORTER_OTLP_TIMEOUT", value)
+		if got := envMillis("OTEL_EXPORTER_OTLP_TIMEOUT", 10*time.Second); got != want {
+			t.Errorf("OTEL_EXPORTER_OTLP_TIMEOUT=%q gives %s, want %s", value, got, want)
+		}
+	}
+}
+
+func TestClientAddrBehindProxy(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8")
+	proxies := trustedProxies()
+	r := httptest.NewRequest("GET", "/ws", nil)
+	r.Header.Set("X-Forwarded-For", "203.0.113.7, 10.0.0.2")
+	r.RemoteAddr = "10.0.0.1:443"
+	if got := clientAddr(proxies, r); got != "203.0.113.7" {
+		t.Errorf("behind a trusted proxy got %s", got)
+	}
+	r.RemoteAddr = "198.51.100.1:443"
+	if got := clientAddr(proxies, r); got != r.RemoteAddr {
+		t.Errorf("from an untrusted address got %s", got)
+	}
+}
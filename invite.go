@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Roles a user can hold in a room
+const (
+	RoleMember    = "member"
+	RoleModerator = "moderator"
+)
+
+// Invite is a shareable code that lets someone join a room, optionally granting a role
+type Invite struct {
+	Code    string     `json:"code"`
+	Room    string     `json:"room"`
+	Creator string     `json:"creator"`
+	Role    string     `json:"role"`
+	MaxUses int        `json:"max_uses,omitempty"`
+	Uses    int        `json:"uses"`
+	Expires *time.Time `json:"expires,omitempty"`
+	Created time.Time  `json:"created"`
+}
+
+// valid reports why an invite can no longer be used, or nil if it can
+func (i *Invite) valid(now time.Time) error {
+	if i.Expires != nil && now.After(*i.Expires) {
+		return errors.New("invite has expired")
+	}
+	if i.MaxUses > 0 && i.Uses >= i.MaxUses {
+		return errors.New("invite has been used up")
+	}
+	return nil
+}
+
+// inviteURL returns the shareable link for an invite code
+func inviteURL(code string) string {
+	if base := os.Getenv("INVITE_BASE_URL"); base != "" {
+		return strings.TrimRight(base, "/") + "/" + code
+	}
+	return code
+}
+
+// IsModerator reports whether a client may moderate a room: admins, and
+// authenticated users holding the moderator role in it
+func (cs *ChatServer) IsModerator(client *Client, room string) bool {
+	if client.Admin {
+		return true
+	}
+	if !client.Authenticated {
+		return false
+	}
+	cs.Mutex.Lock()
+	defer cs.Mutex.Unlock()
+	return cs.getRoom(room).Roles[client.Name] == RoleModerator
+}
+
+// CreateInvite records a new invite for a room
+func (cs *ChatServer) CreateInvite(client *Client, room, role string, maxUses int, ttl time.Duration) (*Invite, error) {
+	code, err := newID(6)
+	if err != nil {
+		return nil, err
+	}
+	invite := &Invite{
+		Code:    code,
+		Room:    room,
+		Creator: client.Name,
+		Role:    role,
+		MaxUses: maxUses,
+		Created: time.Now().UTC(),
+	}
+	if ttl > 0 {
+		expires := invite.Created.Add(ttl)
+		invite.Expires = &expires
+	}
+	data, err := json.Marshal(invite)
+	if err != nil {
+		return nil, err
+	}
+	cs.Record(Event{Type: EventInviteCreate, Room: room, User: client.Name, Target: code, Data: data})
+	cs.Audit(client, "invite.create", room, code, "")
+	return invite, nil
+}
+
+// UseInvite checks an invite for a room, counts the use and grants its role.
+// The use is counted under the same lock as the check, so concurrent joins
+// cannot use an invite more than MaxUses times.
+func (cs *ChatServer) UseInvite(client *Client, room, code string) error {
+	ev := Event{Type: EventInviteUse, Room: room, User: client.Name, Target: code, Time: time.Now().UTC()}
+	cs.Mutex.Lock()
+	invite, ok := cs.Invites[code]
+	var err error
+	if !ok || invite.Room != room {
+		err = errors.New("invalid invite")
+	} else {
+		err = invite.valid(ev.Time)
+	}
+	role := ""
+	if err == nil {
+		role = invite.Role
+		cs.applyEvent(ev)
+	}
+	cs.Mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	cs.appendEvent(ev)
+	if role == RoleModerator {
+		if !client.Authenticated {
+			client.Notice("Log in to receive the moderator role from this invite")
+			return nil
+		}
+		cs.Record(Event{Type: EventRoleGrant, Room: room, User: client.Name, Target: client.Name, Body: role})
+		cs.Audit(client, "role.grant", room, client.Name, "invite "+code)
+	}
+	return nil
+}
+
+// applyInviteEvent updates invites and roles for an event log entry. Caller must hold cs.Mutex.
+func (cs *ChatServer) applyInviteEvent(ev Event) {
+	switch ev.Type {
+	case EventInviteCreate:
+		var invite Invite
+		if err := json.Unmarshal(ev.Data, &invite); err != nil {
+			log.Println("Invalid invite in event log:", err)
+			return
+		}
+		cs.Invites[invite.Code] = &invite
+	case EventInviteUse:
+		if invite := cs.Invites[ev.Target]; invite != nil {
+			invite.Uses++
+		}
+	case EventInviteRevoke:
+		delete(cs.Invites, ev.Target)
+	case EventRoleGrant:
+		cs.getRoom(ev.Room).Roles[ev.Target] = ev.Body
+	}
+}
+
+// parseInviteOptions reads uses=N, expires=<duration> and role=<role> options
+func parseInviteOptions(args []string) (role string, maxUses int, ttl time.Duration, err error) {
+	role = RoleMember
+	ttl = envDuration("INVITE_DEFAULT_TTL", 24*time.Hour)
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return "", 0, 0, fmt.Errorf("invalid option %q", arg)
+		}
+		switch key {
+		case "uses":
+			maxUses, err = strconv.Atoi(value)
+			if err != nil || maxUses < 0 {
+				return "", 0, 0, errors.New("uses must be a non-negative number")
+			}
+		case "expires":
+			if value == "never" {
+				ttl = 0
+				continue
+			}
+			ttl, err = time.ParseDuration(value)
+			if err != nil || ttl <= 0 {
+				return "", 0, 0, errors.New("expires must be a duration such as 24h, or never")
+			}
+		case "role":
+			if value != RoleMember && value != RoleModerator {
+				return "", 0, 0, errors.New("role must be member or moderator")
+			}
+			role = value
+		default:
+			return "", 0, 0, fmt.Errorf("unknown option %q", key)
+		}
+	}
+	return role, maxUses, ttl, nil
+}
+
+// inviteCommand creates, lists and revokes the invites of the client's room
+func (cs *ChatServer) inviteCommand(client *Client, fields []string) {
+	usage := "Usage: /invite create [uses=N] [expires=24h|never] [role=member|moderator] | /invite list | /invite revoke <code> [reason] | /invite add|remove <user>"
+	if len(fields) < 2 {
+		client.Notice(usage)
+		return
+	}
+	if !cs.IsModerator(client, client.Room) {
+		client.Fail(CodePermissionDenied, "Permission denied")
+		return
+	}
+
+	switch fields[1] {
+	case "create":
+		role, maxUses, ttl, err := parseInviteOptions(fields[2:])
+		if err != nil {
+			client.Notice(err.Error())
+			return
+		}
+		if role == RoleModerator && !client.Admin {
+			client.Notice("Only admins can create moderator invites")
+			return
+		}
+		invite, err := cs.CreateInvite(client, client.Room, role, maxUses, ttl)
+		if err != nil {
+			log.Println("Error creating invite:", err)
+			client.Notice("Could not create invite")
+			return
+		}
+		client.Noticef("Invite to %s: %s (join with /join %s %s)", invite.Room, inviteURL(invite.Code), invite.Room, invite.Code)
+	case "list":
+		now := time.Now()
+		cs.Mutex.Lock()
+		var invites []Invite
+		for _, invite := range cs.Invites {
+			if invite.Room == client.Room && invite.valid(now) == nil {
+				invites = append(invites, *invite)
+			}
+		}
+		var invited []string
+		for name := range cs.getRoom(client.Room).Invited {
+			invited = append(invited, name)
+		}
+		cs.Mutex.Unlock()
+		if len(invites) == 0 && len(invited) == 0 {
+			client.Noticef("No outstanding invites for %s", client.Room)
+			return
+		}
+		sort.Slice(invites, func(i, j int) bool { return invites[i].Created.Before(invites[j].Created) })
+		sort.Strings(invited)
+		lines := []string{"Invites for " + client.Room}
+		if len(invited) > 0 {
+			lines = append(lines, "Invited users: "+strings.Join(invited, ", "))
+		}
+		for _, invite := range invites {
+			uses := fmt.Sprintf("%d uses", invite.Uses)
+			if invite.MaxUses > 0 {
+				uses = fmt.Sprintf("%d/%d uses", invite.Uses, invite.MaxUses)
+			}
+			expires := "never expires"
+			if invite.Expires != nil {
+				expires = "expires " + invite.Expires.Local().Format("Jan 2 15:04")
+			}
+			lines = append(lines, fmt.Sprintf("%s  %s, %s, %s, by %s", invite.Code, invite.Role, uses, expires, invite.Creator))
+		}
+		client.Notice(strings.Join(lines, "\n"))
+	case "revoke":
+		if len(fields) < 3 {
+			client.Notice(usage)
+			return
+		}
+		cs.Mutex.Lock()
+		invite, ok := cs.Invites[fields[2]]
+		ok = ok && invite.Room == client.Room
+		cs.Mutex.Unlock()
+		if !ok {
+			client.Noticef("No such invite: %s", fields[2])
+			return
+		}
+		cs.Record(Event{Type: EventInviteRevoke, Room: client.Room, User: client.Name, Target: fields[2]})
+		cs.Audit(client, "invite.revoke", client.Room, fields[2], strings.Join(fields[3:], " "))
+		client.Noticef("Invite %s revoked", fields[2])
+	case "add":
+		if len(fields) != 3 {
+			client.Notice(usage)
+			return
+		}
+		cs.Record(Event{Type: EventRoomInvite, Room: client.Room, User: client.Name, Target: fields[2]})
+		cs.Audit(client, "room.invite", client.Room, fields[2], "")
+		client.Noticef("%s may now join %s", fields[2], client.Room)
+	case "remove":
+		if len(fields) < 3 {
+			client.Notice(usage)
+			return
+		}
+		cs.Mutex.Lock()
+		ok := cs.getRoom(client.Room).Invited[fields[2]]
+		cs.Mutex.Unlock()
+		if !ok {
+			client.Noticef("%s is not invited to %s", fields[2], client.Room)
+			return
+		}
+		cs.Record(Event{Type: EventRoomUninvite, Room: client.Room, User: client.Name, Target: fields[2]})
+		cs.Audit(client, "room.uninvite", client.Room, fields[2], strings.Join(fields[3:], " "))
+		client.Noticef("%s is no longer invited to %s", fields[2], client.Room)
+	default:
+		client.Notice(usage)
+	}
+}
+
+// HandleGetInvite describes an invite so a shared link can show where it leads
+func (cs *ChatServer) HandleGetInvite(w http.ResponseWriter, r *http.Request) {
+	cs.Mutex.Lock()
+	invite, ok := cs.Invites[r.PathValue("code")]
+	var info map[string]interface{}
+	if ok {
+		if err := invite.valid(time.Now()); err != nil {
+			ok = false
+		} else {
+			info = map[string]interface{}{"room": invite.Room, "role": invite.Role, "expires": invite.Expires}
+			if invite.MaxUses > 0 {
+				info["uses_left"] = invite.MaxUses - invite.Uses
+			}
+		}
+	}
+	cs.Mutex.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "invite not found or no longer valid")
+		return
+	}
+	body, err := json.Marshal(info)
+	if err != nil {
+		log.Println("Error encoding invite:", err)
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	writeConditional(w, r, "application/json", body, time.Time{})
+}
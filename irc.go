@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Longest line accepted from an IRC client, including the trailing CRLF
+const maxIRCLine = 512
+
+// IRC nicknames: a letter or special character followed by up to 29 more
+var ircNickPattern = regexp.MustCompile(`^[A-Za-z\[\]\\` + "`" + `_^{|}][A-Za-z0-9\[\]\\` + "`" + `_^{|}-]{0,29}$`)
+
+// ircSession holds the IRC specific state of a client
+type ircSession struct {
+	conn   net.Conn
+	server string
+	nick   string
+	user   string
+}
+
+func (s *ircSession) Send(data []byte) error {
+	_, err := s.conn.Write(data)
+	return err
+}
+
+func (s *ircSession) Close() error {
+	return s.conn.Close()
+}
+
+func (s *ircSession) Remote() string {
+	return s.conn.RemoteAddr().String()
+}
+
+func (s *ircSession) Encode(msg *Message) []byte {
+	return []byte(s.format(msg))
+}
+
+// ircServerName returns the name the IRC listener uses as message prefix
+func ircServerName() string {
+	if name := os.Getenv("IRC_SERVER_NAME"); name != "" {
+		return name
+	}
+	return "chat"
+}
+
+// channel maps a room name to an IRC channel name
+func channel(room string) string {
+	return "#" + room
+}
+
+// reply formats a numeric or command sent by the server
+func (s *ircSession) reply(command string, params ...string) string {
+	target := s.nick
+	if target == "" {
+		target = "*"
+	}
+	line := ":" + s.server + " " + command + " " + target
+	for i, p := range params {
+		if i == len(params)-1 {
+			line += " :" + p
+		} else {
+			line += " " + p
+		}
+	}
+	return line + "\r\n"
+}
+
+// ircPrefix returns the nick!user@host prefix for a chat user
+func ircPrefix(name string) string {
+	return ":" + name + "!" + name + "@" + ircServerName()
+}
+
+// format renders a message as IRC protocol lines
+func (s *ircSession) format(msg *Message) string {
+	var b strings.Builder
+	switch msg.Type {
+	case MessageJoin:
+		b.WriteString(ircPrefix(msg.From) + " JOIN " + channel(msg.Room) + "\r\n")
+	case MessageLeave:
+		b.WriteString(ircPrefix(msg.From) + " PART " + channel(msg.Room) + " :" + msg.Body + "\r\n")
+	case MessageTopic:
+		b.WriteString(ircPrefix(msg.From) + " TOPIC " + channel(msg.Room) + " :" + msg.Body + "\r\n")
+	case MessageRoomInfo:
+		b.WriteString(s.topicReply(msg.Info))
+	case MessageChat, MessageSnippet, MessageLocation, MessagePoll:
+		text := msg.Body
+		if msg.Type != MessageChat {
+			text = msg.Text()
+		}
+		for _, a := range msg.Attachments {
+			text += " [" + a.Type + ": " + a.URL + "]"
+		}
+		for _, line := range strings.Split(text, "\n") {
+			b.WriteString(ircPrefix(msg.From) + " PRIVMSG " + channel(msg.Room) + " :" + line + "\r\n")
+		}
+	default:
+		for _, line := range strings.Split(msg.Text(), "\n") {
+			b.WriteString(s.reply("NOTICE", line))
+		}
+	}
+	return b.String()
+}
+
+// StartIRCServer accepts IRC clients on IRC_ADDR
+func (cs *ChatServer) StartIRCServer(addr string) {
+	listener, _, err := listen("tcp", addr)
+	if err != nil {
+		log.Fatal("IRC Server error:", err)
+	}
+	defer listener.Close()
+
+	log.Println("IRC server listening on", addr)
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Println("IRC connection error:", err)
+			continue
+		}
+		go cs.HandleIRCConnection(conn)
+	}
+}
+
+// nickInUse reports whether a connected client already uses a name
+func (cs *ChatServer) nickInUse(name string) bool {
+	cs.Mutex.Lock()
+	defer cs.Mutex.Unlock()
+	for _, client := range cs.Clients.All() {
+		if strings.EqualFold(client.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleIRCConnection handles a client speaking a subset of the IRC protocol
+func (cs *ChatServer) HandleIRCConnection(conn net.Conn) {
+	session := &ircSession{conn: conn, server: ircServerName()}
+	client := &Client{Transport: session, Address: session.Remote()}
+	defer conn.Close()
+
+	write := func(line string) {
+		client.writeMu.Lock()
+		defer client.writeMu.Unlock()
+		session.Send([]byte(line))
+	}
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, maxIRCLine), maxIRCLine)
+	registered := false
+	for scanner.Scan() {
+		line := cleanText(scanner.Text())
+		command, params := parseIRCLine(line)
+		if command == "" {
+			continue
+		}
+
+		if command != "PING" && command != "PONG" {
+			client.touch()
+		}
+
+		switch command {
+		case "PING":
+			write(":" + session.server + " PONG " + session.server + " :" + strings.Join(params, " ") + "\r\n")
+		case "PONG", "CAP":
+			// Capability negotiation is not supported; clients continue without it
+		case "QUIT":
+			return
+		case "NICK":
+			if len(params) == 0 {
+				write(session.reply("431", "No nickname given"))
+				continue
+			}
+			if registered {
+				write(session.reply("NOTICE", "Nickname changes are not supported"))
+				continue
+			}
+			if !ircNickPattern.MatchString(params[0]) {
+				write(session.reply("432", params[0], "Erroneous nickname"))
+				continue
+			}
+			if err := validateName(params[0], false); err != nil {
+				write(session.reply("432", params[0], "Erroneous nickname: "+err.Error()))
+				continue
+			}
+			if cs.nickInUse(params[0]) {
+				write(session.reply("433", params[0], "Nickname is already in use"))
+				continue
+			}
+			session.nick = params[0]
+		case "USER":
+			if len(params) < 4 {
+				write(session.reply("461", "USER", "Not enough parameters"))
+				continue
+			}
+			if registered {
+				write(session.reply("462", "You may not reregister"))
+				continue
+			}
+			session.user = params[0]
+		default:
+			if !registered {
+				write(session.reply("451", "You have not registered"))
+				continue
+			}
+			cs.handleIRCCommand(client, session, command, params, write)
+		}
+
+		if !registered && session.nick != "" && session.user != "" {
+			registered = true
+			client.Name = session.nick
+			if cs.AddClient(client) != nil {
+				return
+			}
+			defer cs.RemoveClient(client)
+			defer func() { cs.Disconnected(client, scanner.Err()) }()
+			cs.welcomeIRC(session, write)
+		}
+	}
+}
+
+// welcomeIRC sends the registration numerics and the message of the day
+func (cs *ChatServer) welcomeIRC(session *ircSession, write func(string)) {
+	write(session.reply("001", "Welcome to the chat, "+session.nick))
+	write(session.reply("002", "Your host is "+session.server))
+	write(session.reply("003", "This server bridges IRC channels to chat rooms"))
+	write(session.reply("004", session.server, "go-websocket", "o", "o"))
+	text := motd()
+	if text == "" {
+		write(session.reply("422", "MOTD File is missing"))
+		return
+	}
+	write(session.reply("375", "- "+session.server+" Message of the day -"))
+	for _, line := range strings.Split(text, "\n") {
+		write(session.reply("372", "- "+line))
+	}
+	write(session.reply("376", "End of /MOTD command"))
+}
+
+// handleIRCCommand runs a command from a registered IRC client
+func (cs *ChatServer) handleIRCCommand(client *Client, session *ircSession, command string, params []string, write func(string)) {
+	switch command {
+	case "JOIN":
+		if len(params) == 0 {
+			write(session.reply("461", "JOIN", "Not enough parameters"))
+			return
+		}
+		// Clients are in one room at a time, so only the first channel is joined
+		name := strings.SplitN(params[0], ",", 2)[0]
+		if !strings.HasPrefix(name, "#") || len(name) < 2 {
+			write(session.reply("403", name, "No such channel"))
+			return
+		}
+		room := strings.TrimPrefix(name, "#")
+		if room == client.Room {
+			return
+		}
+		key := ""
+		if len(params) > 1 {
+			key = strings.SplitN(params[1], ",", 2)[0]
+		}
+		if err := cs.CanJoin(client, room, key); err == errInviteOnly {
+			write(session.reply("473", name, "Cannot join channel (+i)"))
+			return
+		} else if err != nil {
+			write(session.reply("475", name, "Cannot join channel (+k)"))
+			return
+		}
+		if client.Room != "" {
+			write(ircPrefix(client.Name) + " PART " + channel(client.Room) + " :Switching channels\r\n")
+		}
+		write(ircPrefix(client.Name) + " JOIN " + channel(room) + "\r\n")
+		cs.JoinRoom(client, room, client.ID)
+		cs.ircNames(client, session, room, write)
+	case "PART":
+		if len(params) == 0 || strings.TrimPrefix(params[0], "#") != client.Room || client.Room == "" {
+			write(session.reply("442", strings.Join(params, " "), "You're not on that channel"))
+			return
+		}
+		write(ircPrefix(client.Name) + " PART " + channel(client.Room) + " :Leaving\r\n")
+		cs.LeaveRoom(client, client.ID)
+	case "TOPIC":
+		if len(params) == 0 {
+			write(session.reply("461", "TOPIC", "Not enough parameters"))
+			return
+		}
+		room := strings.TrimPrefix(params[0], "#")
+		if len(params) == 1 {
+			cs.Mutex.Lock()
+			r, ok := cs.Rooms[room]
+			visible := ok && cs.canSee(client, room, r)
+			cs.Mutex.Unlock()
+			info, ok := cs.RoomInfo(room)
+			if !ok || !visible {
+				write(session.reply("403", params[0], "No such channel"))
+				return
+			}
+			write(session.topicReply(info))
+			return
+		}
+		if room != client.Room || client.Room == "" {
+			write(session.reply("442", params[0], "You're not on that channel"))
+			return
+		}
+		if err := cs.SetTopic(client, room, params[1]); err != nil {
+			write(session.reply("482", params[0], "You're not channel operator"))
+		}
+	case "NAMES":
+		if client.Room != "" {
+			cs.ircNames(client, session, client.Room, write)
+		}
+	case "PRIVMSG", "NOTICE":
+		if len(params) < 2 {
+			write(session.reply("412", "No text to send"))
+			return
+		}
+		target, text := params[0], params[1]
+		if !strings.HasPrefix(target, "#") {
+			write(session.reply("401", target, "No such nick/channel"))
+			return
+		}
+		if strings.TrimPrefix(target, "#") != client.Room || client.Room == "" {
+			write(session.reply("404", target, "Cannot send to channel"))
+			return
+		}
+		if cs.HandleCommand(client, text, client.ID) {
+			return
+		}
+		cs.Chat(client, text, client.ID)
+	default:
+		// Anything else is passed to the chat commands, so /QUOTE EVENTS runs /events
+		cs.HandleCommand(client, "/"+strings.ToLower(command)+" "+strings.Join(params, " "), client.ID)
+	}
+}
+
+// topicReply renders the topic of a room as RPL_TOPIC, or RPL_NOTOPIC when it has none
+func (s *ircSession) topicReply(info *RoomInfo) string {
+	if info.Topic == "" {
+		return s.reply("331", channel(info.Name), "No topic is set")
+	}
+	return s.reply("332", channel(info.Name), info.Topic)
+}
+
+// ircNames sends the member list of a room
+func (cs *ChatServer) ircNames(client *Client, session *ircSession, room string, write func(string)) {
+	cs.Mutex.Lock()
+	var names []string
+	for _, c := range cs.Clients.All() {
+		if c.Room == room && c.Name != "" {
+			names = append(names, c.Name)
+		}
+	}
+	cs.Mutex.Unlock()
+	sort.Strings(names)
+	write(session.reply("353", "=", channel(room), strings.Join(names, " ")))
+	write(session.reply("366", channel(room), "End of /NAMES list"))
+}
+
+// parseIRCLine splits an IRC line into its upper case command and parameters
+func parseIRCLine(line string) (string, []string) {
+	// Prefixes sent by clients are ignored
+	if strings.HasPrefix(line, ":") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+	line, trailing, hasTrailing := strings.Cut(line, " :")
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil
+	}
+	params := fields[1:]
+	if hasTrailing {
+		params = append(params, trailing)
+	}
+	return strings.ToUpper(fields[0]), params
+}
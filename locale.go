@@ -0,0 +1,184 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Translations shipped with the server. template.json lists every message
+// with an empty translation for translators to start from.
+//
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+// catalog translates server messages, written in English in the code, into
+// one language. Messages without a translation stay in English.
+type catalog struct {
+	lang     string
+	messages map[string]string
+}
+
+// translate returns the translation of an English message
+func (c *catalog) translate(text string) string {
+	if c == nil {
+		return text
+	}
+	if t := c.messages[text]; t != "" {
+		return t
+	}
+	return text
+}
+
+// LoadLocales reads the shipped catalogs and any in LOCALE_DIR, which take
+// precedence. Catalogs are JSON objects named after their language tag, such
+// as de.json or pt-br.json.
+func LoadLocales() map[string]*catalog {
+	locales := make(map[string]*catalog)
+	load := func(fsys fs.FS, dir string) {
+		names, err := fs.Glob(fsys, path.Join(dir, "*.json"))
+		if err != nil {
+			return
+		}
+		for _, name := range names {
+			lang := strings.ToLower(strings.TrimSuffix(path.Base(name), ".json"))
+			if lang == "template" || lang == "en" {
+				continue
+			}
+			data, err := fs.ReadFile(fsys, name)
+			if err != nil {
+				log.Println("Error reading locale:", err)
+				continue
+			}
+			c := &catalog{lang: lang}
+			if err := json.Unmarshal(data, &c.messages); err != nil {
+				log.Printf("Invalid locale %s: %v", name, err)
+				continue
+			}
+			locales[lang] = c
+		}
+	}
+	load(localeFiles, "locales")
+	if dir := os.Getenv("LOCALE_DIR"); dir != "" {
+		load(os.DirFS(dir), ".")
+	}
+	return locales
+}
+
+// Locale finds the catalog for a language tag, falling back from a regional
+// variant such as pt-BR to its language. It returns nil for English and for
+// languages without a catalog.
+func (cs *ChatServer) Locale(tag string) (*catalog, bool) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if tag == "en" || strings.HasPrefix(tag, "en-") {
+		return nil, true
+	}
+	if c, ok := cs.Locales[tag]; ok {
+		return c, true
+	}
+	if base, _, ok := strings.Cut(tag, "-"); ok {
+		if c, ok := cs.Locales[base]; ok {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// NegotiateLocale picks the preferred available language of an
+// Accept-Language header
+func (cs *ChatServer) NegotiateLocale(header string) *catalog {
+	type choice struct {
+		tag string
+		q   float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		if tag != "" && tag != "*" && q > 0 {
+			choices = append(choices, choice{tag, q})
+		}
+	}
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].q > choices[j].q })
+	for _, c := range choices {
+		if locale, ok := cs.Locale(c.tag); ok {
+			return locale
+		}
+	}
+	return nil
+}
+
+// T translates a server message into the client's language and formats it
+func (c *Client) T(format string, args ...interface{}) string {
+	text := c.locale.Load().translate(format)
+	if len(args) == 0 {
+		return text
+	}
+	return fmt.Sprintf(text, args...)
+}
+
+// Noticef sends a formatted system message to the client in its language
+func (c *Client) Noticef(format string, args ...interface{}) error {
+	return c.Send(&Message{Type: MessageSystem, Body: c.T(format, args...)})
+}
+
+// localize returns the message as a client reads it in its language. Only
+// server messages built with setText are translated.
+func (c *Client) localize(msg *Message) *Message {
+	locale := c.locale.Load()
+	if locale == nil || msg.format == "" {
+		return msg
+	}
+	local := *msg
+	local.Body = fmt.Sprintf(locale.translate(msg.format), msg.args...)
+	return &local
+}
+
+// setText sets the body of a server message from an English format, keeping
+// the format so recipients can read it in their own language
+func (m *Message) setText(format string, args ...interface{}) *Message {
+	m.format = format
+	m.args = args
+	m.Body = fmt.Sprintf(format, args...)
+	return m
+}
+
+// SetLocale changes the language of a client's server messages
+func (cs *ChatServer) SetLocale(client *Client, tag string) error {
+	locale, ok := cs.Locale(tag)
+	if !ok {
+		return fmt.Errorf("no translation for %s", tag)
+	}
+	client.locale.Store(locale)
+	return nil
+}
+
+// langCommand shows the available languages or changes the client's
+func (cs *ChatServer) langCommand(client *Client, fields []string) {
+	if len(fields) != 2 {
+		langs := []string{"en"}
+		for lang := range cs.Locales {
+			langs = append(langs, lang)
+		}
+		sort.Strings(langs)
+		client.Fail(CodeUsage, "Usage: /lang <language>. Available: %s", strings.Join(langs, ", "))
+		return
+	}
+	if err := cs.SetLocale(client, fields[1]); err != nil {
+		client.Noticef("No translation for %s", fields[1])
+		return
+	}
+	client.Notice("Language changed")
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var updateTemplate = flag.Bool("update", false, "rewrite locales/template.json from the source")
+
+// catalogMessages finds the English messages passed to Notice, Noticef, T
+// and setText, and after the code to Fail and the handshake writers, in the
+// server's source
+func catalogMessages(t *testing.T) []string {
+	t.Helper()
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	fset := token.NewFileSet()
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, name, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok || len(call.Args) == 0 {
+				return true
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			arg := 0
+			switch sel.Sel.Name {
+			case "Notice", "Noticef", "T", "setText":
+			case "Fail", "prompt", "fail", "succeed":
+				if arg = 1; len(call.Args) < 2 {
+					return true
+				}
+			default:
+				return true
+			}
+			if lit, ok := call.Args[arg].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+				if s, err := strconv.Unquote(lit.Value); err == nil {
+					seen[s] = true
+				}
+			}
+			return true
+		})
+	}
+	messages := make([]string, 0, len(seen))
+	for s := range seen {
+		messages = append(messages, s)
+	}
+	sort.Strings(messages)
+	return messages
+}
+
+func TestLocaleTemplateIsComplete(t *testing.T) {
+	messages := catalogMessages(t)
+	path := filepath.Join("locales", "template.json")
+	if *updateTemplate {
+		template := make(map[string]string, len(messages))
+		for _, s := range messages {
+			template[s] = ""
+		}
+		data, err := json.MarshalIndent(template, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var template map[string]string
+	if err := json.Unmarshal(data, &template); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range messages {
+		if _, ok := template[s]; !ok {
+			t.Errorf("%s is missing %q, run go test -run TestLocaleTemplate -update", path, s)
+		}
+	}
+}
+
+func TestLocalizedMessages(t *testing.T) {
+	dir := t.TempDir()
+	german := `{"Unknown command: %s": "Unbekannter Befehl: %s", "%s has joined the chat!": "%s ist dem Chat beigetreten!"}`
+	if err := os.WriteFile(filepath.Join(dir, "de.json"), []byte(german), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("LOCALE_DIR", dir)
+	s := startServer(t)
+
+	if locale := s.cs.NegotiateLocale("fr;q=0.9, de-AT, en;q=0.5"); locale == nil || locale.lang != "de" {
+		t.Fatalf("negotiated %v", locale)
+	}
+
+	header := http.Header{"Accept-Language": {"de-DE,de;q=0.9"}}
+	conn, _, err := websocket.DefaultDialer.Dial(s.wsURL, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+	for _, reply := range []string{"1", "dora", "secret"} {
+		conn.ReadMessage()
+		conn.WriteMessage(websocket.TextMessage, []byte(reply))
+	}
+	s.waitForClient(t, "dora")
+	expect := func(want string) {
+		t.Helper()
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				t.Fatalf("waiting for %q: %v", want, err)
+			}
+			if strings.Contains(string(data), want) {
+				return
+			}
+		}
+	}
+
+	conn.WriteMessage(websocket.TextMessage, []byte("/frobnicate"))
+	expect("Unbekannter Befehl: /frobnicate")
+	s.dialTCP(t, "erik")
+	expect("erik ist dem Chat beigetreten!")
+
+	conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"locale","body":"en"}`))
+	conn.WriteMessage(websocket.TextMessage, []byte("/frobnicate"))
+	expect("Unknown command: /frobnicate")
+}
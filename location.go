@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Longest label accepted on a shared location
+const maxLocationLabel = 100
+
+// Location is a position shared in a room. Live locations can be updated by
+// their owner until they expire.
+type Location struct {
+	ID      string     `json:"id"`
+	Lat     float64    `json:"lat"`
+	Lon     float64    `json:"lon"`
+	Label   string     `json:"label,omitempty"`
+	Live    bool       `json:"live"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// liveLocation tracks who may update a live location and until when
+type liveLocation struct {
+	owner   ClientID
+	room    string
+	label   string
+	expires time.Time
+}
+
+// validateLocation checks the coordinates, label and TTL of a location request
+func validateLocation(req *Request, maxTTL time.Duration) error {
+	if req.Lat == nil || req.Lon == nil {
+		return fmt.Errorf("lat and lon are required")
+	}
+	lat, lon := *req.Lat, *req.Lon
+	if math.IsNaN(lat) || lat < -90 || lat > 90 {
+		return fmt.Errorf("lat must be between -90 and 90")
+	}
+	if math.IsNaN(lon) || lon < -180 || lon > 180 {
+		return fmt.Errorf("lon must be between -180 and 180")
+	}
+	if !utf8.ValidString(req.Label) || utf8.RuneCountInString(req.Label) > maxLocationLabel {
+		return fmt.Errorf("label must be at most %d characters", maxLocationLabel)
+	}
+	// Compared in seconds, since a huge TTL would overflow a time.Duration
+	// and wrap around to a short or negative one
+	if req.TTL < 0 || int64(req.TTL) > int64(maxTTL/time.Second) {
+		return fmt.Errorf("ttl must be between 0 and %d seconds", int(maxTTL.Seconds()))
+	}
+	return nil
+}
+
+// ShareLocation broadcasts a location sent by a client, creating or updating a live location
+func (cs *ChatServer) ShareLocation(client *Client, req *Request, sender ClientID) {
+	maxTTL := envDuration("LOCATION_MAX_TTL", 8*time.Hour)
+	if err := validateLocation(req, maxTTL); err != nil {
+		client.Noticef("Invalid location: %s", err.Error())
+		return
+	}
+
+	now := time.Now()
+	cs.Mutex.Lock()
+	if client.locationLimiter == nil {
+		perMinute := envInt("LOCATION_RATE", 12)
+		client.locationLimiter = NewRateLimiter(float64(perMinute)/60, perMinute)
+	}
+	limiter := client.locationLimiter
+	cs.Mutex.Unlock()
+	if !limiter.Allow() {
+		client.Notice("You are sharing your location too often")
+		return
+	}
+	if !cs.admitMessage(client, client.Room) {
+		return
+	}
+
+	loc := &Location{Lat: *req.Lat, Lon: *req.Lon, Label: strings.TrimSpace(req.Label)}
+	cs.Mutex.Lock()
+	// Forget live locations that have run out
+	for id, live := range cs.Locations {
+		if now.After(live.expires) {
+			delete(cs.Locations, id)
+		}
+	}
+	if req.ID != "" {
+		live, ok := cs.Locations[req.ID]
+		if !ok || live.owner != client.ID || live.room != client.Room {
+			cs.Mutex.Unlock()
+			client.Noticef("No live location %s to update", req.ID)
+			return
+		}
+		loc.ID, loc.Live = req.ID, true
+		if loc.Label == "" {
+			loc.Label = live.label
+		}
+		expires := live.expires
+		loc.Expires = &expires
+	} else {
+		id, err := newID(4)
+		if err != nil {
+			cs.Mutex.Unlock()
+			client.Notice("Could not share location")
+			return
+		}
+		loc.ID = id
+		if req.TTL > 0 {
+			expires := now.Add(time.Duration(req.TTL) * time.Second).UTC()
+			loc.Live, loc.Expires = true, &expires
+			cs.Locations[id] = &liveLocation{owner: client.ID, room: client.Room, label: loc.Label, expires: expires}
+		}
+	}
+	cs.Mutex.Unlock()
+
+	msg := &Message{Type: MessageLocation, Room: client.Room, From: client.Name, Body: loc.Label, Location: loc}
+	if cs.archive(msg) != nil {
+		client.Notice("Could not share location")
+		return
+	}
+	client.Send(msg)
+	cs.Broadcast(msg.Room, msg, sender)
+	cs.NotifyWebhooks(msg)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loginFailures counts the recent failed attempts for one address or username
+type loginFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+// LoginGuard throttles logins and registrations so passwords cannot be
+// guessed through the auth service. After each failure for an address or a
+// username the next attempt has to wait twice as long, starting at
+// LOGIN_BACKOFF, and LOGIN_MAX_FAILURES failures lock it out for
+// LOGIN_LOCKOUT. Failures are forgotten after LOGIN_LOCKOUT without one.
+// Only one attempt per address or username is checked at a time, so
+// parallel connections cannot all guess within one backoff.
+type LoginGuard struct {
+	maxFailures int
+	backoff     time.Duration
+	lockout     time.Duration
+
+	mu       sync.Mutex
+	failures map[string]*loginFailures
+	inFlight map[string]bool
+}
+
+// NewLoginGuard creates a guard configured from the environment
+func NewLoginGuard() *LoginGuard {
+	return &LoginGuard{
+		maxFailures: envInt("LOGIN_MAX_FAILURES", 5),
+		backoff:     envDuration("LOGIN_BACKOFF", time.Second),
+		lockout:     envDuration("LOGIN_LOCKOUT", 15*time.Minute),
+		failures:    make(map[string]*loginFailures),
+		inFlight:    make(map[string]bool),
+	}
+}
+
+// loginKeys names the counters an attempt from an address for a username
+// is throttled by. Ports are dropped so each connection counts as the same
+// address.
+func loginKeys(address, username string) []string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	keys := []string{"ip:" + address}
+	if username = strings.TrimSpace(username); username != "" {
+		keys = append(keys, "user:"+strings.ToLower(username))
+	}
+	return keys
+}
+
+// Wait returns how long an address has to wait before trying to log in as
+// a username, or 0 if it may try now
+func (g *LoginGuard) Wait(address, username string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.waitLocked(time.Now(), loginKeys(address, username))
+}
+
+// Begin reserves the check of an attempt from an address as a username. It
+// returns how long to wait if the attempt may not be made now, or else a
+// function to call once the attempt's failure, if any, has been counted.
+func (g *LoginGuard) Begin(address, username string) (func(), time.Duration) {
+	keys := loginKeys(address, username)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	wait := g.waitLocked(time.Now(), keys)
+	for _, key := range keys {
+		if wait == 0 && g.inFlight[key] {
+			wait = max(g.backoff, time.Second)
+		}
+	}
+	if wait > 0 {
+		return nil, wait
+	}
+	for _, key := range keys {
+		g.inFlight[key] = true
+	}
+	return func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		for _, key := range keys {
+			delete(g.inFlight, key)
+		}
+	}, 0
+}
+
+// waitLocked returns how long attempts counted by keys have to wait. Caller
+// must hold g.mu.
+func (g *LoginGuard) waitLocked(now time.Time, keys []string) time.Duration {
+	var wait time.Duration
+	for _, key := range keys {
+		f := g.failures[key]
+		if f == nil {
+			continue
+		}
+		until := f.lockedUntil
+		if f.count < g.maxFailures {
+			delay := g.backoff << (f.count - 1)
+			if delay <= 0 || delay > g.lockout {
+				delay = g.lockout
+			}
+			until = f.last.Add(delay)
+		}
+		if d := until.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// Failed counts a failed attempt and reports whether it locked the address
+// or username out
+func (g *LoginGuard) Failed(address, username string) bool {
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	// Forget counters that have gone quiet
+	for key, f := range g.failures {
+		if now.Sub(f.last) > g.lockout && now.After(f.lockedUntil) {
+			delete(g.failures, key)
+		}
+	}
+	locked := false
+	for _, key := range loginKeys(address, username) {
+		f := g.failures[key]
+		if f == nil {
+			f = &loginFailures{}
+			g.failures[key] = f
+		}
+		f.count++
+		f.last = now
+		if f.count >= g.maxFailures && now.After(f.lockedUntil) {
+			f.lockedUntil = now.Add(g.lockout)
+			locked = true
+		}
+	}
+	return locked
+}
+
+// Succeeded clears the failures counted against a username. The address
+// keeps its count so logging in to one account does not reset guessing at
+// another.
+func (g *LoginGuard) Succeeded(username string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.failures, "user:"+strings.ToLower(strings.TrimSpace(username)))
+}
+
+// LoginFailed counts a failed login or registration and audits it. Failed
+// registrations only count against the address, or anyone could lock an
+// account out by failing to register its name.
+func (cs *ChatServer) LoginFailed(action, address, username, reason string) {
+	counted := username
+	if action == "register" {
+		counted = ""
+	}
+	locked := cs.Logins.Failed(address, counted)
+	cs.auditLogin(action+".failed", address, username, reason)
+	if locked {
+		log.Printf("Locked out logins from %s or as %s after repeated failures", address, username)
+		cs.auditLogin(action+".locked", address, username, "")
+	}
+}
+
+// auditLogin records a login event, naming the remote address as the actor
+func (cs *ChatServer) auditLogin(action, address, username, reason string) {
+	entry := AuditEntry{
+		Time:   time.Now().UTC(),
+		Actor:  address,
+		Action: action,
+		Target: username,
+		Reason: reason,
+	}
+	if err := cs.AuditLog.Add(entry); err != nil {
+		log.Println("Audit log error:", err)
+	}
+}
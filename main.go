@@ -1,9 +1,11 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"net"
 	"net/http"
@@ -11,93 +13,373 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gorilla/websocket"
 	"github.com/joho/godotenv"
 )
 
-// Load environment variables
+// Load environment variables. Without a .env file, as in tests, only the
+// process environment is used.
 func init() {
-	err := godotenv.Load(".env")
-	if err != nil {
+	err := godotenv.Load(envFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
 		log.Fatalf("Error loading .env file: %v", err)
 	}
 }
 
+// ClientID identifies a connected client. Zero means no client.
+type ClientID uint64
+
 // Client struct to hold both TCP and WebSocket connections, and their nickname
 type Client struct {
-	Conn    net.Conn
-	WSConn  *websocket.Conn
-	Name    string
-	Address string
+	ID        ClientID
+	Transport Transport
+	Name      string
+	Address   string
+	Room      string
+	Admin     bool
+	Bot       bool
+	spam      spamState
+	writeMu   sync.Mutex
+	coalesce  coalesceState
+
+	locationLimiter *RateLimiter
+	subscriptions   atomic.Pointer[map[string]bool]
+	echo            atomic.Bool
+	blocked         atomic.Pointer[map[string]bool]
+	status          atomic.Pointer[presence]
+	streamRooms     atomic.Pointer[map[string]bool]
+	locale          atomic.Pointer[catalog]
+
+	// lastActive is when the client last sent something, in Unix nanoseconds
+	lastActive atomic.Int64
+	idleWarned atomic.Bool
+	// kicked is why the server closed the connection, if it did
+	kicked atomic.Pointer[string]
+	// streaming is set while history is being sent to the client
+	streaming atomic.Bool
+	// queue is set when messages are written by a separate goroutine
+	queue *sendQueue
+
+	// Authenticated is set for clients whose name was verified by login or a bot token
+	Authenticated bool
+	Connected     time.Time
+
+	// Guest is set for WebSocket clients admitted without an account in guest mode
+	Guest        bool
+	guestLimiter *RateLimiter
+}
+
+// Send writes a message to the client, as JSON unless its transport has its own encoding
+func (c *Client) Send(msg *Message) error {
+	var data []byte
+	if enc, ok := c.Transport.(messageEncoder); ok {
+		data = enc.Encode(msg)
+	} else {
+		var err error
+		if data, err = json.Marshal(msg); err != nil {
+			return err
+		}
+	}
+	return c.write(data)
+}
+
+// write sends an already encoded message to the client, through its send
+// queue if it has one
+func (c *Client) write(data []byte) error {
+	if c.queue != nil {
+		return c.queue.push(c, data)
+	}
+	return c.writeNow(data)
+}
+
+// writeNow sends an already encoded message to the client, waiting for the write
+func (c *Client) writeNow(data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.coalescing() {
+		return c.queueCoalesced(data)
+	}
+	return c.Transport.Send(data)
+}
+
+// Notice sends a system message to the client in its language
+func (c *Client) Notice(text string) error {
+	return c.Send(&Message{Type: MessageSystem, Body: c.T(text)})
 }
 
 // ChatServer struct to manage all connected clients
 type ChatServer struct {
-	Clients     []*Client
-	Mutex       sync.Mutex
-	BroadcastCh chan string
+	Clients     *ClientRegistry
+	Rooms       map[string]*Room
+	ReplaySize  int
+	EventLog    *EventLog
+	AuditLog    *AuditLog
+	Archive     *Archive
+	Snippets    *SnippetStore
+	Filters     []MessageFilter
+	Enrichers   []Enricher
+	Hooks       []Hooks
+	Plugins     []*Plugin
+	Automations map[string]*Automation
+	Emoji       map[string]*CustomEmoji
+	Delayed     map[string]*DelayedMessage
+	Spam        *SpamDetector
+	Webhooks    *WebhookDispatcher
+	APITokens   *APITokens
+	BotTokens   *APITokens
+	AdminTokens *APITokens
+	Locations   map[string]*liveLocation
+	Invites     map[string]*Invite
+	Blocks      map[string]map[string]bool
+	Profiles    map[string]*Profile
+	PushDevices map[string]*PushDevice
+	Push        *PushGateway
+
+	// Digest is nil unless email digests are configured
+	Digest       *DigestMailer
+	DigestEmails map[string]string
+	Sessions     map[string]*Client
+	Tickets      map[string]*connectTicket
+	Exports      map[string]*exportRequest
+	Rejoins      map[string]rejoin
+	OIDC         map[string]*OIDCProvider
+	TOTPSecrets  map[string]string
+	Logins       *LoginGuard
+	Proxies      []*net.IPNet
+	Challenge    Challenge
+	Locales      map[string]*catalog
+	PublicKeys   map[string]string
+	Matrix       *MatrixBridge
+	Tracer       *Tracer
+	Fanout       *fanoutPool
+	Throughput   *Throughput
+	// SlowConsumers counts clients that fell behind their send queue
+	SlowConsumers slowConsumerStats
+	Mutex         sync.Mutex
+	BroadcastCh   chan string
+
+	// postMu orders posted messages
+	postMu sync.Mutex
+
+	// totpPending holds secrets being set up and totpUsed the last time
+	// step each user logged in with, so codes cannot be replayed
+	totpPending map[string]string
+	totpUsed    map[string]int64
+
+	// digestCodes holds digest addresses waiting to be confirmed
+	digestCodes map[string]*digestConfirmation
 }
 
 // Initializes a new chat server
 func NewChatServer() *ChatServer {
-	return &ChatServer{
-		Clients:     make([]*Client, 0),
-		BroadcastCh: make(chan string),
+	cs := &ChatServer{
+		Clients:      NewClientRegistry(),
+		Rooms:        make(map[string]*Room),
+		ReplaySize:   envInt("ROOM_REPLAY_SIZE", defaultReplaySize),
+		Snippets:     NewSnippetStore(os.Getenv("SNIPPET_DIR")),
+		Filters:      defaultFilters(),
+		Enrichers:    defaultEnrichers(),
+		Spam:         NewSpamDetector(),
+		Throughput:   NewThroughput(),
+		Webhooks:     NewWebhookDispatcher(),
+		APITokens:    LoadAPITokens("API_TOKENS", envInt("API_TOKEN_RATE", 60)),
+		BotTokens:    LoadAPITokens("BOT_TOKENS", 0),
+		AdminTokens:  LoadAPITokens("ADMIN_TOKENS", 0),
+		AuditLog:     &AuditLog{},
+		Locations:    make(map[string]*liveLocation),
+		Invites:      make(map[string]*Invite),
+		Blocks:       make(map[string]map[string]bool),
+		Profiles:     make(map[string]*Profile),
+		PushDevices:  make(map[string]*PushDevice),
+		Push:         NewPushGateway(),
+		Digest:       NewDigestMailer(),
+		DigestEmails: make(map[string]string),
+		Sessions:     make(map[string]*Client),
+		Tickets:      make(map[string]*connectTicket),
+		Exports:      make(map[string]*exportRequest),
+		Rejoins:      make(map[string]rejoin),
+		OIDC:         LoadOIDCProviders(),
+		TOTPSecrets:  make(map[string]string),
+		Logins:       NewLoginGuard(),
+		Proxies:      trustedProxies(),
+		Challenge:    NewChallenge(),
+		Locales:      LoadLocales(),
+		Automations:  make(map[string]*Automation),
+		Emoji:        make(map[string]*CustomEmoji),
+		Delayed:      make(map[string]*DelayedMessage),
+		totpPending:  make(map[string]string),
+		totpUsed:     make(map[string]int64),
+		digestCodes:  make(map[string]*digestConfirmation),
+		PublicKeys:   make(map[string]string),
+		Tracer:       NewTracer(),
+		Fanout:       newFanoutPool(),
+		BroadcastCh:  make(chan string),
+	}
+	cs.Push.gone = func(device *PushDevice) {
+		cs.Record(Event{Type: EventPushUnregister, User: device.User, Target: device.ID})
 	}
+	return cs
 }
 
-// AddClient adds a new client to the server
-func (cs *ChatServer) AddClient(client *Client) {
-	cs.Mutex.Lock()
-	defer cs.Mutex.Unlock()
-	cs.Clients = append(cs.Clients, client)
+// AddClient adds a new client to the server, unless a hook refuses it
+func (cs *ChatServer) AddClient(client *Client) error {
+	client.Connected = time.Now()
+	client.touch()
+	if err := cs.runHooks(func(h Hooks) error { return h.OnConnect(client) }); err != nil {
+		client.Noticef("Connection refused: %s", err.Error())
+		return err
+	}
+	cs.startSendQueue(client)
+	cs.Clients.Add(client)
+	return nil
 }
 
 // RemoveClient removes a client from the server
 func (cs *ChatServer) RemoveClient(client *Client) {
-	cs.Mutex.Lock()
-	defer cs.Mutex.Unlock()
-	for i, c := range cs.Clients {
-		if c == client {
-			cs.Clients = append(cs.Clients[:i], cs.Clients[i+1:]...)
-			break
-		}
+	cs.Clients.Remove(client)
+	if client.queue != nil {
+		client.queue.close()
 	}
+	if client.Authenticated {
+		cs.Digest.Seen(client.Name)
+	}
+	cs.runHooks(func(h Hooks) error {
+		h.OnDisconnect(client)
+		return nil
+	})
 }
 
-// Broadcast sends a message to all clients
-func (cs *ChatServer) Broadcast(msg string, sender interface{}) {
-	cs.Mutex.Lock()
-	defer cs.Mutex.Unlock()
-
-	for _, client := range cs.Clients {
-		// Skip sending the message back to the sender
-		if (client.Conn != nil && client.Conn == sender) || (client.WSConn != nil && client.WSConn == sender) {
+// Broadcast sends a message to all clients in a room, or to every client if room is empty
+func (cs *ChatServer) Broadcast(room string, msg *Message, sender ClientID) {
+	if msg.Time == nil {
+		now := time.Now().UTC()
+		msg.Time = &now
+	}
+	members := cs.Clients.All()
+	if room != "" {
+		members = cs.Clients.InRoom(room)
+	}
+	pooled := recipientPool.Get().(*[]*Client)
+	recipients := (*pooled)[:0]
+	for _, client := range members {
+		// Skip the sender itself, unless it wants its posted messages echoed
+		if sender != 0 && client.ID == sender && (msg.ID == "" || !client.echo.Load()) {
 			continue
 		}
-
-		// Send message to TCP clients
-		if client.Conn != nil {
-			_, err := client.Conn.Write([]byte(msg + "\n"))
-			if err != nil {
-				log.Println("Broadcast to TCP error:", err)
-				client.Conn.Close()
-				cs.RemoveClient(client)
-			}
+		if client.Bot && !client.subscribed(msg) {
+			continue
 		}
+		if client.blocksMessage(msg) {
+			continue
+		}
+		recipients = append(recipients, client)
+	}
+	cs.Fanout.Deliver(recipients, msg)
 
-		// Send message to WebSocket clients
-		if client.WSConn != nil {
-			err := client.WSConn.WriteMessage(websocket.TextMessage, []byte(msg))
-			if err != nil {
-				log.Println("Broadcast to WebSocket error:", err)
-				client.WSConn.Close()
-				cs.RemoveClient(client)
-			}
+	// Drop the client pointers so the pool does not keep disconnected clients alive
+	clear(recipients)
+	*pooled = recipients[:0]
+	recipientPool.Put(pooled)
+}
+
+// Chat records a chat message from a client and broadcasts it to the client's room
+func (cs *ChatServer) Chat(client *Client, text string, sender ClientID) {
+	if client.Bot {
+		cs.BotChat(client, text, sender)
+		return
+	}
+	span := cs.Tracer.Start("chat.message")
+	span.SetAttr("chat.room", client.Room)
+	span.SetAttr("chat.user", client.Name)
+	defer span.End()
+
+	if refused := cs.guestRestriction(client); refused != nil {
+		span.SetAttr("chat.rejected", "guest")
+		client.Send(refused)
+		return
+	}
+	if refused := cs.CheckSpam(client, text); refused != nil {
+		span.SetAttr("chat.rejected", "spam")
+		client.Send(refused)
+		return
+	}
+	text, err := cs.ApplyFilters(client, client.Room, text)
+	if err != nil {
+		span.SetError(err)
+		client.Fail(CodeRejected, "Message rejected: %s", err.Error())
+		return
+	}
+	msg := &Message{Type: MessageChat, Room: client.Room, From: client.Name, Body: text, span: span}
+	if err := cs.ApplyEnrichers(client, msg); err != nil {
+		span.SetError(err)
+		client.Notice(err.Error())
+		return
+	}
+	if err := cs.runHooks(func(h Hooks) error { return h.OnMessage(client, msg) }); err != nil {
+		span.SetError(err)
+		client.Fail(CodeRejected, "Message rejected: %s", err.Error())
+		return
+	}
+	if err := cs.PostMessage(msg, sender); err != nil {
+		if tellThrottled(client, err) {
+			span.SetAttr("chat.rejected", "throttle")
 		}
+		return
+	}
+	cs.NotifyMentions(client, msg)
+	cs.DispatchBotCommand(msg)
+	cs.RunMessageAutomations(client, msg)
+}
+
+// PostMessage records a chat message that has passed filtering and delivers
+// it to its room and webhooks. Every message counts against the room's
+// throughput caps, and a *throttleError is returned if they turn it away.
+func (cs *ChatServer) PostMessage(msg *Message, sender ClientID) error {
+	if wait, ok := cs.Throughput.Admit(msg.Room); !ok {
+		return &throttleError{room: msg.Room, retry: wait}
+	}
+	id, err := newID(8)
+	if err != nil {
+		log.Println("Error creating message ID:", err)
+		return err
+	}
+	now := time.Now().UTC()
+	msg.ID = id
+	msg.Time = &now
+
+	// Numbering and delivery happen together, so clients receive messages in sequence order
+	cs.postMu.Lock()
+	cs.Mutex.Lock()
+	room := cs.getRoom(msg.Room)
+	msg.Seq = room.Seq + 1
+	format := room.formatName()
+	cs.Mutex.Unlock()
+	renderFormat(msg, format)
+
+	// Compliance archiving comes first: a message it misses is not delivered
+	if err := cs.archive(msg); err != nil {
+		cs.postMu.Unlock()
+		log.Printf("Dropping message %s in %s: %v", id, msg.Room, err)
+		return err
 	}
+
+	persist := msg.span.Child("persist")
+	cs.Record(Event{Type: EventMessage, Time: now, Room: msg.Room, User: msg.From, Target: id, Body: msg.Body, Seq: msg.Seq})
+	persist.End()
+
+	fanout := msg.span.Child("fanout")
+	cs.Broadcast(msg.Room, msg, sender)
+	fanout.End()
+	cs.postMu.Unlock()
+	cs.NotifyWebhooks(msg)
+	if cs.Matrix != nil {
+		cs.Matrix.Relay(msg)
+	}
+	return nil
 }
 
 // DisplayClients constantly refreshes the list of connected clients in a table format
@@ -109,20 +391,26 @@ func (cs *ChatServer) DisplayClients() {
 		// Clear the screen using ANSI escape code
 		fmt.Print("\033[H\033[2J")
 		fmt.Println("Connected clients:")
-		fmt.Println("----------------------------------------------------------------")
-		fmt.Printf("| %-15s | %-25s | %-15s |\n", "Type", "Address", "Nickname")
-		fmt.Println("----------------------------------------------------------------")
+		fmt.Println("----------------------------------------------------------------------------------")
+		fmt.Printf("| %-15s | %-25s | %-15s | %-15s |\n", "Type", "Address", "Nickname", "Room")
+		fmt.Println("----------------------------------------------------------------------------------")
 
 		// Print each connected client in a table format
-		for _, client := range cs.Clients {
-			if client.Conn != nil {
-				fmt.Printf("| %-15s | %-25s | %-15s |\n", "TCP Client", client.Address, client.Name)
-			}
-			if client.WSConn != nil {
-				fmt.Printf("| %-15s | %-25s | %-15s |\n", "WebSocket Client", client.Address, client.Name)
+		for _, client := range cs.Clients.All() {
+			kind := "WebSocket Client"
+			switch client.Transport.(type) {
+			case *ircSession:
+				kind = "IRC Client"
+			case *tcpTransport:
+				kind = "TCP Client"
+			case *sseStream:
+				kind = "SSE Client"
+			case *pollQueue:
+				kind = "Polling Client"
 			}
+			fmt.Printf("| %-15s | %-25s | %-15s | %-15s |\n", kind, client.Address, client.Name, client.Room)
 		}
-		fmt.Println("----------------------------------------------------------------")
+		fmt.Println("----------------------------------------------------------------------------------")
 
 		cs.Mutex.Unlock()
 
@@ -132,71 +420,125 @@ func (cs *ChatServer) DisplayClients() {
 
 // HandleTCPConnection handles new TCP clients
 func (cs *ChatServer) HandleTCPConnection(conn net.Conn) {
-	address := conn.RemoteAddr().String()
-	client := &Client{Conn: conn, Address: address}
-	cs.AddClient(client)
+	transport := &tcpTransport{conn: conn}
+	transport.color.Store(envBool("TCP_COLOR", false))
+	client := &Client{Transport: transport, Address: transport.Remote()}
 	defer conn.Close()
-	defer cs.RemoveClient(client)
-
-	// Ask for a nickname
-	conn.Write([]byte("Please enter your nickname: "))
-	nickBuf := make([]byte, 1024)
-	n, err := conn.Read(nickBuf)
-	if err != nil {
+	if cs.AddClient(client) != nil {
 		return
 	}
-	client.Name = strings.TrimSpace(string(nickBuf[:n]))
+	defer cs.RemoveClient(client)
 
-	// Notify all other clients
-	cs.Broadcast(fmt.Sprintf("%s has joined the chat!", client.Name), conn)
+	// Read lines, with telnet negotiation removed and refused
+	telnet := newTelnetReader(conn, client.write)
+	scanner := bufio.NewScanner(telnet)
+	scanner.Buffer(make([]byte, maxTCPLine), maxTCPLine)
 
-	buf := make([]byte, 1024)
+	// Ask for a nickname until the client picks a valid one
+	conn.Write([]byte("Please enter your nickname: "))
 	for {
-		n, err := conn.Read(buf)
-		if err != nil {
-			cs.Broadcast(fmt.Sprintf("%s has left the chat.", client.Name), conn)
+		if !scanner.Scan() {
 			return
 		}
-		msg := fmt.Sprintf("%s: %s", client.Name, string(buf[:n]))
-		cs.Broadcast(msg, conn)
+		client.Name = strings.TrimSpace(cleanText(scanner.Text()))
+		err := validateName(client.Name, false)
+		if err == nil {
+			break
+		}
+		client.Noticef("Invalid nickname: %s", err.Error())
+		conn.Write([]byte("Please enter your nickname: "))
+	}
+	// Telnet clients negotiate options as they connect and show colors
+	if telnet.negotiated {
+		transport.color.Store(true)
+	}
+
+	// Greet the client and join the default room
+	cs.SendMOTD(client)
+	cs.JoinRoom(client, defaultRoom, client.ID)
+
+	for scanner.Scan() {
+		text := strings.TrimSpace(cleanText(scanner.Text()))
+		if text == "" {
+			continue
+		}
+		client.touch()
+		if cs.HandleCommand(client, text, client.ID) {
+			continue
+		}
+		cs.Chat(client, text, client.ID)
 	}
+	cs.Disconnected(client, scanner.Err())
 }
 
 // HandleWebSocketConnection handles new WebSocket clients
-func (cs *ChatServer) HandleWebSocketConnection(wsConn *websocket.Conn) {
-	address := wsConn.RemoteAddr().String()
-	client := &Client{WSConn: wsConn, Address: address}
-	cs.AddClient(client)
-
+func (cs *ChatServer) HandleWebSocketConnection(transport *wsTransport, locale *catalog) {
+	wsConn := transport.conn
+	client := &Client{Transport: transport, Address: transport.Remote()}
+	client.locale.Store(locale)
+	client.echo.Store(envBool("WS_ECHO", true))
 	defer wsConn.Close()
+	if cs.AddClient(client) != nil {
+		return
+	}
 	defer cs.RemoveClient(client)
 
 	// Ask for login or registration
-	wsConn.WriteMessage(websocket.TextMessage, []byte("1. Login\n2. Register"))
+	hs := newHandshake(wsConn, client)
+	menu := client.T("1. Login\n2. Register")
+	if guestAccess() != "" {
+		menu += "\n" + client.T("3. Continue as guest")
+	}
+	hs.send(&Message{Type: MessagePrompt, Code: CodeMenu, Body: menu})
 	_, response, err := wsConn.ReadMessage()
 	if err != nil {
 		return
 	}
 
-	str := string(response)
-	res, err := strconv.Atoi(str)
-	if err != nil {
+	res, err := strconv.Atoi(strings.TrimSpace(string(response)))
+	if err != nil || res < 1 || res > 3 || (res == 3 && guestAccess() == "") {
+		hs.fail(CodeMalformed, "Please answer with the number of an option")
+		return
+	}
+	if res == 3 {
+		cs.AdmitGuest(client)
+		cs.SendMOTD(client)
+		cs.JoinRoom(client, defaultRoom, client.ID)
+		cs.guestWelcome(client)
+		cs.readWebSocket(client, wsConn)
 		return
 	}
 	// Ask for username
-	wsConn.WriteMessage(websocket.TextMessage, []byte("Please enter username:"))
+	hs.prompt(CodeUsername, "Please enter username:")
 	_, username, err := wsConn.ReadMessage()
 	if err != nil {
 		return
 	}
+	// Existing accounts may have reserved names, new ones may not
+	if err := validateName(strings.TrimSpace(string(username)), res == 1); err != nil {
+		hs.fail(CodeInvalidName, "Invalid username: %s", err.Error())
+		return
+	}
+	if wait := cs.Logins.Wait(client.Address, string(username)); wait > 0 {
+		hs.send(errorMessage(CodeLoginLocked, client.T("Too many failed attempts, try again in %s", wait.Round(time.Second))).retryIn(wait))
+		return
+	}
+	// Each check against the auth service is reserved right before it is
+	// made, so parallel connections cannot all get past the wait above
+	begin := func(name string) func() {
+		done, wait := cs.Logins.Begin(client.Address, name)
+		if wait > 0 {
+			hs.send(errorMessage(CodeLoginLocked, client.T("Too many failed attempts, try again in %s", wait.Round(time.Second))).retryIn(wait))
+		}
+		return done
+	}
 
 	// Ask for password
-	wsConn.WriteMessage(websocket.TextMessage, []byte("Please enter password:"))
+	hs.prompt(CodePassword, "Please enter password:")
 	_, password, err := wsConn.ReadMessage()
 	if err != nil {
 		return
 	}
-	url := os.Getenv("AUTH_URL")
 	data := LoginRequest{
 		Username: string(username),
 		Password: string(password),
@@ -206,101 +548,470 @@ func (cs *ChatServer) HandleWebSocketConnection(wsConn *websocket.Conn) {
 		log.Fatalf("Error marshalling login data: %v", err)
 	}
 	if res == 1 {
-		resp, err := http.Post(url+"/login", "application/json", bytes.NewBuffer(loginDataJSON))
+		done := begin(string(username))
+		if done == nil {
+			return
+		}
+		resp, err := cs.postAuth(nil, "/login", loginDataJSON)
 		if err != nil {
-			log.Fatalf("Error making POST request: %v", err)
+			done()
+			log.Println("Error contacting auth service:", err)
+			hs.fail(CodeUnavailable, "Login is unavailable, please try again later")
+			return
 		}
 		defer resp.Body.Close()
 		if resp.StatusCode != http.StatusOK {
-			log.Fatalf("Login failed with status code: %d", resp.StatusCode)
+			cs.LoginFailed("login", client.Address, string(username), fmt.Sprintf("auth service returned status code %d", resp.StatusCode))
+			done()
+			hs.fail(CodeLoginFailed, "Invalid username or password")
+			return
 		}
+		done()
 		// Decode the response body
 		var loginResponse LoginResponse
 		err = json.NewDecoder(resp.Body).Decode(&loginResponse)
 		if err != nil {
-			log.Fatalf("Error decoding response: %v", err)
+			log.Println("Error decoding auth service response:", err)
+			hs.fail(CodeUnavailable, "Login is unavailable, please try again later")
+			return
+		}
+
+		// Users with two-factor authentication must also enter a code
+		if cs.TwoFactorEnabled(strings.TrimSpace(string(username))) {
+			hs.prompt(CodeTwoFactor, "Please enter your two-factor code:")
+			_, code, err := wsConn.ReadMessage()
+			if err != nil {
+				return
+			}
+			done := begin(string(username))
+			if done == nil {
+				return
+			}
+			ok := cs.CheckTwoFactor(strings.TrimSpace(string(username)), string(code))
+			if !ok {
+				cs.LoginFailed("login", client.Address, string(username), "invalid two-factor code")
+			}
+			done()
+			if !ok {
+				hs.fail(CodeLoginFailed, "Invalid two-factor code")
+				return
+			}
 		}
 
+		cs.Logins.Succeeded(string(username))
 		// Print the received token (if the login is successful)
-		message := fmt.Sprintf("%s logged in successfully", username)
-		wsConn.WriteMessage(websocket.TextMessage, []byte(message))
+		hs.succeed(CodeLoggedIn, "%s logged in successfully", username)
 		fmt.Printf("Login successful, received token: %s\n", loginResponse.Token)
+		client.Authenticated = true
+		client.Admin = isAdmin(strings.TrimSpace(string(username)))
 	} else if res == 2 {
-		resp, err := http.Post(url+"/register", "application/json", bytes.NewBuffer(loginDataJSON))
+		// Registrations are challenged before they reach the auth service
+		var token []byte
+		if cs.Challenge != nil {
+			hs.prompt(CodeChallenge, "Please complete the challenge and send its token:")
+			if _, token, err = wsConn.ReadMessage(); err != nil {
+				return
+			}
+		}
+		// Failed registrations only count against the address
+		done := begin("")
+		if done == nil {
+			return
+		}
+		defer done()
+		if cs.Challenge != nil {
+			if err := cs.Challenge.Verify(string(token), client.Address); err != nil {
+				if !errors.Is(err, errChallengeFailed) {
+					log.Println("Error verifying registration challenge:", err)
+					hs.fail(CodeUnavailable, "Registration is unavailable, please try again later")
+					return
+				}
+				cs.LoginFailed("register", client.Address, string(username), err.Error())
+				hs.fail(CodeRegisterFailed, "Challenge failed, please try again")
+				return
+			}
+		}
+		resp, err := cs.postAuth(nil, "/register", loginDataJSON)
 		if err != nil {
-			log.Fatalf("Error making POST request: %v\n", err)
+			log.Println("Error contacting auth service:", err)
+			hs.fail(CodeUnavailable, "Registration is unavailable, please try again later")
+			return
 		}
 		defer resp.Body.Close()
 		if resp.StatusCode != http.StatusCreated {
-			log.Fatalf("Login failed with status code: %d", resp.StatusCode)
+			cs.LoginFailed("register", client.Address, string(username), fmt.Sprintf("auth service returned status code %d", resp.StatusCode))
+			hs.fail(CodeRegisterFailed, "Registration failed")
+			return
 		}
-		message := fmt.Sprintf("%s created successfully", username)
-		wsConn.WriteMessage(websocket.TextMessage, []byte(message))
+		hs.succeed(CodeRegistered, "%s created successfully", username)
+		client.Authenticated = true
+		client.Admin = isAdmin(strings.TrimSpace(string(username)))
 	}
 
 	client.Name = strings.TrimSpace(string(username))
-	// Notify other clients
-	cs.Broadcast(fmt.Sprintf("%s has joined the chat!", client.Name), wsConn)
+	if client.Authenticated && !cs.Authenticated(client) {
+		return
+	}
+	cs.LoadBlocks(client)
+	// Greet the client and join the default room
+	cs.SendMOTD(client)
+	cs.JoinRoom(client, cs.startRoom(client), client.ID)
+	cs.readWebSocket(client, wsConn)
+}
 
+// readWebSocket handles the messages of a joined WebSocket client until it disconnects
+func (cs *ChatServer) readWebSocket(client *Client, wsConn *websocket.Conn) {
 	for {
-		_, msg, err := wsConn.ReadMessage()
+		_, data, err := wsConn.ReadMessage()
 		if err != nil {
-			cs.Broadcast(fmt.Sprintf("%s has left the chat.", client.Name), wsConn)
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				err = nil
+			}
+			cs.Disconnected(client, err)
 			return
 		}
-		cs.Broadcast(fmt.Sprintf("%s: %s", client.Name, string(msg)), wsConn)
+		cs.HandleInput(client, string(data), client.ID)
+	}
+}
+
+// HandleInput dispatches a frame from a client: a JSON request, a slash command, or chat text.
+// Clients of the typed protocol send only JSON requests.
+func (cs *ChatServer) HandleInput(client *Client, text string, sender ClientID) {
+	client.touch()
+	if !utf8.ValidString(text) {
+		client.Fail(CodeMalformed, "Messages must be valid UTF-8")
+		return
+	}
+	if req, ok := parseRequest([]byte(text)); ok {
+		req.sanitize()
+		cs.HandleRequest(client, req, sender)
+		return
+	}
+	if client.typed() {
+		client.Fail(CodeMalformed, "Expected a JSON request with a type")
+		return
 	}
+	text = sanitizeText(text)
+	if cs.HandleCommand(client, text, sender) {
+		return
+	}
+	cs.Chat(client, text, sender)
 }
 
 // Starts the WebSocket server
 func (cs *ChatServer) StartWebSocketServer() {
-	upgrader := websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
+	cs.Routes(http.DefaultServeMux)
+	listener, _, err := listen("tcp", "0.0.0.0:8081")
+	if err != nil {
+		log.Fatal("WebSocket server error:", err)
 	}
+	log.Println("WebSocket server listening on :8081")
+	err = http.Serve(listener, withCORS(hidePprof(http.DefaultServeMux)))
+	if !errors.Is(err, net.ErrClosed) {
+		log.Fatal(err)
+	}
+}
+
+// Routes registers the WebSocket endpoint and the HTTP API on a mux
+func (cs *ChatServer) Routes(mux *http.ServeMux) {
+	upgrader := websocket.Upgrader{CheckOrigin: checkOrigin, Subprotocols: []string{jsonSubprotocol}, EnableCompression: compressionEnabled()}
+
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		span := cs.Tracer.StartRequest(r, "ws.handshake")
+
+		// Bots authenticate with a bearer token instead of the login prompts
+		var bot *APIToken
+		if r.Header.Get("Authorization") != "" {
+			if bot = cs.BotTokens.Authenticate(r); bot == nil {
+				span.SetAttr("http.status_code", http.StatusUnauthorized)
+				span.End()
+				http.Error(w, "invalid bot token", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		// Browsers connect with a ticket from POST /tickets instead of the login prompts
+		var ticket *connectTicket
+		if id := r.URL.Query().Get("ticket"); id != "" {
+			if ticket = cs.RedeemTicket(id); ticket == nil {
+				span.SetAttr("http.status_code", http.StatusUnauthorized)
+				span.End()
+				http.Error(w, "invalid or expired ticket", http.StatusUnauthorized)
+				return
+			}
+		} else if token := r.URL.Query().Get("id_token"); token != "" {
+			// Clients signed in with an OIDC provider can pass their ID token directly
+			provider := cs.OIDC[r.URL.Query().Get("provider")]
+			var user string
+			var err error
+			if provider == nil {
+				err = errors.New("unknown identity provider")
+			} else {
+				user, err = provider.Identify(token, "")
+			}
+			if err != nil {
+				log.Println("Rejected ID token:", err)
+				span.SetAttr("http.status_code", http.StatusUnauthorized)
+				span.End()
+				http.Error(w, "invalid ID token", http.StatusUnauthorized)
+				return
+			}
+			ticket = &connectTicket{user: user, admin: provider.isAdmin(user), needsCode: cs.TwoFactorEnabled(user)}
+		} else if bot == nil && envBool("WS_REQUIRE_TICKET", false) {
+			span.SetAttr("http.status_code", http.StatusUnauthorized)
+			span.End()
+			http.Error(w, "a connect ticket is required", http.StatusUnauthorized)
+			return
+		}
 
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		wsConn, err := upgrader.Upgrade(w, r, nil)
+		span.SetError(err)
+		span.End()
 		if err != nil {
 			log.Println("WebSocket upgrade error:", err)
 			return
 		}
-		cs.HandleWebSocketConnection(wsConn)
+		transport, ok := cs.helloTransport(wsConn, clientAddr(cs.Proxies, r))
+		if !ok {
+			wsConn.Close()
+			return
+		}
+		switch {
+		case bot != nil:
+			cs.HandleBotConnection(transport, bot.Name)
+		case ticket != nil:
+			cs.HandleTicketConnection(transport, ticket, cs.NegotiateLocale(r.Header.Get("Accept-Language")))
+		default:
+			cs.HandleWebSocketConnection(transport, cs.NegotiateLocale(r.Header.Get("Accept-Language")))
+		}
 	})
-
-	log.Println("WebSocket server listening on :8081")
-	log.Fatal(http.ListenAndServe("0.0.0.0:8081", nil))
+	if envBool("WEB_CLIENT", true) {
+		mux.HandleFunc("GET /{$}", cs.HandleWebClient)
+	}
+	mux.HandleFunc("POST /tickets", cs.HandleIssueTicket)
+	mux.HandleFunc("GET /oauth/{provider}/login", cs.HandleOIDCLogin)
+	mux.HandleFunc("GET /oauth/{provider}/callback", cs.HandleOIDCCallback)
+	mux.HandleFunc("GET /snippets/{id}", cs.HandleGetSnippet)
+	mux.HandleFunc("GET /rooms", cs.HandleListRooms)
+	mux.HandleFunc("GET /rooms/{room}/events.ics", cs.HandleRoomCalendar)
+	mux.HandleFunc("GET /rooms/{room}/messages", cs.HandleGetMessages)
+	mux.HandleFunc("POST /rooms/{room}/messages", cs.HandlePostMessage)
+	mux.HandleFunc("GET /invites/{code}", cs.HandleGetInvite)
+	mux.HandleFunc("GET /push/vapid", cs.HandleVAPIDKey)
+	mux.HandleFunc("GET /captcha", cs.HandleChallengeConfig)
+	mux.HandleFunc("POST /hooks/slack/{token}", cs.HandleSlackWebhook)
+	mux.HandleFunc("GET /admin/audit", cs.HandleGetAudit)
+	mux.HandleFunc("GET /admin/rooms/{room}/export", cs.HandleExportRoom)
+	mux.HandleFunc("GET /exports/{id}", cs.HandleDownloadExport)
+	mux.HandleFunc("GET /admin/users/{user}/export", cs.HandleExportUser)
+	mux.HandleFunc("DELETE /admin/users/{user}", cs.HandleEraseUser)
+	mux.HandleFunc("POST /admin/config/reload", cs.HandleReloadConfig)
+	mux.HandleFunc("GET /admin/automations", cs.HandleListAutomations)
+	mux.HandleFunc("PUT /admin/automations/{name}", cs.HandlePutAutomation)
+	mux.HandleFunc("DELETE /admin/automations/{name}", cs.HandleDeleteAutomation)
+	mux.HandleFunc("PUT /admin/emoji/{name}", cs.HandleAddEmoji)
+	mux.HandleFunc("DELETE /admin/emoji/{name}", cs.HandleDeleteEmoji)
+	mux.HandleFunc("GET /emoji/{name}", cs.HandleGetEmoji)
+	mux.HandleFunc("GET /events", cs.HandleEventStream)
+	mux.HandleFunc("POST /send", cs.HandleSend)
+	mux.HandleFunc("POST /poll/sessions", cs.HandlePollConnect)
+	mux.HandleFunc("GET /poll", cs.HandlePoll)
+	mux.HandleFunc("DELETE /poll", cs.HandlePollDisconnect)
 }
 
 // Starts the TCP chat server
 func (cs *ChatServer) StartTCPServer() {
-	listener, err := net.Listen("tcp", ":8080")
+	listener, _, err := listen("tcp", ":8080")
 	if err != nil {
 		log.Fatal("TCP Server error:", err)
 	}
 	defer listener.Close()
 
 	log.Println("TCP server listening on :8080")
+	cs.serveTCP(listener, envBool("PROXY_PROTOCOL", false))
+}
+
+// StartUnixServer serves the TCP chat protocol on a Unix socket, so local
+// bots and tools can connect without a network port
+func (cs *ChatServer) StartUnixServer(path string) {
+	// A socket left behind by a previous run would make Listen fail, unless
+	// it was handed over and is still in use
+	if envList(handoverListenersEnv) == nil {
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+	}
+	listener, inherited, err := listen("unix", path)
+	if err != nil {
+		log.Fatal("Unix socket error:", err)
+	}
+	defer listener.Close()
+
+	if !inherited {
+		mode, err := strconv.ParseUint(os.Getenv("UNIX_SOCKET_MODE"), 8, 32)
+		if err != nil {
+			mode = 0660
+		}
+		if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+			log.Fatal("Unix socket error:", err)
+		}
+	}
+
+	log.Println("Unix socket server listening on", path)
+	cs.serveTCP(listener, false)
+}
+
+// serveTCP accepts chat connections from a listener. With proxyProtocol set,
+// connections from trusted proxies, or from anyone if TRUSTED_PROXIES is
+// empty, must start with a PROXY protocol header naming the real client.
+func (cs *ChatServer) serveTCP(listener net.Listener, proxyProtocol bool) {
+	proxies := cs.Proxies
 	for {
 		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			log.Println("TCP connection error:", err)
 			continue
 		}
-		go cs.HandleTCPConnection(conn)
+		if !proxyProtocol || (len(proxies) > 0 && !isTrustedProxy(proxies, conn.RemoteAddr().String())) {
+			go cs.HandleTCPConnection(conn)
+			continue
+		}
+		go func() {
+			proxied, err := readProxyHeader(conn)
+			if err != nil {
+				log.Printf("PROXY protocol error from %s: %v", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			cs.HandleTCPConnection(proxied)
+		}()
 	}
 }
 
 func main() {
+	// app import reads exports from other platforms into the event log
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		os.Exit(runImport(os.Args[2:], os.Stderr))
+	}
+	// app verify-archive checks the hash chain of a compliance archive
+	if len(os.Args) > 1 && os.Args[1] == "verify-archive" {
+		os.Exit(runVerifyArchive(os.Args[2:], os.Stderr))
+	}
+
+	// After a handover, wait until the old process has stopped writing state
+	waitForHandover()
+
 	chatServer := NewChatServer()
 
+	// Rebuild state from the event log when event sourcing is enabled
+	if path := os.Getenv("EVENT_LOG"); path != "" {
+		var until time.Time
+		if v := os.Getenv("EVENT_LOG_UNTIL"); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				log.Fatalf("Invalid EVENT_LOG_UNTIL: %v", err)
+			}
+			until = t
+		}
+		if err := chatServer.OpenEventLog(path, until); err != nil {
+			log.Fatalf("Error opening event log: %v", err)
+		}
+		defer chatServer.EventLog.Close()
+	}
+
+	// Keep the audit trail of administrative actions across restarts
+	if path := os.Getenv("AUDIT_LOG"); path != "" {
+		audit, err := OpenAuditLog(path)
+		if err != nil {
+			log.Fatalf("Error opening audit log: %v", err)
+		}
+		chatServer.AuditLog = audit
+		defer audit.Close()
+	}
+
+	// Pick up the connections of the process that shut down before this one
+	if path := os.Getenv("STATE_SNAPSHOT"); path != "" {
+		if err := chatServer.RestoreSnapshot(path); err != nil {
+			log.Println("Error restoring state snapshot:", err)
+		}
+	}
+
+	// Archive every message to write-once storage for compliance
+	archive, err := OpenArchiveFromEnv()
+	if err != nil {
+		log.Fatalf("Error opening archive: %v", err)
+	}
+	if archive != nil {
+		chatServer.Archive = archive
+		defer archive.Close()
+	}
+
+	// Apply configuration changes without a restart
+	go chatServer.WatchConfig()
+
+	// Hand the listening sockets to a new binary on SIGUSR2
+	go chatServer.WatchHandover()
+
 	// Start a goroutine to constantly display connected clients in table format
 	go chatServer.DisplayClients()
 
+	// Remind rooms of their upcoming events
+	go chatServer.RunEventReminders()
+
+	// Close polls as they expire
+	go chatServer.RunPolls()
+
+	// Deliver reminders and scheduled messages
+	go chatServer.RunDelayedMessages()
+
+	// Disconnect clients that have been idle for too long
+	go chatServer.RunIdleTimeout()
+
+	// Delete rooms that have been empty for a while
+	go chatServer.RunRoomExpiry()
+
+	// Drop messages past their room's retention
+	go chatServer.RunRetention()
+
+	// Email users the mentions they missed while offline
+	if chatServer.Digest != nil {
+		go chatServer.RunDigests()
+	}
+
+	// Mirror rooms to Matrix when a bridge registration is configured
+	if os.Getenv("MATRIX_REGISTRATION") != "" {
+		bridge, err := NewMatrixBridge(chatServer)
+		if err != nil {
+			log.Fatal("Error configuring Matrix bridge: ", err)
+		}
+		chatServer.Matrix = bridge
+		bridge.Start()
+	}
+
+	// Commands, filters and event consumers from plugin programs
+	if err := chatServer.LoadPlugins(); err != nil {
+		log.Fatal("Error loading plugins: ", err)
+	}
+
 	// Start TCP and WebSocket servers
-	go chatServer.StartTCPServer()
+	if envBool("TCP_LISTEN", true) {
+		go chatServer.StartTCPServer()
+	}
+	if path := os.Getenv("UNIX_SOCKET"); path != "" {
+		go chatServer.StartUnixServer(path)
+	}
 	go chatServer.StartWebSocketServer()
+	if addr := os.Getenv("IRC_ADDR"); addr != "" {
+		go chatServer.StartIRCServer(addr)
+	}
+	// Profiling and hub internals, on an address only operators can reach
+	if addr := os.Getenv("DEBUG_ADDR"); addr != "" {
+		go chatServer.StartDebugServer(addr)
+	}
 
-	select {}
+	// Save connection state and let clients go on SIGINT or SIGTERM
+	chatServer.WatchShutdown()
 }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// Message formats a room can use, set with /room format
+const (
+	FormatPlain    = "plain"
+	FormatMarkdown = "markdown"
+)
+
+var (
+	markdownLink   = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	markdownBold   = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+	markdownItalic = regexp.MustCompile(`\*([^*\s][^*]*)\*|(^|[^\w])_([^_\s][^_]*)_($|[^\w])`)
+	markdownStrike = regexp.MustCompile(`~~([^~]+)~~`)
+)
+
+// renderMarkdown renders the limited Markdown of markdown rooms as HTML that
+// is safe to insert into a page. The text is escaped first, so the only
+// markup in the result is what the renderer adds: paragraphs, fenced code
+// blocks, block quotes, bulleted lists, and inline code, bold, italics,
+// strikethrough and links to http, https and mailto URLs.
+func renderMarkdown(text string) string {
+	var b strings.Builder
+	lines := strings.Split(strings.ReplaceAll(text, "\x00", ""), "\n")
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case strings.TrimSpace(line) == "":
+			i++
+		case strings.HasPrefix(line, "```"):
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(lines[i], "```"); i++ {
+				code = append(code, lines[i])
+			}
+			i++
+			b.WriteString("<pre><code>" + html.EscapeString(strings.Join(code, "\n")) + "</code></pre>")
+		case quoteLine(line):
+			var quoted []string
+			for ; i < len(lines) && quoteLine(lines[i]); i++ {
+				quoted = append(quoted, renderInline(strings.TrimPrefix(strings.TrimPrefix(lines[i], ">"), " ")))
+			}
+			b.WriteString("<blockquote>" + strings.Join(quoted, "<br>") + "</blockquote>")
+		case listItem(line):
+			b.WriteString("<ul>")
+			for ; i < len(lines) && listItem(lines[i]); i++ {
+				b.WriteString("<li>" + renderInline(lines[i][2:]) + "</li>")
+			}
+			b.WriteString("</ul>")
+		default:
+			var para []string
+			for ; i < len(lines) && strings.TrimSpace(lines[i]) != "" && !strings.HasPrefix(lines[i], "```") && !quoteLine(lines[i]) && !listItem(lines[i]); i++ {
+				para = append(para, renderInline(lines[i]))
+			}
+			b.WriteString("<p>" + strings.Join(para, "<br>") + "</p>")
+		}
+	}
+	return b.String()
+}
+
+func quoteLine(line string) bool {
+	return line == ">" || strings.HasPrefix(line, "> ")
+}
+
+func listItem(line string) bool {
+	return strings.HasPrefix(line, "- ") || strings.HasPrefix(line, "* ")
+}
+
+// renderInline renders the inline Markdown of a line. Code spans and links
+// are set aside while emphasis is applied, so their contents stay as written.
+func renderInline(line string) string {
+	var held []string
+	hold := func(s string) string {
+		held = append(held, s)
+		return fmt.Sprintf("\x00%d\x00", len(held)-1)
+	}
+
+	var b strings.Builder
+	for {
+		start := strings.Index(line, "`")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(line[start+1:], "`")
+		if end < 0 {
+			break
+		}
+		b.WriteString(html.EscapeString(line[:start]))
+		b.WriteString(hold("<code>" + html.EscapeString(line[start+1:start+1+end]) + "</code>"))
+		line = line[start+end+2:]
+	}
+	b.WriteString(html.EscapeString(line))
+	out := b.String()
+
+	out = markdownLink.ReplaceAllStringFunc(out, func(m string) string {
+		parts := markdownLink.FindStringSubmatch(m)
+		if !safeLink(html.UnescapeString(parts[2])) {
+			return m
+		}
+		return hold(`<a href="` + parts[2] + `" rel="nofollow noopener" target="_blank">` + parts[1] + "</a>")
+	})
+	out = markdownBold.ReplaceAllString(out, "<strong>${1}${2}</strong>")
+	out = markdownItalic.ReplaceAllStringFunc(out, func(m string) string {
+		parts := markdownItalic.FindStringSubmatch(m)
+		if parts[1] != "" {
+			return "<em>" + parts[1] + "</em>"
+		}
+		return parts[2] + "<em>" + parts[3] + "</em>" + parts[4]
+	})
+	out = markdownStrike.ReplaceAllString(out, "<del>${1}</del>")
+
+	// Links can hold code spans, so put back the later ones first
+	for i := len(held) - 1; i >= 0; i-- {
+		out = strings.Replace(out, fmt.Sprintf("\x00%d\x00", i), held[i], 1)
+	}
+	return out
+}
+
+// safeLink reports whether a link may be rendered: only web and mail links
+// are, never javascript: or data: URLs
+func safeLink(url string) bool {
+	lower := strings.ToLower(url)
+	return strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") || strings.HasPrefix(lower, "mailto:")
+}
+
+// renderFormat adds the rendered form of a chat message in a room using
+// format, if it has one
+func renderFormat(msg *Message, format string) {
+	if format == FormatMarkdown && msg.Type == MessageChat {
+		msg.HTML = renderMarkdown(msg.Body)
+	}
+}
+
+// formatName is the message format of the room, plain unless set
+func (r *Room) formatName() string {
+	if r.Format == "" {
+		return FormatPlain
+	}
+	return r.Format
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MatrixRegistration holds the fields of a Matrix application service
+// registration file that the bridge uses
+type MatrixRegistration struct {
+	ID              string
+	URL             string
+	ASToken         string
+	HSToken         string
+	SenderLocalpart string
+}
+
+// LoadMatrixRegistration reads the top level keys of a registration YAML file.
+// Nested sections such as namespaces are for the homeserver and are skipped.
+func LoadMatrixRegistration(path string) (*MatrixRegistration, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reg := &MatrixRegistration{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line[0] == ' ' || line[0] == '\t' || line[0] == '#' || line[0] == '-' {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		if i := strings.Index(value, " #"); i >= 0 {
+			value = strings.TrimSpace(value[:i])
+		}
+		value = strings.Trim(value, `"'`)
+		switch strings.TrimSpace(key) {
+		case "id":
+			reg.ID = value
+		case "url":
+			reg.URL = value
+		case "as_token":
+			reg.ASToken = value
+		case "hs_token":
+			reg.HSToken = value
+		case "sender_localpart":
+			reg.SenderLocalpart = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if reg.ASToken == "" || reg.HSToken == "" || reg.SenderLocalpart == "" {
+		return nil, errors.New("registration needs as_token, hs_token and sender_localpart")
+	}
+	return reg, nil
+}
+
+// MatrixBridge mirrors rooms to a Matrix homeserver as an application service.
+// Chat room "lobby" maps to the alias #<prefix>lobby:<server name> and chat
+// users appear in Matrix as @<prefix><name>:<server name>.
+type MatrixBridge struct {
+	cs         *ChatServer
+	reg        *MatrixRegistration
+	homeserver string
+	serverName string
+	prefix     string
+	http       *http.Client
+	queue      chan *Message
+
+	mu      sync.Mutex
+	roomIDs map[string]string // chat room to Matrix room ID
+	rooms   map[string]string // Matrix room ID to chat room
+	joined  map[string]bool   // "user room" pairs already joined
+	txns    map[string]bool   // transaction IDs already processed
+}
+
+// NewMatrixBridge configures the bridge from MATRIX_REGISTRATION, MATRIX_HOMESERVER,
+// MATRIX_SERVER_NAME and MATRIX_PREFIX
+func NewMatrixBridge(cs *ChatServer) (*MatrixBridge, error) {
+	reg, err := LoadMatrixRegistration(os.Getenv("MATRIX_REGISTRATION"))
+	if err != nil {
+		return nil, err
+	}
+	homeserver := strings.TrimRight(os.Getenv("MATRIX_HOMESERVER"), "/")
+	serverName := os.Getenv("MATRIX_SERVER_NAME")
+	if homeserver == "" || serverName == "" {
+		return nil, errors.New("MATRIX_HOMESERVER and MATRIX_SERVER_NAME must be set")
+	}
+	prefix := os.Getenv("MATRIX_PREFIX")
+	if prefix == "" {
+		prefix = "chat_"
+	}
+	return &MatrixBridge{
+		cs:         cs,
+		reg:        reg,
+		homeserver: homeserver,
+		serverName: serverName,
+		prefix:     prefix,
+		http:       &http.Client{Timeout: 10 * time.Second},
+		queue:      make(chan *Message, 256),
+		roomIDs:    make(map[string]string),
+		rooms:      make(map[string]string),
+		joined:     make(map[string]bool),
+		txns:       make(map[string]bool),
+	}, nil
+}
+
+// Start registers the application service endpoints and starts relaying messages
+func (b *MatrixBridge) Start() {
+	http.HandleFunc("PUT /_matrix/app/v1/transactions/{txn}", b.HandleTransaction)
+	http.HandleFunc("GET /_matrix/app/v1/rooms/{alias}", b.HandleRoomQuery)
+	http.HandleFunc("GET /_matrix/app/v1/users/{user}", b.HandleUserQuery)
+	go b.run()
+	log.Printf("Matrix bridge %s relaying to %s", b.reg.ID, b.homeserver)
+}
+
+// Relay queues a chat message to be mirrored to Matrix
+func (b *MatrixBridge) Relay(msg *Message) {
+	if msg.origin == "matrix" || (msg.Type != MessageChat && msg.Type != MessageAnnouncement) {
+		return
+	}
+	select {
+	case b.queue <- msg:
+	default:
+		log.Println("Matrix bridge queue full, dropping message in", msg.Room)
+	}
+}
+
+func (b *MatrixBridge) run() {
+	for msg := range b.queue {
+		if err := b.send(msg); err != nil {
+			log.Printf("Error relaying message in %s to Matrix: %v", msg.Room, err)
+		}
+	}
+}
+
+// send posts a message to the room's Matrix mirror as the sender's ghost user
+func (b *MatrixBridge) send(msg *Message) error {
+	roomID, err := b.ensureRoom(msg.Room)
+	if err != nil {
+		return err
+	}
+	user := b.botUser()
+	if msg.Type == MessageChat {
+		if user, err = b.ensureGhost(msg.From, roomID); err != nil {
+			return err
+		}
+	}
+	txn, err := newID(8)
+	if err != nil {
+		return err
+	}
+	content := map[string]string{"msgtype": "m.text", "body": msg.Body}
+	if msg.Type == MessageAnnouncement {
+		content["msgtype"] = "m.notice"
+	}
+	for _, a := range msg.Attachments {
+		content["body"] += "\n" + a.URL
+	}
+	path := fmt.Sprintf("/rooms/%s/send/m.room.message/%s", url.PathEscape(roomID), txn)
+	return b.call(http.MethodPut, path, user, content, nil)
+}
+
+// ensureRoom returns the Matrix room mirroring a chat room, creating it if needed
+func (b *MatrixBridge) ensureRoom(room string) (string, error) {
+	b.mu.Lock()
+	roomID, ok := b.roomIDs[room]
+	b.mu.Unlock()
+	if ok {
+		return roomID, nil
+	}
+
+	var resolved struct {
+		RoomID string `json:"room_id"`
+	}
+	err := b.call(http.MethodGet, "/directory/room/"+url.PathEscape(b.alias(room)), "", nil, &resolved)
+	var merr *matrixError
+	if errors.As(err, &merr) && merr.Status == http.StatusNotFound {
+		err = b.call(http.MethodPost, "/createRoom", "", map[string]interface{}{
+			"room_alias_name": b.prefix + room,
+			"name":            room,
+			"preset":          "public_chat",
+		}, &resolved)
+	}
+	if err != nil {
+		return "", err
+	}
+	b.mapRoom(room, resolved.RoomID)
+	return resolved.RoomID, nil
+}
+
+func (b *MatrixBridge) mapRoom(room, roomID string) {
+	b.mu.Lock()
+	b.roomIDs[room] = roomID
+	b.rooms[roomID] = room
+	b.mu.Unlock()
+}
+
+// ensureGhost registers a chat user's ghost and joins it to a room
+func (b *MatrixBridge) ensureGhost(name, roomID string) (string, error) {
+	localpart := b.prefix + matrixLocalpart(name)
+	user := "@" + localpart + ":" + b.serverName
+	b.mu.Lock()
+	joined := b.joined[user+" "+roomID]
+	b.mu.Unlock()
+	if joined {
+		return user, nil
+	}
+
+	err := b.call(http.MethodPost, "/register", "", map[string]string{
+		"type":     "m.login.application_service",
+		"username": localpart,
+	}, nil)
+	var merr *matrixError
+	if err != nil && !(errors.As(err, &merr) && merr.Code == "M_USER_IN_USE") {
+		return "", err
+	}
+	if err := b.call(http.MethodPut, "/profile/"+url.PathEscape(user)+"/displayname", user, map[string]string{"displayname": name}, nil); err != nil {
+		log.Println("Error setting Matrix display name:", err)
+	}
+	if err := b.call(http.MethodPost, "/join/"+url.PathEscape(roomID), user, struct{}{}, nil); err != nil {
+		return "", err
+	}
+	b.mu.Lock()
+	b.joined[user+" "+roomID] = true
+	b.mu.Unlock()
+	return user, nil
+}
+
+func (b *MatrixBridge) alias(room string) string {
+	return "#" + b.prefix + room + ":" + b.serverName
+}
+
+func (b *MatrixBridge) botUser() string {
+	return "@" + b.reg.SenderLocalpart + ":" + b.serverName
+}
+
+// bridged reports whether a Matrix user belongs to this bridge
+func (b *MatrixBridge) bridged(user string) bool {
+	return user == b.botUser() || (strings.HasPrefix(user, "@"+b.prefix) && strings.HasSuffix(user, ":"+b.serverName))
+}
+
+// matrixLocalpart lowercases a name and replaces characters Matrix user IDs do not allow
+func matrixLocalpart(name string) string {
+	var sb strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || strings.ContainsRune("._=-/", r) {
+			sb.WriteRune(r)
+		} else {
+			sb.WriteByte('_')
+		}
+	}
+	return sb.String()
+}
+
+// matrixError is an error response from the homeserver
+type matrixError struct {
+	Status  int
+	Code    string `json:"errcode"`
+	Message string `json:"error"`
+}
+
+func (e *matrixError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// call makes a client-server API request as the application service, acting as user if set
+func (b *MatrixBridge) call(method, path, user string, body, out interface{}) error {
+	u := b.homeserver + "/_matrix/client/v3" + path
+	if user != "" {
+		u += "?user_id=" + url.QueryEscape(user)
+	}
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, u, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+b.reg.ASToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := b.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		merr := &matrixError{Status: resp.StatusCode}
+		json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(merr)
+		return merr
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// authorized checks the homeserver's token on an application service request
+func (b *MatrixBridge) authorized(w http.ResponseWriter, r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.URL.Query().Get("access_token")
+	}
+	if token != b.reg.HSToken {
+		writeJSON(w, http.StatusForbidden, map[string]string{"errcode": "M_FORBIDDEN"})
+		return false
+	}
+	return true
+}
+
+// HandleTransaction receives events pushed by the homeserver and relays
+// messages from Matrix users into the mirrored chat rooms
+func (b *MatrixBridge) HandleTransaction(w http.ResponseWriter, r *http.Request) {
+	if !b.authorized(w, r) {
+		return
+	}
+	var txn struct {
+		Events []struct {
+			Type    string `json:"type"`
+			RoomID  string `json:"room_id"`
+			Sender  string `json:"sender"`
+			Content struct {
+				MsgType string `json:"msgtype"`
+				Body    string `json:"body"`
+			} `json:"content"`
+		} `json:"events"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&txn); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"errcode": "M_NOT_JSON"})
+		return
+	}
+
+	// The homeserver retries transactions until they succeed, so skip repeats
+	id := r.PathValue("txn")
+	b.mu.Lock()
+	seen := b.txns[id]
+	if len(b.txns) > 1000 {
+		b.txns = make(map[string]bool)
+	}
+	b.txns[id] = true
+	b.mu.Unlock()
+	if seen {
+		writeJSON(w, http.StatusOK, struct{}{})
+		return
+	}
+
+	for _, ev := range txn.Events {
+		if ev.Type != "m.room.message" || b.bridged(ev.Sender) || strings.TrimSpace(ev.Content.Body) == "" {
+			continue
+		}
+		room, ok := b.chatRoom(ev.RoomID)
+		if !ok {
+			continue
+		}
+		body := ev.Content.Body
+		if ev.Content.MsgType == "m.emote" {
+			body = "* " + body
+		}
+		msg := &Message{Type: MessageChat, Room: room, From: ev.Sender, Body: body, origin: "matrix"}
+		if err := b.cs.PostMessage(msg, 0); err != nil {
+			log.Printf("Dropping Matrix message from %s in %s: %v", ev.Sender, room, err)
+		}
+	}
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+// chatRoom returns the chat room a Matrix room mirrors, looking up its
+// canonical alias the first time the room is seen
+func (b *MatrixBridge) chatRoom(roomID string) (string, bool) {
+	b.mu.Lock()
+	room, ok := b.rooms[roomID]
+	b.mu.Unlock()
+	if ok {
+		return room, true
+	}
+	var state struct {
+		Alias string `json:"alias"`
+	}
+	path := "/rooms/" + url.PathEscape(roomID) + "/state/m.room.canonical_alias"
+	if err := b.call(http.MethodGet, path, "", nil, &state); err != nil {
+		return "", false
+	}
+	room, ok = strings.CutPrefix(state.Alias, "#"+b.prefix)
+	if !ok || !strings.HasSuffix(room, ":"+b.serverName) {
+		return "", false
+	}
+	room = strings.TrimSuffix(room, ":"+b.serverName)
+	b.mapRoom(room, roomID)
+	return room, true
+}
+
+// HandleRoomQuery creates the Matrix mirror of a chat room when a Matrix user
+// looks up its alias
+func (b *MatrixBridge) HandleRoomQuery(w http.ResponseWriter, r *http.Request) {
+	if !b.authorized(w, r) {
+		return
+	}
+	room, ok := strings.CutPrefix(r.PathValue("alias"), "#"+b.prefix)
+	room = strings.TrimSuffix(room, ":"+b.serverName)
+	b.cs.Mutex.Lock()
+	_, exists := b.cs.Rooms[room]
+	b.cs.Mutex.Unlock()
+	if !ok || !exists {
+		writeJSON(w, http.StatusNotFound, map[string]string{"errcode": "M_NOT_FOUND"})
+		return
+	}
+	if _, err := b.ensureRoom(room); err != nil {
+		log.Println("Error creating Matrix room:", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"errcode": "M_UNKNOWN"})
+		return
+	}
+	writeJSON(w, http.StatusOK, struct{}{})
+}
+
+// HandleUserQuery answers user lookups. Ghost users are created when they
+// first speak, so none exist ahead of time.
+func (b *MatrixBridge) HandleUserQuery(w http.ResponseWriter, r *http.Request) {
+	if !b.authorized(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusNotFound, map[string]string{"errcode": "M_NOT_FOUND"})
+}
@@ -1,5 +1,11 @@
 package main
 
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
 type LoginRequest struct {
 	Username string
 	Password string
@@ -8,3 +14,253 @@ type LoginRequest struct {
 type LoginResponse struct {
 	Token string
 }
+
+// Message types sent to clients
+const (
+	MessageChat         = "chat"
+	MessageSystem       = "system"
+	MessageAnnouncement = "announcement"
+	MessageMOTD         = "motd"
+	MessageSnippet      = "snippet"
+	MessageModeration   = "moderation"
+	MessageLocation     = "location"
+	MessageJoin         = "join"
+	MessageLeave        = "leave"
+	MessageCommand      = "command"
+	MessageHistoryEnd   = "history.end"
+	MessageTopic        = "topic"
+	MessageRoomInfo     = "room.info"
+	MessageRoomPins     = "room.pins"
+	MessageProfile      = "profile"
+	MessagePresence     = "presence"
+	MessageMention      = "mention"
+	MessagePoll         = "poll"
+	MessageError        = "error"
+	MessagePrompt       = "prompt"
+	MessageHello        = "hello"
+	MessageEmojiList    = "emoji.list"
+	MessageReaction     = "reaction"
+	MessageStream       = "stream"
+	MessageStreams      = "streams"
+
+	// End-to-end encryption, relayed without inspection
+	MessageKey       = "key"
+	MessageKeys      = "keys"
+	MessageEncrypted = "encrypted"
+	MessageRoomKey   = "room_key"
+
+	// Call signaling, relayed without inspection
+	MessageCallOffer     = "call.offer"
+	MessageCallAnswer    = "call.answer"
+	MessageCallCandidate = "call.candidate"
+	MessageCallHangup    = "call.hangup"
+	MessageCallTURN      = "call.turn"
+)
+
+// Message is the envelope sent to clients. WebSocket clients receive it as
+// JSON, TCP clients receive the rendered Text.
+type Message struct {
+	Type string `json:"type"`
+	// Code identifies system, error and prompt messages for clients
+	Code string `json:"code,omitempty"`
+	Room string `json:"room,omitempty"`
+	From string `json:"from,omitempty"`
+	Body string `json:"body"`
+	Bot  bool   `json:"bot,omitempty"`
+	// HTML is the sanitized rendering of Body in rooms with a format other than plain
+	HTML string `json:"html,omitempty"`
+
+	// Posted messages carry the ID and time the server assigned them and
+	// their sequence number in the room, which increases by one per message
+	ID   string     `json:"id,omitempty"`
+	Time *time.Time `json:"time,omitempty"`
+	Seq  uint64     `json:"seq,omitempty"`
+
+	Snippet     *SnippetInfo    `json:"snippet,omitempty"`
+	Attachments []Attachment    `json:"attachments,omitempty"`
+	Preview     *LinkPreview    `json:"preview,omitempty"`
+	Location    *Location       `json:"location,omitempty"`
+	Info        *RoomInfo       `json:"info,omitempty"`
+	Profile     *Profile        `json:"profile,omitempty"`
+	Presence    string          `json:"presence,omitempty"`
+	Reason      string          `json:"reason,omitempty"`
+	Poll        *Poll           `json:"poll,omitempty"`
+	Pins        []PinnedMessage `json:"pins,omitempty"`
+	Hello       *Hello          `json:"hello,omitempty"`
+	Emoji       []*CustomEmoji  `json:"emoji,omitempty"`
+	Reaction    *Reaction       `json:"reaction,omitempty"`
+	Stream      *Stream         `json:"stream,omitempty"`
+	Streams     []LiveStream    `json:"streams,omitempty"`
+
+	// Errors say whether the request may succeed if sent again, and
+	// when it is known, how many seconds to wait first
+	Retryable  bool `json:"retryable,omitempty"`
+	RetryAfter int  `json:"retry_after,omitempty"`
+
+	// End-to-end encryption
+	To         string            `json:"to,omitempty"`
+	Key        string            `json:"key,omitempty"`
+	Keys       map[string]string `json:"keys,omitempty"`
+	Ciphertext string            `json:"ciphertext,omitempty"`
+
+	// Call signaling
+	Call   string          `json:"call,omitempty"`
+	Signal json.RawMessage `json:"signal,omitempty"`
+	ICE    *ICEConfig      `json:"ice,omitempty"`
+
+	// origin names the bridge a message arrived through, so it is not echoed back
+	origin string
+	// span traces the message from receipt through persistence and fan-out
+	span *Span
+	// format and args rebuild the body of server messages in other languages
+	format string
+	args   []interface{}
+}
+
+// Attachment is rich content attached to a message, such as a GIF
+type Attachment struct {
+	Type  string `json:"type"`
+	URL   string `json:"url"`
+	Title string `json:"title,omitempty"`
+}
+
+// SnippetInfo describes a shared snippet whose preview is in the message body
+type SnippetInfo struct {
+	ID        string `json:"id"`
+	Language  string `json:"language,omitempty"`
+	Filename  string `json:"filename,omitempty"`
+	Lines     int    `json:"lines"`
+	Size      int    `json:"size"`
+	Truncated bool   `json:"truncated"`
+}
+
+// Text renders the message as a single line for plain text clients
+func (m *Message) Text() string {
+	switch m.Type {
+	case MessageChat:
+		from := m.From
+		if m.Bot {
+			from += " [bot]"
+		}
+		text := from + ": " + m.Body
+		for _, a := range m.Attachments {
+			text += " [" + a.Type + ": " + a.URL + "]"
+		}
+		if m.Preview != nil && m.Preview.Title != "" {
+			text += " [" + m.Preview.Title + "]"
+		}
+		return text
+	case MessageAnnouncement:
+		return "*** Announcement: " + m.Body + " ***"
+	case MessageMOTD:
+		return "Message of the day: " + m.Body
+	case MessageSnippet:
+		text := fmt.Sprintf("%s shared snippet %s", m.From, m.Snippet.ID)
+		if m.Snippet.Filename != "" {
+			text += " (" + m.Snippet.Filename + ")"
+		}
+		text += ":\n" + m.Body
+		if m.Snippet.Truncated {
+			text += fmt.Sprintf("\n... %d lines, use /snippet %s to see all", m.Snippet.Lines, m.Snippet.ID)
+		}
+		return text
+	case MessageLocation:
+		text := fmt.Sprintf("%s shared a location", m.From)
+		if m.Location.Live {
+			text = fmt.Sprintf("%s shared a live location", m.From)
+		}
+		if m.Body != "" {
+			text += ": " + m.Body
+		}
+		return fmt.Sprintf("%s (%.5f, %.5f) https://www.openstreetmap.org/?mlat=%.5f&mlon=%.5f",
+			text, m.Location.Lat, m.Location.Lon, m.Location.Lat, m.Location.Lon)
+	case MessagePoll:
+		return pollText(m.From, m.Poll)
+	case MessageEncrypted:
+		return m.From + " sent an encrypted message"
+	case MessageKey:
+		return m.From + " published an encryption key"
+	case MessageTopic:
+		if m.Body == "" {
+			return m.From + " cleared the topic"
+		}
+		return m.From + " changed the topic to: " + m.Body
+	case MessageRoomKey:
+		return m.From + " sent you a room key"
+	case MessageCallOffer:
+		return m.From + " started call " + m.Call
+	case MessageCallAnswer:
+		return m.From + " answered call " + m.Call
+	case MessageCallCandidate:
+		return m.From + " sent a connection candidate for call " + m.Call
+	case MessageCallHangup:
+		return m.From + " left call " + m.Call
+	case MessageCallTURN:
+		return "TURN credentials valid until " + m.ICE.Expires.Format(time.RFC3339)
+	default:
+		return m.Body
+	}
+}
+
+// Request is a structured message sent by a WebSocket client
+type Request struct {
+	Type     string `json:"type"`
+	Body     string `json:"body"`
+	Language string `json:"language,omitempty"`
+	Filename string `json:"filename,omitempty"`
+
+	// Bot subscriptions
+	Events []string `json:"events,omitempty"`
+
+	// Flow control
+	Credits int `json:"credits,omitempty"`
+
+	// Hello, sent first by clients of the typed protocol
+	Version  int      `json:"version,omitempty"`
+	Features []string `json:"features,omitempty"`
+
+	// Replay of the sequence range Since to Until, inclusive. Zero Until means the latest.
+	Since uint64 `json:"since,omitempty"`
+	Until uint64 `json:"until,omitempty"`
+
+	// History range requests name the room and the range FromSeq to ToSeq
+	Room    string `json:"room,omitempty"`
+	FromSeq uint64 `json:"from_seq,omitempty"`
+	ToSeq   uint64 `json:"to_seq,omitempty"`
+
+	// End-to-end encryption
+	To         string `json:"to,omitempty"`
+	Key        string `json:"key,omitempty"`
+	Ciphertext string `json:"ciphertext,omitempty"`
+
+	// Call signaling: the call ID clients chose and the session description
+	// or ICE candidate
+	Call   string          `json:"call,omitempty"`
+	Signal json.RawMessage `json:"signal,omitempty"`
+
+	// Stream announcements
+	Stream *Stream `json:"stream,omitempty"`
+
+	// Push notification registration
+	Push *PushSubscription `json:"push,omitempty"`
+
+	// Location requests
+	ID    string   `json:"id,omitempty"`
+	Lat   *float64 `json:"lat,omitempty"`
+	Lon   *float64 `json:"lon,omitempty"`
+	Label string   `json:"label,omitempty"`
+	TTL   int      `json:"ttl,omitempty"`
+}
+
+// parseRequest decodes a JSON request frame. Frames that are not JSON
+// objects with a type are plain chat text.
+func parseRequest(data []byte) (*Request, bool) {
+	if len(data) == 0 || data[0] != '{' {
+		return nil, false
+	}
+	var req Request
+	if err := json.Unmarshal(data, &req); err != nil || req.Type == "" {
+		return nil, false
+	}
+	return &req, true
+}
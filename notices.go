@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Codes identify server notices, errors and prompts so clients can react to
+// them without matching their text, which is translated
+const (
+	CodeMenu           = "prompt.menu"
+	CodeUsername       = "prompt.username"
+	CodePassword       = "prompt.password"
+	CodeTwoFactor      = "prompt.two_factor"
+	CodeChallenge      = "prompt.challenge"
+	CodeLoggedIn       = "login.ok"
+	CodeRegistered     = "register.ok"
+	CodeLoginFailed    = "login.failed"
+	CodeLoginLocked    = "login.locked"
+	CodeRegisterFailed = "register.failed"
+	CodeUnavailable    = "auth.unavailable"
+
+	CodePermissionDenied = "permission.denied"
+	CodeNoSuchRoom       = "room.not_found"
+	CodeNotInRoom        = "room.not_joined"
+	CodeUnknownCommand   = "command.unknown"
+	CodeUsage            = "command.usage"
+	CodeRejected         = "message.rejected"
+	CodeSpam             = "message.spam"
+	CodeGuest            = "message.guest"
+	CodeThrottled        = "message.throttled"
+	CodeRateLimited      = "rate.limited"
+	CodeMalformed        = "request.malformed"
+	CodeLoginRefused     = "login.refused"
+	CodeInvalidName      = "name.invalid"
+)
+
+// retryable are the error codes of requests that may succeed if they are
+// sent again later, unchanged
+var retryable = map[string]bool{
+	CodeUnavailable: true,
+	CodeLoginLocked: true,
+	CodeSpam:        true,
+	CodeThrottled:   true,
+	CodeRateLimited: true,
+}
+
+// errorMessage builds an error message, marked retryable if its code is
+func errorMessage(code, body string) *Message {
+	return &Message{Type: MessageError, Code: code, Body: body, Retryable: retryable[code]}
+}
+
+// retryIn says how long to wait before sending a retryable request again
+func (m *Message) retryIn(wait time.Duration) *Message {
+	m.RetryAfter = retrySeconds(wait)
+	return m
+}
+
+// jsonSubprotocol is the WebSocket subprotocol of the typed protocol. Clients
+// that ask for it exchange hellos, then receive the login exchange as typed
+// messages instead of plain text prompts.
+const jsonSubprotocol = "chat.json"
+
+// Fail tells the client a request failed, in its language, with a code
+// saying why
+func (c *Client) Fail(code, format string, args ...interface{}) error {
+	return c.Send(errorMessage(code, c.T(format, args...)))
+}
+
+// typed reports whether the client speaks the typed protocol, so every
+// frame it sends must be a JSON request
+func (c *Client) typed() bool {
+	ws, ok := c.Transport.(*wsTransport)
+	return ok && ws.features != nil
+}
+
+// handshake writes the login exchange of a WebSocket client. Clients that
+// negotiated jsonSubprotocol get prompt, error and system messages with
+// codes; others get the plain text they always have.
+type handshake struct {
+	conn   *websocket.Conn
+	client *Client
+	typed  bool
+}
+
+func newHandshake(conn *websocket.Conn, client *Client) *handshake {
+	return &handshake{conn: conn, client: client, typed: conn.Subprotocol() == jsonSubprotocol}
+}
+
+// send writes a message of the exchange, only its body for plain clients
+func (h *handshake) send(msg *Message) error {
+	if !h.typed {
+		return h.conn.WriteMessage(websocket.TextMessage, []byte(msg.Body))
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return h.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// prompt asks the client for the next answer of the exchange
+func (h *handshake) prompt(code, format string, args ...interface{}) error {
+	return h.send(&Message{Type: MessagePrompt, Code: code, Body: h.client.T(format, args...)})
+}
+
+// fail ends the exchange with an error
+func (h *handshake) fail(code, format string, args ...interface{}) error {
+	return h.send(errorMessage(code, h.client.T(format, args...)))
+}
+
+// succeed reports a successful login or registration
+func (h *handshake) succeed(code, format string, args ...interface{}) error {
+	return h.send(&Message{Type: MessageSystem, Code: code, Body: h.client.T(format, args...)})
+}
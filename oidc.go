@@ -0,0 +1,452 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Clock skew allowed when checking ID token expiry
+const oidcClockSkew = time.Minute
+
+// How long a browser has to finish signing in at the provider
+const oidcLoginTimeout = 10 * time.Minute
+
+// oidcConfig is the part of a provider's discovery document we use
+type oidcConfig struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oidcLogin is a browser sign-in waiting for the provider to redirect back
+type oidcLogin struct {
+	nonce   string
+	expires time.Time
+}
+
+// OIDCProvider signs users in with an OpenID Connect identity provider,
+// either from an ID token the client already has or through the browser
+// redirect flow
+type OIDCProvider struct {
+	name         string
+	issuer       string
+	clientID     string
+	clientSecret string
+	nameClaim    string
+	namePrefix   string
+	admins       map[string]bool
+	client       *http.Client
+
+	mu      sync.Mutex
+	config  *oidcConfig
+	keys    map[string]crypto.PublicKey
+	pending map[string]oidcLogin
+}
+
+// LoadOIDCProviders reads the providers listed in OIDC_PROVIDERS. Each NAME
+// is configured with OIDC_<NAME>_ISSUER and OIDC_<NAME>_CLIENT_ID, plus
+// OIDC_<NAME>_CLIENT_SECRET for the redirect flow and OIDC_<NAME>_NAME_CLAIM
+// to take chat names from a claim other than preferred_username or email.
+// Users of a provider get chat names in its own namespace, and only those
+// listed in OIDC_<NAME>_ADMINS are administrators.
+func LoadOIDCProviders() map[string]*OIDCProvider {
+	providers := make(map[string]*OIDCProvider)
+	for _, name := range envList("OIDC_PROVIDERS") {
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		p := &OIDCProvider{
+			name:         name,
+			issuer:       strings.TrimSuffix(os.Getenv(prefix+"ISSUER"), "/"),
+			clientID:     os.Getenv(prefix + "CLIENT_ID"),
+			clientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			nameClaim:    os.Getenv(prefix + "NAME_CLAIM"),
+			namePrefix:   oidcNamePrefix(name),
+			admins:       make(map[string]bool),
+			client:       &http.Client{Timeout: envDuration("OIDC_TIMEOUT", 10*time.Second)},
+			pending:      make(map[string]oidcLogin),
+		}
+		for _, admin := range envList(prefix + "ADMINS") {
+			p.admins[admin] = true
+		}
+		if p.issuer == "" || p.clientID == "" {
+			log.Printf("OIDC provider %s disabled: %sISSUER and %sCLIENT_ID must be set", name, prefix, prefix)
+			continue
+		}
+		providers[name] = p
+	}
+	return providers
+}
+
+// oidcNamePrefix is the namespace of a provider's chat names, the provider's
+// name and a dot unless OIDC_<NAME>_NAME_PREFIX sets another
+func oidcNamePrefix(provider string) string {
+	if prefix, ok := os.LookupEnv("OIDC_" + strings.ToUpper(provider) + "_NAME_PREFIX"); ok {
+		return prefix
+	}
+	return provider + "."
+}
+
+// federatedName reports whether a name is in the namespace of a single
+// sign-on provider, so only that provider's users may have it
+func federatedName(name string) bool {
+	for _, provider := range envList("OIDC_PROVIDERS") {
+		if prefix := oidcNamePrefix(provider); prefix != "" && len(name) > len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAdmin reports whether a user of this provider is an administrator.
+// ADMIN_USERS does not apply to them.
+func (p *OIDCProvider) isAdmin(name string) bool {
+	return p.admins[name]
+}
+
+// discover fetches the provider's discovery document the first time it is needed
+func (p *OIDCProvider) discover() (*oidcConfig, error) {
+	p.mu.Lock()
+	config := p.config
+	p.mu.Unlock()
+	if config != nil {
+		return config, nil
+	}
+	config = &oidcConfig{}
+	if err := p.getJSON(p.issuer+"/.well-known/openid-configuration", config); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	if strings.TrimSuffix(config.Issuer, "/") != p.issuer {
+		return nil, fmt.Errorf("discovery document is for issuer %s", config.Issuer)
+	}
+	p.mu.Lock()
+	p.config = config
+	p.mu.Unlock()
+	return config, nil
+}
+
+func (p *OIDCProvider) getJSON(u string, v interface{}) error {
+	resp, err := p.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status code %d", u, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// key returns the signing key with the given ID, fetching the provider's
+// key set again when the key is unknown since providers rotate keys
+func (p *OIDCProvider) key(kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	config, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(config.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("fetching keys: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		switch {
+		case k.Kty == "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil || len(e) > 4 {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+	if key, ok = keys[kid]; !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// verify checks the signature of an ID token and returns its claims
+func (p *OIDCProvider) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(raw, &header) != nil {
+		return nil, errors.New("malformed token header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+			return nil, errors.New("invalid signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(signature) != 64 {
+			return nil, errors.New("invalid signature")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			return nil, errors.New("invalid signature")
+		}
+	default:
+		return nil, errors.New("unsupported signing key")
+	}
+
+	raw, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	return claims, nil
+}
+
+// Identify verifies an ID token issued to this server and returns the chat
+// name of the user it identifies. nonce is checked when it is not empty.
+func (p *OIDCProvider) Identify(token, nonce string) (string, error) {
+	claims, err := p.verify(token)
+	if err != nil {
+		return "", err
+	}
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != p.issuer {
+		return "", fmt.Errorf("token issued by %q", iss)
+	}
+	if !audienceIncludes(claims["aud"], p.clientID) {
+		return "", errors.New("token was issued to another client")
+	}
+	exp, _ := claims["exp"].(float64)
+	if time.Now().Add(-oidcClockSkew).After(time.Unix(int64(exp), 0)) {
+		return "", errors.New("token has expired")
+	}
+	if got, _ := claims["nonce"].(string); nonce != "" && got != nonce {
+		return "", errors.New("token nonce does not match")
+	}
+
+	name := p.chatName(claims)
+	if name == "" {
+		return "", errors.New("token has no usable name claim")
+	}
+	if err := checkName(name); err != nil {
+		return "", fmt.Errorf("name %q: %w", name, err)
+	}
+	// Without a namespace, provider names could pass for reserved ones
+	if reservedName(name) && !p.isAdmin(name) {
+		return "", fmt.Errorf("name %q is reserved", name)
+	}
+	return name, nil
+}
+
+// chatName maps the claims of a verified token to a chat name in the
+// provider's namespace. Email addresses are only trusted once the provider
+// has verified them, and their @ becomes a dot.
+func (p *OIDCProvider) chatName(claims map[string]interface{}) string {
+	var name string
+	switch {
+	case p.nameClaim != "":
+		name, _ = claims[p.nameClaim].(string)
+	case claims["preferred_username"] != nil:
+		name, _ = claims["preferred_username"].(string)
+	default:
+		verified := claims["email_verified"] == true || claims["email_verified"] == "true"
+		if email, _ := claims["email"].(string); verified {
+			name = email
+		}
+	}
+	name = strings.TrimSpace(name)
+	if name == "" || strings.ContainsAny(name, " \t\r\n") {
+		return ""
+	}
+	return p.namePrefix + strings.ReplaceAll(name, "@", ".")
+}
+
+// audienceIncludes reports whether an aud claim, a string or a list of
+// strings, names the client
+func audienceIncludes(aud interface{}, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// redirectURI is where the provider sends browsers back to after sign-in
+func (p *OIDCProvider) redirectURI() string {
+	return strings.TrimSuffix(os.Getenv("OIDC_REDIRECT_BASE"), "/") + "/oauth/" + p.name + "/callback"
+}
+
+// HandleOIDCLogin starts the browser sign-in flow by redirecting to the provider
+func (cs *ChatServer) HandleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	p := cs.OIDC[r.PathValue("provider")]
+	if p == nil {
+		writeError(w, http.StatusNotFound, "unknown identity provider")
+		return
+	}
+	config, err := p.discover()
+	if err != nil {
+		log.Printf("Error contacting identity provider %s: %v", p.name, err)
+		writeError(w, http.StatusBadGateway, "identity provider unavailable")
+		return
+	}
+	state, err := newID(16)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	nonce, err := newID(16)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	now := time.Now()
+	p.mu.Lock()
+	for id, login := range p.pending {
+		if now.After(login.expires) {
+			delete(p.pending, id)
+		}
+	}
+	p.pending[state] = oidcLogin{nonce: nonce, expires: now.Add(oidcLoginTimeout)}
+	p.mu.Unlock()
+
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.clientID},
+		"redirect_uri":  {p.redirectURI()},
+		"scope":         {"openid profile email"},
+		"state":         {state},
+		"nonce":         {nonce},
+	}
+	http.Redirect(w, r, config.AuthorizationEndpoint+"?"+query.Encode(), http.StatusFound)
+}
+
+// HandleOIDCCallback finishes the browser sign-in flow. The authorization
+// code is exchanged for an ID token and the browser is sent to OIDC_APP_URL
+// with a connect ticket in the fragment.
+func (cs *ChatServer) HandleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	p := cs.OIDC[r.PathValue("provider")]
+	if p == nil {
+		writeError(w, http.StatusNotFound, "unknown identity provider")
+		return
+	}
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		writeError(w, http.StatusUnauthorized, "sign-in failed: "+e)
+		return
+	}
+	p.mu.Lock()
+	login, ok := p.pending[query.Get("state")]
+	delete(p.pending, query.Get("state"))
+	p.mu.Unlock()
+	if !ok || time.Now().After(login.expires) {
+		writeError(w, http.StatusBadRequest, "sign-in expired, please try again")
+		return
+	}
+
+	config, err := p.discover()
+	if err != nil {
+		log.Printf("Error contacting identity provider %s: %v", p.name, err)
+		writeError(w, http.StatusBadGateway, "identity provider unavailable")
+		return
+	}
+	resp, err := p.client.PostForm(config.TokenEndpoint, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {query.Get("code")},
+		"redirect_uri":  {p.redirectURI()},
+		"client_id":     {p.clientID},
+		"client_secret": {p.clientSecret},
+	})
+	if err != nil {
+		log.Printf("Error contacting identity provider %s: %v", p.name, err)
+		writeError(w, http.StatusBadGateway, "identity provider unavailable")
+		return
+	}
+	defer resp.Body.Close()
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&tokens) != nil || tokens.IDToken == "" {
+		log.Printf("Identity provider %s rejected the authorization code with status code %d", p.name, resp.StatusCode)
+		writeError(w, http.StatusUnauthorized, "sign-in failed")
+		return
+	}
+
+	user, err := p.Identify(tokens.IDToken, login.nonce)
+	if err != nil {
+		log.Printf("Rejected %s ID token: %v", p.name, err)
+		writeError(w, http.StatusUnauthorized, "sign-in failed")
+		return
+	}
+	ticket, _, err := cs.IssueTicket(&connectTicket{user: user, admin: p.isAdmin(user), needsCode: cs.TwoFactorEnabled(user)})
+	if err != nil {
+		log.Println("Error creating ticket:", err)
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, os.Getenv("OIDC_APP_URL")+"#ticket="+url.QueryEscape(ticket), http.StatusFound)
+}
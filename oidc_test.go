@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeIssuer is an OIDC provider that signs ID tokens with an RSA key
+type fakeIssuer struct {
+	url string
+	key *rsa.PrivateKey
+}
+
+func startIssuer(t *testing.T) *fakeIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer := &fakeIssuer{key: key}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(oidcConfig{Issuer: issuer.url, JWKSURI: issuer.url + "/keys"})
+		case "/keys":
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+				"kid": "test",
+				"kty": "RSA",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	issuer.url = server.URL
+	return issuer
+}
+
+// token signs an ID token with the given claims
+func (i *fakeIssuer) token(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","kid":"test"}`)) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, i.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	issuer := startIssuer(t)
+	t.Setenv("OIDC_PROVIDERS", "corp")
+	t.Setenv("OIDC_CORP_ISSUER", issuer.url)
+	t.Setenv("OIDC_CORP_CLIENT_ID", "chat")
+	t.Setenv("OIDC_CORP_ADMINS", "corp.ada")
+	t.Setenv("ADMIN_USERS", "alice")
+	s := startServer(t)
+	httpURL := "http" + strings.TrimSuffix(strings.TrimPrefix(s.wsURL, "ws"), "/ws")
+	exp := time.Now().Add(time.Hour).Unix()
+
+	issueTicket := func(token string) *http.Response {
+		body, _ := json.Marshal(map[string]string{"provider": "corp", "id_token": token})
+		resp, err := http.Post(httpURL+"/tickets", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := issueTicket(issuer.token(t, map[string]interface{}{"iss": issuer.url, "aud": "other", "exp": exp, "preferred_username": "mallory"}))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("token for another client: status %d", resp.StatusCode)
+	}
+	resp = issueTicket(issuer.token(t, map[string]interface{}{"iss": issuer.url, "aud": "chat", "exp": exp, "email": "eve@example.com", "email_verified": false}))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("token with unverified email: status %d", resp.StatusCode)
+	}
+
+	resp = issueTicket(issuer.token(t, map[string]interface{}{"iss": issuer.url, "aud": []string{"chat"}, "exp": exp, "email": "olivia@example.com", "email_verified": true}))
+	var issued struct {
+		Ticket string `json:"ticket"`
+	}
+	json.NewDecoder(resp.Body).Decode(&issued)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || issued.Ticket == "" {
+		t.Fatalf("valid token: status %d", resp.StatusCode)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(s.wsURL+"?ticket="+issued.Ticket, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	s.waitForClient(t, "corp.olivia.example.com")
+
+	token := issuer.token(t, map[string]interface{}{"iss": issuer.url, "aud": "chat", "exp": exp, "preferred_username": "oscar"})
+	conn, _, err = websocket.DefaultDialer.Dial(s.wsURL+"?provider=corp&id_token="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	s.waitForClient(t, "corp.oscar")
+
+	expired := issuer.token(t, map[string]interface{}{"iss": issuer.url, "aud": "chat", "exp": time.Now().Add(-time.Hour).Unix(), "preferred_username": "oscar"})
+	if _, resp, err := websocket.DefaultDialer.Dial(s.wsURL+"?provider=corp&id_token="+expired, nil); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expired token was accepted: %v", err)
+	}
+
+	// Provider names cannot pass for local ones, and only the provider's
+	// admins are admins
+	token = issuer.token(t, map[string]interface{}{"iss": issuer.url, "aud": "chat", "exp": exp, "preferred_username": "alice"})
+	conn, _, err = websocket.DefaultDialer.Dial(s.wsURL+"?provider=corp&id_token="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if c := s.waitForClient(t, "corp.alice"); c.Admin {
+		t.Fatal("a provider's alice got the admin rights of alice")
+	}
+	token = issuer.token(t, map[string]interface{}{"iss": issuer.url, "aud": "chat", "exp": exp, "preferred_username": "ada"})
+	conn, _, err = websocket.DefaultDialer.Dial(s.wsURL+"?provider=corp&id_token="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if c := s.waitForClient(t, "corp.ada"); !c.Admin {
+		t.Fatal("OIDC_CORP_ADMINS did not make corp.ada an admin")
+	}
+	if err := validateName("corp.oscar", true); err != errNameFederated {
+		t.Fatalf("local user could take a provider's name: %v", err)
+	}
+
+	// Two-factor authentication applies to provider users too
+	s.cs.Mutex.Lock()
+	s.cs.TOTPSecrets["corp.tess"] = "JBSWY3DPEHPK3PXP"
+	s.cs.Mutex.Unlock()
+	token = issuer.token(t, map[string]interface{}{"iss": issuer.url, "aud": "chat", "exp": exp, "preferred_username": "tess"})
+	resp = issueTicket(token)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("ticket without two-factor code: status %d", resp.StatusCode)
+	}
+	conn, _, err = websocket.DefaultDialer.Dial(s.wsURL+"?provider=corp&id_token="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	_, prompt, err := conn.ReadMessage()
+	if err != nil || !strings.Contains(string(prompt), "two-factor code") {
+		t.Fatalf("expected a two-factor prompt, got %q (%v)", prompt, err)
+	}
+	for _, c := range s.cs.Clients.All() {
+		if c.Name == "corp.tess" {
+			t.Fatal("client joined before entering its two-factor code")
+		}
+	}
+	conn.WriteMessage(websocket.TextMessage, []byte("not a code"))
+	if _, reply, _ := conn.ReadMessage(); !strings.Contains(string(reply), "Invalid two-factor code") {
+		t.Fatalf("wrong code was accepted: %q", reply)
+	}
+
+	// Codes sent with ID tokens are throttled like any other login
+	body, _ := json.Marshal(map[string]string{"provider": "corp", "id_token": token, "code": "000000"})
+	resp, err = http.Post(httpURL+"/tickets", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("code after a failure: status %d", resp.StatusCode)
+	}
+	conn, _, err = websocket.DefaultDialer.Dial(s.wsURL+"?provider=corp&id_token="+token, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if _, reply, _ := conn.ReadMessage(); !strings.Contains(string(reply), "Too many failed attempts") {
+		t.Fatalf("two-factor prompt after a failure: %q", reply)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// PinnedMessage is a copy of a message a moderator pinned in a room
+type PinnedMessage struct {
+	ID       string    `json:"id"`
+	From     string    `json:"from"`
+	Body     string    `json:"body"`
+	Time     time.Time `json:"time"`
+	PinnedBy string    `json:"pinned_by"`
+	Pinned   time.Time `json:"pinned"`
+}
+
+// pinsText renders the pinned messages of a room
+func pinsText(room string, pins []PinnedMessage) string {
+	if len(pins) == 0 {
+		return fmt.Sprintf("No pinned messages in %s", room)
+	}
+	lines := []string{fmt.Sprintf("Pinned in %s:", room)}
+	for _, pin := range pins {
+		lines = append(lines, fmt.Sprintf("  [%s] %s: %s", pin.ID, pin.From, pin.Body))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Pins returns the pinned messages of a room, oldest pin first
+func (cs *ChatServer) Pins(name string) []PinnedMessage {
+	cs.Mutex.Lock()
+	defer cs.Mutex.Unlock()
+	room, ok := cs.Rooms[name]
+	if !ok {
+		return nil
+	}
+	return append([]PinnedMessage(nil), room.Pins...)
+}
+
+// SendPins sends a client the pinned messages of a room it can see
+func (cs *ChatServer) SendPins(client *Client, name string) {
+	cs.Mutex.Lock()
+	room, ok := cs.Rooms[name]
+	visible := ok && cs.canSee(client, name, room)
+	cs.Mutex.Unlock()
+	if !visible {
+		client.Fail(CodeNoSuchRoom, "No such room: %s", name)
+		return
+	}
+	pins := cs.Pins(name)
+	client.Send(&Message{Type: MessageRoomPins, Room: name, Body: pinsText(name, pins), Pins: pins})
+}
+
+// findRoomMessage looks a message up by ID in the recent messages of a room,
+// then in the event log. "last" finds the latest message.
+func (cs *ChatServer) findRoomMessage(name, id string) *Message {
+	cs.Mutex.Lock()
+	recent := cs.getRoom(name).Replay.Items()
+	cs.Mutex.Unlock()
+	for i := len(recent) - 1; i >= 0; i-- {
+		if msg := recent[i]; msg.ID != "" && (msg.ID == id || id == "last") {
+			return msg
+		}
+	}
+	if id == "last" || cs.EventLog == nil {
+		return nil
+	}
+	var found *Message
+	err := cs.EventLog.Messages(name, 1, 0, func(msg *Message) {
+		if msg.ID == id {
+			found = msg
+		}
+	})
+	if err != nil {
+		log.Println("Error reading history:", err)
+	}
+	return found
+}
+
+// applyPinEvent updates the pinned messages of a room for an event log
+// entry. Caller must hold cs.Mutex.
+func (cs *ChatServer) applyPinEvent(ev Event) {
+	room := cs.getRoom(ev.Room)
+	for i, pin := range room.Pins {
+		if pin.ID == ev.Target {
+			room.Pins = append(room.Pins[:i:i], room.Pins[i+1:]...)
+			break
+		}
+	}
+	if ev.Type == EventRoomUnpin {
+		return
+	}
+	var pin PinnedMessage
+	if err := json.Unmarshal(ev.Data, &pin); err != nil {
+		log.Println("Invalid pin in event log:", err)
+		return
+	}
+	room.Pins = append(room.Pins, pin)
+}
+
+// pinCommand pins or unpins a message of the client's room, for moderators
+func (cs *ChatServer) pinCommand(client *Client, fields []string) {
+	pin := fields[0] == "/pin"
+	if len(fields) != 2 {
+		client.Fail(CodeUsage, "Usage: /pin <id>|last | /unpin <id> | /pins")
+		return
+	}
+	if !cs.IsModerator(client, client.Room) {
+		client.Fail(CodePermissionDenied, "Permission denied")
+		return
+	}
+	if !pin {
+		cs.Mutex.Lock()
+		pinned := false
+		for _, p := range cs.getRoom(client.Room).Pins {
+			pinned = pinned || p.ID == fields[1]
+		}
+		cs.Mutex.Unlock()
+		if !pinned {
+			client.Noticef("Message %s is not pinned", fields[1])
+			return
+		}
+		cs.Record(Event{Type: EventRoomUnpin, Room: client.Room, User: client.Name, Target: fields[1]})
+		cs.Audit(client, "room.unpin", client.Room, fields[1], "")
+		pins := cs.Pins(client.Room)
+		cs.Broadcast(client.Room, (&Message{Type: MessageRoomPins, Room: client.Room, Pins: pins}).setText("%s unpinned a message", client.Name), 0)
+		return
+	}
+
+	msg := cs.findRoomMessage(client.Room, fields[1])
+	if msg == nil {
+		client.Noticef("No message %s in %s", fields[1], client.Room)
+		return
+	}
+	if limit := envInt("ROOM_MAX_PINS", 25); len(cs.Pins(client.Room)) >= limit {
+		client.Noticef("%s already has %d pinned messages", client.Room, limit)
+		return
+	}
+	p := PinnedMessage{ID: msg.ID, From: msg.From, Body: msg.Body, PinnedBy: client.Name, Pinned: time.Now().UTC()}
+	if msg.Time != nil {
+		p.Time = *msg.Time
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		log.Println("Error pinning message:", err)
+		client.Notice("Could not pin message")
+		return
+	}
+	cs.Record(Event{Type: EventRoomPin, Room: client.Room, User: client.Name, Target: p.ID, Data: data})
+	cs.Audit(client, "room.pin", client.Room, p.ID, "")
+	pins := cs.Pins(client.Room)
+	cs.Broadcast(client.Room, (&Message{Type: MessageRoomPins, Room: client.Room, Pins: pins}).setText("%s pinned a message from %s: %s", client.Name, p.From, p.Body), 0)
+}
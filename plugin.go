@@ -0,0 +1,365 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Plugins are programs that add commands, message filters and event
+// consumers without rebuilding the server. Each program listed in PLUGINS is
+// started with its standard input and output connected to the server, which
+// calls a JSON-RPC service named Plugin over them, as net/rpc/jsonrpc
+// serves it:
+//
+//	Plugin.Describe({})                 -> PluginInfo
+//	Plugin.Command(PluginCommand)       -> PluginReply
+//	Plugin.Filter(PluginFilterRequest)  -> PluginFilterResult
+//	Plugin.Event(PluginEvent)           -> {}
+//
+// A plugin should exit when its standard input closes. Plugins that exit are
+// restarted after PLUGIN_RESTART_DELAY. cmd/exampleplugin is a sample.
+
+// PluginInfo is what a plugin says it provides when it starts
+type PluginInfo struct {
+	Name string `json:"name"`
+	// Commands are the slash commands the plugin handles, such as /roll
+	Commands []string `json:"commands"`
+	// Filter is set if the plugin filters messages. Rooms turn it on with
+	// /filter on plugin:<name>.
+	Filter bool `json:"filter"`
+	// Events are the events the plugin consumes: connect, authenticated,
+	// join, message and disconnect
+	Events []string `json:"events"`
+}
+
+// PluginCommand is a command a client sent
+type PluginCommand struct {
+	User    string   `json:"user"`
+	Room    string   `json:"room"`
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+}
+
+// PluginReply answers a command. Reply is shown to the client that sent it
+// and Say is posted to its room from the plugin.
+type PluginReply struct {
+	Reply string `json:"reply"`
+	Say   string `json:"say"`
+}
+
+// PluginFilterRequest is a message to filter
+type PluginFilterRequest struct {
+	User string `json:"user"`
+	Room string `json:"room"`
+	Text string `json:"text"`
+}
+
+// PluginFilterResult is the filtered text, or why the message is rejected
+type PluginFilterResult struct {
+	Text   string `json:"text"`
+	Reject string `json:"reject"`
+}
+
+// PluginEvent tells a plugin something happened
+type PluginEvent struct {
+	Type string    `json:"type"`
+	User string    `json:"user"`
+	Room string    `json:"room,omitempty"`
+	Body string    `json:"body,omitempty"`
+	Time time.Time `json:"time"`
+}
+
+// errPluginDown is returned while a plugin is restarting
+var errPluginDown = errors.New("plugin is not running")
+
+// Plugin is a running plugin program
+type Plugin struct {
+	path         string
+	timeout      time.Duration
+	restartDelay time.Duration
+	events       chan PluginEvent
+
+	mu     sync.Mutex
+	info   PluginInfo
+	client *rpc.Client
+}
+
+// pluginConn joins a plugin's standard output and input into one connection
+type pluginConn struct {
+	io.ReadCloser
+	stdin io.WriteCloser
+}
+
+func (c pluginConn) Write(p []byte) (int, error) { return c.stdin.Write(p) }
+
+func (c pluginConn) Close() error {
+	c.stdin.Close()
+	return c.ReadCloser.Close()
+}
+
+// StartPlugin starts a plugin program and asks it what it provides
+func StartPlugin(path string) (*Plugin, error) {
+	p := &Plugin{
+		path:         path,
+		timeout:      envDuration("PLUGIN_TIMEOUT", 2*time.Second),
+		restartDelay: envDuration("PLUGIN_RESTART_DELAY", 5*time.Second),
+		events:       make(chan PluginEvent, 256),
+	}
+	if err := p.start(); err != nil {
+		return nil, err
+	}
+	go p.deliverEvents()
+	return p, nil
+}
+
+// start runs the program and keeps it running
+func (p *Plugin) start() error {
+	cmd := exec.Command(p.path)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	client := jsonrpc.NewClient(pluginConn{stdout, stdin})
+	p.mu.Lock()
+	p.client = client
+	p.mu.Unlock()
+
+	var info PluginInfo
+	if err := p.call("Describe", struct{}{}, &info); err != nil || info.Name == "" {
+		client.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		if err == nil {
+			err = errors.New("plugin has no name")
+		}
+		return fmt.Errorf("plugin %s: %w", p.path, err)
+	}
+	p.mu.Lock()
+	// The name stays as first described, since filters are enabled by it
+	if p.info.Name != "" {
+		info.Name = p.info.Name
+	}
+	p.info = info
+	p.mu.Unlock()
+
+	go func() {
+		err := cmd.Wait()
+		log.Printf("Plugin %s exited: %v", info.Name, err)
+		p.mu.Lock()
+		p.client = nil
+		p.mu.Unlock()
+		client.Close()
+		for {
+			time.Sleep(p.restartDelay)
+			if err := p.start(); err != nil {
+				log.Println("Error restarting plugin:", err)
+				continue
+			}
+			log.Printf("Plugin %s restarted", info.Name)
+			return
+		}
+	}()
+	return nil
+}
+
+// Name returns the name the plugin described itself with
+func (p *Plugin) Name() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.info.Name
+}
+
+// Info returns what the plugin provides
+func (p *Plugin) Info() PluginInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.info
+}
+
+// call calls a method of the plugin, waiting at most PLUGIN_TIMEOUT
+func (p *Plugin) call(method string, args, reply interface{}) error {
+	p.mu.Lock()
+	client := p.client
+	p.mu.Unlock()
+	if client == nil {
+		return errPluginDown
+	}
+	call := client.Go("Plugin."+method, args, reply, make(chan *rpc.Call, 1))
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-timer.C:
+		return fmt.Errorf("plugin %s timed out", p.Name())
+	}
+}
+
+// handles reports whether the plugin handles a command
+func (p *Plugin) handles(command string) bool {
+	for _, c := range p.Info().Commands {
+		if strings.EqualFold(c, command) {
+			return true
+		}
+	}
+	return false
+}
+
+// consumes reports whether the plugin consumes an event
+func (p *Plugin) consumes(event string) bool {
+	for _, e := range p.Info().Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// notify queues an event for the plugin, dropping it if the plugin is too
+// far behind, so a slow plugin cannot hold up the chat
+func (p *Plugin) notify(event, user, room, body string) {
+	if !p.consumes(event) {
+		return
+	}
+	select {
+	case p.events <- PluginEvent{Type: event, User: user, Room: room, Body: body, Time: time.Now().UTC()}:
+	default:
+		log.Printf("Plugin %s is behind, dropped a %s event", p.Name(), event)
+	}
+}
+
+// deliverEvents sends queued events to the plugin in order
+func (p *Plugin) deliverEvents() {
+	for event := range p.events {
+		if err := p.call("Event", event, &struct{}{}); err != nil && err != errPluginDown {
+			log.Printf("Plugin %s event error: %v", p.Name(), err)
+		}
+	}
+}
+
+// pluginFilter is a message filter provided by a plugin
+type pluginFilter struct {
+	plugin *Plugin
+	name   string
+}
+
+func (f *pluginFilter) Name() string { return f.name }
+
+func (f *pluginFilter) Filter(client *Client, room, text string) (string, error) {
+	var result PluginFilterResult
+	if err := f.plugin.call("Filter", PluginFilterRequest{User: client.Name, Room: room, Text: text}, &result); err != nil {
+		// Messages pass while a filter plugin is unavailable
+		log.Printf("Plugin filter %s error: %v", f.name, err)
+		return text, nil
+	}
+	if result.Reject != "" {
+		return "", errors.New(result.Reject)
+	}
+	return result.Text, nil
+}
+
+// pluginHooks sends the events a plugin consumes to it
+type pluginHooks struct {
+	NopHooks
+	plugin *Plugin
+}
+
+func (h pluginHooks) OnConnect(client *Client) error {
+	h.plugin.notify("connect", client.Name, "", "")
+	return nil
+}
+
+func (h pluginHooks) OnAuthenticated(client *Client) error {
+	h.plugin.notify("authenticated", client.Name, "", "")
+	return nil
+}
+
+func (h pluginHooks) OnJoinRoom(client *Client, room string) error {
+	h.plugin.notify("join", client.Name, room, "")
+	return nil
+}
+
+func (h pluginHooks) OnMessage(client *Client, msg *Message) error {
+	h.plugin.notify("message", client.Name, msg.Room, msg.Body)
+	return nil
+}
+
+func (h pluginHooks) OnDisconnect(client *Client) {
+	h.plugin.notify("disconnect", client.Name, client.Room, "")
+}
+
+// AddPlugin registers the commands, filter and event consumers of a plugin
+func (cs *ChatServer) AddPlugin(p *Plugin) {
+	info := p.Info()
+	cs.Mutex.Lock()
+	cs.Plugins = append(cs.Plugins, p)
+	cs.Mutex.Unlock()
+	if info.Filter {
+		cs.RegisterFilter(&pluginFilter{plugin: p, name: "plugin:" + info.Name})
+	}
+	if len(info.Events) > 0 {
+		cs.RegisterHooks(pluginHooks{plugin: p})
+	}
+	log.Printf("Loaded plugin %s: commands %v, filter %t, events %v", info.Name, info.Commands, info.Filter, info.Events)
+}
+
+// LoadPlugins starts the plugins listed in PLUGINS
+func (cs *ChatServer) LoadPlugins() error {
+	for _, path := range envList("PLUGINS") {
+		p, err := StartPlugin(path)
+		if err != nil {
+			return err
+		}
+		cs.AddPlugin(p)
+	}
+	return nil
+}
+
+// pluginFor returns the plugin handling a command, if any
+func (cs *ChatServer) pluginFor(command string) *Plugin {
+	cs.Mutex.Lock()
+	plugins := cs.Plugins
+	cs.Mutex.Unlock()
+	for _, p := range plugins {
+		if p.handles(command) {
+			return p
+		}
+	}
+	return nil
+}
+
+// pluginCommand runs a command handled by a plugin
+func (cs *ChatServer) pluginCommand(p *Plugin, client *Client, fields []string) {
+	var reply PluginReply
+	req := PluginCommand{User: client.Name, Room: client.Room, Command: fields[0], Args: fields[1:]}
+	if err := p.call("Command", req, &reply); err != nil {
+		log.Printf("Plugin %s command error: %v", p.Name(), err)
+		client.Noticef("%s is unavailable, please try again later", fields[0])
+		return
+	}
+	if reply.Reply != "" {
+		client.Notice(reply.Reply)
+	}
+	if reply.Say != "" && client.Room != "" {
+		if err := cs.PostMessage(&Message{Type: MessageChat, Room: client.Room, From: p.Name(), Body: reply.Say, Bot: true}, 0); err != nil {
+			tellThrottled(client, err)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestMain runs the test binary as a plugin when the plugin tests start it
+func TestMain(m *testing.M) {
+	if os.Getenv("CHAT_TEST_PLUGIN") == "1" {
+		server := rpc.NewServer()
+		server.RegisterName("Plugin", &testPlugin{})
+		server.ServeCodec(jsonrpc.NewServerCodec(struct {
+			io.Reader
+			io.Writer
+			io.Closer
+		}{os.Stdin, os.Stdout, os.Stdin}))
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// testPlugin shouts back, rejects a word and remembers who joined
+type testPlugin struct {
+	mu     sync.Mutex
+	joined []string
+}
+
+func (p *testPlugin) Describe(_ struct{}, info *PluginInfo) error {
+	*info = PluginInfo{Name: "tester", Commands: []string{"/shout", "/joined"}, Filter: true, Events: []string{"join"}}
+	return nil
+}
+
+func (p *testPlugin) Command(cmd PluginCommand, reply *PluginReply) error {
+	switch cmd.Command {
+	case "/shout":
+		reply.Say = strings.ToUpper(strings.Join(cmd.Args, " "))
+	case "/joined":
+		p.mu.Lock()
+		reply.Reply = "Joined: " + strings.Join(p.joined, ", ")
+		p.mu.Unlock()
+	}
+	return nil
+}
+
+func (p *testPlugin) Filter(req PluginFilterRequest, result *PluginFilterResult) error {
+	if strings.Contains(req.Text, "spoiler") {
+		result.Reject = "no spoilers"
+	}
+	result.Text = req.Text
+	return nil
+}
+
+func (p *testPlugin) Event(event PluginEvent, _ *struct{}) error {
+	p.mu.Lock()
+	p.joined = append(p.joined, event.User+"@"+event.Room)
+	p.mu.Unlock()
+	return nil
+}
+
+func TestPlugins(t *testing.T) {
+	t.Setenv("CHAT_TEST_PLUGIN", "1")
+	t.Setenv("PLUGINS", os.Args[0])
+	s := startServer(t)
+	if err := s.cs.LoadPlugins(); err != nil {
+		t.Fatal(err)
+	}
+
+	alice := s.dialTCP(t, "alice")
+	bob := s.dialTCP(t, "bob")
+	alice.Send("/shout hello there")
+	bob.Expect("tester [bot]: HELLO THERE")
+
+	if err := s.cs.SetRoomFilter(&Client{Name: "root"}, defaultRoom, "plugin:tester", "on"); err != nil {
+		t.Fatal(err)
+	}
+	alice.Send("the spoiler is")
+	alice.Expect("Message rejected: no spoilers")
+
+	alice.Send("/joined")
+	alice.Expect("Joined: alice@lobby, bob@lobby")
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errPollTimeout ends a long-poll session whose client stopped polling
+var errPollTimeout = errors.New("long-poll session timed out")
+
+// Default number of messages kept for a long-poll session between polls
+const defaultPollBuffer = 500
+
+// pollQueue buffers messages for a long-polling client. Every message gets a
+// sequence number; clients poll with the last number they saw as a cursor.
+type pollQueue struct {
+	remote   string
+	mu       sync.Mutex
+	msgs     []json.RawMessage
+	first    int // sequence number of msgs[0]
+	wake     chan struct{}
+	lastPoll time.Time
+	closed   bool
+}
+
+func newPollQueue(remote string) *pollQueue {
+	return &pollQueue{remote: remote, first: 1, wake: make(chan struct{}), lastPoll: time.Now()}
+}
+
+// Send appends a JSON message and wakes any waiting poll
+func (q *pollQueue) Send(data []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return errors.New("poll session closed")
+	}
+	q.msgs = append(q.msgs, append(json.RawMessage(nil), data...))
+	if max := envInt("POLL_BUFFER", defaultPollBuffer); len(q.msgs) > max {
+		q.first += len(q.msgs) - max
+		q.msgs = q.msgs[len(q.msgs)-max:]
+	}
+	close(q.wake)
+	q.wake = make(chan struct{})
+	return nil
+}
+
+// since returns the messages after cursor, the new cursor, and a channel
+// closed when more messages arrive
+func (q *pollQueue) since(cursor int) ([]json.RawMessage, int, <-chan struct{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.lastPoll = time.Now()
+	next := q.first + len(q.msgs) - 1
+
+	// The cursor acknowledges everything up to it, so those can be dropped
+	ack := cursor + 1 - q.first
+	if ack > len(q.msgs) {
+		ack = len(q.msgs)
+	}
+	if ack > 0 {
+		q.msgs = q.msgs[ack:]
+		q.first += ack
+	}
+	if len(q.msgs) == 0 {
+		return nil, next, q.wake
+	}
+	return append([]json.RawMessage(nil), q.msgs...), next, q.wake
+}
+
+// Close ends the session, waking any waiting poll
+func (q *pollQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.wake)
+	}
+	return nil
+}
+
+func (q *pollQueue) Remote() string {
+	return q.remote
+}
+
+// idle reports how long it has been since the client last polled
+func (q *pollQueue) idle() time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return time.Since(q.lastPoll)
+}
+
+// HandlePollConnect starts a long-poll session and returns its ID and starting cursor
+func (cs *ChatServer) HandlePollConnect(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	if err := validateName(name, false); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid name: "+err.Error())
+		return
+	}
+	room := r.URL.Query().Get("room")
+	if room == "" {
+		room = defaultRoom
+	}
+	session, err := newID(16)
+	if err != nil {
+		log.Println("Error creating session:", err)
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	queue := newPollQueue(clientAddr(cs.Proxies, r))
+	client := &Client{Transport: queue, Name: name, Address: queue.Remote()}
+	client.locale.Store(cs.NegotiateLocale(r.Header.Get("Accept-Language")))
+	if err := cs.CanJoin(client, room, r.URL.Query().Get("password")); err != nil {
+		writeError(w, http.StatusForbidden, joinError(room, err))
+		return
+	}
+	if err := cs.AddClient(client); err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	cs.Mutex.Lock()
+	cs.Sessions[session] = client
+	cs.Mutex.Unlock()
+	go cs.expirePollSession(session, client, queue)
+
+	cs.SendMOTD(client)
+	cs.JoinRoom(client, room, client.ID)
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"session": session, "cursor": 0})
+}
+
+// expirePollSession disconnects a long-poll client once it stops polling or is closed
+func (cs *ChatServer) expirePollSession(session string, client *Client, queue *pollQueue) {
+	timeout := envDuration("POLL_SESSION_TIMEOUT", time.Minute)
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for range ticker.C {
+		queue.mu.Lock()
+		closed := queue.closed
+		queue.mu.Unlock()
+		if closed || queue.idle() > timeout {
+			break
+		}
+	}
+
+	queue.mu.Lock()
+	closed := queue.closed
+	queue.mu.Unlock()
+	var err error
+	if !closed {
+		err = errPollTimeout
+	}
+	queue.Close()
+	cs.Mutex.Lock()
+	delete(cs.Sessions, session)
+	cs.Mutex.Unlock()
+	cs.RemoveClient(client)
+	cs.Disconnected(client, err)
+}
+
+// pollSession looks up the queue of the long-poll session named in the request
+func (cs *ChatServer) pollSession(r *http.Request) *pollQueue {
+	session := r.Header.Get("X-Session-ID")
+	if session == "" {
+		session = r.URL.Query().Get("session")
+	}
+	cs.Mutex.Lock()
+	defer cs.Mutex.Unlock()
+	client := cs.Sessions[session]
+	if client == nil {
+		return nil
+	}
+	queue, _ := client.Transport.(*pollQueue)
+	return queue
+}
+
+// HandlePoll returns the messages after the cursor, waiting up to
+// POLL_TIMEOUT for one to arrive if there are none yet
+func (cs *ChatServer) HandlePoll(w http.ResponseWriter, r *http.Request) {
+	queue := cs.pollSession(r)
+	if queue == nil {
+		writeError(w, http.StatusNotFound, "unknown session")
+		return
+	}
+	cursor, err := strconv.Atoi(r.URL.Query().Get("cursor"))
+	if err != nil || cursor < 0 {
+		writeError(w, http.StatusBadRequest, "cursor must be a non-negative number")
+		return
+	}
+
+	msgs, next, wake := queue.since(cursor)
+	if len(msgs) == 0 {
+		timer := time.NewTimer(envDuration("POLL_TIMEOUT", 25*time.Second))
+		defer timer.Stop()
+		select {
+		case <-wake:
+			msgs, next, _ = queue.since(cursor)
+		case <-timer.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if msgs == nil {
+		msgs = []json.RawMessage{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"messages": msgs, "cursor": next})
+}
+
+// HandlePollDisconnect ends a long-poll session
+func (cs *ChatServer) HandlePollDisconnect(w http.ResponseWriter, r *http.Request) {
+	queue := cs.pollSession(r)
+	if queue == nil {
+		writeError(w, http.StatusNotFound, "unknown session")
+		return
+	}
+	queue.Close()
+	w.WriteHeader(http.StatusNoContent)
+}
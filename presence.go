@@ -0,0 +1,145 @@
+package main
+
+import (
+	"strings"
+)
+
+// Presence modes a client can set. Clients that set none are online.
+const (
+	PresenceOnline = "online"
+	PresenceAway   = "away"
+	PresenceDND    = "dnd"
+)
+
+// Longest message text included in a push notification
+const maxPushBody = 200
+
+// presence is a client's mode, the message it left with it and the stream
+// it is running, if any
+type presence struct {
+	Mode    string
+	Message string
+	Stream  *Stream
+}
+
+// presence returns the client's current presence
+func (c *Client) presence() presence {
+	if p := c.status.Load(); p != nil {
+		return *p
+	}
+	return presence{Mode: PresenceOnline}
+}
+
+// describe renders a presence for other users, such as "away: at lunch"
+func (p presence) describe() string {
+	text := p.Mode
+	if p.Mode == PresenceDND {
+		text = "busy (do not disturb)"
+	}
+	if p.Message != "" {
+		text += ": " + p.Message
+	}
+	return text
+}
+
+// SetPresence changes a client's presence, on all of its user's devices, and tells their rooms
+func (cs *ChatServer) SetPresence(client *Client, mode, message string) {
+	status := &presence{Mode: mode, Message: message, Stream: client.presence().Stream}
+	msg := (&Message{Type: MessagePresence, From: client.Name, Presence: mode}).setText("%s is back", client.Name)
+	if mode != PresenceOnline {
+		msg.setText("%s is %s", client.Name, status.describe())
+	}
+
+	// A logged in user's presence applies to all of their devices
+	sessions := []*Client{client}
+	if client.Authenticated {
+		sessions = cs.sessionsOf(client.Name)
+	}
+	announced := make(map[string]bool)
+	for _, c := range sessions {
+		c.status.Store(status)
+		if c.Room == "" || announced[c.Room] {
+			continue
+		}
+		announced[c.Room] = true
+		announcement := *msg
+		announcement.Room = c.Room
+		cs.Broadcast(c.Room, &announcement, client.ID)
+	}
+}
+
+// NotifyMentions tells users mentioned as @name in a message from another
+// room about it, unless they do not want to be disturbed, and tells the
+// sender when someone it mentioned is away
+func (cs *ChatServer) NotifyMentions(client *Client, msg *Message) {
+	mentioned := make(map[string]bool)
+	for _, word := range strings.Fields(msg.Body) {
+		if !strings.HasPrefix(word, "@") {
+			continue
+		}
+		if name := strings.TrimRight(word[1:], ",.:;!?"); name != "" && name != client.Name {
+			mentioned[name] = true
+		}
+	}
+	if len(mentioned) == 0 {
+		return
+	}
+
+	notice := (&Message{Type: MessageMention, Room: msg.Room, From: msg.From}).setText("%s mentioned you in %s: %s", msg.From, msg.Room, msg.Body)
+	away := make(map[string]presence)
+	for _, c := range cs.Clients.All() {
+		if !mentioned[c.Name] {
+			continue
+		}
+		p := c.presence()
+		if p.Mode != PresenceOnline {
+			away[c.Name] = p
+		}
+		if p.Mode == PresenceDND || c.Room == msg.Room || c.blocksMessage(msg) {
+			continue
+		}
+		c.Send(notice)
+	}
+	for name, p := range away {
+		client.Noticef("%s is %s", name, p.describe())
+	}
+
+	// Users without a connection get a push notification and an email digest instead
+	body := msg.Body
+	if runes := []rune(body); len(runes) > maxPushBody {
+		body = string(runes[:maxPushBody]) + "…"
+	}
+	push := &PushNotification{Title: msg.From + " mentioned you in " + msg.Room, Body: body, Room: msg.Room}
+	cs.Mutex.Lock()
+	var offline []string
+	digest := make(map[string]bool)
+	for name := range mentioned {
+		if !cs.Blocks[name][msg.From] {
+			offline = append(offline, name)
+			digest[name] = cs.DigestEmails[name] != ""
+		}
+	}
+	cs.Mutex.Unlock()
+	for _, name := range offline {
+		cs.PushToOffline(name, push)
+		if digest[name] && !cs.online(name) {
+			cs.Digest.Missed(name, missedMention{From: msg.From, Room: msg.Room, Body: body, Time: *msg.Time})
+		}
+	}
+}
+
+// presenceCommand sets the client away, to do not disturb or back online
+func (cs *ChatServer) presenceCommand(client *Client, fields []string) {
+	message := strings.Join(fields[1:], " ")
+	switch fields[0] {
+	case "/away":
+		cs.SetPresence(client, PresenceAway, message)
+		client.Notice("You are marked as away")
+	case "/dnd":
+		cs.SetPresence(client, PresenceDND, message)
+		client.Notice("Do not disturb is on: you will not be notified of mentions")
+	default:
+		cs.SetPresence(client, PresenceOnline, "")
+		client.Notice("You are back")
+	}
+}
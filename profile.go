@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Longest display name and status text a profile can have
+const (
+	maxDisplayName = 32
+	maxStatusText  = 100
+)
+
+// Profile is what a logged in user tells others about themselves. Guests
+// cannot have one, since anyone can connect under their name.
+type Profile struct {
+	DisplayName string `json:"display_name,omitempty"`
+	Avatar      string `json:"avatar,omitempty"`
+	Status      string `json:"status,omitempty"`
+}
+
+// set changes one profile field after checking the value. An empty value clears it.
+func (p *Profile) set(field, value string) error {
+	switch field {
+	case "name":
+		if utf8.RuneCountInString(value) > maxDisplayName {
+			return fmt.Errorf("display names can be at most %d characters", maxDisplayName)
+		}
+		p.DisplayName = value
+	case "avatar":
+		if value != "" {
+			u, err := url.Parse(value)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return errors.New("avatar must be an http or https URL")
+			}
+		}
+		p.Avatar = value
+	case "status":
+		if utf8.RuneCountInString(value) > maxStatusText {
+			return fmt.Errorf("status text can be at most %d characters", maxStatusText)
+		}
+		p.Status = value
+	default:
+		return errors.New("profile fields are name, avatar and status")
+	}
+	return nil
+}
+
+// Profile returns a copy of a user's profile, or nil if they have none
+func (cs *ChatServer) Profile(name string) *Profile {
+	cs.Mutex.Lock()
+	defer cs.Mutex.Unlock()
+	profile, ok := cs.Profiles[name]
+	if !ok {
+		return nil
+	}
+	p := *profile
+	return &p
+}
+
+// SetProfile changes a field of a logged in client's profile and tells its room
+func (cs *ChatServer) SetProfile(client *Client, field, value string) error {
+	if !client.Authenticated {
+		return errors.New("log in to set up a profile")
+	}
+	profile := cs.Profile(client.Name)
+	if profile == nil {
+		profile = &Profile{}
+	}
+	if err := profile.set(field, value); err != nil {
+		return err
+	}
+	data, err := json.Marshal(profile)
+	if err != nil {
+		return err
+	}
+	cs.Record(Event{Type: EventProfile, User: client.Name, Data: data})
+	if client.Room != "" {
+		cs.Broadcast(client.Room, (&Message{Type: MessageProfile, Room: client.Room, From: client.Name, Profile: profile}).setText("%s updated their profile", client.Name), 0)
+	}
+	return nil
+}
+
+// applyProfileEvent stores a user's profile for an event log entry. Caller must hold cs.Mutex.
+func (cs *ChatServer) applyProfileEvent(ev Event) {
+	var profile Profile
+	if err := json.Unmarshal(ev.Data, &profile); err != nil {
+		log.Println("Invalid profile in event log:", err)
+		return
+	}
+	cs.Profiles[ev.User] = &profile
+}
+
+// describe renders a user with their display name and status
+func (p *Profile) describe(name string) string {
+	if p == nil {
+		return name
+	}
+	text := name
+	if p.DisplayName != "" {
+		text += " (" + p.DisplayName + ")"
+	}
+	if p.Status != "" {
+		text += " - " + p.Status
+	}
+	return text
+}
+
+// profileCommand shows a user's profile or changes a field of the client's own
+func (cs *ChatServer) profileCommand(client *Client, fields []string) {
+	if len(fields) <= 2 {
+		name := client.Name
+		if len(fields) == 2 {
+			name = fields[1]
+		}
+		profile := cs.Profile(name)
+		if profile == nil {
+			client.Noticef("%s has no profile", name)
+			return
+		}
+		text := profile.describe(name)
+		if profile.Avatar != "" {
+			text += "\nAvatar: " + profile.Avatar
+		}
+		client.Notice(text)
+		return
+	}
+
+	field := fields[1]
+	if field != "name" && field != "avatar" && field != "status" {
+		client.Fail(CodeUsage, "Usage: /profile [nick] | /profile name|avatar|status <value|->")
+		return
+	}
+	value := strings.Join(fields[2:], " ")
+	if value == "-" {
+		value = ""
+	}
+	if err := cs.SetProfile(client, field, value); err != nil {
+		client.Notice(err.Error())
+		return
+	}
+	client.Notice("Profile updated")
+}
+
+// whoCommand lists the members of the client's room with their profiles
+func (cs *ChatServer) whoCommand(client *Client) {
+	if client.Room == "" {
+		client.Fail(CodeNotInRoom, "You are not in a room")
+		return
+	}
+	members := cs.Clients.InRoom(client.Room)
+	lines := make([]string, 0, len(members))
+	// Users connected from several devices are listed once
+	listed := make(map[string]bool)
+	cs.Mutex.Lock()
+	for _, c := range members {
+		var line string
+		switch {
+		case c.Name == "", c.Authenticated && listed[c.Name]:
+			continue
+		case c.Authenticated:
+			listed[c.Name] = true
+			line = cs.Profiles[c.Name].describe(c.Name)
+		default:
+			line = c.Name + " (guest)"
+		}
+		if p := c.presence(); p.Mode != PresenceOnline {
+			line += " [" + p.describe() + "]"
+		}
+		lines = append(lines, line)
+	}
+	cs.Mutex.Unlock()
+	sort.Strings(lines)
+	client.Noticef("%d in %s\n%s", len(lines), client.Room, strings.Join(lines, "\n"))
+}
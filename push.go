@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PushSubscription is what a client registers to receive push notifications.
+// Web Push clients send the JSON form of their browser subscription.
+type PushSubscription struct {
+	Provider string `json:"provider,omitempty"`
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh,omitempty"`
+		Auth   string `json:"auth,omitempty"`
+	} `json:"keys"`
+}
+
+// PushDevice is a subscription registered for a user
+type PushDevice struct {
+	ID           string           `json:"id"`
+	User         string           `json:"user"`
+	Subscription PushSubscription `json:"subscription"`
+	Created      time.Time        `json:"created"`
+}
+
+// PushNotification is shown on a user's devices
+type PushNotification struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	Room  string `json:"room,omitempty"`
+}
+
+// PushProvider delivers notifications through one push service
+type PushProvider interface {
+	Push(device *PushDevice, n *PushNotification) error
+}
+
+// errDeviceGone is returned by providers when a push service reports that
+// a subscription no longer exists
+var errDeviceGone = errors.New("push subscription no longer exists")
+
+// pushDelivery is a notification waiting to be sent to a device
+type pushDelivery struct {
+	device       *PushDevice
+	notification *PushNotification
+}
+
+// PushGateway sends notifications to registered devices from a pool of
+// workers, using the provider each device registered with
+type PushGateway struct {
+	providers map[string]PushProvider
+	queue     chan pushDelivery
+
+	// gone is called for devices whose subscription has expired
+	gone func(device *PushDevice)
+}
+
+// NewPushGateway starts the delivery workers for the configured providers
+func NewPushGateway() *PushGateway {
+	g := &PushGateway{
+		providers: make(map[string]PushProvider),
+		queue:     make(chan pushDelivery, envInt("PUSH_QUEUE_SIZE", 1000)),
+	}
+	webPush, err := NewWebPushProvider()
+	if err != nil {
+		log.Println("Web Push disabled:", err)
+	} else if webPush != nil {
+		g.providers["webpush"] = webPush
+	}
+	for i := 0; i < envInt("PUSH_WORKERS", 2); i++ {
+		go g.worker()
+	}
+	return g
+}
+
+// Enabled reports whether a provider is configured
+func (g *PushGateway) Enabled(provider string) bool {
+	_, ok := g.providers[provider]
+	return ok
+}
+
+// Enqueue schedules a notification, dropping it if the queue is full
+func (g *PushGateway) Enqueue(device *PushDevice, n *PushNotification) {
+	select {
+	case g.queue <- pushDelivery{device, n}:
+	default:
+		log.Printf("Push queue full, dropping notification to %s", device.User)
+	}
+}
+
+func (g *PushGateway) worker() {
+	for delivery := range g.queue {
+		provider := g.providers[delivery.device.Subscription.Provider]
+		if provider == nil {
+			continue
+		}
+		err := provider.Push(delivery.device, delivery.notification)
+		switch {
+		case errors.Is(err, errDeviceGone) && g.gone != nil:
+			g.gone(delivery.device)
+		case err != nil:
+			log.Printf("Push to device %s of %s failed: %v", delivery.device.ID, delivery.device.User, err)
+		}
+	}
+}
+
+// RegisterDevice saves a push subscription for a logged in client
+func (cs *ChatServer) RegisterDevice(client *Client, sub PushSubscription) (*PushDevice, error) {
+	if !client.Authenticated {
+		return nil, errors.New("log in to receive push notifications")
+	}
+	if sub.Provider == "" {
+		sub.Provider = "webpush"
+	}
+	if !cs.Push.Enabled(sub.Provider) {
+		return nil, fmt.Errorf("push provider %s is not available", sub.Provider)
+	}
+	if u, err := url.Parse(sub.Endpoint); err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, errors.New("push endpoint must be an https URL")
+	}
+	if sub.Provider == "webpush" && (sub.Keys.P256dh == "" || sub.Keys.Auth == "") {
+		return nil, errors.New("push subscription keys are missing")
+	}
+
+	// Subscribing the same endpoint again replaces the user's old registration
+	cs.Mutex.Lock()
+	var replaced string
+	for id, device := range cs.PushDevices {
+		if device.User == client.Name && device.Subscription.Endpoint == sub.Endpoint {
+			replaced = id
+		}
+	}
+	cs.Mutex.Unlock()
+	if replaced != "" {
+		cs.Record(Event{Type: EventPushUnregister, User: client.Name, Target: replaced})
+	}
+
+	id, err := newID(6)
+	if err != nil {
+		return nil, err
+	}
+	device := &PushDevice{ID: id, User: client.Name, Subscription: sub, Created: time.Now().UTC()}
+	data, err := json.Marshal(device)
+	if err != nil {
+		return nil, err
+	}
+	cs.Record(Event{Type: EventPushRegister, User: client.Name, Target: id, Data: data})
+	return device, nil
+}
+
+// applyPushEvent updates the registered devices for an event log entry. Caller must hold cs.Mutex.
+func (cs *ChatServer) applyPushEvent(ev Event) {
+	switch ev.Type {
+	case EventPushRegister:
+		var device PushDevice
+		if err := json.Unmarshal(ev.Data, &device); err != nil {
+			log.Println("Invalid push device in event log:", err)
+			return
+		}
+		cs.PushDevices[device.ID] = &device
+	case EventPushUnregister:
+		delete(cs.PushDevices, ev.Target)
+	}
+}
+
+// online reports whether a user is logged in on any connection
+func (cs *ChatServer) online(user string) bool {
+	for _, c := range cs.Clients.All() {
+		if c.Authenticated && c.Name == user {
+			return true
+		}
+	}
+	return false
+}
+
+// PushToOffline sends a notification to the devices of a user who has no
+// connection open
+func (cs *ChatServer) PushToOffline(user string, n *PushNotification) {
+	if cs.online(user) {
+		return
+	}
+	cs.Mutex.Lock()
+	var devices []*PushDevice
+	for _, device := range cs.PushDevices {
+		if device.User == user {
+			devices = append(devices, device)
+		}
+	}
+	cs.Mutex.Unlock()
+	for _, device := range devices {
+		cs.Push.Enqueue(device, n)
+	}
+}
+
+// HandleVAPIDKey returns the key browsers subscribe to Web Push with
+func (cs *ChatServer) HandleVAPIDKey(w http.ResponseWriter, r *http.Request) {
+	provider, ok := cs.Push.providers["webpush"].(*WebPushProvider)
+	if !ok {
+		writeError(w, http.StatusNotFound, "web push is not enabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"public_key": provider.PublicKey()})
+}
+
+// pushCommand lists the devices registered for the client or removes one
+func (cs *ChatServer) pushCommand(client *Client, fields []string) {
+	switch {
+	case len(fields) == 1:
+		cs.Mutex.Lock()
+		var devices []PushDevice
+		for _, device := range cs.PushDevices {
+			if client.Authenticated && device.User == client.Name {
+				devices = append(devices, *device)
+			}
+		}
+		cs.Mutex.Unlock()
+		if len(devices) == 0 {
+			client.Notice("No devices registered for push notifications")
+			return
+		}
+		sort.Slice(devices, func(i, j int) bool { return devices[i].Created.Before(devices[j].Created) })
+		lines := []string{"Push devices"}
+		for _, device := range devices {
+			host := device.Subscription.Endpoint
+			if u, err := url.Parse(host); err == nil {
+				host = u.Host
+			}
+			lines = append(lines, fmt.Sprintf("%s  %s via %s, registered %s", device.ID, device.Subscription.Provider, host, device.Created.Local().Format("Jan 2 15:04")))
+		}
+		client.Notice(strings.Join(lines, "\n"))
+	case len(fields) == 3 && fields[1] == "remove":
+		cs.Mutex.Lock()
+		device, ok := cs.PushDevices[fields[2]]
+		ok = ok && client.Authenticated && device.User == client.Name
+		cs.Mutex.Unlock()
+		if !ok {
+			client.Noticef("No such device: %s", fields[2])
+			return
+		}
+		cs.Record(Event{Type: EventPushUnregister, User: client.Name, Target: fields[2]})
+		client.Noticef("Device %s removed", fields[2])
+	default:
+		client.Fail(CodeUsage, "Usage: /push [remove <id>]")
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// ClientRegistry tracks the connected clients and the room each one is in,
+// and assigns each client its ID.
+// Readers load an immutable snapshot without locking, so broadcasts never
+// wait on joins and disconnects; writers copy the parts of the snapshot
+// they change.
+type ClientRegistry struct {
+	mu     sync.Mutex
+	lastID ClientID
+	rooms  map[ClientID]string
+	snap   atomic.Pointer[clientSnapshot]
+}
+
+// clientSnapshot is the registry's contents at one moment. It must not be modified.
+type clientSnapshot struct {
+	all    []*Client
+	byRoom map[string][]*Client
+}
+
+// NewClientRegistry returns an empty registry
+func NewClientRegistry() *ClientRegistry {
+	r := &ClientRegistry{rooms: make(map[ClientID]string)}
+	r.snap.Store(&clientSnapshot{byRoom: make(map[string][]*Client)})
+	return r
+}
+
+// All returns every connected client. The slice must not be modified.
+func (r *ClientRegistry) All() []*Client {
+	return r.snap.Load().all
+}
+
+// InRoom returns the clients in a room. The slice must not be modified.
+func (r *ClientRegistry) InRoom(room string) []*Client {
+	return r.snap.Load().byRoom[room]
+}
+
+// Rooms returns the names of the rooms that have clients in them
+func (r *ClientRegistry) Rooms() []string {
+	byRoom := r.snap.Load().byRoom
+	rooms := make([]string, 0, len(byRoom))
+	for room := range byRoom {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+// Add registers a new client, not yet in any room, and gives it the next ID
+func (r *ClientRegistry) Add(client *Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.rooms[client.ID]; ok {
+		return
+	}
+	r.lastID++
+	client.ID = r.lastID
+	r.rooms[client.ID] = ""
+	old := r.snap.Load()
+	all := make([]*Client, len(old.all), len(old.all)+1)
+	copy(all, old.all)
+	r.snap.Store(&clientSnapshot{all: append(all, client), byRoom: old.byRoom})
+}
+
+// Remove unregisters a client and takes it out of its room
+func (r *ClientRegistry) Remove(client *Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	room, ok := r.rooms[client.ID]
+	if !ok {
+		return
+	}
+	delete(r.rooms, client.ID)
+	old := r.snap.Load()
+	r.snap.Store(&clientSnapshot{
+		all:    without(old.all, client),
+		byRoom: r.moved(old.byRoom, client, room, ""),
+	})
+}
+
+// Move records that a client left one room for another. An empty room
+// name means no room.
+func (r *ClientRegistry) Move(client *Client, room string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	previous, ok := r.rooms[client.ID]
+	if !ok || previous == room {
+		return
+	}
+	r.rooms[client.ID] = room
+	old := r.snap.Load()
+	r.snap.Store(&clientSnapshot{all: old.all, byRoom: r.moved(old.byRoom, client, previous, room)})
+}
+
+// moved copies the room index with a client taken out of one room and put in another
+func (r *ClientRegistry) moved(byRoom map[string][]*Client, client *Client, from, to string) map[string][]*Client {
+	rooms := make(map[string][]*Client, len(byRoom)+1)
+	for name, members := range byRoom {
+		rooms[name] = members
+	}
+	if from != "" {
+		if members := without(rooms[from], client); len(members) > 0 {
+			rooms[from] = members
+		} else {
+			delete(rooms, from)
+		}
+	}
+	if to != "" {
+		members := make([]*Client, len(rooms[to]), len(rooms[to])+1)
+		copy(members, rooms[to])
+		rooms[to] = append(members, client)
+	}
+	return rooms
+}
+
+// without returns a copy of clients leaving out one client
+func without(clients []*Client, client *Client) []*Client {
+	result := make([]*Client, 0, len(clients))
+	for _, c := range clients {
+		if c.ID != client.ID {
+			result = append(result, c)
+		}
+	}
+	return result
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// envFile is the configuration file read at startup and on reload
+const envFile = ".env"
+
+// reloadEnv reads the .env file again and updates the environment with its
+// values, returning the names of the variables that changed. Variables
+// removed from the file keep their current value.
+func reloadEnv(path string) ([]string, error) {
+	values, err := godotenv.Read(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var changed []string
+	for key, value := range values {
+		if current, ok := os.LookupEnv(key); ok && current == value {
+			continue
+		}
+		os.Setenv(key, value)
+		changed = append(changed, key)
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// ReloadConfig reads the .env file again and applies the settings that can
+// change while clients stay connected: spam detection, the built-in filters,
+// rate limits and throughput caps. The MOTD and the defaults of new rooms are read when
+// needed, so they follow the new environment without more work. Everything
+// else takes effect on the next restart.
+func (cs *ChatServer) ReloadConfig() ([]string, error) {
+	changed, err := reloadEnv(envFile)
+	if err != nil {
+		return nil, err
+	}
+	filters, err := loadDefaultFilters()
+	if err != nil {
+		return nil, err
+	}
+	spam := NewSpamDetector()
+
+	cs.Mutex.Lock()
+	cs.Spam = spam
+	// Replace the built-in filters in place, keeping those added by plugins
+	for i, filter := range cs.Filters {
+		for _, reloaded := range filters {
+			if filter.Name() == reloaded.Name() {
+				cs.Filters[i] = reloaded
+			}
+		}
+	}
+	guestRate, locationRate := envInt("GUEST_RATE", 4), envInt("LOCATION_RATE", 12)
+	for _, client := range cs.Clients.All() {
+		if client.guestLimiter != nil {
+			client.guestLimiter.SetRate(float64(guestRate)/60, guestRate)
+		}
+		if client.locationLimiter != nil {
+			client.locationLimiter.SetRate(float64(locationRate)/60, locationRate)
+		}
+	}
+	cs.Mutex.Unlock()
+	cs.APITokens.SetRate(envInt("API_TOKEN_RATE", 60))
+	cs.Throughput.Configure()
+
+	log.Printf("Reloaded configuration, changed: %v", changed)
+	return changed, nil
+}
+
+// WatchConfig reloads the configuration on SIGHUP, and when the .env file
+// changes if CONFIG_WATCH_INTERVAL is set
+func (cs *ChatServer) WatchConfig() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	var modified time.Time
+	if interval := envDuration("CONFIG_WATCH_INTERVAL", 0); interval > 0 {
+		tick = time.NewTicker(interval).C
+		if info, err := os.Stat(envFile); err == nil {
+			modified = info.ModTime()
+		}
+	}
+	for {
+		select {
+		case <-hup:
+		case <-tick:
+			info, err := os.Stat(envFile)
+			if err != nil || !info.ModTime().After(modified) {
+				continue
+			}
+			modified = info.ModTime()
+		}
+		if _, err := cs.ReloadConfig(); err != nil {
+			log.Println("Error reloading configuration:", err)
+		}
+	}
+}
+
+// HandleReloadConfig reloads the configuration for an admin token
+func (cs *ChatServer) HandleReloadConfig(w http.ResponseWriter, r *http.Request) {
+	token := cs.AdminTokens.Authenticate(r)
+	if token == nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, "missing or invalid token")
+		return
+	}
+	changed, err := cs.ReloadConfig()
+	if err != nil {
+		log.Println("Error reloading configuration:", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	cs.auditAdmin(token, "config.reload", "")
+	if changed == nil {
+		changed = []string{}
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"changed": changed})
+}
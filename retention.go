@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// retentionPolicy limits how long the messages of a room are kept. The zero
+// value keeps them forever.
+type retentionPolicy struct {
+	Days     int  `json:"days,omitempty"`
+	Messages int  `json:"messages,omitempty"`
+	None     bool `json:"none,omitempty"`
+}
+
+// parseRetention reads "forever", "none", "days N" or "messages N"
+func parseRetention(args []string) (retentionPolicy, error) {
+	switch {
+	case len(args) == 1 && args[0] == "forever":
+		return retentionPolicy{}, nil
+	case len(args) == 1 && args[0] == "none":
+		return retentionPolicy{None: true}, nil
+	case len(args) == 2 && (args[0] == "days" || args[0] == "messages"):
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n <= 0 {
+			return retentionPolicy{}, errors.New(args[0] + " must be a positive number")
+		}
+		if args[0] == "days" {
+			return retentionPolicy{Days: n}, nil
+		}
+		return retentionPolicy{Messages: n}, nil
+	}
+	return retentionPolicy{}, errors.New("retention must be forever, none, days N or messages N")
+}
+
+func (p retentionPolicy) String() string {
+	switch {
+	case p.None:
+		return "none"
+	case p.Days > 0:
+		return fmt.Sprintf("%d days", p.Days)
+	case p.Messages > 0:
+		return fmt.Sprintf("%d messages", p.Messages)
+	default:
+		return "forever"
+	}
+}
+
+// keeps reports whether a message sent at t, with newer messages after it
+// in the room, is still kept at now
+func (p retentionPolicy) keeps(t time.Time, newer int, now time.Time) bool {
+	switch {
+	case p.None:
+		return false
+	case p.Days > 0:
+		return now.Sub(t) < time.Duration(p.Days)*24*time.Hour
+	case p.Messages > 0:
+		return newer < p.Messages
+	default:
+		return true
+	}
+}
+
+// SetRetention changes how long the messages of a room are kept
+func (cs *ChatServer) SetRetention(client *Client, name string, policy retentionPolicy) error {
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+	cs.Record(Event{Type: EventRoomRetention, Room: name, User: client.Name, Data: data})
+	cs.Audit(client, "room.retention", name, policy.String(), "")
+	return nil
+}
+
+// applyRetentionEvent sets the retention policy of a room for an event log
+// entry. Caller must hold cs.Mutex.
+func (cs *ChatServer) applyRetentionEvent(ev Event) {
+	var policy retentionPolicy
+	if err := json.Unmarshal(ev.Data, &policy); err != nil {
+		log.Println("Invalid retention policy in event log:", err)
+		return
+	}
+	cs.getRoom(ev.Room).Retention = policy
+}
+
+// RunRetention prunes messages past their room's retention every
+// RETENTION_INTERVAL
+func (cs *ChatServer) RunRetention() {
+	interval := envDuration("RETENTION_INTERVAL", time.Hour)
+	for {
+		time.Sleep(interval)
+		cs.PruneHistory(time.Now())
+	}
+}
+
+// PruneHistory drops the messages rooms no longer keep from their replay
+// buffers and from the event log
+func (cs *ChatServer) PruneHistory(now time.Time) {
+	policies := make(map[string]retentionPolicy)
+	cs.Mutex.Lock()
+	for name, room := range cs.Rooms {
+		if room.Retention == (retentionPolicy{}) {
+			continue
+		}
+		policies[name] = room.Retention
+		room.Replay.Retain(func(msg *Message, newer int) bool {
+			return msg.Time == nil || room.Retention.keeps(*msg.Time, newer, now)
+		})
+	}
+	cs.Mutex.Unlock()
+	if len(policies) == 0 || cs.EventLog == nil {
+		return
+	}
+
+	removed, err := cs.EventLog.PruneMessages(func(ev Event, newer int) bool {
+		policy, ok := policies[ev.Room]
+		return !ok || policy.keeps(ev.Time, newer, now)
+	})
+	if err != nil {
+		log.Println("Error pruning event log:", err)
+		return
+	}
+	if removed > 0 {
+		log.Printf("Pruned %d messages from the event log", removed)
+	}
+}
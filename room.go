@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Name of the room clients are placed in after connecting
+const defaultRoom = "lobby"
+
+// Default number of messages kept per room for new joiners
+const defaultReplaySize = 50
+
+// Room holds the state of a single chat room
+type Room struct {
+	Name      string
+	Replay    *RingBuffer
+	Filters   map[string]bool
+	Enrichers map[string]bool
+	Events    map[string]*ScheduledEvent
+	Polls     map[string]*Poll
+	Pins      []PinnedMessage
+	Webhooks  map[string]*Webhook
+	Roles     map[string]string
+
+	// ShadowFilters run without being enforced, reporting what they would do
+	ShadowFilters map[string]bool
+
+	// Who may join and see the room. Invited users may join whatever the policy.
+	JoinPolicy   string
+	PasswordHash string
+	Visibility   string
+	Invited      map[string]bool
+
+	// Topic is shown to everyone joining, and only moderators may change it when TopicLocked
+	Topic       string
+	TopicLocked bool
+	Description string
+
+	// Persistent rooms are kept when empty. Other rooms expire once they have
+	// been empty since Emptied for long enough.
+	Persistent bool
+	Emptied    time.Time
+
+	// Retention limits how long messages are kept in Replay and the event log
+	Retention retentionPolicy
+
+	// Format is how chat messages are rendered for web clients, plain when empty
+	Format string
+
+	// Updated is when the last message was added to Replay, and Seq its sequence number
+	Updated time.Time
+	Seq     uint64
+}
+
+// RingBuffer keeps the last N messages sent to a room
+type RingBuffer struct {
+	items []*Message
+	next  int
+	full  bool
+}
+
+// NewRingBuffer creates a buffer holding up to size messages
+func NewRingBuffer(size int) *RingBuffer {
+	return &RingBuffer{items: make([]*Message, size)}
+}
+
+// Add appends a message, overwriting the oldest one when the buffer is full
+func (b *RingBuffer) Add(msg *Message) {
+	if len(b.items) == 0 {
+		return
+	}
+	b.items[b.next] = msg
+	b.next = (b.next + 1) % len(b.items)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// Items returns the buffered messages, oldest first
+func (b *RingBuffer) Items() []*Message {
+	if !b.full {
+		return append([]*Message(nil), b.items[:b.next]...)
+	}
+	return append(append([]*Message(nil), b.items[b.next:]...), b.items[:b.next]...)
+}
+
+// Retain drops the buffered messages keep returns false for. keep is also
+// given the number of messages newer than msg.
+func (b *RingBuffer) Retain(keep func(msg *Message, newer int) bool) {
+	items := b.Items()
+	clear(b.items)
+	b.next, b.full = 0, false
+	for i, msg := range items {
+		if keep(msg, len(items)-1-i) {
+			b.Add(msg)
+		}
+	}
+}
+
+// Range returns the buffered messages with sequence numbers from since to
+// until, inclusive. Zero until means no upper bound.
+func (b *RingBuffer) Range(since, until uint64) []*Message {
+	var result []*Message
+	for _, msg := range b.Items() {
+		if msg.Seq >= since && (until == 0 || msg.Seq <= until) {
+			result = append(result, msg)
+		}
+	}
+	return result
+}
+
+// getRoom returns the named room, creating it if needed. Caller must hold cs.Mutex.
+func (cs *ChatServer) getRoom(name string) *Room {
+	room, ok := cs.Rooms[name]
+	if !ok {
+		room = &Room{
+			Name:          name,
+			Replay:        NewRingBuffer(cs.ReplaySize),
+			Filters:       roomFilterDefaults(),
+			ShadowFilters: make(map[string]bool),
+			Enrichers:     roomEnricherDefaults(),
+			Events:        make(map[string]*ScheduledEvent),
+			Polls:         make(map[string]*Poll),
+			Webhooks:      make(map[string]*Webhook),
+			Roles:         make(map[string]string),
+			JoinPolicy:    JoinOpen,
+			Visibility:    VisibilityPublic,
+			Invited:       make(map[string]bool),
+		}
+		cs.Rooms[name] = room
+	}
+	return room
+}
+
+// JoinRoom moves a client into a room, replays its recent messages and notifies the other members
+func (cs *ChatServer) JoinRoom(client *Client, name string, sender ClientID) {
+	if err := cs.runHooks(func(h Hooks) error { return h.OnJoinRoom(client, name) }); err != nil {
+		client.Noticef("Cannot join %s: %s", name, err.Error())
+		return
+	}
+	previous := client.Room
+	if previous != "" {
+		cs.Record(Event{Type: EventLeave, Room: previous, User: client.Name})
+	}
+	cs.Record(Event{Type: EventJoin, Room: name, User: client.Name})
+
+	cs.Mutex.Lock()
+	client.Room = name
+	cs.Clients.Move(client, name)
+	replay := cs.getRoom(name).Replay.Items()
+	cs.Mutex.Unlock()
+
+	if previous != "" && !cs.inRoomElsewhere(client, previous) {
+		cs.Broadcast(previous, (&Message{Type: MessageLeave, Room: previous, From: client.Name}).setText("%s has left the room.", client.Name), sender)
+	}
+	for _, msg := range replay {
+		client.Send(msg)
+	}
+	if info, ok := cs.RoomInfo(name); ok {
+		client.Send(&Message{Type: MessageRoomInfo, Room: name, Body: info.Text(), Info: info})
+	}
+	if pins := cs.Pins(name); len(pins) > 0 {
+		client.Send(&Message{Type: MessageRoomPins, Room: name, Body: pinsText(name, pins), Pins: pins})
+	}
+	join := (&Message{Type: MessageJoin, Room: name, From: client.Name}).setText("%s has joined the chat!", client.Name)
+	if client.Authenticated {
+		join.Profile = cs.Profile(client.Name)
+	}
+	if p := client.presence(); p.Mode != PresenceOnline {
+		join.Presence = p.Mode
+	}
+	if !cs.inRoomElsewhere(client, name) {
+		cs.Broadcast(name, join, sender)
+	}
+	cs.RunJoinAutomations(client, name)
+}
+
+// LeaveRoom takes a client out of its room without joining another and notifies the remaining members
+func (cs *ChatServer) LeaveRoom(client *Client, sender ClientID) {
+	room := client.Room
+	if room == "" {
+		return
+	}
+	cs.Record(Event{Type: EventLeave, Room: room, User: client.Name})
+
+	cs.Mutex.Lock()
+	client.Room = ""
+	cs.Clients.Move(client, "")
+	cs.Mutex.Unlock()
+
+	if cs.inRoomElsewhere(client, room) {
+		return
+	}
+	cs.Broadcast(room, (&Message{Type: MessageLeave, Room: room, From: client.Name}).setText("%s has left the room.", client.Name), sender)
+}
+
+// Replay resends the messages of the client's room numbered since to until,
+// inclusive, so a client that noticed a gap in the sequence can fill it
+func (cs *ChatServer) Replay(client *Client, since, until uint64) {
+	if client.Room == "" {
+		client.Fail(CodeNotInRoom, "You are not in a room")
+		return
+	}
+	cs.HistoryRange(client, client.Room, since, until)
+}
+
+// HistoryRange sends the messages of a room numbered since to until,
+// inclusive, followed by a history.end message carrying the room's latest
+// sequence number. Messages that have left the replay buffer are read back
+// from the event log. They are streamed in the background at the pace the
+// client reads them, one request at a time.
+func (cs *ChatServer) HistoryRange(client *Client, name string, since, until uint64) {
+	if name != client.Room && cs.CanJoin(client, name, "") != nil {
+		client.Fail(CodePermissionDenied, "Permission denied")
+		return
+	}
+	since = max(since, 1)
+	cs.Mutex.Lock()
+	room, ok := cs.Rooms[name]
+	var buffered []*Message
+	var latest uint64
+	if ok {
+		buffered = room.Replay.Range(since, until)
+		latest = room.Seq
+	}
+	cs.Mutex.Unlock()
+	if !ok {
+		client.Fail(CodeNoSuchRoom, "No such room: %s", name)
+		return
+	}
+
+	// The replay buffer holds everything from its first message on
+	oldest := latest + 1
+	if len(buffered) > 0 {
+		oldest = buffered[0].Seq
+	}
+	end := oldest - 1
+	if until != 0 {
+		end = min(end, until)
+	}
+	if !client.streaming.CompareAndSwap(false, true) {
+		client.Notice("Your last history request is still being sent")
+		return
+	}
+	// The stream waits for the client to keep up, so it must not hold up
+	// the client's own requests, such as flow control credit
+	go func() {
+		defer client.streaming.Store(false)
+		cs.streamHistory(client, name, since, end, buffered, latest)
+	}()
+}
+
+// parseSeqRange parses "<from> [to]" sequence number arguments
+func parseSeqRange(args []string) (since, until uint64, err error) {
+	if len(args) != 1 && len(args) != 2 {
+		return 0, 0, errors.New("expected one or two sequence numbers")
+	}
+	if since, err = strconv.ParseUint(args[0], 10, 64); err != nil {
+		return 0, 0, err
+	}
+	if len(args) == 2 {
+		if until, err = strconv.ParseUint(args[1], 10, 64); err != nil {
+			return 0, 0, err
+		}
+	}
+	return since, until, nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Rooms listed per page by /list and GET /rooms
+const (
+	defaultRoomPage = 20
+	maxRoomPage     = 100
+)
+
+// RoomInfo describes a room in room.info messages
+type RoomInfo struct {
+	Name        string `json:"name"`
+	Topic       string `json:"topic,omitempty"`
+	Description string `json:"description,omitempty"`
+	Visibility  string `json:"visibility"`
+	JoinPolicy  string `json:"join_policy"`
+	Members     int    `json:"members"`
+	Persistent  bool   `json:"persistent,omitempty"`
+	Retention   string `json:"retention"`
+	Format      string `json:"format"`
+	Seq         uint64 `json:"seq"`
+}
+
+// Text renders the topic, description and policies of a room
+func (info *RoomInfo) Text() string {
+	lines := []string{fmt.Sprintf("No topic is set for %s", info.Name)}
+	if info.Topic != "" {
+		lines[0] = fmt.Sprintf("Topic for %s: %s", info.Name, info.Topic)
+	}
+	if info.Description != "" {
+		lines = append(lines, info.Description)
+	}
+	lines = append(lines, fmt.Sprintf("%s is %s and %s to join, %d online", info.Name, info.Visibility, info.JoinPolicy, info.Members))
+	return strings.Join(lines, "\n")
+}
+
+// RoomInfo returns the description of an existing room
+func (cs *ChatServer) RoomInfo(name string) (*RoomInfo, bool) {
+	cs.Mutex.Lock()
+	room, ok := cs.Rooms[name]
+	var info *RoomInfo
+	if ok {
+		info = &RoomInfo{
+			Name:        name,
+			Topic:       room.Topic,
+			Description: room.Description,
+			Visibility:  room.Visibility,
+			JoinPolicy:  room.JoinPolicy,
+			Persistent:  room.Persistent,
+			Retention:   room.Retention.String(),
+			Format:      room.formatName(),
+			Seq:         room.Seq,
+		}
+	}
+	cs.Mutex.Unlock()
+	if !ok {
+		return nil, false
+	}
+	info.Members = len(cs.Clients.InRoom(name))
+	return info, true
+}
+
+// SendRoomInfo sends a client the description of a room it can see
+func (cs *ChatServer) SendRoomInfo(client *Client, name string) {
+	cs.Mutex.Lock()
+	room, ok := cs.Rooms[name]
+	visible := ok && cs.canSee(client, name, room)
+	cs.Mutex.Unlock()
+	info, ok := cs.RoomInfo(name)
+	if !ok || !visible {
+		client.Fail(CodeNoSuchRoom, "No such room: %s", name)
+		return
+	}
+	client.Send(&Message{Type: MessageRoomInfo, Room: name, Body: info.Text(), Info: info})
+}
+
+// ListRooms returns up to limit rooms a client can see, or public rooms when
+// client is nil, in name order starting after the given name. next is the
+// name to continue from, or empty on the last page.
+func (cs *ChatServer) ListRooms(client *Client, after string, limit int) (rooms []*RoomInfo, next string) {
+	cs.Mutex.Lock()
+	var names []string
+	for name, room := range cs.Rooms {
+		if name > after && cs.canSee(client, name, room) {
+			names = append(names, name)
+		}
+	}
+	cs.Mutex.Unlock()
+
+	sort.Strings(names)
+	if len(names) > limit {
+		names = names[:limit]
+		next = names[limit-1]
+	}
+	rooms = make([]*RoomInfo, 0, len(names))
+	for _, name := range names {
+		if info, ok := cs.RoomInfo(name); ok {
+			rooms = append(rooms, info)
+		}
+	}
+	return rooms, next
+}
+
+// listCommand lists a page of the rooms a client can see with their member
+// counts and topics
+func (cs *ChatServer) listCommand(client *Client, args []string) {
+	if len(args) > 1 {
+		client.Fail(CodeUsage, "Usage: /list [after room]")
+		return
+	}
+	after := ""
+	if len(args) == 1 {
+		after = args[0]
+	}
+	rooms, next := cs.ListRooms(client, after, defaultRoomPage)
+	if len(rooms) == 0 {
+		client.Notice("No rooms to list")
+		return
+	}
+	lines := []string{"Rooms"}
+	for _, info := range rooms {
+		line := fmt.Sprintf("%s (%d online)", info.Name, info.Members)
+		if info.Topic != "" {
+			line += " - " + info.Topic
+		}
+		lines = append(lines, line)
+	}
+	if next != "" {
+		lines = append(lines, "More: /list "+next)
+	}
+	client.Notice(strings.Join(lines, "\n"))
+}
+
+// HandleListRooms returns a page of public rooms for room browsers. Pages
+// continue from the next cursor of the previous page.
+func (cs *ChatServer) HandleListRooms(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := defaultRoomPage
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = min(n, maxRoomPage)
+	}
+
+	rooms, next := cs.ListRooms(nil, query.Get("cursor"), limit)
+	result := map[string]interface{}{"rooms": rooms}
+	if next != "" {
+		result["next"] = next
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// SetTopic changes the topic of a room and tells its members. An empty
+// topic clears it.
+func (cs *ChatServer) SetTopic(client *Client, name, topic string) error {
+	if client.Guest {
+		return errors.New("register to change room topics")
+	}
+	cs.Mutex.Lock()
+	locked := cs.getRoom(name).TopicLocked
+	cs.Mutex.Unlock()
+	if locked && !cs.IsModerator(client, name) {
+		return fmt.Errorf("only moderators can change the topic of %s", name)
+	}
+
+	cs.Record(Event{Type: EventRoomTopic, Room: name, User: client.Name, Body: topic})
+	cs.Audit(client, "room.topic", name, topic, "")
+	cs.Broadcast(name, &Message{Type: MessageTopic, Room: name, From: client.Name, Body: topic}, 0)
+	return nil
+}
+
+// applyRoomInfoEvent updates the topic and description of a room for an
+// event log entry. Caller must hold cs.Mutex.
+func (cs *ChatServer) applyRoomInfoEvent(ev Event) {
+	room := cs.getRoom(ev.Room)
+	switch ev.Type {
+	case EventRoomTopic:
+		room.Topic = ev.Body
+	case EventRoomTopicLock:
+		room.TopicLocked = ev.Body == "moderators"
+	case EventRoomDescription:
+		room.Description = ev.Body
+	}
+}
+
+// topicCommand shows the topic of the client's room or changes it
+func (cs *ChatServer) topicCommand(client *Client, msg string) {
+	if client.Room == "" {
+		client.Fail(CodeNotInRoom, "You are not in a room")
+		return
+	}
+	topic := strings.TrimSpace(strings.TrimPrefix(msg, "/topic"))
+	if topic == "" {
+		cs.SendRoomInfo(client, client.Room)
+		return
+	}
+	if topic == "-" {
+		topic = ""
+	}
+	if err := cs.SetTopic(client, client.Room, topic); err != nil {
+		client.Notice(err.Error())
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3Uploader puts closed archive segments into an S3 bucket with object
+// lock, so they cannot be deleted or overwritten before their retention ends.
+// Requests are signed with AWS Signature Version 4.
+type s3Uploader struct {
+	endpoint  string
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	token     string
+	lockMode  string
+	retention time.Duration
+	client    *http.Client
+	now       func() time.Time
+}
+
+// newS3Uploader configures an uploader for a bucket from the environment.
+// The bucket must have object lock enabled.
+func newS3Uploader(bucket string) (*s3Uploader, error) {
+	u := &s3Uploader{
+		endpoint:  strings.TrimRight(os.Getenv("ARCHIVE_S3_ENDPOINT"), "/"),
+		bucket:    bucket,
+		prefix:    os.Getenv("ARCHIVE_S3_PREFIX"),
+		region:    os.Getenv("ARCHIVE_S3_REGION"),
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+		lockMode:  strings.ToUpper(os.Getenv("ARCHIVE_S3_LOCK_MODE")),
+		retention: envDuration("ARCHIVE_RETENTION", 7*365*24*time.Hour),
+		client:    &http.Client{Timeout: envDuration("ARCHIVE_S3_TIMEOUT", time.Minute)},
+		now:       time.Now,
+	}
+	if u.region == "" {
+		u.region = "us-east-1"
+	}
+	if u.endpoint == "" {
+		u.endpoint = "https://s3." + u.region + ".amazonaws.com"
+	}
+	if u.lockMode == "" {
+		u.lockMode = "COMPLIANCE"
+	}
+	if u.lockMode != "COMPLIANCE" && u.lockMode != "GOVERNANCE" {
+		return nil, errors.New("ARCHIVE_S3_LOCK_MODE must be COMPLIANCE or GOVERNANCE")
+	}
+	if u.accessKey == "" || u.secretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required for ARCHIVE_S3_BUCKET")
+	}
+	return u, nil
+}
+
+// Upload puts a segment in the bucket, locked until the retention period ends
+func (u *s3Uploader) Upload(path string) error {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	key := u.prefix + filepath.Base(path)
+	req, err := http.NewRequest(http.MethodPut, u.endpoint+"/"+u.bucket+"/"+key, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	now := u.now().UTC()
+	sum := md5.Sum(body)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+	req.Header.Set("X-Amz-Object-Lock-Mode", u.lockMode)
+	req.Header.Set("X-Amz-Object-Lock-Retain-Until-Date", now.Add(u.retention).Format(time.RFC3339))
+	u.sign(req, body, now)
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("s3 returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data under key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sign adds an AWS Signature Version 4 authorization to a request
+func (u *s3Uploader) sign(req *http.Request, body []byte, now time.Time) {
+	payload := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payload[:])
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if u.token != "" {
+		req.Header.Set("X-Amz-Security-Token", u.token)
+	}
+
+	// Every header set above is signed, along with the host
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		(&url.URL{Path: req.URL.Path}).EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + u.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+u.secretKey), date)
+	key = hmacSHA256(key, u.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", u.accessKey, scope, signedHeaders, signature))
+}
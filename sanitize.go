@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Default longest name, in characters
+const defaultMaxNameLength = 32
+
+// defaultReservedNames may not be taken by clients that have not logged in,
+// so nobody can pass for staff or the server. RESERVED_NAMES replaces them.
+var defaultReservedNames = []string{"admin", "administrator", "moderator", "operator", "root", "server", "system", "staff", "nickserv", "chanserv"}
+
+var (
+	errNameRequired  = errors.New("a name is required")
+	errNameReserved  = errors.New("that name is reserved")
+	errInvalidUTF8   = errors.New("messages must be valid UTF-8")
+	errNameFederated = errors.New("that name belongs to a single sign-on provider")
+)
+
+// ansiEscape matches terminal escape sequences: CSI sequences such as colors
+// and cursor movement, OSC sequences such as window titles, and the
+// two-character escapes
+var ansiEscape = regexp.MustCompile(`\x1b(\[[0-?]*[ -/]*[@-~]?|\][^\x07\x1b]*(\x07|\x1b\\)?|[ -~])?`)
+
+// validateName checks a name a client wants to go by. Names are letters,
+// digits, '-', '_' and '.', up to NAME_MAX_LENGTH characters. Clients that
+// have not logged in may not take reserved names, the names of
+// administrators or names that look like a guest's, and nobody may take a
+// name in the namespace of a single sign-on provider.
+func validateName(name string, authenticated bool) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	if federatedName(name) {
+		return errNameFederated
+	}
+	if !authenticated && reservedName(name) {
+		return errNameReserved
+	}
+	return nil
+}
+
+// checkName checks that a name is made of the characters names may use
+func checkName(name string) error {
+	if name == "" {
+		return errNameRequired
+	}
+	if !utf8.ValidString(name) {
+		return errors.New("names must be valid UTF-8")
+	}
+	if limit := envInt("NAME_MAX_LENGTH", defaultMaxNameLength); utf8.RuneCountInString(name) > limit {
+		return fmt.Errorf("names can be at most %d characters", limit)
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("-_.", r) {
+			return fmt.Errorf("names can only contain letters, digits, '-', '_' and '.', not %q", r)
+		}
+	}
+	return nil
+}
+
+// reservedName reports whether a name is kept for staff, the server or guests
+func reservedName(name string) bool {
+	reserved := envList("RESERVED_NAMES")
+	if reserved == nil {
+		reserved = defaultReservedNames
+	}
+	for _, r := range reserved {
+		if strings.EqualFold(name, r) {
+			return true
+		}
+	}
+	return isAdmin(name) || strings.HasPrefix(strings.ToLower(name), "guest-")
+}
+
+// stripEscapes removes terminal escape sequences, which could move other
+// terminals' cursors, change their colors or set their titles
+func stripEscapes(s string) string {
+	if !strings.ContainsRune(s, '\x1b') {
+		return s
+	}
+	return ansiEscape.ReplaceAllString(s, "")
+}
+
+// sanitizeText makes a message body safe to show on terminals. Escape
+// sequences and control characters other than newlines and tabs are
+// dropped. The text must already be valid UTF-8.
+func sanitizeText(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r != '\t' && r != '\n' && unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, stripEscapes(s))
+}
+
+// sanitize cleans the free text fields of a request
+func (req *Request) sanitize() {
+	req.Body = sanitizeText(req.Body)
+	req.Filename = sanitizeText(req.Filename)
+	req.Label = sanitizeText(req.Label)
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// How often the reminder loop checks for upcoming room events
+const reminderInterval = 30 * time.Second
+
+// RSVP answers a user can give to a room event
+var rsvpAnswers = map[string]bool{"yes": true, "no": true, "maybe": true}
+
+// ScheduledEvent is an event planned in a room, such as a game night
+type ScheduledEvent struct {
+	ID       string            `json:"id"`
+	Room     string            `json:"room"`
+	Title    string            `json:"title"`
+	Start    time.Time         `json:"start"`
+	Creator  string            `json:"creator"`
+	Created  time.Time         `json:"created"`
+	RSVPs    map[string]string `json:"rsvps,omitempty"`
+	Reminded bool              `json:"reminded,omitempty"`
+}
+
+// Going returns the number of users who answered yes
+func (e *ScheduledEvent) Going() int {
+	going := 0
+	for _, answer := range e.RSVPs {
+		if answer == "yes" {
+			going++
+		}
+	}
+	return going
+}
+
+// snapshot copies an event with its own RSVPs, so it can be read after
+// cs.Mutex is released. Caller must hold cs.Mutex.
+func (e *ScheduledEvent) snapshot() ScheduledEvent {
+	s := *e
+	s.RSVPs = make(map[string]string, len(e.RSVPs))
+	for user, answer := range e.RSVPs {
+		s.RSVPs[user] = answer
+	}
+	return s
+}
+
+// parseEventTime turns a day ("today", "tomorrow", a weekday or YYYY-MM-DD)
+// and a clock time ("20:00") into the next matching time after now
+func parseEventTime(day, clock string, now time.Time) (time.Time, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return time.Time{}, errors.New("time must look like 20:00")
+	}
+	at := func(d time.Time) time.Time {
+		return time.Date(d.Year(), d.Month(), d.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+	}
+
+	day = strings.ToLower(day)
+	var start time.Time
+	switch day {
+	case "today":
+		start = at(now)
+	case "tomorrow":
+		start = at(now.AddDate(0, 0, 1))
+	default:
+		if d, err := time.ParseInLocation("2006-01-02", day, now.Location()); err == nil {
+			start = at(d)
+			break
+		}
+		weekday := -1
+		for i := time.Sunday; i <= time.Saturday; i++ {
+			name := strings.ToLower(i.String())
+			if day == name || day == name[:3] {
+				weekday = int(i)
+			}
+		}
+		if weekday < 0 {
+			return time.Time{}, errors.New("day must be today, tomorrow, a weekday or YYYY-MM-DD")
+		}
+		days := (weekday - int(now.Weekday()) + 7) % 7
+		start = at(now.AddDate(0, 0, days))
+		if !start.After(now) {
+			start = start.AddDate(0, 0, 7)
+		}
+	}
+
+	if !start.After(now) {
+		return time.Time{}, errors.New("event must start in the future")
+	}
+	return start, nil
+}
+
+// CreateEvent schedules a new event in a room
+func (cs *ChatServer) CreateEvent(client *Client, title string, start time.Time) (*ScheduledEvent, error) {
+	id, err := newID(4)
+	if err != nil {
+		return nil, err
+	}
+	event := &ScheduledEvent{
+		ID:      id,
+		Room:    client.Room,
+		Title:   title,
+		Start:   start.UTC(),
+		Creator: client.Name,
+		Created: time.Now().UTC(),
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	cs.Record(Event{Type: EventRoomEventCreate, Room: event.Room, User: client.Name, Target: id, Data: data})
+	return event, nil
+}
+
+// findEvent returns a room event by ID. Caller must hold cs.Mutex.
+func (cs *ChatServer) findEvent(room, id string) *ScheduledEvent {
+	return cs.getRoom(room).Events[id]
+}
+
+// applyRoomEvent updates room events for an event log entry. Caller must hold cs.Mutex.
+func (cs *ChatServer) applyRoomEvent(ev Event) {
+	room := cs.getRoom(ev.Room)
+	switch ev.Type {
+	case EventRoomEventCreate:
+		var event ScheduledEvent
+		if err := json.Unmarshal(ev.Data, &event); err != nil {
+			log.Println("Invalid room event in event log:", err)
+			return
+		}
+		if event.RSVPs == nil {
+			event.RSVPs = make(map[string]string)
+		}
+		room.Events[event.ID] = &event
+	case EventRoomEventRSVP:
+		if event := room.Events[ev.Target]; event != nil {
+			event.RSVPs[ev.User] = ev.Body
+		}
+	case EventRoomEventRemind:
+		if event := room.Events[ev.Target]; event != nil {
+			event.Reminded = true
+		}
+	case EventRoomEventCancel:
+		delete(room.Events, ev.Target)
+	}
+}
+
+// UpcomingEvents returns the events of a room that have not started yet, soonest first
+func (cs *ChatServer) UpcomingEvents(room string) []ScheduledEvent {
+	now := time.Now()
+	cs.Mutex.Lock()
+	var events []ScheduledEvent
+	for _, event := range cs.getRoom(room).Events {
+		if event.Start.After(now) {
+			events = append(events, event.snapshot())
+		}
+	}
+	cs.Mutex.Unlock()
+
+	sort.Slice(events, func(i, j int) bool { return events[i].Start.Before(events[j].Start) })
+	return events
+}
+
+// RunEventReminders broadcasts a reminder to each room shortly before its events start
+func (cs *ChatServer) RunEventReminders() {
+	lead := envDuration("EVENT_REMINDER", 15*time.Minute)
+	for {
+		now := time.Now()
+		var due []ScheduledEvent
+		cs.Mutex.Lock()
+		for _, room := range cs.Rooms {
+			for _, event := range room.Events {
+				if !event.Reminded && event.Start.After(now) && event.Start.Sub(now) <= lead {
+					due = append(due, event.snapshot())
+				}
+			}
+		}
+		cs.Mutex.Unlock()
+
+		for _, event := range due {
+			cs.Record(Event{Type: EventRoomEventRemind, Room: event.Room, Target: event.ID})
+			msg := (&Message{Type: MessageSystem, Room: event.Room}).setText("Reminder: %q starts at %s (%d going)", event.Title, event.Start.Local().Format("Mon 15:04"), event.Going())
+			cs.Broadcast(event.Room, msg, 0)
+		}
+		time.Sleep(reminderInterval)
+	}
+}
+
+// icalEscape escapes text for use in an iCalendar property value
+func icalEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(s)
+}
+
+// HandleRoomCalendar serves the events of a public room as an iCalendar feed
+func (cs *ChatServer) HandleRoomCalendar(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("room")
+	cs.Mutex.Lock()
+	room, ok := cs.Rooms[name]
+	// Calendar apps fetch without credentials, so only public rooms have one
+	ok = ok && cs.canSee(nil, name, room)
+	var events []ScheduledEvent
+	if ok {
+		for _, event := range room.Events {
+			events = append(events, event.snapshot())
+		}
+	}
+	cs.Mutex.Unlock()
+	if !ok {
+		http.Error(w, "room not found", http.StatusNotFound)
+		return
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Start.Before(events[j].Start) })
+
+	const stamp = "20060102T150405Z"
+	var b strings.Builder
+	b.WriteString("BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//go-websocket//chat//EN\r\n")
+	b.WriteString("X-WR-CALNAME:" + icalEscape(name) + "\r\n")
+	for _, event := range events {
+		b.WriteString("BEGIN:VEVENT\r\n")
+		b.WriteString("UID:" + event.ID + "@" + icalEscape(r.Host) + "\r\n")
+		b.WriteString("DTSTAMP:" + event.Created.UTC().Format(stamp) + "\r\n")
+		b.WriteString("DTSTART:" + event.Start.UTC().Format(stamp) + "\r\n")
+		b.WriteString("SUMMARY:" + icalEscape(event.Title) + "\r\n")
+		b.WriteString("DESCRIPTION:" + icalEscape(fmt.Sprintf("Created by %s in %s. %d going.", event.Creator, event.Room, event.Going())) + "\r\n")
+		b.WriteString("END:VEVENT\r\n")
+	}
+	b.WriteString("END:VCALENDAR\r\n")
+
+	writeConditional(w, r, "text/calendar; charset=utf-8", []byte(b.String()), time.Time{})
+}
+
+// eventCommand creates, lists, answers and cancels room events
+func (cs *ChatServer) eventCommand(client *Client, args []string) {
+	usage := "Usage: /event \"<title>\" <day> <HH:MM> | /event cancel <id> [reason]"
+	if len(args) >= 2 && args[0] == "cancel" {
+		cs.Mutex.Lock()
+		event := cs.findEvent(client.Room, args[1])
+		cs.Mutex.Unlock()
+		if event == nil {
+			client.Noticef("No such event: %s", args[1])
+			return
+		}
+		if event.Creator != client.Name && !cs.IsModerator(client, client.Room) {
+			client.Fail(CodePermissionDenied, "Permission denied")
+			return
+		}
+		cs.Record(Event{Type: EventRoomEventCancel, Room: client.Room, User: client.Name, Target: args[1]})
+		if event.Creator != client.Name {
+			// Moderators cancelling someone else's event is an administrative action
+			cs.Audit(client, "event.cancel", client.Room, args[1], strings.Join(args[2:], " "))
+		}
+		cs.Broadcast(client.Room, (&Message{Type: MessageSystem, Room: client.Room}).setText("%s cancelled %q", client.Name, event.Title), 0)
+		return
+	}
+	if len(args) != 3 || strings.TrimSpace(args[0]) == "" {
+		client.Notice(usage)
+		return
+	}
+
+	start, err := parseEventTime(args[1], args[2], time.Now())
+	if err != nil {
+		client.Notice(err.Error())
+		return
+	}
+	event, err := cs.CreateEvent(client, args[0], start)
+	if err != nil {
+		log.Println("Error creating room event:", err)
+		client.Notice("Could not create event")
+		return
+	}
+	msg := (&Message{Type: MessageSystem, Room: client.Room}).setText("%s scheduled %q for %s. RSVP with /rsvp %s yes|no|maybe", client.Name, event.Title, start.Format("Mon Jan 2 15:04"), event.ID)
+	cs.Broadcast(client.Room, msg, 0)
+}
+
+// rsvpCommand records a user's answer to a room event
+func (cs *ChatServer) rsvpCommand(client *Client, args []string) {
+	if len(args) != 2 || !rsvpAnswers[strings.ToLower(args[1])] {
+		client.Fail(CodeUsage, "Usage: /rsvp <id> yes|no|maybe")
+		return
+	}
+	cs.Mutex.Lock()
+	event := cs.findEvent(client.Room, args[0])
+	cs.Mutex.Unlock()
+	if event == nil {
+		client.Noticef("No such event: %s", args[0])
+		return
+	}
+	answer := strings.ToLower(args[1])
+	cs.Record(Event{Type: EventRoomEventRSVP, Room: client.Room, User: client.Name, Target: args[0], Body: answer})
+	client.Noticef("You answered %s to %q", answer, event.Title)
+}
+
+// eventsCommand lists the upcoming events of the client's room
+func (cs *ChatServer) eventsCommand(client *Client) {
+	events := cs.UpcomingEvents(client.Room)
+	if len(events) == 0 {
+		client.Noticef("No upcoming events in %s", client.Room)
+		return
+	}
+	lines := []string{client.T("Upcoming events in %s", client.Room)}
+	for _, event := range events {
+		lines = append(lines, fmt.Sprintf("%s  %s  %q by %s (%d going)", event.ID, event.Start.Local().Format("Mon Jan 2 15:04"), event.Title, event.Creator, event.Going()))
+	}
+	client.Notice(strings.Join(lines, "\n"))
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// kind names the kind of connection a client is using
+func (c *Client) kind() string {
+	switch c.Transport.(type) {
+	case *tcpTransport:
+		return "tcp"
+	case *wsTransport:
+		if c.Bot {
+			return "bot"
+		}
+		return "websocket"
+	case *ircSession:
+		return "irc"
+	case *sseStream:
+		return "sse"
+	case *pollQueue:
+		return "poll"
+	}
+	return "unknown"
+}
+
+// sessionsOf returns every connection a logged in user has open
+func (cs *ChatServer) sessionsOf(user string) []*Client {
+	var sessions []*Client
+	for _, c := range cs.Clients.All() {
+		if c.Authenticated && c.Name == user {
+			sessions = append(sessions, c)
+		}
+	}
+	return sessions
+}
+
+// inRoomElsewhere reports whether a logged in client's user is also in a
+// room from another device. Joins and leaves of a user's second device are
+// not announced to the room.
+func (cs *ChatServer) inRoomElsewhere(client *Client, room string) bool {
+	if !client.Authenticated || room == "" {
+		return false
+	}
+	for _, c := range cs.Clients.InRoom(room) {
+		if c != client && c.Authenticated && c.Name == client.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// Disconnected records that a client left the chat and tells its room,
+// unless the user is still there from another device. err is what ended the
+// connection, nil if the client closed it.
+func (cs *ChatServer) Disconnected(client *Client, err error) {
+	if client.Room == "" {
+		return
+	}
+	cs.Record(Event{Type: EventLeave, Room: client.Room, User: client.Name})
+	if cs.inRoomElsewhere(client, client.Room) {
+		return
+	}
+	cs.Broadcast(client.Room, leaveMessage(client, client.leaveReason(err)), client.ID)
+}
+
+// sessionsCommand lists the connections of the client's user or closes them
+func (cs *ChatServer) sessionsCommand(client *Client, fields []string) {
+	if !client.Authenticated {
+		client.Notice("Log in to connect from several devices")
+		return
+	}
+	sessions := cs.sessionsOf(client.Name)
+	switch {
+	case len(fields) == 1:
+		sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+		lines := []string{"Sessions"}
+		for _, s := range sessions {
+			line := fmt.Sprintf("%d  %s from %s, connected %s", s.ID, s.kind(), s.Address, s.Connected.Local().Format("Jan 2 15:04"))
+			if s.Room != "" {
+				line += ", in " + s.Room
+			}
+			if s == client {
+				line += " (this session)"
+			}
+			lines = append(lines, line)
+		}
+		client.Notice(strings.Join(lines, "\n"))
+	case len(fields) == 3 && fields[1] == "revoke":
+		var revoke []*Client
+		for _, s := range sessions {
+			if s != client && (fields[2] == "others" || strconv.FormatUint(uint64(s.ID), 10) == fields[2]) {
+				revoke = append(revoke, s)
+			}
+		}
+		if len(revoke) == 0 {
+			client.Noticef("No such session: %s", fields[2])
+			return
+		}
+		for _, s := range revoke {
+			s.Notice("This session was closed from another device")
+			s.disconnect()
+		}
+		if len(revoke) == 1 {
+			client.Notice("Closed 1 session")
+		} else {
+			client.Noticef("Closed %d sessions", len(revoke))
+		}
+	default:
+		client.Fail(CodeUsage, "Usage: /sessions [revoke <id>|revoke others]")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// slackPayload is the subset of Slack's incoming webhook payload we understand
+type slackPayload struct {
+	Text     string `json:"text"`
+	Channel  string `json:"channel"`
+	Username string `json:"username"`
+}
+
+// Slack escapes &, < and > in text and wraps links and mentions in angle brackets
+var (
+	slackLink     = regexp.MustCompile(`<([^<>|]+)(?:\|([^<>]*))?>`)
+	slackUnescape = strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&")
+)
+
+// slackText converts Slack message formatting to plain chat text
+func slackText(text string) string {
+	text = slackLink.ReplaceAllStringFunc(text, func(m string) string {
+		parts := slackLink.FindStringSubmatch(m)
+		target, label := parts[1], parts[2]
+		switch {
+		case strings.HasPrefix(target, "#"), strings.HasPrefix(target, "@"):
+			if label != "" {
+				return target[:1] + label
+			}
+			return target
+		case strings.HasPrefix(target, "!"):
+			return "@" + strings.TrimPrefix(target, "!")
+		case label != "" && label != target:
+			return label + " (" + target + ")"
+		}
+		return target
+	})
+	return slackUnescape.Replace(text)
+}
+
+// slackError answers a Slack webhook request the way Slack does, with a plain text code
+func slackError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(status)
+	w.Write([]byte(code))
+}
+
+// HandleSlackWebhook accepts Slack-style incoming webhooks, authenticated by
+// the API token in the URL. The payload may be sent as JSON or as a
+// form-encoded payload field; channel picks the room, defaulting to the lobby.
+func (cs *ChatServer) HandleSlackWebhook(w http.ResponseWriter, r *http.Request) {
+	token := cs.APITokens.Lookup(r.PathValue("token"))
+	if token == nil {
+		slackError(w, http.StatusForbidden, "invalid_token")
+		return
+	}
+	if !token.limiter.Allow() {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(token.limiter.Delay().Seconds()))))
+		slackError(w, http.StatusTooManyRequests, "rate_limited")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxAPIBodySize)
+	var payload slackPayload
+	var err error
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/x-www-form-urlencoded" || mediaType == "multipart/form-data" {
+		err = json.Unmarshal([]byte(r.FormValue("payload")), &payload)
+	} else {
+		err = json.NewDecoder(r.Body).Decode(&payload)
+	}
+	if err != nil {
+		slackError(w, http.StatusBadRequest, "invalid_payload")
+		return
+	}
+	text := slackText(payload.Text)
+	if !utf8.ValidString(text) || strings.TrimSpace(sanitizeText(text)) == "" {
+		slackError(w, http.StatusBadRequest, "no_text")
+		return
+	}
+
+	room := strings.TrimPrefix(payload.Channel, "#")
+	if room == "" {
+		room = defaultRoom
+	}
+	from, err := apiSender(token, payload.Username)
+	if err != nil {
+		slackError(w, http.StatusBadRequest, "invalid_username")
+		return
+	}
+	span := cs.Tracer.StartRequest(r, "slack.message")
+	span.SetAttr("api.token", token.Name)
+	defer span.End()
+	status, err := cs.postAPIMessage(span, token, room, from, text)
+	span.SetError(err)
+	switch {
+	case status == http.StatusNotFound:
+		slackError(w, status, "channel_not_found")
+	case status == http.StatusTooManyRequests:
+		w.Header().Set("Retry-After", strconv.Itoa(retrySeconds(err.(*throttleError).retry)))
+		slackError(w, status, "rate_limited")
+	case err != nil:
+		slackError(w, status, err.Error())
+	default:
+		slackError(w, http.StatusOK, "ok")
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Slow consumer policies, chosen with SLOW_CONSUMER_POLICY
+const (
+	SlowConsumerDrop  = "drop"
+	SlowConsumerClose = "close"
+)
+
+// sendQueue holds the messages waiting to be written to a client, so a slow
+// connection holds up only its own writer instead of every broadcast. Set up
+// when SEND_QUEUE_SIZE is positive.
+type sendQueue struct {
+	mu      sync.Mutex
+	msgs    [][]byte
+	wake    chan struct{}
+	closed  bool
+	limit   int
+	policy  string
+	lagging bool
+	dropped int
+	stats   *slowConsumerStats
+}
+
+// slowConsumerStats counts what the slow consumer policy did, for /debug/hub
+type slowConsumerStats struct {
+	dropped      atomic.Int64
+	disconnected atomic.Int64
+}
+
+func (s *slowConsumerStats) snapshot() map[string]int64 {
+	return map[string]int64{"dropped": s.dropped.Load(), "disconnected": s.disconnected.Load()}
+}
+
+// startSendQueue gives a client a send queue and a writer draining it, when
+// SEND_QUEUE_SIZE is set. Long-poll clients already have a queue.
+func (cs *ChatServer) startSendQueue(client *Client) {
+	limit := envInt("SEND_QUEUE_SIZE", 0)
+	if _, ok := client.Transport.(*pollQueue); ok || limit == 0 {
+		return
+	}
+	policy := SlowConsumerDrop
+	if os.Getenv("SLOW_CONSUMER_POLICY") == SlowConsumerClose {
+		policy = SlowConsumerClose
+	}
+	q := &sendQueue{wake: make(chan struct{}, 1), limit: limit, policy: policy, stats: &cs.SlowConsumers}
+	client.queue = q
+	go q.run(client)
+}
+
+// push adds a message to the queue. When the queue is full it drops the
+// oldest messages or, with the close policy, disconnects the client.
+func (q *sendQueue) push(client *Client, data []byte) error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return errClientGone
+	}
+	if data != nil {
+		data = append([]byte(nil), data...)
+	}
+	q.msgs = append(q.msgs, data)
+	overflow := len(q.msgs) - q.limit
+	first := overflow > 0 && !q.lagging
+	if overflow > 0 {
+		q.lagging = true
+		if q.policy == SlowConsumerDrop {
+			q.dropped += overflow
+			q.msgs = q.msgs[overflow:]
+			q.stats.dropped.Add(int64(overflow))
+		}
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	q.mu.Unlock()
+
+	switch {
+	case overflow <= 0:
+	case q.policy == SlowConsumerClose:
+		// The writer is stuck, so the connection is closed at once
+		reason := LeaveSlow
+		if client.kicked.CompareAndSwap(nil, &reason) {
+			client.Transport.Close()
+			q.stats.disconnected.Add(1)
+			log.Printf("Disconnected slow consumer %s (%s): %d messages queued", client.Name, client.Address, q.limit+overflow)
+		}
+	case first:
+		log.Printf("Slow consumer %s (%s): dropping its oldest messages", client.Name, client.Address)
+	}
+	return nil
+}
+
+// run writes a client's queued messages until the queue is closed
+func (q *sendQueue) run(client *Client) {
+	for range q.wake {
+		for {
+			q.mu.Lock()
+			if q.closed {
+				q.mu.Unlock()
+				return
+			}
+			if len(q.msgs) == 0 {
+				q.lagging = false
+				q.mu.Unlock()
+				break
+			}
+			data := q.msgs[0]
+			q.msgs[0] = nil
+			q.msgs = q.msgs[1:]
+			q.mu.Unlock()
+
+			// A nil message asks for the connection to be closed once
+			// everything before it is written
+			if data == nil {
+				client.Transport.Close()
+				continue
+			}
+			// Closing the connection makes its handler remove the client
+			if err := client.writeNow(data); err != nil {
+				log.Printf("Write to %s error: %v", client.Address, err)
+				client.Transport.Close()
+			}
+		}
+	}
+}
+
+// disconnect closes a client's connection after the messages already sent
+// to it, such as a notice saying why, have been written. A writer that is
+// stuck gets a second to finish.
+func (c *Client) disconnect() {
+	if c.queue == nil {
+		c.Transport.Close()
+		return
+	}
+	c.queue.push(c, nil)
+	time.AfterFunc(time.Second, func() { c.Transport.Close() })
+}
+
+// close stops the writer, discarding what is left in the queue
+func (q *sendQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		q.msgs = nil
+		close(q.wake)
+	}
+}
+
+// depth returns the number of queued messages and how many were dropped
+func (q *sendQueue) depth() (int, int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.msgs), q.dropped
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// StateSnapshot is the connection state saved on shutdown so a restart
+// disrupts clients less. Logged in users are put back in the room they were
+// in when they reconnect, and long-poll sessions carry on with the same
+// session ID, cursor and undelivered messages.
+type StateSnapshot struct {
+	Taken    time.Time         `json:"taken"`
+	Rooms    map[string]string `json:"rooms"`
+	Sessions []pollSnapshot    `json:"sessions"`
+}
+
+// pollSnapshot is a long-poll session in a snapshot
+type pollSnapshot struct {
+	Session       string            `json:"session"`
+	Name          string            `json:"name"`
+	Room          string            `json:"room"`
+	Address       string            `json:"address"`
+	Locale        string            `json:"locale"`
+	Authenticated bool              `json:"authenticated,omitempty"`
+	Admin         bool              `json:"admin,omitempty"`
+	Guest         bool              `json:"guest,omitempty"`
+	First         int               `json:"first"`
+	Messages      []json.RawMessage `json:"messages"`
+}
+
+// rejoin is a room a logged in user is put back in when they reconnect
+type rejoin struct {
+	room    string
+	expires time.Time
+}
+
+// Snapshot captures the connection state
+func (cs *ChatServer) Snapshot() *StateSnapshot {
+	snap := &StateSnapshot{Taken: time.Now().UTC(), Rooms: make(map[string]string), Sessions: []pollSnapshot{}}
+	cs.Mutex.Lock()
+	defer cs.Mutex.Unlock()
+	for _, client := range cs.Clients.All() {
+		if client.Authenticated && client.Room != "" {
+			snap.Rooms[client.Name] = client.Room
+		}
+	}
+	for session, client := range cs.Sessions {
+		queue, ok := client.Transport.(*pollQueue)
+		if !ok {
+			continue
+		}
+		locale := ""
+		if c := client.locale.Load(); c != nil {
+			locale = c.lang
+		}
+		queue.mu.Lock()
+		if !queue.closed {
+			snap.Sessions = append(snap.Sessions, pollSnapshot{
+				Session:       session,
+				Name:          client.Name,
+				Room:          client.Room,
+				Address:       client.Address,
+				Locale:        locale,
+				Authenticated: client.Authenticated,
+				Admin:         client.Admin,
+				Guest:         client.Guest,
+				First:         queue.first,
+				Messages:      append([]json.RawMessage(nil), queue.msgs...),
+			})
+		}
+		queue.mu.Unlock()
+	}
+	return snap
+}
+
+// SaveSnapshot writes the connection state to path
+func (cs *ChatServer) SaveSnapshot(path string) error {
+	data, err := json.Marshal(cs.Snapshot())
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// RestoreSnapshot restores the connection state saved at path and removes
+// the file, so an old snapshot is never applied twice. Snapshots older than
+// SNAPSHOT_MAX_AGE are ignored.
+func (cs *ChatServer) RestoreSnapshot(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	os.Remove(path)
+	var snap StateSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return err
+	}
+	maxAge := envDuration("SNAPSHOT_MAX_AGE", 5*time.Minute)
+	if time.Since(snap.Taken) > maxAge {
+		log.Printf("Ignoring state snapshot taken %s ago", time.Since(snap.Taken).Round(time.Second))
+		return nil
+	}
+
+	expires := time.Now().Add(maxAge)
+	cs.Mutex.Lock()
+	for user, room := range snap.Rooms {
+		cs.Rejoins[user] = rejoin{room: room, expires: expires}
+	}
+	cs.Mutex.Unlock()
+
+	for _, s := range snap.Sessions {
+		queue := newPollQueue(s.Address)
+		queue.first, queue.msgs = s.First, s.Messages
+		client := &Client{Transport: queue, Name: s.Name, Address: s.Address, Authenticated: s.Authenticated, Admin: s.Admin}
+		client.locale.Store(cs.NegotiateLocale(s.Locale))
+		if s.Guest {
+			cs.limitGuest(client)
+		}
+		if cs.AddClient(client) != nil {
+			continue
+		}
+		if client.Authenticated && !cs.Authenticated(client) {
+			cs.RemoveClient(client)
+			continue
+		}
+		cs.LoadBlocks(client)
+		cs.Mutex.Lock()
+		cs.Sessions[s.Session] = client
+		cs.Mutex.Unlock()
+		go cs.expirePollSession(s.Session, client, queue)
+		if s.Room != "" {
+			cs.rejoinRoom(client, s.Room)
+		}
+	}
+	log.Printf("Restored state snapshot: %d users, %d long-poll sessions", len(snap.Rooms), len(snap.Sessions))
+	return nil
+}
+
+// rejoinRoom puts a restored client back in its room. Unlike JoinRoom it
+// sends the client nothing, since it already has the room's history.
+func (cs *ChatServer) rejoinRoom(client *Client, room string) {
+	if cs.CanJoin(client, room, "") != nil {
+		room = defaultRoom
+	}
+	cs.Record(Event{Type: EventJoin, Room: room, User: client.Name})
+	cs.Mutex.Lock()
+	client.Room = room
+	cs.Clients.Move(client, room)
+	cs.Mutex.Unlock()
+	if !cs.inRoomElsewhere(client, room) {
+		cs.Broadcast(room, (&Message{Type: MessageJoin, Room: room, From: client.Name}).setText("%s has joined the chat!", client.Name), client.ID)
+	}
+}
+
+// startRoom returns the room a newly connected client joins: the one a
+// logged in user was in before a restart, or the default room
+func (cs *ChatServer) startRoom(client *Client) string {
+	if !client.Authenticated {
+		return defaultRoom
+	}
+	cs.Mutex.Lock()
+	r, ok := cs.Rejoins[client.Name]
+	delete(cs.Rejoins, client.Name)
+	cs.Mutex.Unlock()
+	if !ok || time.Now().After(r.expires) || cs.CanJoin(client, r.room, "") != nil {
+		return defaultRoom
+	}
+	return r.room
+}
+
+// stepDown saves a snapshot if STATE_SNAPSHOT is set, asks every client to
+// reconnect and closes the logs, ahead of this process exiting
+func (cs *ChatServer) stepDown(drain time.Duration) {
+	if path := os.Getenv("STATE_SNAPSHOT"); path != "" {
+		if err := cs.SaveSnapshot(path); err != nil {
+			log.Println("Error saving state snapshot:", err)
+		}
+	}
+	cs.drain(drain)
+	if cs.EventLog != nil {
+		cs.EventLog.Close()
+	}
+	if cs.AuditLog != nil {
+		cs.AuditLog.Close()
+	}
+	if cs.Archive != nil {
+		cs.Archive.Close()
+	}
+}
+
+// WatchShutdown steps down on SIGINT or SIGTERM and exits
+func (cs *ChatServer) WatchShutdown() {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	sig := <-stop
+	log.Printf("Shutting down on %s", sig)
+	cs.stepDown(envDuration("SHUTDOWN_DRAIN", 5*time.Second))
+	os.Exit(0)
+}
+
+// drain asks every client to reconnect and disconnects them, waiting up to
+// timeout for their connections to wind down
+func (cs *ChatServer) drain(timeout time.Duration) {
+	for _, client := range cs.Clients.All() {
+		client.Notice("The server is restarting, please reconnect")
+		client.disconnect()
+	}
+	deadline := time.Now().Add(timeout)
+	for len(cs.Clients.All()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default maximum snippet size in bytes
+const defaultSnippetMaxSize = 64 * 1024
+
+// Number of lines of a snippet included in the room preview
+const snippetPreviewLines = 5
+
+// Maximum number of characters of a snippet included in the room preview
+const snippetPreviewChars = 400
+
+var errSnippetNotFound = errors.New("snippet not found")
+
+// Snippet is a block of code shared in a room
+type Snippet struct {
+	ID       string    `json:"id"`
+	Room     string    `json:"room"`
+	From     string    `json:"from"`
+	Language string    `json:"language,omitempty"`
+	Filename string    `json:"filename,omitempty"`
+	Body     string    `json:"body"`
+	Created  time.Time `json:"created"`
+}
+
+// SnippetStore keeps snippets apart from chat messages, in memory or as
+// JSON files in a directory
+type SnippetStore struct {
+	mu       sync.Mutex
+	dir      string
+	snippets map[string]*Snippet
+}
+
+// NewSnippetStore creates a store. Snippets are written to dir if it is not empty.
+func NewSnippetStore(dir string) *SnippetStore {
+	return &SnippetStore{dir: dir, snippets: make(map[string]*Snippet)}
+}
+
+// Save stores a snippet, assigning it a new ID
+func (s *SnippetStore) Save(snippet *Snippet) error {
+	id, err := newID(8)
+	if err != nil {
+		return err
+	}
+	snippet.ID = id
+
+	if s.dir != "" {
+		if err := os.MkdirAll(s.dir, 0755); err != nil {
+			return err
+		}
+		data, err := json.Marshal(snippet)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(s.dir, snippet.ID+".json"), data, 0644)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snippets[snippet.ID] = snippet
+	return nil
+}
+
+// Get returns the snippet with the given ID
+func (s *SnippetStore) Get(id string) (*Snippet, error) {
+	if _, err := hex.DecodeString(id); err != nil {
+		return nil, errSnippetNotFound
+	}
+
+	if s.dir != "" {
+		data, err := os.ReadFile(filepath.Join(s.dir, id+".json"))
+		if os.IsNotExist(err) {
+			return nil, errSnippetNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		var snippet Snippet
+		if err := json.Unmarshal(data, &snippet); err != nil {
+			return nil, err
+		}
+		return &snippet, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snippet, ok := s.snippets[id]
+	if !ok {
+		return nil, errSnippetNotFound
+	}
+	return snippet, nil
+}
+
+// all returns every stored snippet
+func (s *SnippetStore) all() ([]*Snippet, error) {
+	if s.dir == "" {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		snippets := make([]*Snippet, 0, len(s.snippets))
+		for _, snippet := range s.snippets {
+			snippets = append(snippets, snippet)
+		}
+		return snippets, nil
+	}
+
+	entries, err := os.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snippets []*Snippet
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		snippet, err := s.Get(id)
+		if err == errSnippetNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		snippets = append(snippets, snippet)
+	}
+	return snippets, nil
+}
+
+// Of returns the snippets a user shared, oldest first
+func (s *SnippetStore) Of(user string) ([]Snippet, error) {
+	all, err := s.all()
+	if err != nil {
+		return nil, err
+	}
+	snippets := []Snippet{}
+	for _, snippet := range all {
+		if snippet.From == user {
+			snippets = append(snippets, *snippet)
+		}
+	}
+	sort.Slice(snippets, func(i, j int) bool { return snippets[i].Created.Before(snippets[j].Created) })
+	return snippets, nil
+}
+
+// Erase deletes the snippets a user shared, or attributes them to pseudonym
+// when keep is set
+func (s *SnippetStore) Erase(user, pseudonym string, keep bool) error {
+	all, err := s.all()
+	if err != nil {
+		return err
+	}
+	for _, snippet := range all {
+		if snippet.From != user {
+			continue
+		}
+		if s.dir == "" {
+			s.mu.Lock()
+			if keep {
+				snippet.From = pseudonym
+			} else {
+				delete(s.snippets, snippet.ID)
+			}
+			s.mu.Unlock()
+			continue
+		}
+		path := filepath.Join(s.dir, snippet.ID+".json")
+		if !keep {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		snippet.From = pseudonym
+		data, err := json.Marshal(snippet)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snippetPreview returns the first lines of a snippet and whether it was cut short
+func snippetPreview(body string) (string, bool) {
+	lines := strings.SplitN(body, "\n", snippetPreviewLines+1)
+	truncated := len(lines) > snippetPreviewLines
+	if truncated {
+		lines = lines[:snippetPreviewLines]
+	}
+	preview := strings.Join(lines, "\n")
+	if len(preview) > snippetPreviewChars {
+		preview = strings.ToValidUTF8(preview[:snippetPreviewChars], "")
+		truncated = true
+	}
+	return preview, truncated
+}
+
+// ShareSnippet stores a snippet sent by a client and broadcasts a preview to its room
+func (cs *ChatServer) ShareSnippet(client *Client, req *Request, sender ClientID) {
+	if strings.TrimSpace(req.Body) == "" {
+		client.Notice("Snippet is empty")
+		return
+	}
+	if max := envPositiveInt("SNIPPET_MAX_SIZE", defaultSnippetMaxSize); len(req.Body) > max {
+		client.Noticef("Snippet is larger than %d bytes", max)
+		return
+	}
+	if !cs.admitMessage(client, client.Room) {
+		return
+	}
+
+	// Keep only the base name so clients can't smuggle paths into downloads
+	filename := req.Filename
+	if filename != "" {
+		filename = filepath.Base(filename)
+	}
+	snippet := &Snippet{
+		Room:     client.Room,
+		From:     client.Name,
+		Language: req.Language,
+		Filename: filename,
+		Body:     req.Body,
+		Created:  time.Now().UTC(),
+	}
+	if err := cs.Snippets.Save(snippet); err != nil {
+		log.Println("Error saving snippet:", err)
+		client.Notice("Could not save snippet")
+		return
+	}
+
+	preview, truncated := snippetPreview(snippet.Body)
+	msg := &Message{
+		Type: MessageSnippet,
+		Room: snippet.Room,
+		From: snippet.From,
+		Body: preview,
+		Snippet: &SnippetInfo{
+			ID:        snippet.ID,
+			Language:  snippet.Language,
+			Filename:  snippet.Filename,
+			Lines:     strings.Count(snippet.Body, "\n") + 1,
+			Size:      len(snippet.Body),
+			Truncated: truncated,
+		},
+	}
+	// The archive keeps the whole snippet, not just the preview
+	archived := *msg
+	archived.Body = snippet.Body
+	if cs.archive(&archived) != nil {
+		client.Notice("Could not share snippet")
+		return
+	}
+	client.Send(msg)
+	cs.Broadcast(snippet.Room, msg, sender)
+	cs.NotifyWebhooks(msg)
+}
+
+// HandleGetSnippet serves the full snippet as JSON, or as plain text with ?raw=1
+func (cs *ChatServer) HandleGetSnippet(w http.ResponseWriter, r *http.Request) {
+	snippet, err := cs.Snippets.Get(r.PathValue("id"))
+	if errors.Is(err, errSnippetNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Println("Error reading snippet:", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("raw") == "1" {
+		writeConditional(w, r, "text/plain; charset=utf-8", []byte(snippet.Body), snippet.Created)
+		return
+	}
+	body, err := json.Marshal(snippet)
+	if err != nil {
+		log.Println("Error encoding snippet:", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	writeConditional(w, r, "application/json", body, snippet.Created)
+}
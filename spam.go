@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Messages shorter than this many letters are never counted as shouting
+const minCapsLetters = 10
+
+// Fraction of upper case letters above which a message counts as shouting
+const maxCapsRatio = 0.7
+
+// SpamDetector decides when a client is spamming and how long to mute them
+type SpamDetector struct {
+	Enabled      bool
+	RepeatLimit  int
+	RepeatWindow time.Duration
+	FloodLimit   int
+	FloodWindow  time.Duration
+	MuteDuration time.Duration
+
+	// Shadow reports spam to moderators without muting anyone
+	Shadow bool
+}
+
+// spamState tracks the recent messages of a single client
+type spamState struct {
+	recent     []spamEntry
+	mutedUntil time.Time
+}
+
+type spamEntry struct {
+	text string
+	at   time.Time
+}
+
+// NewSpamDetector reads the spam detection settings from the environment
+func NewSpamDetector() *SpamDetector {
+	return &SpamDetector{
+		Enabled:      envBool("SPAM_DETECTION", true),
+		RepeatLimit:  envPositiveInt("SPAM_REPEAT_LIMIT", 3),
+		RepeatWindow: envDuration("SPAM_REPEAT_WINDOW", 30*time.Second),
+		FloodLimit:   envPositiveInt("SPAM_FLOOD_LIMIT", 10),
+		FloodWindow:  envDuration("SPAM_FLOOD_WINDOW", 10*time.Second),
+		MuteDuration: envDuration("SPAM_MUTE_DURATION", time.Minute),
+		Shadow:       os.Getenv("SPAM_MODE") == "shadow",
+	}
+}
+
+// isShouting reports whether a message is mostly upper case letters
+func isShouting(text string) bool {
+	var letters, upper int
+	for _, r := range text {
+		if unicode.IsLetter(r) {
+			letters++
+			if unicode.IsUpper(r) {
+				upper++
+			}
+		}
+	}
+	return letters >= minCapsLetters && float64(upper)/float64(letters) > maxCapsRatio
+}
+
+// Check records a message from a client and returns why it is spam, or an
+// empty string if it is not. Caller must hold cs.Mutex.
+func (d *SpamDetector) Check(state *spamState, text string, now time.Time) string {
+	// Forget messages older than both windows
+	window := d.RepeatWindow
+	if d.FloodWindow > window {
+		window = d.FloodWindow
+	}
+	kept := state.recent[:0]
+	for _, entry := range state.recent {
+		if now.Sub(entry.at) < window {
+			kept = append(kept, entry)
+		}
+	}
+	state.recent = append(kept, spamEntry{text: text, at: now})
+
+	var repeats, count int
+	for _, entry := range state.recent {
+		if now.Sub(entry.at) < d.RepeatWindow && strings.EqualFold(entry.text, text) {
+			repeats++
+		}
+		if now.Sub(entry.at) < d.FloodWindow {
+			count++
+		}
+	}
+
+	switch {
+	case d.RepeatLimit > 0 && repeats >= d.RepeatLimit:
+		return "repeating the same message"
+	case d.FloodLimit > 0 && count > d.FloodLimit:
+		return "sending messages too quickly"
+	case isShouting(text):
+		return "excessive caps"
+	}
+	return ""
+}
+
+// CheckSpam returns an error message if the client is muted or has just been
+// muted for spamming, or nil if the message may be sent
+func (cs *ChatServer) CheckSpam(client *Client, text string) *Message {
+	now := time.Now()
+
+	// A reload swaps the detector, so the one checking this message is kept
+	cs.Mutex.Lock()
+	spam := cs.Spam
+	if !spam.Enabled {
+		cs.Mutex.Unlock()
+		return nil
+	}
+	if now.Before(client.spam.mutedUntil) {
+		left := client.spam.mutedUntil.Sub(now)
+		cs.Mutex.Unlock()
+		return errorMessage(CodeSpam, client.T("You are muted for another %s", left.Round(time.Second))).retryIn(left)
+	}
+	reason := spam.Check(&client.spam, text, now)
+	if reason != "" {
+		if !spam.Shadow {
+			client.spam.mutedUntil = now.Add(spam.MuteDuration)
+		}
+		client.spam.recent = nil
+	}
+	cs.Mutex.Unlock()
+
+	if reason == "" {
+		return nil
+	}
+	if spam.Shadow {
+		cs.ReportShadow(client, client.Room, "spam detection", "would mute for "+spam.MuteDuration.String()+": "+reason)
+		return nil
+	}
+	log.Printf("Muted %s (%s) for %s: %s", client.Name, client.Address, spam.MuteDuration, reason)
+	cs.auditServer("spam.mute", client.Room, client.Name, reason)
+	cs.NotifyModerators(fmt.Sprintf("%s was muted for %s in %s: %s", client.Name, spam.MuteDuration, client.Room, reason))
+	return errorMessage(CodeSpam, client.T("You have been muted for %s: %s", spam.MuteDuration, reason)).retryIn(spam.MuteDuration)
+}
+
+// NotifyModerators sends a moderation event to every connected admin and to
+// everyone in the staff room named by STAFF_ROOM
+func (cs *ChatServer) NotifyModerators(text string) {
+	staffRoom := os.Getenv("STAFF_ROOM")
+	cs.Mutex.Lock()
+	var staff []*Client
+	for _, client := range cs.Clients.All() {
+		if client.Admin || (staffRoom != "" && client.Room == staffRoom) {
+			staff = append(staff, client)
+		}
+	}
+	cs.Mutex.Unlock()
+
+	msg := &Message{Type: MessageModeration, Body: text}
+	for _, client := range staff {
+		client.Send(msg)
+	}
+}
+
+// ReportShadow logs and reports what a moderation rule in shadow mode would
+// have done to a message. The client is nil for messages posted through the HTTP API.
+func (cs *ChatServer) ReportShadow(client *Client, room, rule, action string) {
+	who := "API"
+	if client != nil {
+		who = client.Name
+	}
+	log.Printf("Shadow %s in %s for %s: %s", rule, room, who, action)
+	cs.NotifyModerators(fmt.Sprintf("[shadow] %s in %s for %s: %s", rule, room, who, action))
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often an idle event stream gets a comment to keep proxies from closing it
+const sseKeepAlive = 30 * time.Second
+
+// sseStream is a Server-Sent Events connection to a client that cannot use WebSockets
+type sseStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	remote  string
+	done    chan struct{}
+	once    sync.Once
+}
+
+// Send writes a JSON message as an SSE event. Caller must hold the client's writeMu.
+func (s *sseStream) Send(data []byte) error {
+	select {
+	case <-s.done:
+		return errors.New("event stream closed")
+	default:
+	}
+	if _, err := io.WriteString(s.w, "data: "); err != nil {
+		return err
+	}
+	if _, err := s.w.Write(data); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(s.w, "\n\n"); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// Close ends the stream
+func (s *sseStream) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return nil
+}
+
+func (s *sseStream) Remote() string {
+	return s.remote
+}
+
+// HandleEventStream connects a client over Server-Sent Events. The first
+// event carries a session ID that is sent back with each POST /send.
+func (cs *ChatServer) HandleEventStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	if err := validateName(name, false); err != nil {
+		http.Error(w, "invalid name: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	room := r.URL.Query().Get("room")
+	if room == "" {
+		room = defaultRoom
+	}
+	session, err := newID(16)
+	if err != nil {
+		log.Println("Error creating session:", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	stream := &sseStream{w: w, flusher: flusher, remote: clientAddr(cs.Proxies, r), done: make(chan struct{})}
+	client := &Client{Transport: stream, Name: name, Address: stream.Remote()}
+	client.locale.Store(cs.NegotiateLocale(r.Header.Get("Accept-Language")))
+	if err := cs.CanJoin(client, room, r.URL.Query().Get("password")); err != nil {
+		http.Error(w, joinError(room, err), http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprintf(w, "event: session\ndata: {\"session\":%q}\n\n", session)
+	flusher.Flush()
+
+	if cs.AddClient(client) != nil {
+		return
+	}
+	cs.Mutex.Lock()
+	cs.Sessions[session] = client
+	cs.Mutex.Unlock()
+	defer func() {
+		cs.Mutex.Lock()
+		delete(cs.Sessions, session)
+		cs.Mutex.Unlock()
+		cs.RemoveClient(client)
+	}()
+
+	cs.SendMOTD(client)
+	cs.JoinRoom(client, room, client.ID)
+
+	ticker := time.NewTicker(sseKeepAlive)
+	defer ticker.Stop()
+	var lost error
+	for {
+		select {
+		case <-ticker.C:
+			client.writeMu.Lock()
+			_, err := io.WriteString(w, ": keep-alive\n\n")
+			if err == nil {
+				flusher.Flush()
+			}
+			client.writeMu.Unlock()
+			if err != nil {
+				lost = err
+				stream.Close()
+			}
+			continue
+		case <-r.Context().Done():
+		case <-stream.done:
+		}
+		break
+	}
+
+	// Wait for any write in progress, later writes see the stream is closed
+	stream.Close()
+	client.writeMu.Lock()
+	client.writeMu.Unlock()
+	cs.Disconnected(client, lost)
+}
+
+// HandleSend accepts input from an event stream or long-poll session, either
+// a JSON request like WebSocket clients send or a line of plain text. The
+// session is passed in the X-Session-ID header or the session query parameter.
+func (cs *ChatServer) HandleSend(w http.ResponseWriter, r *http.Request) {
+	session := r.Header.Get("X-Session-ID")
+	if session == "" {
+		session = r.URL.Query().Get("session")
+	}
+	cs.Mutex.Lock()
+	client, ok := cs.Sessions[session]
+	cs.Mutex.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown session")
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxAPIBodySize))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, "request too large")
+		return
+	}
+	text := strings.TrimSpace(string(data))
+	if text == "" {
+		writeError(w, http.StatusBadRequest, "empty message")
+		return
+	}
+	cs.HandleInput(client, text, client.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
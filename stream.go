@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Kinds of live streams
+const (
+	StreamScreen    = "screen"
+	StreamCamera    = "camera"
+	StreamBroadcast = "broadcast"
+)
+
+// Longest stream title, in characters
+const maxStreamTitle = 100
+
+// Stream is a live stream a user started, such as a screen share, shown
+// with their presence while it lasts
+type Stream struct {
+	URL     string    `json:"url"`
+	Title   string    `json:"title,omitempty"`
+	Kind    string    `json:"kind,omitempty"`
+	Started time.Time `json:"started"`
+}
+
+// LiveStream is a stream running in a room and who is streaming it
+type LiveStream struct {
+	From   string  `json:"from"`
+	Stream *Stream `json:"stream"`
+}
+
+// check validates a stream a client announced and cleans its title
+func (s *Stream) check() error {
+	u, err := url.Parse(s.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("streams need an http or https URL")
+	}
+	s.Title = strings.TrimSpace(sanitizeText(s.Title))
+	if utf8.RuneCountInString(s.Title) > maxStreamTitle {
+		return errors.New("stream titles can be at most 100 characters")
+	}
+	switch s.Kind {
+	case "":
+		s.Kind = StreamBroadcast
+	case StreamScreen, StreamCamera, StreamBroadcast:
+	default:
+		return errors.New("stream kinds are screen, camera or broadcast")
+	}
+	return nil
+}
+
+// streamText sets the text of a stream announcement for plain text clients
+func streamText(msg *Message, from string, s *Stream) *Message {
+	switch {
+	case s == nil:
+		return msg.setText("%s stopped streaming", from)
+	case s.Kind == StreamScreen && s.Title != "":
+		return msg.setText("%s is sharing their screen: %s %s", from, s.Title, s.URL)
+	case s.Kind == StreamScreen:
+		return msg.setText("%s is sharing their screen %s", from, s.URL)
+	case s.Title != "":
+		return msg.setText("%s is streaming: %s %s", from, s.Title, s.URL)
+	}
+	return msg.setText("%s is streaming %s", from, s.URL)
+}
+
+// streamsText renders the live streams of a room in a client's language
+func streamsText(client *Client, room string, streams []LiveStream) string {
+	if len(streams) == 0 {
+		return client.T("Nobody is streaming in %s", room)
+	}
+	lines := []string{client.T("Live in %s:", room)}
+	for _, live := range streams {
+		lines = append(lines, "  "+client.localize(streamText(&Message{}, live.From, live.Stream)).Body)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// follows reports whether the client follows the streams of a room it is
+// not in
+func (c *Client) follows(room string) bool {
+	rooms := c.streamRooms.Load()
+	return rooms != nil && (*rooms)[room]
+}
+
+// follow subscribes the client to the stream announcements of a room, or
+// unsubscribes it
+func (c *Client) follow(room string, on bool) {
+	rooms := make(map[string]bool)
+	if old := c.streamRooms.Load(); old != nil {
+		for r := range *old {
+			rooms[r] = true
+		}
+	}
+	if on {
+		rooms[room] = true
+	} else {
+		delete(rooms, room)
+	}
+	c.streamRooms.Store(&rooms)
+}
+
+// SetStream starts a client's live stream, or stops it when stream is nil,
+// on all of its user's devices. The rooms they are in, and the clients
+// following those rooms' streams, are told.
+func (cs *ChatServer) SetStream(client *Client, stream *Stream) {
+	current := client.presence()
+	status := &presence{Mode: current.Mode, Message: current.Message, Stream: stream}
+
+	sessions := []*Client{client}
+	if client.Authenticated {
+		sessions = cs.sessionsOf(client.Name)
+	}
+	rooms := make(map[string]bool)
+	for _, c := range sessions {
+		c.status.Store(status)
+		if c.Room != "" {
+			rooms[c.Room] = true
+		}
+	}
+	// Followers hear about the stream once, and not at all when they are in
+	// one of the rooms already
+	told := make(map[ClientID]bool)
+	for room := range rooms {
+		msg := streamText(&Message{Type: MessageStream, Room: room, From: client.Name, Stream: stream}, client.Name, stream)
+		cs.Broadcast(room, msg, client.ID)
+		for _, c := range cs.followers(room) {
+			if !rooms[c.Room] && !told[c.ID] && !c.blocksMessage(msg) {
+				told[c.ID] = true
+				c.Send(msg)
+			}
+		}
+	}
+}
+
+// followers returns the clients following the streams of a room that can
+// still see it. A room may have turned private, or a follower lost its
+// invite, since it followed.
+func (cs *ChatServer) followers(name string) []*Client {
+	var followers []*Client
+	cs.Mutex.Lock()
+	defer cs.Mutex.Unlock()
+	room, ok := cs.Rooms[name]
+	if !ok {
+		return nil
+	}
+	for _, c := range cs.Clients.All() {
+		if c.follows(name) && cs.canSee(c, name, room) {
+			followers = append(followers, c)
+		}
+	}
+	return followers
+}
+
+// LiveStreams returns the streams running in a room, oldest first
+func (cs *ChatServer) LiveStreams(room string) []LiveStream {
+	seen := make(map[string]bool)
+	var streams []LiveStream
+	for _, c := range cs.Clients.InRoom(room) {
+		if s := c.presence().Stream; s != nil && !seen[c.Name] {
+			seen[c.Name] = true
+			streams = append(streams, LiveStream{From: c.Name, Stream: s})
+		}
+	}
+	sort.Slice(streams, func(i, j int) bool { return streams[i].Stream.Started.Before(streams[j].Stream.Started) })
+	return streams
+}
+
+// SendStreams sends a client the live streams of a room it can see
+func (cs *ChatServer) SendStreams(client *Client, name string) {
+	cs.Mutex.Lock()
+	room, ok := cs.Rooms[name]
+	visible := ok && cs.canSee(client, name, room)
+	cs.Mutex.Unlock()
+	if !visible {
+		client.Fail(CodeNoSuchRoom, "No such room: %s", name)
+		return
+	}
+	streams := cs.LiveStreams(name)
+	client.Send(&Message{Type: MessageStreams, Room: name, Body: streamsText(client, name, streams), Streams: streams})
+}
+
+// FollowStreams subscribes a client to the stream announcements of a room
+// it can see, or unsubscribes it
+func (cs *ChatServer) FollowStreams(client *Client, name string, on bool) {
+	cs.Mutex.Lock()
+	room, ok := cs.Rooms[name]
+	visible := ok && cs.canSee(client, name, room)
+	cs.Mutex.Unlock()
+	if on && !visible {
+		client.Fail(CodeNoSuchRoom, "No such room: %s", name)
+		return
+	}
+	client.follow(name, on)
+	if on {
+		client.Noticef("You will be told when someone in %s starts streaming", name)
+	} else {
+		client.Noticef("You will no longer be told about streams in %s", name)
+	}
+}
+
+// StartStream announces a stream a client started
+func (cs *ChatServer) StartStream(client *Client, stream *Stream) {
+	if client.Guest {
+		client.Fail(CodeGuest, "Guests cannot stream. Register to take part.")
+		return
+	}
+	if err := stream.check(); err != nil {
+		client.Fail(CodeUsage, "Invalid stream: %s", err.Error())
+		return
+	}
+	stream.Started = time.Now().UTC()
+	cs.SetStream(client, stream)
+	client.Notice("Your stream is announced")
+}
+
+// streamCommand starts or stops the client's stream, lists the streams of
+// its room, or follows the streams of another
+func (cs *ChatServer) streamCommand(client *Client, fields []string) {
+	usage := "Usage: /stream [screen|camera] <url> [title] | /stream off | /streams [room] | /streams follow|unfollow <room>"
+	if fields[0] == "/streams" {
+		switch {
+		case len(fields) == 1 && client.Room != "":
+			cs.SendStreams(client, client.Room)
+		case len(fields) == 2:
+			cs.SendStreams(client, fields[1])
+		case len(fields) == 3 && (fields[1] == "follow" || fields[1] == "unfollow"):
+			cs.FollowStreams(client, fields[2], fields[1] == "follow")
+		default:
+			client.Notice(usage)
+		}
+		return
+	}
+
+	if len(fields) == 2 && fields[1] == "off" {
+		if client.presence().Stream == nil {
+			client.Notice("You are not streaming")
+			return
+		}
+		cs.SetStream(client, nil)
+		client.Notice("Your stream has ended")
+		return
+	}
+	stream := &Stream{}
+	args := fields[1:]
+	if len(args) > 0 && (args[0] == StreamScreen || args[0] == StreamCamera) {
+		stream.Kind, args = args[0], args[1:]
+	}
+	if len(args) == 0 {
+		client.Notice(usage)
+		return
+	}
+	stream.URL, stream.Title = args[0], strings.Join(args[1:], " ")
+	cs.StartStream(client, stream)
+}
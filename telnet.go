@@ -0,0 +1,152 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"unicode"
+)
+
+// maxTCPLine is the longest line a TCP client may send
+const maxTCPLine = 4096
+
+// Telnet protocol bytes
+const (
+	telnetSE   = 240
+	telnetSB   = 250
+	telnetWILL = 251
+	telnetWONT = 252
+	telnetDO   = 253
+	telnetDONT = 254
+	telnetIAC  = 255
+)
+
+// telnetReader decodes what a TCP client sends. Telnet option negotiation is
+// removed and refused, and line endings are normalized to \n. Its state
+// carries across reads, so sequences split between packets are handled.
+type telnetReader struct {
+	r     io.Reader
+	reply func([]byte) error
+
+	state byte
+	cmd   byte
+	// negotiated is set once the client has sent any negotiation, which
+	// telnet clients do and netcat never does
+	negotiated bool
+	refused    map[[2]byte]bool
+	buf        []byte
+}
+
+// telnetReader states
+const (
+	telnetData = iota
+	telnetCR
+	telnetCommand
+	telnetOption
+	telnetSub
+	telnetSubIAC
+)
+
+func newTelnetReader(r io.Reader, reply func([]byte) error) *telnetReader {
+	return &telnetReader{r: r, reply: reply, refused: make(map[[2]byte]bool), buf: make([]byte, 1024)}
+}
+
+func (t *telnetReader) Read(p []byte) (int, error) {
+	for {
+		size := len(p)
+		if size > len(t.buf) {
+			size = len(t.buf)
+		}
+		n, err := t.r.Read(t.buf[:size])
+		out := t.decode(p[:0], t.buf[:n])
+		// Reads that held only negotiation return nothing, so read again
+		if len(out) > 0 || err != nil {
+			return len(out), err
+		}
+	}
+}
+
+// decode appends the text in data to out. It never writes past len(data),
+// so out can share p's memory.
+func (t *telnetReader) decode(out, data []byte) []byte {
+	for _, b := range data {
+		switch t.state {
+		case telnetData, telnetCR:
+			cr := t.state == telnetCR
+			t.state = telnetData
+			switch {
+			case b == telnetIAC:
+				t.state = telnetCommand
+			case b == '\r':
+				out = append(out, '\n')
+				t.state = telnetCR
+			case cr && (b == '\n' || b == 0):
+				// The \n of \r\n or the NUL of a bare \r was already counted
+			default:
+				out = append(out, b)
+			}
+		case telnetCommand:
+			t.negotiated = true
+			switch {
+			case b == telnetIAC:
+				// An escaped 255 data byte
+				out = append(out, b)
+				t.state = telnetData
+			case b == telnetSB:
+				t.state = telnetSub
+			case b >= telnetWILL && b <= telnetDONT:
+				t.cmd = b
+				t.state = telnetOption
+			default:
+				t.state = telnetData
+			}
+		case telnetOption:
+			t.refuse(t.cmd, b)
+			t.state = telnetData
+		case telnetSub:
+			if b == telnetIAC {
+				t.state = telnetSubIAC
+			}
+		case telnetSubIAC:
+			t.state = telnetSub
+			if b == telnetSE {
+				t.state = telnetData
+			}
+		}
+	}
+	return out
+}
+
+// refuse answers the client's offer to use an option, or its request that
+// the server does, with no. Each is answered once so the two sides cannot
+// loop.
+func (t *telnetReader) refuse(cmd, option byte) {
+	var answer byte
+	switch cmd {
+	case telnetWILL:
+		answer = telnetDONT
+	case telnetDO:
+		answer = telnetWONT
+	default:
+		// WONT and DONT need no answer
+		return
+	}
+	key := [2]byte{answer, option}
+	if t.refused[key] || t.reply == nil {
+		return
+	}
+	t.refused[key] = true
+	t.reply([]byte{telnetIAC, answer, option})
+}
+
+// cleanText makes a line from a TCP client safe to pass on. Invalid UTF-8 is
+// replaced and escape sequences and control characters, which could move
+// other terminals' cursors or change their colors, are dropped.
+func cleanText(s string) string {
+	s = stripEscapes(strings.ToValidUTF8(s, "\uFFFD"))
+	return strings.Map(func(r rune) rune {
+		if r != '\t' && unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+)
+
+// oneByteReader returns its data a byte per read, splitting every sequence
+type oneByteReader struct {
+	data []byte
+}
+
+func (r *oneByteReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	p[0] = r.data[0]
+	r.data = r.data[1:]
+	return 1, nil
+}
+
+func TestTelnetReader(t *testing.T) {
+	input := []byte("\xff\xfd\x01\xff\xfb\x1f\xff\xfa\x1f\x00\x50\x00\x18\xff\xf0" +
+		"gr\xc3\xbc\xc3\x9fe\r\n" +
+		"two\r\x00" +
+		"\xff\xfd\x01" +
+		"a\xff\xffb\n" +
+		"bad \x1b[31mred\x1b[0m \xc3\n")
+	var replies bytes.Buffer
+	telnet := newTelnetReader(&oneByteReader{data: input}, func(b []byte) error {
+		replies.Write(b)
+		return nil
+	})
+	scanner := bufio.NewScanner(telnet)
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, cleanText(scanner.Text()))
+	}
+	want := []string{"grüße", "two", "a�b", "bad red �"}
+	if len(lines) != len(want) {
+		t.Fatalf("got lines %q, want %q", lines, want)
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Errorf("line %d is %q, want %q", i, lines[i], want[i])
+		}
+	}
+	if !telnet.negotiated {
+		t.Error("negotiation was not detected")
+	}
+	// DO ECHO is refused once and WILL NAWS once
+	if got, want := replies.String(), "\xff\xfc\x01\xff\xfe\x1f"; got != want {
+		t.Errorf("replied %q, want %q", got, want)
+	}
+}
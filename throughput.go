@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// Throttle modes, chosen with THROTTLE_MODE
+const (
+	ThrottleReject = "reject"
+	ThrottleQueue  = "queue"
+)
+
+// Throughput caps how many messages per second are posted in each room and
+// across the server, to protect the event log, webhooks and bridges from
+// bursts. Messages over a cap are rejected with an error, or in
+// queue mode held for up to THROTTLE_MAX_WAIT until there is room.
+type Throughput struct {
+	mu        sync.Mutex
+	global    *RateLimiter
+	roomRate  int
+	roomBurst int
+	rooms     map[string]*RateLimiter
+	queue     bool
+	maxWait   time.Duration
+}
+
+// NewThroughput reads the caps from the environment
+func NewThroughput() *Throughput {
+	t := &Throughput{}
+	t.Configure()
+	return t
+}
+
+// Configure reads the caps from the environment again. A rate of zero
+// leaves that cap off. Rooms start over with full buckets.
+func (t *Throughput) Configure() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.roomRate = envInt("ROOM_MESSAGE_RATE", 0)
+	t.roomBurst = envInt("ROOM_MESSAGE_BURST", t.roomRate)
+	t.rooms = make(map[string]*RateLimiter)
+	t.queue = os.Getenv("THROTTLE_MODE") == ThrottleQueue
+	t.maxWait = envDuration("THROTTLE_MAX_WAIT", 5*time.Second)
+	t.global = nil
+	if rate := envInt("GLOBAL_MESSAGE_RATE", 0); rate > 0 {
+		t.global = NewRateLimiter(float64(rate), max(envInt("GLOBAL_MESSAGE_BURST", rate), 1))
+	}
+}
+
+// take uses up one message of a room's cap and the global one, returning
+// how long to wait instead if either is exhausted
+func (t *Throughput) take(room string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var limiters []*RateLimiter
+	if t.global != nil {
+		limiters = append(limiters, t.global)
+	}
+	if t.roomRate > 0 {
+		limiter, ok := t.rooms[room]
+		if !ok {
+			limiter = NewRateLimiter(float64(t.roomRate), max(t.roomBurst, 1))
+			t.rooms[room] = limiter
+		}
+		limiters = append(limiters, limiter)
+	}
+	var wait time.Duration
+	for _, limiter := range limiters {
+		wait = max(wait, limiter.Delay())
+	}
+	if wait > 0 {
+		return wait
+	}
+	for _, limiter := range limiters {
+		limiter.Allow()
+	}
+	return 0
+}
+
+// Admit lets a message into a room, waiting for room under the caps in
+// queue mode. When the message has to be turned away it returns how long
+// the sender should wait before trying again.
+func (t *Throughput) Admit(room string) (time.Duration, bool) {
+	var waited time.Duration
+	for {
+		wait := t.take(room)
+		if wait == 0 {
+			return 0, true
+		}
+		t.mu.Lock()
+		queue, maxWait := t.queue, t.maxWait
+		t.mu.Unlock()
+		if !queue || waited+wait > maxWait {
+			return wait, false
+		}
+		time.Sleep(wait)
+		waited += wait
+	}
+}
+
+// ForgetRoom drops the cap state of a deleted room
+func (t *Throughput) ForgetRoom(room string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.rooms, room)
+}
+
+// retrySeconds rounds a wait up to whole seconds, at least one
+func retrySeconds(wait time.Duration) int {
+	return max(int(math.Ceil(wait.Seconds())), 1)
+}
+
+// throttleError is returned for API messages over the throughput caps
+type throttleError struct {
+	room  string
+	retry time.Duration
+}
+
+func (e *throttleError) Error() string {
+	return fmt.Sprintf("too many messages in %s, retry in %ds", e.room, retrySeconds(e.retry))
+}
+
+// message tells a client when to try again
+func (e *throttleError) message() *Message {
+	return (&Message{Type: MessageError, Code: CodeThrottled, Room: e.room, Retryable: true}).retryIn(e.retry).setText("Too many messages in %s right now, try again in %ds", e.room, retrySeconds(e.retry))
+}
+
+// admitMessage checks a client's message that is broadcast without
+// PostMessage against the throughput caps, and tells the client when to try
+// again if it is turned away
+func (cs *ChatServer) admitMessage(client *Client, room string) bool {
+	wait, ok := cs.Throughput.Admit(room)
+	if !ok {
+		client.Send((&throttleError{room: room, retry: wait}).message())
+	}
+	return ok
+}
+
+// tellThrottled tells a client when to try again if PostMessage turned its
+// message away with err, and reports whether it did
+func tellThrottled(client *Client, err error) bool {
+	var throttle *throttleError
+	if !errors.As(err, &throttle) {
+		return false
+	}
+	client.Send(throttle.message())
+	return true
+}
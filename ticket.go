@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// connectTicket lets a browser open a WebSocket as a user it already
+// authenticated over HTTP, without sending the credentials over the socket
+type connectTicket struct {
+	user    string
+	expires time.Time
+	// admin is decided when the ticket is issued: by ADMIN_USERS for
+	// password logins, by the provider's admins for single sign-on
+	admin bool
+	// needsCode is set for single sign-on users with two-factor
+	// authentication who have not entered a code yet
+	needsCode bool
+}
+
+// postAuth sends a JSON request to the AUTH_URL service, traced as part of
+// parent when there is one
+func (cs *ChatServer) postAuth(parent *Span, path string, body []byte) (*http.Response, error) {
+	span := cs.Tracer.StartClient(parent, "auth"+strings.ReplaceAll(path, "/", "."))
+	defer span.End()
+
+	req, err := http.NewRequest(http.MethodPost, os.Getenv("AUTH_URL")+path, bytes.NewReader(body))
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	span.Inject(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	span.SetAttr("http.status_code", resp.StatusCode)
+	return resp, nil
+}
+
+// authLogin checks a username and password against the AUTH_URL service
+func (cs *ChatServer) authLogin(parent *Span, username, password string) (bool, error) {
+	body, err := json.Marshal(LoginRequest{Username: username, Password: password})
+	if err != nil {
+		return false, err
+	}
+	resp, err := cs.postAuth(parent, "/login", body)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode == http.StatusOK, nil
+}
+
+// HandleIssueTicket exchanges a username and password, or an ID token from
+// an OIDC provider, for a single-use ticket that is passed to /ws?ticket=
+// within TICKET_TTL
+func (cs *ChatServer) HandleIssueTicket(w http.ResponseWriter, r *http.Request) {
+	span := cs.Tracer.StartRequest(r, "ticket.issue")
+	defer span.End()
+
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		Provider string `json:"provider"`
+		IDToken  string `json:"id_token"`
+		Code     string `json:"code"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxAPIBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+
+	var username string
+	admin := false
+	if req.IDToken != "" {
+		provider := cs.OIDC[req.Provider]
+		if provider == nil {
+			writeError(w, http.StatusBadRequest, "unknown identity provider")
+			return
+		}
+		user, err := provider.Identify(req.IDToken, "")
+		if err != nil {
+			log.Printf("Rejected %s ID token: %v", req.Provider, err)
+			writeError(w, http.StatusUnauthorized, "invalid ID token")
+			return
+		}
+		if cs.TwoFactorEnabled(user) {
+			address := clientAddr(cs.Proxies, r)
+			done, wait := cs.Logins.Begin(address, user)
+			if wait > 0 {
+				w.Header().Set("Retry-After", fmt.Sprint(int(wait.Seconds())+1))
+				writeError(w, http.StatusTooManyRequests, "too many failed attempts")
+				return
+			}
+			ok := cs.checkTicketCode(w, address, user, req.Code)
+			done()
+			if !ok {
+				return
+			}
+			cs.Logins.Succeeded(user)
+		}
+		username = user
+		admin = provider.isAdmin(user)
+	} else {
+		username = strings.TrimSpace(req.Username)
+		if username == "" || req.Password == "" {
+			writeError(w, http.StatusBadRequest, "username and password are required")
+			return
+		}
+		if err := validateName(username, true); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid username: "+err.Error())
+			return
+		}
+		address := clientAddr(cs.Proxies, r)
+		done, wait := cs.Logins.Begin(address, username)
+		if wait > 0 {
+			w.Header().Set("Retry-After", fmt.Sprint(int(wait.Seconds())+1))
+			writeError(w, http.StatusTooManyRequests, "too many failed attempts")
+			return
+		}
+		defer done()
+		ok, err := cs.authLogin(span, username, req.Password)
+		if err != nil {
+			log.Println("Error contacting auth service:", err)
+			writeError(w, http.StatusBadGateway, "authentication service unavailable")
+			return
+		}
+		if !ok {
+			cs.LoginFailed("login", address, username, "invalid password")
+			writeError(w, http.StatusUnauthorized, "invalid username or password")
+			return
+		}
+		if cs.TwoFactorEnabled(username) && !cs.checkTicketCode(w, address, username, req.Code) {
+			return
+		}
+		cs.Logins.Succeeded(username)
+		admin = isAdmin(username)
+	}
+
+	ticket, expires, err := cs.IssueTicket(&connectTicket{user: username, admin: admin})
+	if err != nil {
+		log.Println("Error creating ticket:", err)
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"ticket": ticket, "expires": expires.UTC()})
+}
+
+// checkTicketCode checks the two-factor code sent with a ticket request,
+// writing the error response if it is missing or wrong
+func (cs *ChatServer) checkTicketCode(w http.ResponseWriter, address, username, code string) bool {
+	if code == "" {
+		writeError(w, http.StatusUnauthorized, "two-factor code required")
+		return false
+	}
+	if !cs.CheckTwoFactor(username, code) {
+		cs.LoginFailed("login", address, username, "invalid two-factor code")
+		writeError(w, http.StatusUnauthorized, "invalid two-factor code")
+		return false
+	}
+	return true
+}
+
+// IssueTicket creates a connect ticket for an authenticated user
+func (cs *ChatServer) IssueTicket(t *connectTicket) (string, time.Time, error) {
+	ticket, err := newID(24)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	now := time.Now()
+	expires := now.Add(envDuration("TICKET_TTL", 30*time.Second))
+	cs.Mutex.Lock()
+	for id, t := range cs.Tickets {
+		if now.After(t.expires) {
+			delete(cs.Tickets, id)
+		}
+	}
+	t.expires = expires
+	cs.Tickets[ticket] = t
+	cs.Mutex.Unlock()
+	return ticket, expires, nil
+}
+
+// RedeemTicket consumes a connect ticket and returns it, or nil if it is
+// unknown or expired
+func (cs *ChatServer) RedeemTicket(ticket string) *connectTicket {
+	cs.Mutex.Lock()
+	defer cs.Mutex.Unlock()
+	t, ok := cs.Tickets[ticket]
+	if !ok {
+		return nil
+	}
+	delete(cs.Tickets, ticket)
+	if time.Now().After(t.expires) {
+		return nil
+	}
+	return t
+}
+
+// HandleTicketConnection handles a WebSocket client that connected with a
+// ticket, skipping the login prompts other than the two-factor code the
+// ticket may still need
+func (cs *ChatServer) HandleTicketConnection(transport *wsTransport, t *connectTicket, locale *catalog) {
+	wsConn := transport.conn
+	client := &Client{
+		Transport:     transport,
+		Name:          t.user,
+		Address:       transport.Remote(),
+		Admin:         t.admin,
+		Authenticated: true,
+	}
+	client.echo.Store(envBool("WS_ECHO", true))
+	client.locale.Store(locale)
+	defer wsConn.Close()
+	// The client only joins once the ticket's login is complete
+	if t.needsCode {
+		hs := newHandshake(wsConn, client)
+		locked := func(wait time.Duration) {
+			hs.send(errorMessage(CodeLoginLocked, client.T("Too many failed attempts, try again in %s", wait.Round(time.Second))).retryIn(wait))
+		}
+		if wait := cs.Logins.Wait(client.Address, t.user); wait > 0 {
+			locked(wait)
+			return
+		}
+		hs.prompt(CodeTwoFactor, "Please enter your two-factor code:")
+		_, code, err := wsConn.ReadMessage()
+		if err != nil {
+			return
+		}
+		done, wait := cs.Logins.Begin(client.Address, t.user)
+		if wait > 0 {
+			locked(wait)
+			return
+		}
+		ok := cs.CheckTwoFactor(t.user, string(code))
+		if !ok {
+			cs.LoginFailed("login", client.Address, t.user, "invalid two-factor code")
+		}
+		done()
+		if !ok {
+			hs.fail(CodeLoginFailed, "Invalid two-factor code")
+			return
+		}
+		cs.Logins.Succeeded(t.user)
+	}
+	if cs.AddClient(client) != nil {
+		return
+	}
+	defer cs.RemoveClient(client)
+	if !cs.Authenticated(client) {
+		return
+	}
+
+	cs.LoadBlocks(client)
+	cs.SendMOTD(client)
+	cs.JoinRoom(client, cs.startRoom(client), client.ID)
+	cs.readWebSocket(client, wsConn)
+}
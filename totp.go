@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// TOTP parameters from RFC 6238, the defaults every authenticator app supports
+const (
+	totpPeriod = 30 * time.Second
+	totpDigits = 6
+	// Codes from one period either side are accepted to allow for clock drift
+	totpSkew = 1
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret generates a random 160 bit secret in base32
+func newTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// totpCode computes the code for a secret in the given time step
+func totpCode(secret string, step int64) string {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return ""
+	}
+	mac := hmac.New(sha1.New, key)
+	binary.Write(mac, binary.BigEndian, step)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// totpStep returns the time step a code matches, or -1 if it matches none
+// near now
+func totpStep(secret, code string, now time.Time) int64 {
+	code = strings.TrimSpace(code)
+	current := now.Unix() / int64(totpPeriod.Seconds())
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if want := totpCode(secret, step); want != "" && hmac.Equal([]byte(want), []byte(code)) {
+			return step
+		}
+	}
+	return -1
+}
+
+// totpURI is the otpauth:// URI authenticator apps scan as a QR code
+func totpURI(user, secret string) string {
+	issuer := os.Getenv("TOTP_ISSUER")
+	if issuer == "" {
+		issuer = "go-websocket"
+	}
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(totpDigits)},
+		"period":    {fmt.Sprint(int(totpPeriod.Seconds()))},
+	}
+	label := url.PathEscape(issuer + ":" + user)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// TwoFactorEnabled reports whether a user has to enter a code to log in
+func (cs *ChatServer) TwoFactorEnabled(user string) bool {
+	cs.Mutex.Lock()
+	defer cs.Mutex.Unlock()
+	return cs.TOTPSecrets[user] != ""
+}
+
+// CheckTwoFactor verifies a code for a user with two-factor authentication
+// enabled. Each code is only accepted once.
+func (cs *ChatServer) CheckTwoFactor(user, code string) bool {
+	cs.Mutex.Lock()
+	defer cs.Mutex.Unlock()
+	secret := cs.TOTPSecrets[user]
+	if secret == "" {
+		return false
+	}
+	step := totpStep(secret, code, time.Now())
+	if step < 0 || step <= cs.totpUsed[user] {
+		return false
+	}
+	cs.totpUsed[user] = step
+	return true
+}
+
+// applyTOTPEvent enables or disables two-factor authentication for an event
+// log entry. Caller must hold cs.Mutex.
+func (cs *ChatServer) applyTOTPEvent(ev Event) {
+	switch ev.Type {
+	case EventTOTPEnable:
+		cs.TOTPSecrets[ev.User] = ev.Body
+	case EventTOTPDisable:
+		delete(cs.TOTPSecrets, ev.User)
+	}
+}
+
+// twoFactorCommand sets up, confirms or turns off two-factor authentication
+// for a logged in client
+func (cs *ChatServer) twoFactorCommand(client *Client, fields []string) {
+	if !client.Authenticated {
+		client.Notice("Log in to use two-factor authentication")
+		return
+	}
+	switch {
+	case len(fields) == 1:
+		if cs.TwoFactorEnabled(client.Name) {
+			client.Notice("Two-factor authentication is on. Turn it off with /2fa off <code>")
+		} else {
+			client.Notice("Two-factor authentication is off. Turn it on with /2fa setup")
+		}
+	case len(fields) == 2 && fields[1] == "setup":
+		if cs.TwoFactorEnabled(client.Name) {
+			client.Notice("Two-factor authentication is already on")
+			return
+		}
+		secret, err := newTOTPSecret()
+		if err != nil {
+			client.Notice("Could not create a secret, please try again")
+			return
+		}
+		cs.Mutex.Lock()
+		cs.totpPending[client.Name] = secret
+		cs.Mutex.Unlock()
+		client.Noticef("Add this key to your authenticator app, or scan a QR code of the URI below, then confirm with /2fa confirm <code>\nKey: %s\n%s", secret, totpURI(client.Name, secret))
+	case len(fields) == 3 && fields[1] == "confirm":
+		cs.Mutex.Lock()
+		secret := cs.totpPending[client.Name]
+		cs.Mutex.Unlock()
+		if secret == "" {
+			client.Notice("Start with /2fa setup")
+			return
+		}
+		step := totpStep(secret, fields[2], time.Now())
+		if step < 0 {
+			client.Notice("That code is not valid, check your device's clock and try again")
+			return
+		}
+		cs.Mutex.Lock()
+		delete(cs.totpPending, client.Name)
+		cs.totpUsed[client.Name] = step
+		cs.Mutex.Unlock()
+		cs.Record(Event{Type: EventTOTPEnable, User: client.Name, Body: secret})
+		client.Notice("Two-factor authentication is on. You will be asked for a code when you log in")
+	case len(fields) == 3 && fields[1] == "off":
+		if !cs.TwoFactorEnabled(client.Name) {
+			client.Notice("Two-factor authentication is already off")
+			return
+		}
+		if !cs.CheckTwoFactor(client.Name, fields[2]) {
+			client.Notice("That code is not valid")
+			return
+		}
+		cs.Record(Event{Type: EventTOTPDisable, User: client.Name})
+		client.Notice("Two-factor authentication is off")
+	default:
+		client.Fail(CodeUsage, "Usage: /2fa [setup|confirm <code>|off <code>]")
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Most spans sent to the collector in one export request
+const maxSpanBatch = 512
+
+// OTLP span kinds
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// Tracer records spans and exports them in batches to an OpenTelemetry
+// collector using OTLP over HTTP with JSON encoding. A nil Tracer records
+// nothing, so tracing can be left off without checks at every call site.
+type Tracer struct {
+	endpoint string
+	headers  map[string]string
+	service  string
+	client   *http.Client
+	queue    chan *Span
+	proxies  []*net.IPNet
+}
+
+// Span is one timed operation in a trace. Methods on a nil Span do nothing.
+type Span struct {
+	tracer  *Tracer
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	name    string
+	kind    int
+	start   time.Time
+	end     time.Time
+	mu      sync.Mutex
+	attrs   map[string]interface{}
+	err     string
+}
+
+// NewTracer configures tracing from the standard OTEL_EXPORTER_OTLP_*
+// variables. It returns nil if no endpoint is set.
+func NewTracer() *Tracer {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if base == "" {
+			return nil
+		}
+		endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+	service := os.Getenv("OTEL_SERVICE_NAME")
+	if service == "" {
+		service = "go-websocket"
+	}
+	headers := make(map[string]string)
+	for _, entry := range envList("OTEL_EXPORTER_OTLP_HEADERS") {
+		if key, value, ok := strings.Cut(entry, "="); ok {
+			headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+
+	t := &Tracer{
+		endpoint: endpoint,
+		headers:  headers,
+		service:  service,
+		client:   &http.Client{Timeout: envMillis("OTEL_EXPORTER_OTLP_TIMEOUT", 10*time.Second)},
+		queue:    make(chan *Span, envInt("OTEL_BSP_MAX_QUEUE_SIZE", 2048)),
+		proxies:  trustedProxies(),
+	}
+	go t.export(envMillis("OTEL_BSP_SCHEDULE_DELAY", 5*time.Second))
+	return t
+}
+
+// envMillis reads a duration given in whole milliseconds, as the
+// OpenTelemetry variables are, returning def if it is unset, invalid or zero
+func envMillis(key string, def time.Duration) time.Duration {
+	return time.Duration(envPositiveInt(key, int(def/time.Millisecond))) * time.Millisecond
+}
+
+// Start begins a new trace
+func (t *Tracer) Start(name string) *Span {
+	if t == nil {
+		return nil
+	}
+	span := t.newSpan(name, spanKindInternal)
+	rand.Read(span.traceID[:])
+	return span
+}
+
+// StartRequest begins a span for an incoming HTTP request, continuing the
+// caller's trace if the request carries a W3C traceparent header
+func (t *Tracer) StartRequest(r *http.Request, name string) *Span {
+	if t == nil {
+		return nil
+	}
+	span := t.newSpan(name, spanKindServer)
+	if !parseTraceparent(r.Header.Get("traceparent"), span) {
+		rand.Read(span.traceID[:])
+	}
+	span.SetAttr("http.method", r.Method)
+	span.SetAttr("http.target", r.URL.Path)
+	span.SetAttr("client.address", clientAddr(t.proxies, r))
+	return span
+}
+
+// StartClient begins a span for an outgoing call, inside parent if there is
+// one and otherwise as a new trace
+func (t *Tracer) StartClient(parent *Span, name string) *Span {
+	if t == nil {
+		return nil
+	}
+	span := t.newSpan(name, spanKindClient)
+	if parent != nil {
+		span.traceID = parent.traceID
+		span.parent = parent.spanID
+	} else {
+		rand.Read(span.traceID[:])
+	}
+	return span
+}
+
+func (t *Tracer) newSpan(name string, kind int) *Span {
+	span := &Span{tracer: t, name: name, kind: kind, start: time.Now()}
+	rand.Read(span.spanID[:])
+	return span
+}
+
+// parseTraceparent sets the trace and parent IDs of span from a traceparent header
+func parseTraceparent(header string, span *Span) bool {
+	parts := strings.Split(header, "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return false
+	}
+	traceID, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	parent, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	copy(span.traceID[:], traceID)
+	copy(span.parent[:], parent)
+	return span.traceID != [16]byte{} && span.parent != [8]byte{}
+}
+
+// Child begins a span inside this one
+func (s *Span) Child(name string) *Span {
+	if s == nil {
+		return nil
+	}
+	child := s.tracer.newSpan(name, spanKindInternal)
+	child.traceID = s.traceID
+	child.parent = s.spanID
+	return child
+}
+
+// Inject adds a traceparent header to an outgoing request so the service
+// it calls can join the trace
+func (s *Span) Inject(req *http.Request) {
+	if s == nil {
+		return
+	}
+	req.Header.Set("traceparent", "00-"+hex.EncodeToString(s.traceID[:])+"-"+hex.EncodeToString(s.spanID[:])+"-01")
+}
+
+// SetAttr attaches a string, integer or boolean attribute to the span
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attrs == nil {
+		s.attrs = make(map[string]interface{})
+	}
+	s.attrs[key] = value
+}
+
+// SetError marks the span as failed
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err.Error()
+}
+
+// End finishes the span and queues it for export, dropping it if the queue is full
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.end = time.Now()
+	s.mu.Unlock()
+	select {
+	case s.tracer.queue <- s:
+	default:
+	}
+}
+
+// export sends queued spans to the collector whenever a batch fills up or
+// the schedule delay passes
+func (t *Tracer) export(delay time.Duration) {
+	ticker := time.NewTicker(delay)
+	defer ticker.Stop()
+	var batch []*Span
+	for {
+		select {
+		case span := <-t.queue:
+			batch = append(batch, span)
+			if len(batch) < maxSpanBatch {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := t.post(batch); err != nil {
+			log.Printf("Error exporting %d spans: %v", len(batch), err)
+		}
+		batch = nil
+	}
+}
+
+// post sends a batch of spans as an OTLP JSON ExportTraceServiceRequest
+func (t *Tracer) post(batch []*Span) error {
+	spans := make([]map[string]interface{}, 0, len(batch))
+	for _, s := range batch {
+		spans = append(spans, s.otlp())
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{"service.name": t.service}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "github.com/luka-sijic/go-websocket"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// otlp converts the span to its OTLP JSON form
+func (s *Span) otlp() map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	span := map[string]interface{}{
+		"traceId":           hex.EncodeToString(s.traceID[:]),
+		"spanId":            hex.EncodeToString(s.spanID[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        otlpAttributes(s.attrs),
+	}
+	if s.parent != [8]byte{} {
+		span["parentSpanId"] = hex.EncodeToString(s.parent[:])
+	}
+	if s.err != "" {
+		span["status"] = map[string]interface{}{"code": 2, "message": s.err}
+	}
+	return span
+}
+
+// otlpAttributes converts attributes to OTLP key-value pairs
+func otlpAttributes(attrs map[string]interface{}) []map[string]interface{} {
+	list := make([]map[string]interface{}, 0, len(attrs))
+	for key, value := range attrs {
+		var v map[string]interface{}
+		switch value := value.(type) {
+		case int:
+			v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+		case bool:
+			v = map[string]interface{}{"boolValue": value}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+		}
+		list = append(list, map[string]interface{}{"key": key, "value": v})
+	}
+	return list
+}
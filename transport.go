@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+)
+
+// Transport carries encoded messages to a client over one kind of connection.
+// Send must not keep data after it returns, because broadcasts reuse their
+// buffers.
+type Transport interface {
+	Send([]byte) error
+	Close() error
+	Remote() string
+}
+
+// messageEncoder is implemented by transports whose clients do not read the
+// JSON message envelope
+type messageEncoder interface {
+	Encode(msg *Message) []byte
+}
+
+// tcpTransport sends messages as text lines, colored with ANSI escapes for
+// clients that turned colors on
+type tcpTransport struct {
+	conn  net.Conn
+	color atomic.Bool
+}
+
+func (t *tcpTransport) Send(data []byte) error {
+	_, err := t.conn.Write(data)
+	return err
+}
+
+func (t *tcpTransport) Close() error {
+	return t.conn.Close()
+}
+
+func (t *tcpTransport) Remote() string {
+	// Unix socket peers have no address, so name the socket instead
+	if t.conn.LocalAddr().Network() == "unix" {
+		return "unix:" + t.conn.LocalAddr().String()
+	}
+	return t.conn.RemoteAddr().String()
+}
+
+func (t *tcpTransport) Encode(msg *Message) []byte {
+	if t.color.Load() {
+		return []byte(msg.ANSIText() + "\n")
+	}
+	return []byte(msg.Text() + "\n")
+}
+
+// wsTransport sends JSON messages as WebSocket text frames
+type wsTransport struct {
+	conn   *websocket.Conn
+	remote string
+	flow   flowControl
+	// features are those the client selected in its hello, nil if it
+	// did not send one
+	features map[string]bool
+}
+
+func (t *wsTransport) Send(data []byte) error {
+	if t.flow.enabled {
+		return t.flow.send(t.conn, data)
+	}
+	return t.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func (t *wsTransport) Close() error {
+	return t.conn.Close()
+}
+
+func (t *wsTransport) Remote() string {
+	return t.remote
+}
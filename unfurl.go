@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Most of a page read when looking for its metadata
+const maxUnfurlBody = 512 << 10
+
+// Most pages cached by the preview enricher
+const maxUnfurlCache = 1000
+
+// LinkPreview describes the page a link in a message points to
+type LinkPreview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Image       string `json:"image,omitempty"`
+	SiteName    string `json:"site_name,omitempty"`
+}
+
+var (
+	previewLinkPattern = regexp.MustCompile(`https?://[^\s<>"']+`)
+	titlePattern       = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	metaPattern        = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	attrPattern        = regexp.MustCompile(`(?is)([a-z:_-]+)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+)
+
+// errBlockedAddress is returned when a link resolves to an address the
+// server must not connect to
+var errBlockedAddress = errors.New("address not allowed")
+
+// publicAddress reports whether an IP address is on the public internet, so
+// links cannot be used to reach the server's own network
+func publicAddress(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast())
+}
+
+// publicDialer connects only to public addresses, checking the address it
+// actually dials so DNS cannot get around it. allowPrivate, if not nil, can
+// lift the check for tests.
+func publicDialer(timeout time.Duration, allowPrivate func() bool) *net.Dialer {
+	return &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			private := allowPrivate != nil && allowPrivate()
+			if ip := net.ParseIP(host); ip == nil || (!private && !publicAddress(ip)) {
+				return errBlockedAddress
+			}
+			return nil
+		},
+	}
+}
+
+// unfurlEntry is a cached preview, nil for pages that had none
+type unfurlEntry struct {
+	preview *LinkPreview
+	expires time.Time
+}
+
+// PreviewEnricher attaches a preview of the first link in a message, fetched
+// from the page's title and Open Graph tags. Only public addresses are
+// fetched, checked when connecting so redirects and DNS cannot get around
+// it, and previews are cached for UNFURL_CACHE_TTL.
+type PreviewEnricher struct {
+	client   *http.Client
+	cacheTTL time.Duration
+	// allowPrivate lets tests fetch from local servers
+	allowPrivate bool
+
+	mu    sync.Mutex
+	cache map[string]unfurlEntry
+}
+
+// NewPreviewEnricher creates an enricher that gives up on a page after timeout
+func NewPreviewEnricher(timeout, cacheTTL time.Duration) *PreviewEnricher {
+	p := &PreviewEnricher{cacheTTL: cacheTTL, cache: make(map[string]unfurlEntry)}
+	dialer := publicDialer(timeout, func() bool { return p.allowPrivate })
+	p.client = &http.Client{
+		Timeout: timeout,
+		// No proxy, so every connection goes through the address check
+		Transport: &http.Transport{DialContext: dialer.DialContext, Proxy: nil},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 3 {
+				return errors.New("too many redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return errors.New("unsupported redirect")
+			}
+			return nil
+		},
+	}
+	return p
+}
+
+func (p *PreviewEnricher) Name() string {
+	return "preview"
+}
+
+func (p *PreviewEnricher) Enrich(client *Client, msg *Message) error {
+	link := previewLinkPattern.FindString(msg.Body)
+	if link == "" {
+		return nil
+	}
+	link = strings.TrimRight(link, ".,;:!?)")
+	if preview := p.Preview(link); preview != nil {
+		msg.Preview = preview
+	}
+	// A page that cannot be previewed does not stop the message
+	return nil
+}
+
+// Preview returns the preview of a page, from the cache when possible
+func (p *PreviewEnricher) Preview(link string) *LinkPreview {
+	now := time.Now()
+	p.mu.Lock()
+	entry, ok := p.cache[link]
+	p.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.preview
+	}
+
+	preview, err := p.fetch(link)
+	if err != nil {
+		log.Printf("Link preview of %s failed: %v", link, err)
+	}
+	p.mu.Lock()
+	if len(p.cache) >= maxUnfurlCache {
+		for key, e := range p.cache {
+			if now.After(e.expires) || len(p.cache) >= maxUnfurlCache {
+				delete(p.cache, key)
+			}
+		}
+	}
+	p.cache[link] = unfurlEntry{preview: preview, expires: now.Add(p.cacheTTL)}
+	p.mu.Unlock()
+	return preview
+}
+
+// fetch reads the metadata of an HTML page
+func (p *PreviewEnricher) fetch(link string) (*LinkPreview, error) {
+	u, err := url.Parse(link)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("invalid link")
+	}
+	req, err := http.NewRequest(http.MethodGet, link, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("User-Agent", "go-websocket-chat link preview")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "text/html" {
+		return nil, nil
+	}
+	page, err := io.ReadAll(io.LimitReader(resp.Body, maxUnfurlBody))
+	if err != nil {
+		return nil, err
+	}
+	return parsePreview(resp.Request.URL, string(page)), nil
+}
+
+// parsePreview reads the title, description, image and site name of a page
+// from its Open Graph tags, falling back to its title and description
+func parsePreview(base *url.URL, page string) *LinkPreview {
+	meta := make(map[string]string)
+	for _, tag := range metaPattern.FindAllString(page, -1) {
+		attrs := make(map[string]string)
+		for _, m := range attrPattern.FindAllStringSubmatch(tag, -1) {
+			attrs[strings.ToLower(m[1])] = m[2] + m[3]
+		}
+		key := strings.ToLower(attrs["property"])
+		if key == "" {
+			key = strings.ToLower(attrs["name"])
+		}
+		if _, seen := meta[key]; key != "" && !seen {
+			meta[key] = previewText(attrs["content"])
+		}
+	}
+
+	preview := &LinkPreview{
+		URL:         base.String(),
+		Title:       meta["og:title"],
+		Description: meta["og:description"],
+		SiteName:    meta["og:site_name"],
+	}
+	if preview.Title == "" {
+		if m := titlePattern.FindStringSubmatch(page); m != nil {
+			preview.Title = previewText(strings.Join(strings.Fields(m[1]), " "))
+		}
+	}
+	if preview.Description == "" {
+		preview.Description = meta["description"]
+	}
+	if image, err := base.Parse(meta["og:image"]); err == nil && meta["og:image"] != "" && (image.Scheme == "http" || image.Scheme == "https") {
+		preview.Image = image.String()
+	}
+	if preview.Title == "" && preview.Description == "" {
+		return nil
+	}
+	return preview
+}
+
+// previewText decodes text from a page and makes it safe to show on
+// terminals, since pages can spell escape sequences as character references
+func previewText(raw string) string {
+	text := strings.ToValidUTF8(html.UnescapeString(raw), "\uFFFD")
+	return clip(strings.TrimSpace(sanitizeText(text)), 300)
+}
+
+// clip shortens text to at most n runes
+func clip(text string, n int) string {
+	runes := []rune(text)
+	if len(runes) <= n {
+		return text
+	}
+	return string(runes[:n-1]) + "…"
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPreviewEnricher(t *testing.T) {
+	var fetches atomic.Int32
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, `<html><head><title>Fallback</title>
+<meta property="og:title" content="Gophers &amp; friends">
+<meta name="description" content="All about gophers">
+<meta property="og:image" content="/gopher.png">
+</head></html>`)
+	}))
+	defer site.Close()
+
+	// Local addresses are refused
+	blocked := NewPreviewEnricher(time.Second, time.Minute)
+	msg := &Message{Type: MessageChat, Body: "see " + site.URL + "/page"}
+	if err := blocked.Enrich(nil, msg); err != nil || msg.Preview != nil {
+		t.Fatalf("local address previewed: %v %+v", err, msg.Preview)
+	}
+	if fetches.Load() != 0 {
+		t.Fatal("local address was fetched")
+	}
+
+	p := NewPreviewEnricher(time.Second, time.Minute)
+	p.allowPrivate = true
+	for i := 0; i < 2; i++ {
+		msg := &Message{Type: MessageChat, From: "alice", Body: "see " + site.URL + "/page."}
+		if err := p.Enrich(nil, msg); err != nil {
+			t.Fatal(err)
+		}
+		want := LinkPreview{URL: site.URL + "/page", Title: "Gophers & friends", Description: "All about gophers", Image: site.URL + "/gopher.png"}
+		if msg.Preview == nil || *msg.Preview != want {
+			t.Fatalf("preview %+v, want %+v", msg.Preview, want)
+		}
+		if got := msg.Text(); got != "alice: see "+site.URL+"/page. [Gophers & friends]" {
+			t.Errorf("text %q", got)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("page fetched %d times, want once", n)
+	}
+}
+
+func TestPreviewEscapes(t *testing.T) {
+	base, _ := url.Parse("https://example.com/page")
+	preview := parsePreview(base, `<title>Clear &#27;[2Jscreen</title>
+<meta property="og:description" content="Bell&#7; and &#x1b;]0;title&#7;done">
+<meta property="og:site_name" content="Site&#27;[31m">`)
+	want := LinkPreview{URL: "https://example.com/page", Title: "Clear screen", Description: "Bell and done", SiteName: "Site"}
+	if preview == nil || *preview != want {
+		t.Fatalf("preview %+v, want %+v", preview, want)
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// UserData is everything the server stores about a user, for data subject
+// access requests
+type UserData struct {
+	User             string            `json:"user"`
+	Exported         time.Time         `json:"exported"`
+	Profile          *Profile          `json:"profile,omitempty"`
+	DigestEmail      string            `json:"digest_email,omitempty"`
+	TwoFactor        bool              `json:"two_factor"`
+	TwoFactorPending bool              `json:"two_factor_pending"`
+	TwoFactorUsed    *time.Time        `json:"two_factor_used,omitempty"`
+	PublicKey        string            `json:"public_key,omitempty"`
+	Blocked          []string          `json:"blocked"`
+	Devices          []PushDevice      `json:"push_devices"`
+	Roles            map[string]string `json:"roles"`
+	Scheduled        []DelayedMessage  `json:"scheduled"`
+	Snippets         []Snippet         `json:"snippets"`
+	Messages         []ExportRecord    `json:"messages"`
+}
+
+// personalEvents are the events that only hold a user's own data, dropped
+// when the user is erased
+var personalEvents = map[string]bool{
+	EventJoin: true, EventLeave: true, EventProfile: true, EventBlock: true, EventUnblock: true,
+	EventPushRegister: true, EventPushUnregister: true, EventDigestEmail: true,
+	EventTOTPEnable: true, EventTOTPDisable: true,
+	EventDelayedCreate: true, EventDelayedDone: true, EventDelayedCancel: true,
+}
+
+// CollectUserData gathers what the server stores about a user. Messages
+// come from the event log, or the replay buffers without one.
+func (cs *ChatServer) CollectUserData(user string) (*UserData, error) {
+	data := &UserData{
+		User:     user,
+		Exported: time.Now().UTC(),
+		Profile:  cs.Profile(user),
+		Blocked:  []string{},
+		Devices:  []PushDevice{},
+		Roles:    make(map[string]string),
+		Messages: []ExportRecord{},
+	}
+	var rooms []string
+	cs.Mutex.Lock()
+	data.DigestEmail = cs.DigestEmails[user]
+	_, data.TwoFactor = cs.TOTPSecrets[user]
+	_, data.TwoFactorPending = cs.totpPending[user]
+	if step, ok := cs.totpUsed[user]; ok {
+		used := time.Unix(step*int64(totpPeriod/time.Second), 0).UTC()
+		data.TwoFactorUsed = &used
+	}
+	data.PublicKey = cs.PublicKeys[user]
+	for name := range cs.Blocks[user] {
+		data.Blocked = append(data.Blocked, name)
+	}
+	for _, device := range cs.PushDevices {
+		if device.User == user {
+			data.Devices = append(data.Devices, *device)
+		}
+	}
+	for name, room := range cs.Rooms {
+		rooms = append(rooms, name)
+		if role, ok := room.Roles[user]; ok {
+			data.Roles[name] = role
+		}
+	}
+	cs.Mutex.Unlock()
+	sort.Strings(data.Blocked)
+	sort.Strings(rooms)
+	data.Scheduled = cs.delayedOf(user)
+	snippets, err := cs.Snippets.Of(user)
+	if err != nil {
+		return nil, err
+	}
+	data.Snippets = snippets
+
+	add := func(msg *Message) {
+		if msg.From == user && msg.Time != nil {
+			data.Messages = append(data.Messages, ExportRecord{ID: msg.ID, Room: msg.Room, Seq: msg.Seq, Time: *msg.Time, From: msg.From, Body: msg.Body})
+		}
+	}
+	for _, room := range rooms {
+		if cs.EventLog != nil {
+			if err := cs.EventLog.Messages(room, 1, 0, add); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		cs.Mutex.Lock()
+		recent := cs.getRoom(room).Replay.Items()
+		cs.Mutex.Unlock()
+		for _, msg := range recent {
+			add(msg)
+		}
+	}
+	return data, nil
+}
+
+// renameInData replaces a user's name in the top-level string fields of an
+// event's data, such as the creator of a poll
+func renameInData(data json.RawMessage, user, pseudonym string) json.RawMessage {
+	var fields map[string]json.RawMessage
+	if len(data) == 0 || json.Unmarshal(data, &fields) != nil {
+		return data
+	}
+	changed := false
+	for key, value := range fields {
+		var s string
+		if json.Unmarshal(value, &s) == nil && s == user {
+			fields[key], _ = json.Marshal(pseudonym)
+			changed = true
+		}
+	}
+	if !changed {
+		return data
+	}
+	renamed, err := json.Marshal(fields)
+	if err != nil {
+		return data
+	}
+	return renamed
+}
+
+// EraseUser removes a user's personal data: their profile, settings, keys,
+// devices, block lists and scheduled messages. Their messages and snippets
+// are deleted, or kept under pseudonym when keepMessages is set, and everything else that names
+// them, such as moderation actions and poll votes, is attributed to
+// pseudonym. The event log is rewritten, so the data does not come back on
+// restart. Accounts live in the AUTH_URL service and are not touched.
+func (cs *ChatServer) EraseUser(user, pseudonym string, keepMessages bool) error {
+	if cs.EventLog != nil {
+		_, err := cs.EventLog.Rewrite(func(ev *Event) bool {
+			if ev.User == user && personalEvents[ev.Type] {
+				return false
+			}
+			if (ev.Type == EventBlock || ev.Type == EventUnblock) && ev.Target == user {
+				return false
+			}
+			if ev.Type == EventMessage && ev.User == user && !keepMessages {
+				return false
+			}
+			if ev.Type == EventRoomPin && !keepMessages {
+				var pin PinnedMessage
+				if json.Unmarshal(ev.Data, &pin) == nil && pin.From == user {
+					return false
+				}
+			}
+			if ev.User == user {
+				ev.User = pseudonym
+			}
+			if ev.Target == user {
+				ev.Target = pseudonym
+			}
+			ev.Data = renameInData(ev.Data, user, pseudonym)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := cs.Snippets.Erase(user, pseudonym, keepMessages); err != nil {
+		return err
+	}
+
+	cs.Mutex.Lock()
+	defer cs.Mutex.Unlock()
+	delete(cs.Profiles, user)
+	delete(cs.DigestEmails, user)
+	delete(cs.digestCodes, user)
+	delete(cs.TOTPSecrets, user)
+	delete(cs.totpPending, user)
+	delete(cs.totpUsed, user)
+	delete(cs.PublicKeys, user)
+	delete(cs.Blocks, user)
+	for _, blocked := range cs.Blocks {
+		delete(blocked, user)
+	}
+	for id, device := range cs.PushDevices {
+		if device.User == user {
+			delete(cs.PushDevices, id)
+		}
+	}
+	for id, d := range cs.Delayed {
+		if d.User == user {
+			delete(cs.Delayed, id)
+		}
+	}
+	for _, room := range cs.Rooms {
+		recent := room.Replay.Items()
+		room.Replay.Retain(func(*Message, int) bool { return false })
+		for _, msg := range recent {
+			if msg.From == user {
+				if !keepMessages {
+					continue
+				}
+				renamed := *msg
+				renamed.From = pseudonym
+				msg = &renamed
+			}
+			room.Replay.Add(msg)
+		}
+		pins := room.Pins[:0]
+		for _, pin := range room.Pins {
+			if pin.From == user {
+				if !keepMessages {
+					continue
+				}
+				pin.From = pseudonym
+			}
+			if pin.PinnedBy == user {
+				pin.PinnedBy = pseudonym
+			}
+			pins = append(pins, pin)
+		}
+		room.Pins = pins
+		if role, ok := room.Roles[user]; ok {
+			delete(room.Roles, user)
+			room.Roles[pseudonym] = role
+		}
+		if room.Invited[user] {
+			delete(room.Invited, user)
+			room.Invited[pseudonym] = true
+		}
+		for _, event := range room.Events {
+			if answer, ok := event.RSVPs[user]; ok {
+				delete(event.RSVPs, user)
+				event.RSVPs[pseudonym] = answer
+			}
+			if event.Creator == user {
+				event.Creator = pseudonym
+			}
+		}
+		for _, poll := range room.Polls {
+			if option, ok := poll.votes[user]; ok {
+				delete(poll.votes, user)
+				poll.votes[pseudonym] = option
+			}
+			if poll.Creator == user {
+				poll.Creator = pseudonym
+			}
+		}
+	}
+	return nil
+}
+
+// HandleExportUser sends an admin token everything stored about a user
+func (cs *ChatServer) HandleExportUser(w http.ResponseWriter, r *http.Request) {
+	token := cs.AdminTokens.Authenticate(r)
+	if token == nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, "missing or invalid token")
+		return
+	}
+	user := r.PathValue("user")
+	data, err := cs.CollectUserData(user)
+	if err != nil {
+		log.Println("Error exporting user data:", err)
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	cs.auditAdmin(token, "user.export", user)
+	writeJSON(w, http.StatusOK, data)
+}
+
+// HandleEraseUser erases a user's data for an admin token. Their messages
+// are deleted, or kept under a pseudonym with ?messages=anonymize.
+func (cs *ChatServer) HandleEraseUser(w http.ResponseWriter, r *http.Request) {
+	token := cs.AdminTokens.Authenticate(r)
+	if token == nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, http.StatusUnauthorized, "missing or invalid token")
+		return
+	}
+	mode := r.URL.Query().Get("messages")
+	if mode == "" {
+		mode = "delete"
+	}
+	if mode != "delete" && mode != "anonymize" {
+		writeError(w, http.StatusBadRequest, "messages must be delete or anonymize")
+		return
+	}
+	id, err := newID(4)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	user, pseudonym := r.PathValue("user"), "deleted-"+id
+	if err := cs.EraseUser(user, pseudonym, mode == "anonymize"); err != nil {
+		log.Println("Error erasing user:", err)
+		writeError(w, http.StatusInternalServerError, "internal error")
+		return
+	}
+	cs.auditAdmin(token, "user.erase", user)
+	writeJSON(w, http.StatusOK, map[string]string{"user": user, "pseudonym": pseudonym, "messages": mode})
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How often expired polls are closed
+const pollInterval = time.Second
+
+// Most options a poll may offer
+const maxPollOptions = 10
+
+// Poll is a question asked in a room. Each user votes for one option, and
+// the results are posted when the poll is closed or expires.
+type Poll struct {
+	ID       string    `json:"id"`
+	Room     string    `json:"room"`
+	Creator  string    `json:"creator"`
+	Question string    `json:"question"`
+	Options  []string  `json:"options"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+	Closed   bool      `json:"closed,omitempty"`
+	// Tally is the number of votes per option in messages sent to clients
+	Tally []int `json:"tally,omitempty"`
+
+	// votes maps each voter to the option they chose
+	votes map[string]int
+}
+
+// snapshot copies a poll with its current tally. Caller must hold cs.Mutex.
+func (p *Poll) snapshot() *Poll {
+	s := *p
+	s.votes = nil
+	s.Tally = make([]int, len(p.Options))
+	for _, option := range p.votes {
+		s.Tally[option]++
+	}
+	return &s
+}
+
+// pollText renders a poll for plain text clients
+func pollText(from string, p *Poll) string {
+	var b strings.Builder
+	if p.Closed {
+		fmt.Fprintf(&b, "Poll %s closed: %s", p.ID, p.Question)
+	} else {
+		fmt.Fprintf(&b, "%s started poll %s: %s", from, p.ID, p.Question)
+	}
+	for i, option := range p.Options {
+		fmt.Fprintf(&b, "\n  %d. %s", i+1, option)
+		if p.Closed && i < len(p.Tally) {
+			fmt.Fprintf(&b, " (%d)", p.Tally[i])
+		}
+	}
+	if !p.Closed {
+		fmt.Fprintf(&b, "\nVote with /vote %s <number>", p.ID)
+	}
+	return b.String()
+}
+
+// findPoll returns an open poll by ID. Caller must hold cs.Mutex.
+func (cs *ChatServer) findPoll(room, id string) *Poll {
+	return cs.getRoom(room).Polls[id]
+}
+
+// applyPollEvent updates the polls of a room for an event log entry. Caller
+// must hold cs.Mutex.
+func (cs *ChatServer) applyPollEvent(ev Event) {
+	room := cs.getRoom(ev.Room)
+	switch ev.Type {
+	case EventPollCreate:
+		var poll Poll
+		if err := json.Unmarshal(ev.Data, &poll); err != nil {
+			log.Println("Invalid poll in event log:", err)
+			return
+		}
+		poll.votes = make(map[string]int)
+		room.Polls[poll.ID] = &poll
+	case EventPollVote:
+		if poll := room.Polls[ev.Target]; poll != nil {
+			// The first vote counts
+			if _, voted := poll.votes[ev.User]; voted {
+				return
+			}
+			if option, err := strconv.Atoi(ev.Body); err == nil && option >= 0 && option < len(poll.Options) {
+				poll.votes[ev.User] = option
+			}
+		}
+	case EventPollClose:
+		delete(room.Polls, ev.Target)
+	}
+}
+
+// CreatePoll asks a question in the client's room
+func (cs *ChatServer) CreatePoll(client *Client, question string, options []string, duration time.Duration) (*Poll, error) {
+	id, err := newID(4)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	poll := &Poll{
+		ID:       id,
+		Room:     client.Room,
+		Creator:  client.Name,
+		Question: question,
+		Options:  options,
+		Created:  now,
+		Expires:  now.Add(duration),
+	}
+	data, err := json.Marshal(poll)
+	if err != nil {
+		return nil, err
+	}
+	poll.Tally = make([]int, len(options))
+	msg := &Message{Type: MessagePoll, Room: poll.Room, From: client.Name, Body: question, Poll: poll}
+	if err := cs.archive(msg); err != nil {
+		return nil, err
+	}
+	cs.Record(Event{Type: EventPollCreate, Room: poll.Room, User: client.Name, Target: id, Data: data})
+	cs.Broadcast(poll.Room, msg, 0)
+	return poll, nil
+}
+
+// ClosePoll ends a poll and posts its results to the room
+func (cs *ChatServer) ClosePoll(room, id string) {
+	cs.Mutex.Lock()
+	poll := cs.findPoll(room, id)
+	if poll == nil || poll.Closed {
+		cs.Mutex.Unlock()
+		return
+	}
+	poll.Closed = true
+	results := poll.snapshot()
+	cs.Mutex.Unlock()
+
+	cs.Record(Event{Type: EventPollClose, Room: room, Target: id})
+	cs.Broadcast(room, &Message{Type: MessagePoll, Room: room, From: results.Creator, Body: results.Question, Poll: results}, 0)
+}
+
+// RunPolls closes polls as they expire
+func (cs *ChatServer) RunPolls() {
+	for {
+		now := time.Now()
+		var expired []*Poll
+		cs.Mutex.Lock()
+		for _, room := range cs.Rooms {
+			for _, poll := range room.Polls {
+				if !poll.Expires.After(now) {
+					expired = append(expired, poll)
+				}
+			}
+		}
+		cs.Mutex.Unlock()
+
+		for _, poll := range expired {
+			cs.ClosePoll(poll.Room, poll.ID)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// pollCommand creates a poll in the client's room, shows the current tally
+// of one or closes one early
+func (cs *ChatServer) pollCommand(client *Client, args []string) {
+	usage := "Usage: /poll [duration] \"<question>\" <option> <option>... | /poll results <id> | /poll close <id>"
+	if len(args) == 2 && (args[0] == "results" || args[0] == "close") {
+		cs.Mutex.Lock()
+		poll := cs.findPoll(client.Room, args[1])
+		var results *Poll
+		if poll != nil {
+			results = poll.snapshot()
+		}
+		cs.Mutex.Unlock()
+		if poll == nil {
+			client.Noticef("No such poll: %s", args[1])
+			return
+		}
+		if args[0] == "results" {
+			client.Send(&Message{Type: MessagePoll, Room: client.Room, From: results.Creator, Body: results.Question, Poll: results})
+			return
+		}
+		if results.Creator != client.Name && !cs.IsModerator(client, client.Room) {
+			client.Fail(CodePermissionDenied, "Permission denied")
+			return
+		}
+		if results.Creator != client.Name {
+			cs.Audit(client, "poll.close", client.Room, args[1], "")
+		}
+		cs.ClosePoll(client.Room, args[1])
+		return
+	}
+
+	duration := envDuration("POLL_DURATION", 24*time.Hour)
+	if len(args) > 0 {
+		if d, err := time.ParseDuration(args[0]); err == nil {
+			if d <= 0 {
+				client.Notice("Poll duration must be positive")
+				return
+			}
+			duration, args = d, args[1:]
+		}
+	}
+	if len(args) < 3 || strings.TrimSpace(args[0]) == "" {
+		client.Notice(usage)
+		return
+	}
+	if len(args)-1 > maxPollOptions {
+		client.Noticef("A poll can have at most %d options", maxPollOptions)
+		return
+	}
+	if client.Room == "" {
+		client.Fail(CodeNotInRoom, "You are not in a room")
+		return
+	}
+	if !cs.admitMessage(client, client.Room) {
+		return
+	}
+	if _, err := cs.CreatePoll(client, args[0], args[1:], duration); err != nil {
+		log.Println("Error creating poll:", err)
+		client.Notice("Could not create poll")
+	}
+}
+
+// voteCommand records a user's vote, by option number or text. Each user
+// votes once per poll.
+func (cs *ChatServer) voteCommand(client *Client, args []string) {
+	if len(args) < 2 {
+		client.Fail(CodeUsage, "Usage: /vote <id> <number>")
+		return
+	}
+	if client.Guest {
+		client.Notice("Guests cannot vote. Register to take part.")
+		return
+	}
+	choice := strings.Join(args[1:], " ")
+
+	cs.Mutex.Lock()
+	poll := cs.findPoll(client.Room, args[0])
+	if poll == nil {
+		cs.Mutex.Unlock()
+		client.Noticef("No such poll: %s", args[0])
+		return
+	}
+	_, voted := poll.votes[client.Name]
+	option := -1
+	if n, err := strconv.Atoi(choice); err == nil && n >= 1 && n <= len(poll.Options) {
+		option = n - 1
+	} else {
+		for i, o := range poll.Options {
+			if strings.EqualFold(o, choice) {
+				option = i
+			}
+		}
+	}
+	cs.Mutex.Unlock()
+
+	switch {
+	case voted:
+		client.Noticef("You already voted in poll %s", poll.ID)
+	case option < 0:
+		client.Noticef("Poll %s has no option %s", poll.ID, choice)
+	default:
+		cs.Record(Event{Type: EventPollVote, Room: client.Room, User: client.Name, Target: poll.ID, Body: strconv.Itoa(option)})
+		client.Noticef("You voted for %s", poll.Options[option])
+	}
+}
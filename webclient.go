@@ -0,0 +1,18 @@
+package main
+
+import (
+	"embed"
+	"net/http"
+)
+
+// The single-page web client served at /, which signs in through POST
+// /tickets and speaks the JSON protocol over /ws
+//
+//go:embed web/index.html
+var webClient embed.FS
+
+// HandleWebClient serves the embedded web client
+func (cs *ChatServer) HandleWebClient(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'; connect-src 'self' ws: wss:")
+	http.ServeFileFS(w, r, webClient, "web/index.html")
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Backoff before the first retry of a failed webhook delivery, doubled on each attempt
+const webhookInitialBackoff = time.Second
+
+// Longest wait between webhook delivery attempts
+const webhookMaxBackoff = time.Minute
+
+// Webhook is an outbound URL that receives every message posted in a room
+type Webhook struct {
+	ID      string `json:"id"`
+	URL     string `json:"url"`
+	Secret  string `json:"secret"`
+	Creator string `json:"creator"`
+}
+
+// WebhookPayload is the JSON body posted to webhooks
+type WebhookPayload struct {
+	Event   string    `json:"event"`
+	Time    time.Time `json:"time"`
+	Message *Message  `json:"message"`
+}
+
+// webhookDelivery is a payload waiting to be posted to a webhook
+type webhookDelivery struct {
+	hook    Webhook
+	body    []byte
+	attempt int
+}
+
+// WebhookDispatcher posts payloads to webhooks from a pool of workers,
+// retrying failed deliveries with exponential backoff
+type WebhookDispatcher struct {
+	queue      chan *webhookDelivery
+	client     *http.Client
+	maxRetries int
+}
+
+// NewWebhookDispatcher starts the delivery workers
+func NewWebhookDispatcher() *WebhookDispatcher {
+	d := &WebhookDispatcher{
+		queue:      make(chan *webhookDelivery, envInt("WEBHOOK_QUEUE_SIZE", 1000)),
+		client:     &http.Client{Timeout: envDuration("WEBHOOK_TIMEOUT", 10*time.Second)},
+		maxRetries: envInt("WEBHOOK_MAX_RETRIES", 5),
+	}
+	for i := 0; i < envInt("WEBHOOK_WORKERS", 4); i++ {
+		go d.worker()
+	}
+	return d
+}
+
+// Enqueue schedules a delivery, dropping it if the queue is full
+func (d *WebhookDispatcher) Enqueue(delivery *webhookDelivery) {
+	select {
+	case d.queue <- delivery:
+	default:
+		log.Printf("Webhook queue full, dropping delivery to %s", delivery.hook.URL)
+	}
+}
+
+func (d *WebhookDispatcher) worker() {
+	for delivery := range d.queue {
+		err := d.post(delivery)
+		if err == nil {
+			continue
+		}
+		var permanent permanentError
+		if errors.As(err, &permanent) || delivery.attempt >= d.maxRetries {
+			log.Printf("Webhook %s delivery failed after %d attempts: %v", delivery.hook.ID, delivery.attempt+1, err)
+			continue
+		}
+
+		backoff := webhookInitialBackoff << delivery.attempt
+		if backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+		delivery.attempt++
+		time.AfterFunc(backoff, func() { d.Enqueue(delivery) })
+	}
+}
+
+// permanentError is a delivery failure that retrying will not fix
+type permanentError struct {
+	status int
+}
+
+func (e permanentError) Error() string {
+	return fmt.Sprintf("webhook rejected delivery with status code %d", e.status)
+}
+
+// signWebhook computes the signature sent in X-Chat-Signature
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// post makes a single delivery attempt
+func (d *WebhookDispatcher) post(delivery *webhookDelivery) error {
+	req, err := http.NewRequest(http.MethodPost, delivery.hook.URL, bytes.NewReader(delivery.body))
+	if err != nil {
+		return permanentError{}
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Chat-Webhook-ID", delivery.hook.ID)
+	req.Header.Set("X-Chat-Timestamp", timestamp)
+	req.Header.Set("X-Chat-Signature", signWebhook(delivery.hook.Secret, timestamp, delivery.body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return fmt.Errorf("webhook returned status code %d", resp.StatusCode)
+	default:
+		return permanentError{status: resp.StatusCode}
+	}
+}
+
+// NotifyWebhooks posts a message to every webhook registered in its room
+func (cs *ChatServer) NotifyWebhooks(msg *Message) {
+	cs.Mutex.Lock()
+	hooks := make([]Webhook, 0, len(cs.getRoom(msg.Room).Webhooks))
+	for _, hook := range cs.getRoom(msg.Room).Webhooks {
+		hooks = append(hooks, *hook)
+	}
+	cs.Mutex.Unlock()
+	if len(hooks) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(WebhookPayload{Event: "message", Time: time.Now().UTC(), Message: msg})
+	if err != nil {
+		log.Println("Error encoding webhook payload:", err)
+		return
+	}
+	for _, hook := range hooks {
+		cs.Webhooks.Enqueue(&webhookDelivery{hook: hook, body: body})
+	}
+}
+
+// AddWebhook registers a webhook in a room and returns it with its signing secret
+func (cs *ChatServer) AddWebhook(client *Client, room, rawURL string) (*Webhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("webhook URL must be an absolute http or https URL")
+	}
+	id, err := newID(4)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := newID(16)
+	if err != nil {
+		return nil, err
+	}
+	hook := &Webhook{ID: id, URL: u.String(), Secret: secret, Creator: client.Name}
+	data, err := json.Marshal(hook)
+	if err != nil {
+		return nil, err
+	}
+	cs.Record(Event{Type: EventWebhookAdd, Room: room, User: client.Name, Target: id, Data: data})
+	cs.Audit(client, "webhook.add", room, id, "")
+	return hook, nil
+}
+
+// applyWebhookEvent updates room webhooks for an event log entry. Caller must hold cs.Mutex.
+func (cs *ChatServer) applyWebhookEvent(ev Event) {
+	room := cs.getRoom(ev.Room)
+	switch ev.Type {
+	case EventWebhookAdd:
+		var hook Webhook
+		if err := json.Unmarshal(ev.Data, &hook); err != nil {
+			log.Println("Invalid webhook in event log:", err)
+			return
+		}
+		room.Webhooks[hook.ID] = &hook
+	case EventWebhookRemove:
+		delete(room.Webhooks, ev.Target)
+	}
+}
+
+// webhookCommand lets admins list, add and remove the webhooks of their room
+func (cs *ChatServer) webhookCommand(client *Client, fields []string) {
+	if !cs.IsModerator(client, client.Room) {
+		client.Fail(CodePermissionDenied, "Permission denied")
+		return
+	}
+	switch {
+	case len(fields) == 1:
+		cs.Mutex.Lock()
+		var lines []string
+		for _, hook := range cs.getRoom(client.Room).Webhooks {
+			lines = append(lines, fmt.Sprintf("%s  %s (added by %s)", hook.ID, hook.URL, hook.Creator))
+		}
+		cs.Mutex.Unlock()
+		if len(lines) == 0 {
+			client.Noticef("No webhooks in %s", client.Room)
+			return
+		}
+		sort.Strings(lines)
+		client.Noticef("Webhooks in %s\n%s", client.Room, strings.Join(lines, "\n"))
+	case len(fields) == 3 && fields[1] == "add":
+		hook, err := cs.AddWebhook(client, client.Room, fields[2])
+		if err != nil {
+			client.Notice(err.Error())
+			return
+		}
+		client.Noticef("Webhook %s added. Signing secret: %s", hook.ID, hook.Secret)
+	case len(fields) >= 3 && fields[1] == "remove":
+		cs.Mutex.Lock()
+		_, ok := cs.getRoom(client.Room).Webhooks[fields[2]]
+		cs.Mutex.Unlock()
+		if !ok {
+			client.Noticef("No such webhook: %s", fields[2])
+			return
+		}
+		cs.Record(Event{Type: EventWebhookRemove, Room: client.Room, User: client.Name, Target: fields[2]})
+		cs.Audit(client, "webhook.remove", client.Room, fields[2], strings.Join(fields[3:], " "))
+		client.Noticef("Webhook %s removed", fields[2])
+	default:
+		client.Fail(CodeUsage, "Usage: /webhook [add <url> | remove <id> [reason]]")
+	}
+}
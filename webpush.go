@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Record size announced in Web Push message headers. Notifications are
+// always sent as a single record.
+const webPushRecordSize = 4096
+
+// WebPushProvider sends notifications to browsers through their push
+// services, encrypted as in RFC 8291 and signed with a VAPID key (RFC 8292)
+type WebPushProvider struct {
+	key       *ecdsa.PrivateKey
+	publicKey []byte
+	subject   string
+	ttl       time.Duration
+	client    *http.Client
+}
+
+// NewWebPushProvider loads the VAPID key from WEBPUSH_VAPID_PRIVATE_KEY, the
+// raw P-256 private key in unpadded base64url as generated by common Web Push
+// tools. It returns nil when no key is configured.
+func NewWebPushProvider() (*WebPushProvider, error) {
+	encoded := os.Getenv("WEBPUSH_VAPID_PRIVATE_KEY")
+	if encoded == "" {
+		return nil, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("WEBPUSH_VAPID_PRIVATE_KEY: %w", err)
+	}
+	private, err := ecdh.P256().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("WEBPUSH_VAPID_PRIVATE_KEY: %w", err)
+	}
+	public := private.PublicKey().Bytes()
+	key := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(public[1:33]),
+			Y:     new(big.Int).SetBytes(public[33:]),
+		},
+		D: new(big.Int).SetBytes(raw),
+	}
+
+	subject := os.Getenv("WEBPUSH_VAPID_SUBJECT")
+	if subject == "" {
+		return nil, errors.New("WEBPUSH_VAPID_SUBJECT must be set to a mailto: or https: contact")
+	}
+	// Endpoints come from clients, so like link previews only public
+	// addresses are reached, and redirects are not followed
+	timeout := envDuration("WEBPUSH_TIMEOUT", 10*time.Second)
+	client := &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{DialContext: publicDialer(timeout, nil).DialContext, Proxy: nil},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return &WebPushProvider{
+		key:       key,
+		publicKey: public,
+		subject:   subject,
+		ttl:       envDuration("WEBPUSH_TTL", 24*time.Hour),
+		client:    client,
+	}, nil
+}
+
+// PublicKey returns the VAPID public key browsers subscribe with, in unpadded base64url
+func (p *WebPushProvider) PublicKey() string {
+	return base64.RawURLEncoding.EncodeToString(p.publicKey)
+}
+
+// Push encrypts a notification for a browser subscription and posts it to its push service
+func (p *WebPushProvider) Push(device *PushDevice, n *PushNotification) error {
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	body, err := encryptWebPush(device.Subscription, payload)
+	if err != nil {
+		return err
+	}
+	endpoint, err := url.Parse(device.Subscription.Endpoint)
+	if err != nil {
+		return err
+	}
+	token, err := p.vapidToken(endpoint.Scheme + "://" + endpoint.Host)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", fmt.Sprint(int(p.ttl.Seconds())))
+	req.Header.Set("Authorization", "vapid t="+token+", k="+p.PublicKey())
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return errDeviceGone
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("push service returned status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// vapidToken signs the JWT that identifies this server to a push service
+func (p *WebPushProvider) vapidToken(audience string) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": audience,
+		"exp": time.Now().Add(12 * time.Hour).Unix(),
+		"sub": p.subject,
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, p.key, digest[:])
+	if err != nil {
+		return "", err
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// hkdf derives length bytes of key material from a secret, as in RFC 5869.
+// Web Push never needs more than one block of output.
+func hkdf(salt, secret, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(secret)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write(info)
+	expand.Write([]byte{1})
+	return expand.Sum(nil)[:length]
+}
+
+// decodeWebPushKey decodes a subscription key, which browsers send in
+// base64url with or without padding
+func decodeWebPushKey(s string) ([]byte, error) {
+	if b, err := base64.RawURLEncoding.DecodeString(s); err == nil {
+		return b, nil
+	}
+	return base64.URLEncoding.DecodeString(s)
+}
+
+// encryptWebPush encrypts a payload for a subscription with the aes128gcm
+// content encoding of RFC 8291
+func encryptWebPush(sub PushSubscription, payload []byte) ([]byte, error) {
+	uaKey, err := decodeWebPushKey(sub.Keys.P256dh)
+	if err != nil {
+		return nil, fmt.Errorf("invalid p256dh key: %w", err)
+	}
+	authSecret, err := decodeWebPushKey(sub.Keys.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth secret: %w", err)
+	}
+	uaPublic, err := ecdh.P256().NewPublicKey(uaKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid p256dh key: %w", err)
+	}
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asPrivate.PublicKey().Bytes()
+	shared, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaKey...), asPublic...)
+	ikm := hkdf(authSecret, shared, keyInfo, 32)
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// Header: salt, record size, key ID length and the sender's public key
+	body := make([]byte, 0, 16+4+1+len(asPublic)+len(payload)+1+gcm.Overhead())
+	body = append(body, salt...)
+	body = binary.BigEndian.AppendUint32(body, webPushRecordSize)
+	body = append(body, byte(len(asPublic)))
+	body = append(body, asPublic...)
+	// The 0x02 delimiter marks the last and only record
+	return gcm.Seal(body, nonce, append(payload, 2), nil), nil
+}
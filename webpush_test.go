@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// decryptWebPush reverses encryptWebPush with the browser's keys, as in RFC 8291
+func decryptWebPush(t *testing.T, ua *ecdh.PrivateKey, authSecret, body []byte) []byte {
+	t.Helper()
+	salt, idLen := body[:16], int(body[20])
+	asPublic, ciphertext := body[21:21+idLen], body[21+idLen:]
+	asKey, err := ecdh.P256().NewPublicKey(asPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := ua.ECDH(asKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyInfo := append(append([]byte("WebPush: info\x00"), ua.PublicKey().Bytes()...), asPublic...)
+	ikm := hkdf(authSecret, shared, keyInfo, 32)
+	block, err := aes.NewCipher(hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := gcm.Open(nil, hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12), ciphertext, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plaintext) == 0 || plaintext[len(plaintext)-1] != 2 {
+		t.Fatal("missing last record delimiter")
+	}
+	return plaintext[:len(plaintext)-1]
+}
+
+func TestWebPushDelivery(t *testing.T) {
+	vapid, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("WEBPUSH_VAPID_PRIVATE_KEY", base64.RawURLEncoding.EncodeToString(vapid.Bytes()))
+	t.Setenv("WEBPUSH_VAPID_SUBJECT", "mailto:ops@example.com")
+	provider, err := NewWebPushProvider()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	browser, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authSecret := make([]byte, 16)
+	rand.Read(authSecret)
+
+	received := make(chan []byte, 1)
+	service := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Authorization: vapid t=<jwt>, k=<public key>
+		auth := strings.TrimPrefix(r.Header.Get("Authorization"), "vapid t=")
+		token, key, _ := strings.Cut(auth, ", k=")
+		if key != provider.PublicKey() || !verifyES256(vapid, token) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("Content-Encoding") != "aes128gcm" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		received <- body
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer service.Close()
+
+	device := &PushDevice{ID: "d1", User: "wendy"}
+	device.Subscription.Provider = "webpush"
+	device.Subscription.Endpoint = service.URL + "/push/abc"
+	device.Subscription.Keys.P256dh = base64.RawURLEncoding.EncodeToString(browser.PublicKey().Bytes())
+	device.Subscription.Keys.Auth = base64.RawURLEncoding.EncodeToString(authSecret)
+
+	// Endpoints on local addresses are refused
+	if err := provider.Push(device, &PushNotification{Title: "hi"}); !errors.Is(err, errBlockedAddress) {
+		t.Fatalf("push to a local address: %v", err)
+	}
+
+	provider.client = service.Client()
+
+	want := &PushNotification{Title: "alice mentioned you in lobby", Body: "hi @wendy", Room: "lobby"}
+	if err := provider.Push(device, want); err != nil {
+		t.Fatal(err)
+	}
+	var got PushNotification
+	if err := json.Unmarshal(decryptWebPush(t, browser, authSecret, <-received), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got != *want {
+		t.Fatalf("notification = %+v, want %+v", got, *want)
+	}
+}
+
+// verifyES256 checks the signature of a VAPID JWT against the key it was signed with
+func verifyES256(key *ecdh.PrivateKey, token string) bool {
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return false
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(token[i+1:])
+	if err != nil || len(signature) != 64 {
+		return false
+	}
+	public := key.PublicKey().Bytes()
+	ecKey := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(public[1:33]),
+		Y:     new(big.Int).SetBytes(public[33:]),
+	}
+	digest := sha256.Sum256([]byte(token[:i]))
+	return ecdsa.Verify(ecKey, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:]))
+}
+
+func TestRegisterDeviceOwnership(t *testing.T) {
+	vapid, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("WEBPUSH_VAPID_PRIVATE_KEY", base64.RawURLEncoding.EncodeToString(vapid.Bytes()))
+	t.Setenv("WEBPUSH_VAPID_SUBJECT", "mailto:ops@example.com")
+	s := startServer(t)
+
+	var sub PushSubscription
+	sub.Endpoint = "https://push.example.com/send/abc"
+	sub.Keys.P256dh, sub.Keys.Auth = "key", "auth"
+	alice := &Client{Name: "alice", Authenticated: true}
+	bob := &Client{Name: "bob", Authenticated: true}
+	for _, c := range []*Client{alice, bob, alice} {
+		if _, err := s.cs.RegisterDevice(c, sub); err != nil {
+			t.Fatal(err)
+		}
+	}
+	owners := make(map[string]int)
+	s.cs.Mutex.Lock()
+	for _, device := range s.cs.PushDevices {
+		owners[device.User]++
+	}
+	s.cs.Mutex.Unlock()
+	if owners["alice"] != 1 || owners["bob"] != 1 {
+		t.Fatalf("devices per user = %v, want one each", owners)
+	}
+}